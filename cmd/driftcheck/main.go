@@ -0,0 +1,80 @@
+// Command driftcheck compares a deployment with its desired-state manifest
+// and exits with status 1 if any value differs or cannot be read, or 2 if
+// the check could not run.
+//
+//	driftcheck -rpc https://forno.celo.org -manifest manifest.json
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+
+	"github.com/cosmo-local-credit/protocol/pkg/drift"
+)
+
+func main() {
+	var (
+		rpcURL   = flag.String("rpc", "", "RPC endpoint")
+		manifest = flag.String("manifest", "manifest.json", "desired-state manifest")
+		block    = flag.Uint64("block", 0, "block to check (default latest)")
+		asJSON   = flag.Bool("json", false, "write the report as JSON")
+	)
+	flag.Parse()
+
+	drifted, err := run(*rpcURL, *manifest, *block, *asJSON)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "driftcheck:", err)
+		os.Exit(2)
+	}
+	if drifted {
+		os.Exit(1)
+	}
+}
+
+func run(rpcURL, path string, block uint64, asJSON bool) (bool, error) {
+	if rpcURL == "" {
+		return false, errors.New("-rpc is required")
+	}
+	m, err := drift.LoadManifest(path)
+	if err != nil {
+		return false, err
+	}
+	client, err := w3.Dial(rpcURL)
+	if err != nil {
+		return false, fmt.Errorf("dial %s: %w", rpcURL, err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	if m.ChainID != 0 {
+		var chainID uint64
+		if err := client.CallCtx(ctx, eth.ChainID().Returns(&chainID)); err != nil {
+			return false, fmt.Errorf("get chain id: %w", err)
+		}
+		if chainID != uint64(m.ChainID) {
+			return false, fmt.Errorf("manifest is for chain %d, endpoint serves %d", m.ChainID, chainID)
+		}
+	}
+
+	var blockNumber *big.Int
+	if block != 0 {
+		blockNumber = new(big.Int).SetUint64(block)
+	}
+	r, err := drift.Check(ctx, client, m, blockNumber)
+	if err != nil {
+		return false, err
+	}
+	if asJSON {
+		err = r.WriteJSON(os.Stdout)
+	} else {
+		err = r.WriteText(os.Stdout)
+	}
+	return r.Drifted(), err
+}
@@ -0,0 +1,318 @@
+// Package drift compares deployed contracts with a desired-state manifest
+// and reports every value that differs.
+package drift
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/protocolfeecontroller"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/swappool"
+)
+
+var (
+	funcOwner                   = w3.MustNewFunc("owner()", "address")
+	funcAdminOf                 = w3.MustNewFunc("adminOf(address)", "address")
+	funcFeePolicy               = w3.MustNewFunc("feePolicy()", "address")
+	funcQuoter                  = w3.MustNewFunc("quoter()", "address")
+	funcTokenLimiter            = w3.MustNewFunc("tokenLimiter()", "address")
+	funcTokenRegistry           = w3.MustNewFunc("tokenRegistry()", "address")
+	funcFeeAddress              = w3.MustNewFunc("feeAddress()", "address")
+	funcProtocolFeeController   = w3.MustNewFunc("protocolFeeController()", "address")
+	funcSealState               = w3.MustNewFunc("sealState()", "uint8")
+	funcGetDefaultFee           = w3.MustNewFunc("getDefaultFee()", "uint256")
+	funcGetFee                  = w3.MustNewFunc("getFee(address,address)", "uint256")
+	funcGetProtocolFeeRecipient = w3.MustNewFunc("getProtocolFeeRecipient()", "address")
+	funcIsActive                = w3.MustNewFunc("isActive()", "bool")
+	funcAmount                  = w3.MustNewFunc("amount()", "uint256")
+)
+
+var ErrNoFactory = errors.New("manifest sets an admin but no factory")
+
+type (
+	// Manifest is the desired state of a deployment. It extends the
+	// address book format, so an address book is a valid manifest that
+	// checks each proxy's implementation and each contract's code.
+	Manifest struct {
+		ChainID   int64              `json:"chain_id"`
+		Factory   common.Address     `json:"factory,omitzero"`
+		Contracts map[string]Desired `json:"contracts"`
+	}
+
+	// Desired is the intended state of one contract. Contract, Address and
+	// Implementation are as in publish.BookEntry; a zero Implementation is
+	// not checked. Every other field is checked only if set, and only
+	// applies to the contracts that have it.
+	Desired struct {
+		Contract       string         `json:"contract"`
+		Address        common.Address `json:"address"`
+		Implementation common.Address `json:"implementation,omitzero"`
+
+		Owner *common.Address `json:"owner,omitempty"`
+		Admin *common.Address `json:"admin,omitempty"`
+
+		// SwapPool
+		FeePolicy             *common.Address `json:"fee_policy,omitempty"`
+		Quoter                *common.Address `json:"quoter,omitempty"`
+		TokenLimiter          *common.Address `json:"token_limiter,omitempty"`
+		TokenRegistry         *common.Address `json:"token_registry,omitempty"`
+		FeeAddress            *common.Address `json:"fee_address,omitempty"`
+		ProtocolFeeController *common.Address `json:"protocol_fee_controller,omitempty"`
+		SealState             *uint8          `json:"seal_state,omitempty"`
+
+		// FeePolicy
+		DefaultFee *uint64   `json:"default_fee,omitempty"`
+		PairFees   []PairFee `json:"pair_fees,omitempty"`
+
+		// ProtocolFeeController
+		ProtocolFee          *uint64         `json:"protocol_fee,omitempty"`
+		ProtocolFeeRecipient *common.Address `json:"protocol_fee_recipient,omitempty"`
+		ProtocolFeeActive    *bool           `json:"protocol_fee_active,omitempty"`
+
+		// EthFaucet
+		FaucetAmount *big.Int `json:"faucet_amount,omitempty"`
+	}
+
+	// PairFee is the fee in PPM that getFee(In, Out) should return.
+	PairFee struct {
+		In  common.Address `json:"in"`
+		Out common.Address `json:"out"`
+		Fee uint64         `json:"fee"`
+	}
+)
+
+// Difference is one value that does not match the manifest. Field names
+// follow the manifest's JSON keys, e.g. "quoter" or "pair_fee(0x…,0x…)".
+type Difference struct {
+	Name    string         `json:"name"`
+	Address common.Address `json:"address"`
+	Field   string         `json:"field"`
+	Want    string         `json:"want"`
+	Got     string         `json:"got"`
+}
+
+func (d Difference) String() string {
+	return fmt.Sprintf("%s (%s) %s: want %s, got %s", d.Name, d.Address.Hex(), d.Field, d.Want, d.Got)
+}
+
+// Failure is a value that could not be read, e.g. because the call reverted.
+type Failure struct {
+	Name    string         `json:"name"`
+	Address common.Address `json:"address"`
+	Field   string         `json:"field"`
+	Err     string         `json:"error"`
+}
+
+func (f Failure) String() string {
+	return fmt.Sprintf("%s (%s) %s: %s", f.Name, f.Address.Hex(), f.Field, f.Err)
+}
+
+// Report is the result of Check, ordered by manifest name.
+type Report struct {
+	Checked     int          `json:"checked"`
+	Differences []Difference `json:"differences"`
+	Failures    []Failure    `json:"failures"`
+}
+
+// Drifted reports whether anything differs or could not be checked.
+func (r *Report) Drifted() bool {
+	return len(r.Differences) > 0 || len(r.Failures) > 0
+}
+
+func LoadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("decode manifest %s: %w", path, err)
+	}
+	return &m, nil
+}
+
+// check is one value to compare: call reads it, got formats what was read.
+type check struct {
+	field string
+	want  string
+	call  w3types.RPCCaller
+	got   func() string
+}
+
+// Check reads every value the manifest sets at blockNumber (nil for latest)
+// and compares it. The code of each entry with a Contract is identified as
+// by contracts.IdentifyAt; unknown code is reported as a difference.
+func Check(ctx context.Context, caller publish.Caller, m *Manifest, blockNumber *big.Int) (*Report, error) {
+	if blockNumber == nil {
+		if err := caller.CallCtx(ctx, eth.BlockNumber().Returns(&blockNumber)); err != nil {
+			return nil, fmt.Errorf("get block number: %w", err)
+		}
+	}
+
+	r := &Report{Differences: []Difference{}, Failures: []Failure{}}
+	for _, name := range slices.Sorted(maps.Keys(m.Contracts)) {
+		d := m.Contracts[name]
+		checks, err := checksFor(m, d, blockNumber)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		calls := make([]w3types.RPCCaller, len(checks))
+		for i, c := range checks {
+			calls[i] = c.call
+		}
+		errs, err := publish.BatchCallEach(ctx, caller, calls, 0)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		if d.Contract != "" {
+			r.Checked++
+			var got string
+			if c, _, err := contracts.IdentifyAt(ctx, caller, d.Address, blockNumber); err != nil {
+				got = err.Error()
+			} else {
+				got = c.Package
+			}
+			if got != d.Contract {
+				r.Differences = append(r.Differences, Difference{Name: name, Address: d.Address, Field: "contract", Want: d.Contract, Got: got})
+			}
+		}
+		for i, c := range checks {
+			r.Checked++
+			if errs[i] != nil {
+				r.Failures = append(r.Failures, Failure{Name: name, Address: d.Address, Field: c.field, Err: errs[i].Error()})
+				continue
+			}
+			if got := c.got(); got != c.want {
+				r.Differences = append(r.Differences, Difference{Name: name, Address: d.Address, Field: c.field, Want: c.want, Got: got})
+			}
+		}
+	}
+	return r, nil
+}
+
+func checksFor(m *Manifest, d Desired, block *big.Int) ([]check, error) {
+	var checks []check
+	address := func(field string, to common.Address, fn *w3.Func, want *common.Address, args ...any) {
+		if want == nil {
+			return
+		}
+		got := new(common.Address)
+		checks = append(checks, check{field, want.Hex(), eth.CallFunc(to, fn, args...).AtBlock(block).Returns(got), func() string { return got.Hex() }})
+	}
+	number := func(field string, to common.Address, fn *w3.Func, want *uint64, args ...any) {
+		if want == nil {
+			return
+		}
+		got := new(big.Int)
+		checks = append(checks, check{field, fmt.Sprint(*want), eth.CallFunc(to, fn, args...).AtBlock(block).Returns(got), got.String})
+	}
+
+	if d.Implementation != (common.Address{}) {
+		slot := new(common.Hash)
+		checks = append(checks, check{"implementation", d.Implementation.Hex(), eth.StorageAt(d.Address, publish.ImplementationSlot, block).Returns(slot), func() string {
+			return common.BytesToAddress(slot.Bytes()).Hex()
+		}})
+	}
+	if d.Admin != nil {
+		if m.Factory == (common.Address{}) {
+			return nil, ErrNoFactory
+		}
+		address("admin", m.Factory, funcAdminOf, d.Admin, d.Address)
+	}
+	address("owner", d.Address, funcOwner, d.Owner)
+
+	address("fee_policy", d.Address, funcFeePolicy, d.FeePolicy)
+	address("quoter", d.Address, funcQuoter, d.Quoter)
+	address("token_limiter", d.Address, funcTokenLimiter, d.TokenLimiter)
+	address("token_registry", d.Address, funcTokenRegistry, d.TokenRegistry)
+	address("fee_address", d.Address, funcFeeAddress, d.FeeAddress)
+	address("protocol_fee_controller", d.Address, funcProtocolFeeController, d.ProtocolFeeController)
+	if d.SealState != nil {
+		var got uint8
+		checks = append(checks, check{"seal_state", sealString(*d.SealState), eth.CallFunc(d.Address, funcSealState).AtBlock(block).Returns(&got), func() string { return sealString(got) }})
+	}
+
+	number("default_fee", d.Address, funcGetDefaultFee, d.DefaultFee)
+	for _, p := range d.PairFees {
+		number(fmt.Sprintf("pair_fee(%s,%s)", p.In.Hex(), p.Out.Hex()), d.Address, funcGetFee, &p.Fee, p.In, p.Out)
+	}
+
+	if d.ProtocolFee != nil {
+		// The stored fee, not getProtocolFee(), which is 0 while the
+		// controller is inactive.
+		slot := new(common.Hash)
+		checks = append(checks, check{"protocol_fee", fmt.Sprint(*d.ProtocolFee), eth.StorageAt(d.Address, protocolfeecontroller.ProtocolFeeSlot, block).Returns(slot), func() string {
+			return slot.Big().String()
+		}})
+	}
+	address("protocol_fee_recipient", d.Address, funcGetProtocolFeeRecipient, d.ProtocolFeeRecipient)
+	if d.ProtocolFeeActive != nil {
+		var got bool
+		checks = append(checks, check{"protocol_fee_active", fmt.Sprint(*d.ProtocolFeeActive), eth.CallFunc(d.Address, funcIsActive).AtBlock(block).Returns(&got), func() string { return fmt.Sprint(got) }})
+	}
+
+	if d.FaucetAmount != nil {
+		got := new(big.Int)
+		checks = append(checks, check{"faucet_amount", d.FaucetAmount.String(), eth.CallFunc(d.Address, funcAmount).AtBlock(block).Returns(got), got.String})
+	}
+	return checks, nil
+}
+
+// sealString formats a SwapPool seal state with the bits it sets, so that
+// a diff shows which seal differs.
+func sealString(state uint8) string {
+	seal := swappool.DecodeSeal(state)
+	var bits []string
+	if seal.Fee {
+		bits = append(bits, "fee")
+	}
+	if seal.FeeAddress {
+		bits = append(bits, "fee_address")
+	}
+	if seal.Quoter {
+		bits = append(bits, "quoter")
+	}
+	if len(bits) == 0 {
+		bits = append(bits, "none")
+	}
+	return fmt.Sprintf("%d (%s)", state, strings.Join(bits, ", "))
+}
+
+// WriteText writes one line per difference and failure, then a summary.
+func (r *Report) WriteText(w io.Writer) error {
+	for _, d := range r.Differences {
+		if _, err := fmt.Fprintf(w, "DRIFT %s\n", d); err != nil {
+			return err
+		}
+	}
+	for _, f := range r.Failures {
+		if _, err := fmt.Fprintf(w, "ERROR %s\n", f); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d checked, %d drifted, %d failed\n", r.Checked, len(r.Differences), len(r.Failures))
+	return err
+}
+
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
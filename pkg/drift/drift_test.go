@@ -0,0 +1,70 @@
+package drift_test
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lmittmann/w3"
+
+	"github.com/cosmo-local-credit/protocol/pkg/drift"
+	"github.com/cosmo-local-credit/protocol/pkg/internal/vmtest"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/protocolfeecontroller"
+)
+
+var funcSetActive = w3.MustNewFunc("setActive(bool)", "")
+
+func TestCheckProtocolFee(t *testing.T) {
+	recipient := common.Address{0x77}
+	tests := []struct {
+		name   string
+		active bool
+		want   drift.Desired
+		// drifted are the fields expected to differ.
+		drifted []string
+	}{
+		{name: "active", active: true, want: drift.Desired{ProtocolFee: ptr[uint64](2_000), ProtocolFeeActive: ptr(true)}},
+		{name: "inactive", want: drift.Desired{ProtocolFee: ptr[uint64](2_000), ProtocolFeeActive: ptr(false)}},
+		{name: "fee differs while inactive", want: drift.Desired{ProtocolFee: ptr[uint64](3_000)}, drifted: []string{"protocol_fee"}},
+		{
+			name:    "deactivated",
+			want:    drift.Desired{ProtocolFeeRecipient: &recipient, ProtocolFeeActive: ptr(true)},
+			drifted: []string{"protocol_fee_active"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := vmtest.New(t)
+			init, err := protocolfeecontroller.EncodeInit(protocolfeecontroller.InitArgs{Owner: vmtest.Owner, InitialFee: big.NewInt(2_000), InitialRecipient: recipient})
+			if err != nil {
+				t.Fatal(err)
+			}
+			controller := e.Proxy(protocolfeecontroller.Bytecode(), init)
+			if !tt.active {
+				e.Send(controller, funcSetActive, []any{false})
+			}
+			e.Mine()
+
+			want := tt.want
+			want.Contract, want.Address = "protocolfeecontroller", controller
+			m := &drift.Manifest{ChainID: 1, Contracts: map[string]drift.Desired{"ProtocolFeeController": want}}
+			r, err := drift.Check(context.Background(), e.Caller(), m, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(r.Failures) != 0 {
+				t.Errorf("failures %v", r.Failures)
+			}
+			var drifted []string
+			for _, d := range r.Differences {
+				drifted = append(drifted, d.Field)
+			}
+			if len(drifted) != len(tt.drifted) || len(drifted) > 0 && drifted[0] != tt.drifted[0] {
+				t.Errorf("drifted %v (%v), want %v", drifted, r.Differences, tt.drifted)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
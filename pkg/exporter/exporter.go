@@ -0,0 +1,582 @@
+// Package exporter publishes the state of the contracts in an address book
+// as Prometheus metrics: pool balances, fees and limiter headroom, oracle
+// feed age, faucet funding and claims, voucher supply, swap counters and
+// protocol fee settings.
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/oraclequoter"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/swappool"
+)
+
+// DefaultConfirmations is the number of blocks, counting its own, a block
+// must have before its events are counted. Counted events are never
+// subtracted, so this is what keeps reorged events out of the counters.
+const DefaultConfirmations = 5
+
+const namespace = "clc"
+
+var (
+	funcSymbol                  = w3.MustNewFunc("symbol()", "string")
+	funcDecimals                = w3.MustNewFunc("decimals()", "uint8")
+	funcBalanceOf               = w3.MustNewFunc("balanceOf(address)", "uint256")
+	funcTotalSupply             = w3.MustNewFunc("totalSupply()", "uint256")
+	funcTotalMinted             = w3.MustNewFunc("totalMinted()", "uint256")
+	funcTotalBurned             = w3.MustNewFunc("totalBurned()", "uint256")
+	funcExpired                 = w3.MustNewFunc("expired()", "bool")
+	funcTokenRegistry           = w3.MustNewFunc("tokenRegistry()", "address")
+	funcTokenLimiter            = w3.MustNewFunc("tokenLimiter()", "address")
+	funcFees                    = w3.MustNewFunc("fees(address)", "uint256")
+	funcLimitOf                 = w3.MustNewFunc("limitOf(address,address)", "uint256")
+	funcEntryCount              = w3.MustNewFunc("entryCount()", "uint256")
+	funcEntry                   = w3.MustNewFunc("entry(uint256)", "address")
+	funcAmount                  = w3.MustNewFunc("amount()", "uint256")
+	funcIsActive                = w3.MustNewFunc("isActive()", "bool")
+	funcGetProtocolFee          = w3.MustNewFunc("getProtocolFee()", "uint256")
+	funcGetProtocolFeeRecipient = w3.MustNewFunc("getProtocolFeeRecipient()", "address")
+
+	eventGive = w3.MustNewEvent("Give(address indexed _recipient, address indexed _token, uint256 _amount)")
+)
+
+// Exporter refreshes its metrics from the chain on Refresh, not on scrape,
+// so that scrapes never wait on RPC. Contracts are labelled with their
+// address book name and address, tokens with their address and symbol.
+// Amounts are in whole token units, ETH in ether.
+//
+// Swap and faucet claim counters count events from the start block given
+// to New, up to the last block with the configured confirmations; they
+// restart from there when the process restarts, which Prometheus' rate()
+// and increase() handle as a counter reset.
+type Exporter struct {
+	caller        publish.Caller
+	book          *publish.AddressBook
+	registry      *prometheus.Registry
+	logRange      uint64
+	confirmations uint64
+
+	mu       sync.Mutex
+	next     uint64
+	monitors map[common.Address]*oraclequoter.Monitor
+	tokens   map[common.Address]tokenInfo
+
+	poolBalance  *prometheus.GaugeVec
+	poolFees     *prometheus.GaugeVec
+	poolHeadroom *prometheus.GaugeVec
+	poolLimit    *prometheus.GaugeVec
+	swaps        *prometheus.CounterVec
+	swapVolumeIn *prometheus.CounterVec
+	swapVolume   *prometheus.CounterVec
+	swapFees     *prometheus.CounterVec
+
+	feedAge          *prometheus.GaugeVec
+	feedAnswer       *prometheus.GaugeVec
+	feedMaxStaleness *prometheus.GaugeVec
+
+	faucetBalance *prometheus.GaugeVec
+	faucetAmount  *prometheus.GaugeVec
+	faucetClaims  *prometheus.CounterVec
+	faucetGiven   *prometheus.CounterVec
+
+	voucherMinted  *prometheus.GaugeVec
+	voucherBurned  *prometheus.GaugeVec
+	voucherSupply  *prometheus.GaugeVec
+	voucherExpired *prometheus.GaugeVec
+
+	protocolFeeActive *prometheus.GaugeVec
+	protocolFeePPM    *prometheus.GaugeVec
+
+	block         prometheus.Gauge
+	lastRefresh   prometheus.Gauge
+	refreshErrors prometheus.Counter
+}
+
+// tokenInfo is a token's symbol, or its address if symbol() fails, and its
+// decimals. decimalsErr is set if decimals() fails, in which case amounts
+// of the token are not exported.
+type tokenInfo struct {
+	symbol      string
+	decimals    uint8
+	decimalsErr error
+}
+
+var (
+	contractLabels = []string{"name", "address"}
+	voucherLabels  = []string{"name", "address", "symbol"}
+	tokenLabels    = []string{"name", "address", "token", "symbol"}
+	swapLabels     = []string{"name", "address", "token_in", "symbol_in", "token_out", "symbol_out"}
+)
+
+// New returns an exporter for the contracts in book. fromBlock is where
+// event counters start; it should be at or before the first deployment.
+// Only the swappool, oraclequoter, ethfaucet, giftabletoken and
+// protocolfeecontroller entries are exported.
+func New(caller publish.Caller, book *publish.AddressBook, fromBlock uint64) *Exporter {
+	e := &Exporter{
+		caller:        caller,
+		book:          book,
+		registry:      prometheus.NewRegistry(),
+		logRange:      publish.DefaultLogRange,
+		confirmations: DefaultConfirmations,
+		next:          fromBlock,
+		monitors:      make(map[common.Address]*oraclequoter.Monitor),
+		tokens:        make(map[common.Address]tokenInfo),
+	}
+
+	gauge := func(subsystem, name, help string, labels []string) *prometheus.GaugeVec {
+		g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Subsystem: subsystem, Name: name, Help: help}, labels)
+		e.registry.MustRegister(g)
+		return g
+	}
+	counter := func(subsystem, name, help string, labels []string) *prometheus.CounterVec {
+		c := prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: name, Help: help}, labels)
+		e.registry.MustRegister(c)
+		return c
+	}
+
+	e.poolBalance = gauge("pool", "token_balance", "Pool balance of each registered token.", tokenLabels)
+	e.poolFees = gauge("pool", "token_fees", "Fees accumulated in the pool per token, not yet withdrawn.", tokenLabels)
+	e.poolLimit = gauge("pool", "token_limit", "Limiter limit of each registered token for the pool.", tokenLabels)
+	e.poolHeadroom = gauge("pool", "token_headroom", "Amount of each token the pool can still accept before hitting its limit.", tokenLabels)
+	e.swaps = counter("pool", "swaps_total", "Swap events per token pair.", swapLabels)
+	e.swapVolumeIn = counter("pool", "swap_volume_in_total", "Swapped in amount per token pair, in units of token_in.", swapLabels)
+	e.swapVolume = counter("pool", "swap_volume_out_total", "Quoted out amount per token pair before fees, in units of token_out.", swapLabels)
+	e.swapFees = counter("pool", "swap_fees_total", "Pool fees per token pair, in units of token_out.", swapLabels)
+
+	feedLabels := []string{"name", "address", "token", "symbol", "oracle"}
+	e.feedAge = gauge("oracle", "feed_age_seconds", "Seconds since the feed's latest round was updated, at the head block.", feedLabels)
+	e.feedAnswer = gauge("oracle", "feed_answer", "Latest feed answer scaled by the feed's decimals.", feedLabels)
+	e.feedMaxStaleness = gauge("oracle", "max_staleness_seconds", "OracleQuoter maxStaleness.", contractLabels)
+
+	e.faucetBalance = gauge("faucet", "balance_ether", "Faucet ETH balance.", contractLabels)
+	e.faucetAmount = gauge("faucet", "amount_ether", "ETH given per claim.", contractLabels)
+	e.faucetClaims = counter("faucet", "claims_total", "Give events.", contractLabels)
+	e.faucetGiven = counter("faucet", "given_ether_total", "ETH given out.", contractLabels)
+
+	e.voucherMinted = gauge("voucher", "total_minted", "GiftableToken totalMinted.", voucherLabels)
+	e.voucherBurned = gauge("voucher", "total_burned", "GiftableToken totalBurned.", voucherLabels)
+	e.voucherSupply = gauge("voucher", "total_supply", "GiftableToken totalSupply.", voucherLabels)
+	e.voucherExpired = gauge("voucher", "expired", "1 if the token has been marked expired.", voucherLabels)
+
+	e.protocolFeeActive = gauge("protocol_fee", "active", "1 if the ProtocolFeeController is active.", []string{"name", "address", "recipient"})
+	e.protocolFeePPM = gauge("protocol_fee", "ppm", "Protocol fee in parts per million.", []string{"name", "address", "recipient"})
+
+	e.block = prometheus.NewGauge(prometheus.GaugeOpts{Namespace: namespace, Name: "block_number", Help: "Head block of the last refresh."})
+	e.lastRefresh = prometheus.NewGauge(prometheus.GaugeOpts{Namespace: namespace, Name: "last_refresh_timestamp_seconds", Help: "Time of the last refresh."})
+	e.refreshErrors = prometheus.NewCounter(prometheus.CounterOpts{Namespace: namespace, Name: "refresh_errors_total", Help: "Contracts that failed to refresh."})
+	e.registry.MustRegister(e.block, e.lastRefresh, e.refreshErrors)
+	return e
+}
+
+// SetLogRange sets the maximum block span of one eth_getLogs request.
+func (e *Exporter) SetLogRange(n uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.logRange = max(n, 1)
+}
+
+// SetConfirmations overrides DefaultConfirmations; zero is the same as one,
+// i.e. counting events up to the head.
+func (e *Exporter) SetConfirmations(n uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.confirmations = max(n, 1)
+}
+
+// Handler serves the metrics, e.g. at /metrics.
+func (e *Exporter) Handler() http.Handler {
+	return promhttp.HandlerFor(e.registry, promhttp.HandlerOpts{})
+}
+
+// Refresh reads every exported contract at the head and counts the events
+// emitted since the last refresh, up to the last block with the configured
+// confirmations. A failing contract does not stop the
+// others; each failure is counted in refresh_errors_total and the errors
+// are joined.
+func (e *Exporter) Refresh(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var head *big.Int
+	if err := e.caller.CallCtx(ctx, eth.BlockNumber().Returns(&head)); err != nil {
+		e.refreshErrors.Inc()
+		return fmt.Errorf("get block number: %w", err)
+	}
+
+	var errs []error
+	for _, name := range e.book.Names() {
+		entry := e.book.Contracts[name]
+		var err error
+		switch entry.Contract {
+		case "swappool":
+			err = e.refreshPool(ctx, name, entry.Address, head)
+		case "oraclequoter":
+			err = e.refreshQuoter(ctx, name, entry.Address)
+		case "ethfaucet":
+			err = e.refreshFaucet(ctx, name, entry.Address, head)
+		case "giftabletoken":
+			err = e.refreshVoucher(ctx, name, entry.Address, head)
+		case "protocolfeecontroller":
+			err = e.refreshProtocolFee(ctx, name, entry.Address, head)
+		}
+		if err != nil {
+			e.refreshErrors.Inc()
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	if head.Uint64()+1 >= e.confirmations {
+		if err := e.countEvents(ctx, head.Uint64()+1-e.confirmations); err != nil {
+			e.refreshErrors.Inc()
+			errs = append(errs, err)
+		}
+	}
+
+	e.block.Set(float64(head.Uint64()))
+	e.lastRefresh.SetToCurrentTime()
+	return errors.Join(errs...)
+}
+
+// Run refreshes every interval until ctx is cancelled. Errors are passed to
+// onErr, if set, and retried on the next tick.
+func (e *Exporter) Run(ctx context.Context, interval time.Duration, onErr func(error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.Refresh(ctx); err != nil && onErr != nil {
+			onErr(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Exporter) refreshPool(ctx context.Context, name string, pool common.Address, block *big.Int) error {
+	var registry, limiter common.Address
+	if err := e.caller.CallCtx(ctx,
+		eth.CallFunc(pool, funcTokenRegistry).AtBlock(block).Returns(&registry),
+		eth.CallFunc(pool, funcTokenLimiter).AtBlock(block).Returns(&limiter),
+	); err != nil {
+		return fmt.Errorf("get pool config: %w", err)
+	}
+	if registry == (common.Address{}) {
+		return nil
+	}
+
+	var count big.Int
+	if err := e.caller.CallCtx(ctx, eth.CallFunc(registry, funcEntryCount).AtBlock(block).Returns(&count)); err != nil {
+		return fmt.Errorf("entryCount: %w", err)
+	}
+	tokens := make([]common.Address, count.Uint64())
+	calls := make([]w3types.RPCCaller, len(tokens))
+	for i := range tokens {
+		calls[i] = eth.CallFunc(registry, funcEntry, big.NewInt(int64(i))).AtBlock(block).Returns(&tokens[i])
+	}
+	if err := publish.BatchCall(ctx, e.caller, calls, 0); err != nil {
+		return fmt.Errorf("entry: %w", err)
+	}
+	if err := e.loadTokens(ctx, tokens); err != nil {
+		return err
+	}
+
+	balances := make([]big.Int, len(tokens))
+	fees := make([]big.Int, len(tokens))
+	limits := make([]big.Int, len(tokens))
+	calls = calls[:0]
+	for i, token := range tokens {
+		calls = append(calls,
+			eth.CallFunc(token, funcBalanceOf, pool).AtBlock(block).Returns(&balances[i]),
+			eth.CallFunc(pool, funcFees, token).AtBlock(block).Returns(&fees[i]),
+		)
+		if limiter != (common.Address{}) {
+			calls = append(calls, eth.CallFunc(limiter, funcLimitOf, token, pool).AtBlock(block).Returns(&limits[i]))
+		}
+	}
+	callErrs, err := publish.BatchCallEach(ctx, e.caller, calls, 0)
+	if err != nil {
+		return fmt.Errorf("get pool balances: %w", err)
+	}
+
+	// A token whose calls fail, e.g. one without code, keeps its previous
+	// values; the others are still exported.
+	perToken := len(calls) / max(len(tokens), 1)
+	var errs []error
+	for i, token := range tokens {
+		info := e.tokens[token]
+		if err := errors.Join(callErrs[i*perToken : (i+1)*perToken]...); err != nil {
+			errs = append(errs, fmt.Errorf("get balances of %s: %w", info.symbol, err))
+			continue
+		}
+		if info.decimalsErr != nil {
+			errs = append(errs, fmt.Errorf("decimals of %s: %w", info.symbol, info.decimalsErr))
+			continue
+		}
+		labels := prometheus.Labels{"name": name, "address": pool.Hex(), "token": token.Hex(), "symbol": info.symbol}
+		e.poolBalance.With(labels).Set(units(&balances[i], info.decimals))
+		e.poolFees.With(labels).Set(units(&fees[i], info.decimals))
+		if limiter != (common.Address{}) {
+			headroom := new(big.Int)
+			if limits[i].Cmp(&balances[i]) > 0 {
+				headroom.Sub(&limits[i], &balances[i])
+			}
+			e.poolLimit.With(labels).Set(units(&limits[i], info.decimals))
+			e.poolHeadroom.With(labels).Set(units(headroom, info.decimals))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (e *Exporter) refreshQuoter(ctx context.Context, name string, quoter common.Address) error {
+	m, ok := e.monitors[quoter]
+	if !ok {
+		m = oraclequoter.NewMonitor(oraclequoter.NewClient(e.caller, quoter), e.next, oraclequoter.MonitorConfig{LogRange: e.logRange, Confirmations: e.confirmations})
+		e.monitors[quoter] = m
+	}
+	s, _, err := m.State(ctx)
+	if err != nil {
+		return err
+	}
+	tokens := make([]common.Address, 0, len(s.Tokens))
+	for token := range s.Tokens {
+		tokens = append(tokens, token)
+	}
+	if err := e.loadTokens(ctx, tokens); err != nil {
+		return err
+	}
+
+	e.feedMaxStaleness.WithLabelValues(name, quoter.Hex()).Set(float64(s.MaxStaleness.Uint64()))
+	// Drop the series of removed or replaced feeds.
+	e.feedAge.DeletePartialMatch(prometheus.Labels{"address": quoter.Hex()})
+	e.feedAnswer.DeletePartialMatch(prometheus.Labels{"address": quoter.Hex()})
+	for token, t := range s.Tokens {
+		feed := s.Feeds[t.Oracle]
+		if feed.Err != nil {
+			continue
+		}
+		labels := prometheus.Labels{"name": name, "address": quoter.Hex(), "token": token.Hex(), "symbol": e.tokens[token].symbol, "oracle": t.Oracle.Hex()}
+		age := float64(s.Timestamp) - float64(feed.UpdatedAt.Uint64())
+		e.feedAge.With(labels).Set(age)
+		e.feedAnswer.With(labels).Set(units(feed.Answer, feed.Decimals))
+	}
+	return nil
+}
+
+func (e *Exporter) refreshFaucet(ctx context.Context, name string, faucet common.Address, block *big.Int) error {
+	var (
+		balance *big.Int
+		amount  big.Int
+	)
+	if err := e.caller.CallCtx(ctx,
+		eth.Balance(faucet, block).Returns(&balance),
+		eth.CallFunc(faucet, funcAmount).AtBlock(block).Returns(&amount),
+	); err != nil {
+		return fmt.Errorf("get faucet status: %w", err)
+	}
+	e.faucetBalance.WithLabelValues(name, faucet.Hex()).Set(units(balance, 18))
+	e.faucetAmount.WithLabelValues(name, faucet.Hex()).Set(units(&amount, 18))
+	return nil
+}
+
+func (e *Exporter) refreshVoucher(ctx context.Context, name string, token common.Address, block *big.Int) error {
+	if err := e.loadTokens(ctx, []common.Address{token}); err != nil {
+		return err
+	}
+	var (
+		minted, burned, supply big.Int
+		expired                bool
+	)
+	if err := e.caller.CallCtx(ctx,
+		eth.CallFunc(token, funcTotalMinted).AtBlock(block).Returns(&minted),
+		eth.CallFunc(token, funcTotalBurned).AtBlock(block).Returns(&burned),
+		eth.CallFunc(token, funcTotalSupply).AtBlock(block).Returns(&supply),
+		eth.CallFunc(token, funcExpired).AtBlock(block).Returns(&expired),
+	); err != nil {
+		return fmt.Errorf("get supply: %w", err)
+	}
+	info := e.tokens[token]
+	labels := []string{name, token.Hex(), info.symbol}
+	e.voucherExpired.WithLabelValues(labels...).Set(boolFloat(expired))
+	if info.decimalsErr != nil {
+		return fmt.Errorf("decimals: %w", info.decimalsErr)
+	}
+	e.voucherMinted.WithLabelValues(labels...).Set(units(&minted, info.decimals))
+	e.voucherBurned.WithLabelValues(labels...).Set(units(&burned, info.decimals))
+	e.voucherSupply.WithLabelValues(labels...).Set(units(&supply, info.decimals))
+	return nil
+}
+
+func (e *Exporter) refreshProtocolFee(ctx context.Context, name string, controller common.Address, block *big.Int) error {
+	var (
+		active    bool
+		fee       big.Int
+		recipient common.Address
+	)
+	if err := e.caller.CallCtx(ctx,
+		eth.CallFunc(controller, funcIsActive).AtBlock(block).Returns(&active),
+		eth.CallFunc(controller, funcGetProtocolFee).AtBlock(block).Returns(&fee),
+		eth.CallFunc(controller, funcGetProtocolFeeRecipient).AtBlock(block).Returns(&recipient),
+	); err != nil {
+		return fmt.Errorf("get protocol fee: %w", err)
+	}
+	// A changed recipient starts a new series; drop the old one.
+	e.protocolFeeActive.DeletePartialMatch(prometheus.Labels{"address": controller.Hex()})
+	e.protocolFeePPM.DeletePartialMatch(prometheus.Labels{"address": controller.Hex()})
+	e.protocolFeeActive.WithLabelValues(name, controller.Hex(), recipient.Hex()).Set(boolFloat(active))
+	e.protocolFeePPM.WithLabelValues(name, controller.Hex(), recipient.Hex()).Set(float64(fee.Uint64()))
+	return nil
+}
+
+// countEvents adds the Swap and Give events of the book's pools and faucets
+// up to toBlock to the counters.
+func (e *Exporter) countEvents(ctx context.Context, toBlock uint64) error {
+	names := make(map[common.Address]string)
+	var addresses []common.Address
+	for _, name := range e.book.Names() {
+		entry := e.book.Contracts[name]
+		if entry.Contract == "swappool" || entry.Contract == "ethfaucet" {
+			names[entry.Address] = name
+			addresses = append(addresses, entry.Address)
+		}
+	}
+	if len(addresses) == 0 {
+		e.next = toBlock + 1
+		return nil
+	}
+
+	query := ethereum.FilterQuery{
+		Addresses: addresses,
+		Topics:    [][]common.Hash{{swappool.EventSwap.Topic0, eventGive.Topic0}},
+	}
+	return publish.ScanLogs(ctx, e.caller, query, e.next, toBlock, e.logRange, func(_, to uint64, logs []types.Log) error {
+		if err := e.count(ctx, logs, names); err != nil {
+			return err
+		}
+		e.next = to + 1
+		return nil
+	})
+}
+
+func (e *Exporter) count(ctx context.Context, logs []types.Log, names map[common.Address]string) error {
+	var tokens []common.Address
+	for i := range logs {
+		if logs[i].Topics[0] == swappool.EventSwap.Topic0 && len(logs[i].Topics) == 3 {
+			tokens = append(tokens, common.BytesToAddress(logs[i].Topics[2].Bytes()))
+			if len(logs[i].Data) >= 32 {
+				tokens = append(tokens, common.BytesToAddress(logs[i].Data[:32]))
+			}
+		}
+	}
+	if err := e.loadTokens(ctx, tokens); err != nil {
+		return err
+	}
+
+	for i := range logs {
+		log := &logs[i]
+		name, ok := names[log.Address]
+		if !ok {
+			continue
+		}
+		switch log.Topics[0] {
+		case swappool.EventSwap.Topic0:
+			var initiator, in, out common.Address
+			amountIn, amountOut, fee := new(big.Int), new(big.Int), new(big.Int)
+			if err := swappool.EventSwap.DecodeArgs(log, &initiator, &in, &out, amountIn, amountOut, fee); err != nil {
+				return fmt.Errorf("decode Swap in tx %s: %w", log.TxHash.Hex(), err)
+			}
+			inInfo, outInfo := e.tokens[in], e.tokens[out]
+			labels := []string{name, log.Address.Hex(), in.Hex(), inInfo.symbol, out.Hex(), outInfo.symbol}
+			e.swaps.WithLabelValues(labels...).Inc()
+			if inInfo.decimalsErr == nil {
+				e.swapVolumeIn.WithLabelValues(labels...).Add(units(amountIn, inInfo.decimals))
+			}
+			if outInfo.decimalsErr == nil {
+				e.swapVolume.WithLabelValues(labels...).Add(units(amountOut, outInfo.decimals))
+				e.swapFees.WithLabelValues(labels...).Add(units(fee, outInfo.decimals))
+			}
+		case eventGive.Topic0:
+			var recipient, token common.Address
+			amount := new(big.Int)
+			if err := eventGive.DecodeArgs(log, &recipient, &token, amount); err != nil {
+				return fmt.Errorf("decode Give in tx %s: %w", log.TxHash.Hex(), err)
+			}
+			e.faucetClaims.WithLabelValues(name, log.Address.Hex()).Inc()
+			e.faucetGiven.WithLabelValues(name, log.Address.Hex()).Add(units(amount, 18))
+		}
+	}
+	return nil
+}
+
+// loadTokens caches the symbol and decimals of tokens not seen before. Both
+// are optional in ERC20, so a failing call does not fail the others.
+func (e *Exporter) loadTokens(ctx context.Context, tokens []common.Address) error {
+	var (
+		missing []common.Address
+		seen    = make(map[common.Address]bool)
+	)
+	for _, token := range tokens {
+		if _, ok := e.tokens[token]; !ok && !seen[token] {
+			seen[token] = true
+			missing = append(missing, token)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	infos := make([]tokenInfo, len(missing))
+	calls := make([]w3types.RPCCaller, 0, 2*len(missing))
+	for i, token := range missing {
+		calls = append(calls,
+			eth.CallFunc(token, funcSymbol).Returns(&infos[i].symbol),
+			eth.CallFunc(token, funcDecimals).Returns(&infos[i].decimals),
+		)
+	}
+	errs, err := publish.BatchCallEach(ctx, e.caller, calls, 0)
+	if err != nil {
+		return fmt.Errorf("get token metadata: %w", err)
+	}
+	for i, token := range missing {
+		if errs[2*i] != nil {
+			infos[i].symbol = token.Hex()
+		}
+		infos[i].decimalsErr = errs[2*i+1]
+		e.tokens[token] = infos[i]
+	}
+	return nil
+}
+
+// units converts x base units to whole units of a token with decimals.
+func units(x *big.Int, decimals uint8) float64 {
+	f := new(big.Float).SetInt(x)
+	f.Quo(f, new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)))
+	v, _ := f.Float64()
+	return v
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
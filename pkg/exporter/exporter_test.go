@@ -0,0 +1,146 @@
+package exporter_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/exporter"
+	"github.com/cosmo-local-credit/protocol/pkg/internal/vmtest"
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/accountsindex"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/giftabletoken"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/swappool"
+)
+
+var (
+	funcAdd       = w3.MustNewFunc("add(address)", "bool")
+	funcMintTo    = w3.MustNewFunc("mintTo(address,uint256)", "")
+	funcApprove   = w3.MustNewFunc("approve(address,uint256)", "bool")
+	funcBalanceOf = w3.MustNewFunc("balanceOf(address)", "uint256")
+	funcDeposit   = w3.MustNewFunc("deposit(address,uint256)", "")
+	funcWithdraw  = w3.MustNewFunc("withdraw(address,address,uint256,address)", "")
+)
+
+// metric returns the value of the first series of name whose labels
+// include label, or "" if there is none.
+func metric(body, name, label string) string {
+	for line := range strings.Lines(body) {
+		if strings.HasPrefix(line, name+"{") && strings.Contains(line, label) {
+			fields := strings.Fields(line)
+			return fields[len(fields)-1]
+		}
+	}
+	return ""
+}
+
+func TestRefresh(t *testing.T) {
+	tests := []struct {
+		name          string
+		confirmations uint64
+		// mined is the number of blocks mined after the swap's.
+		mined int
+		// failBalance fails balanceOf of token B.
+		failBalance bool
+		wantSwaps   string
+		wantBalance string
+		wantErr     string
+	}{
+		{name: "swap unconfirmed", mined: 3, wantBalance: "1001"},
+		{name: "swap confirmed", mined: 4, wantSwaps: "1", wantBalance: "1001"},
+		{name: "one confirmation", confirmations: 1, wantSwaps: "1", wantBalance: "1001"},
+		{name: "balanceOf fails", confirmations: 1, failBalance: true, wantSwaps: "1", wantErr: "get balances of B"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := vmtest.New(t)
+			init, err := accountsindex.EncodeInit(accountsindex.InitArgs{Owner: vmtest.Owner})
+			if err != nil {
+				t.Fatal(err)
+			}
+			registry := e.Proxy(accountsindex.Bytecode(), init)
+			if init, err = swappool.EncodeInit(swappool.InitArgs{Name: "Pool", Symbol: "POOL", Decimals: 6, Owner: vmtest.Owner, TokenRegistry: registry}); err != nil {
+				t.Fatal(err)
+			}
+			pool := e.Proxy(swappool.Bytecode(), init)
+
+			book := publish.NewAddressBook(vmtest.ChainID)
+			book.Set("Pool", publish.BookEntry{Contract: "swappool", Address: pool})
+			tokens := make(map[string]common.Address)
+			for _, symbol := range []string{"A", "B"} {
+				init, err := giftabletoken.EncodeInit(giftabletoken.InitArgs{Name: symbol, Symbol: symbol, Decimals: 6, Owner: vmtest.Owner, ExpiresAt: new(big.Int)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				token := e.Proxy(giftabletoken.Bytecode(), init)
+				tokens[symbol] = token
+				book.Set(symbol, publish.BookEntry{Contract: "giftabletoken", Address: token})
+				e.Send(registry, funcAdd, []any{token}, new(bool))
+				e.Send(token, funcMintTo, []any{vmtest.Owner, big.NewInt(2_000_000_000)})
+				e.Send(token, funcApprove, []any{pool, big.NewInt(2_000_000_000)}, new(bool))
+				e.Send(pool, funcDeposit, []any{token, big.NewInt(1_000_000_000)})
+			}
+			from := e.Mine().Number.Uint64()
+			e.Send(pool, funcWithdraw, []any{tokens["A"], tokens["B"], big.NewInt(1_000_000), vmtest.Owner})
+			e.Mine()
+			for range tt.mined {
+				e.Mine()
+			}
+
+			caller := e.Caller()
+			if tt.failBalance {
+				caller.Hook = func(method string, args []any) error {
+					if method != "eth_call" {
+						return nil
+					}
+					if msg, ok := args[0].(*w3types.Message); ok && *msg.To == tokens["B"] &&
+						bytes.HasPrefix(msg.Input, funcBalanceOf.Selector[:]) {
+						return errors.New("execution reverted")
+					}
+					return nil
+				}
+			}
+			exp := exporter.New(caller, book, from)
+			if tt.confirmations != 0 {
+				exp.SetConfirmations(tt.confirmations)
+			}
+
+			// A second refresh must not count the swap again.
+			for range 2 {
+				err := exp.Refresh(context.Background())
+				if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+					t.Fatalf("err %v, want %q", err, tt.wantErr)
+				}
+			}
+
+			rec := httptest.NewRecorder()
+			exp.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+			body := rec.Body.String()
+			if got := metric(body, "clc_pool_swaps_total", `symbol_in="B"`); got != tt.wantSwaps {
+				t.Errorf("swaps %q, want %q", got, tt.wantSwaps)
+			}
+			if got := metric(body, "clc_pool_token_balance", `symbol="B"`); got != tt.wantBalance {
+				t.Errorf("balance of B %q, want %q", got, tt.wantBalance)
+			}
+			// A's series is exported whether or not B's calls fail.
+			if got := metric(body, "clc_pool_token_balance", `symbol="A"`); got != "999" {
+				t.Errorf("balance of A %q, want 999", got)
+			}
+			wantErrors := "0"
+			if tt.wantErr != "" {
+				wantErrors = "2"
+			}
+			if !strings.Contains(body, "\nclc_refresh_errors_total "+wantErrors+"\n") {
+				t.Errorf("refresh errors, want %s:\n%s", wantErrors, body)
+			}
+		})
+	}
+}
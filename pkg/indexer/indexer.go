@@ -0,0 +1,449 @@
+// Package indexer follows a set of protocol contracts and stores their events
+// in a local bbolt database. It tracks the hash of every block it stores logs
+// for, so that logs from blocks that are reorganised away are rolled back
+// and fetched again from the new chain.
+package indexer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"math/big"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts"
+)
+
+// ErrChainChanged is returned by Sync when the chain reorganised while a
+// range was being fetched. Nothing from that range is stored; the next Sync
+// rolls back to the common ancestor and continues.
+var ErrChainChanged = errors.New("chain changed during sync")
+
+type Indexer struct {
+	caller publish.Caller
+	db     *bolt.DB
+
+	// syncMu serialises Sync and Follow, which both write logs.
+	syncMu        sync.Mutex
+	confirmations uint64
+	logRange      uint64
+
+	mu        sync.RWMutex
+	contracts map[common.Address]contracts.Contract
+}
+
+// Open opens or creates the database at path. A new database starts syncing
+// at startBlock, usually the block the earliest followed contract was
+// deployed in; an existing one resumes where it stopped and keeps the
+// contracts it was following.
+func Open(path string, caller publish.Caller, startBlock uint64) (*Indexer, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	ix := &Indexer{
+		caller:    caller,
+		db:        db,
+		logRange:  publish.DefaultLogRange,
+		contracts: make(map[common.Address]contracts.Contract),
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := createBuckets(tx); err != nil {
+			return err
+		}
+		meta := tx.Bucket(bucketMeta)
+		if _, ok := getUint64(meta, keyStart); !ok {
+			if err := meta.Put(keyStart, uint64Key(startBlock)); err != nil {
+				return err
+			}
+			if err := meta.Put(keyNext, uint64Key(startBlock)); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bucketContracts).ForEach(func(k, v []byte) error {
+			c, ok := contracts.ByPackage(string(v))
+			if !ok {
+				return fmt.Errorf("unknown package %q for %s", v, common.BytesToAddress(k).Hex())
+			}
+			ix.contracts[common.BytesToAddress(k)] = c
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return ix, nil
+}
+
+func (ix *Indexer) Close() error {
+	return ix.db.Close()
+}
+
+// SetConfirmations makes Sync stop n blocks behind the head.
+func (ix *Indexer) SetConfirmations(n uint64) {
+	ix.syncMu.Lock()
+	defer ix.syncMu.Unlock()
+	ix.confirmations = n
+}
+
+// SetLogRange overrides publish.DefaultLogRange for providers with tighter limits.
+func (ix *Indexer) SetLogRange(blocks uint64) {
+	ix.syncMu.Lock()
+	defer ix.syncMu.Unlock()
+	ix.logRange = max(blocks, 1)
+}
+
+// Follow adds address to the followed contracts. pkg names its contract
+// package, e.g. "swappool"; if empty the contract is identified by its
+// code. If the indexer has already synced past its start block, the
+// contract's logs up to the synced block are backfilled first.
+func (ix *Indexer) Follow(ctx context.Context, address common.Address, pkg string) error {
+	var (
+		c  contracts.Contract
+		ok bool
+	)
+	if pkg == "" {
+		var err error
+		if c, _, err = contracts.IdentifyAt(ctx, ix.caller, address, nil); err != nil {
+			return fmt.Errorf("identify %s: %w", address.Hex(), err)
+		}
+	} else if c, ok = contracts.ByPackage(pkg); !ok {
+		return fmt.Errorf("unknown package %q", pkg)
+	}
+
+	ix.syncMu.Lock()
+	defer ix.syncMu.Unlock()
+
+	ix.mu.RLock()
+	current, ok := ix.contracts[address]
+	ix.mu.RUnlock()
+	if ok {
+		if current.Package != c.Package {
+			return fmt.Errorf("%s is already followed as %s", address.Hex(), current.Package)
+		}
+		return nil
+	}
+
+	start, next, err := ix.bounds()
+	if err != nil {
+		return err
+	}
+	var logs []types.Log
+	if next > start {
+		query := ethereum.FilterQuery{Addresses: []common.Address{address}}
+		if logs, err = publish.GetLogs(ctx, ix.caller, query, start, next-1, ix.logRange); err != nil {
+			return err
+		}
+	}
+
+	err = ix.db.Update(func(tx *bolt.Tx) error {
+		for i := range logs {
+			if _, ok := c.EventName(&logs[i]); !ok {
+				continue
+			}
+			if hash, ok := getHash(tx, logs[i].BlockNumber); ok && hash != logs[i].BlockHash {
+				return fmt.Errorf("%w: backfilled log in block %d", ErrChainChanged, logs[i].BlockNumber)
+			}
+			if err := putLog(tx, &logs[i]); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bucketContracts).Put(address.Bytes(), []byte(c.Package))
+	})
+	if err != nil {
+		return fmt.Errorf("backfill %s: %w", address.Hex(), err)
+	}
+
+	ix.mu.Lock()
+	ix.contracts[address] = c
+	ix.mu.Unlock()
+	return nil
+}
+
+// FollowAddressBook follows every contract in book.
+func (ix *Indexer) FollowAddressBook(ctx context.Context, book *publish.AddressBook) error {
+	for _, name := range book.Names() {
+		entry := book.Contracts[name]
+		if err := ix.Follow(ctx, entry.Address, entry.Contract); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Contracts returns the followed contracts and their packages.
+func (ix *Indexer) Contracts() map[common.Address]string {
+	out := make(map[common.Address]string)
+	for address, c := range ix.followed() {
+		out[address] = c.Package
+	}
+	return out
+}
+
+// SyncedBlock returns the last block whose logs are stored, or false if
+// nothing has been synced yet.
+func (ix *Indexer) SyncedBlock() (uint64, bool) {
+	start, next, err := ix.bounds()
+	if err != nil || next == start {
+		return 0, false
+	}
+	return next - 1, true
+}
+
+func (ix *Indexer) followed() map[common.Address]contracts.Contract {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return maps.Clone(ix.contracts)
+}
+
+func (ix *Indexer) bounds() (start, next uint64, err error) {
+	err = ix.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(bucketMeta)
+		start, _ = getUint64(meta, keyStart)
+		next, _ = getUint64(meta, keyNext)
+		return nil
+	})
+	return start, next, err
+}
+
+// Sync stores the logs of the followed contracts up to the head less the
+// confirmation depth, first rolling back any stored blocks that are no
+// longer canonical. It returns the last synced block.
+func (ix *Indexer) Sync(ctx context.Context) (uint64, error) {
+	ix.syncMu.Lock()
+	defer ix.syncMu.Unlock()
+
+	var head *big.Int
+	if err := ix.caller.CallCtx(ctx, eth.BlockNumber().Returns(&head)); err != nil {
+		return 0, fmt.Errorf("get block number: %w", err)
+	}
+	if err := ix.unwind(ctx, head.Uint64()); err != nil {
+		return 0, err
+	}
+
+	start, next, err := ix.bounds()
+	if err != nil {
+		return 0, err
+	}
+	if head.Uint64() < ix.confirmations || head.Uint64()-ix.confirmations < next {
+		return max(next, 1) - 1, nil
+	}
+	target := head.Uint64() - ix.confirmations
+
+	followed := ix.followed()
+	addresses := slices.SortedFunc(maps.Keys(followed), func(a, b common.Address) int { return a.Cmp(b) })
+	query := ethereum.FilterQuery{Addresses: addresses}
+	for from := next; from <= target; from = next {
+		to := min(from+ix.logRange-1, target)
+		if len(addresses) == 0 {
+			to = target
+		}
+
+		// Logs only say which blocks they are in, so a reorg during
+		// getLogs that adds logs to a block that had none goes unnoticed
+		// unless the chain up to the last block is the same before and
+		// after.
+		var before *blockRef
+		if err := ix.caller.CallCtx(ctx, blockRefCall{number: to, ret: &before}); err != nil {
+			return max(next, 1) - 1, fmt.Errorf("get block %d: %w", to, err)
+		}
+		var logs []types.Log
+		// With nothing followed there are no logs to fetch, and an empty
+		// address filter would match every contract.
+		if len(addresses) > 0 {
+			if logs, err = publish.GetLogs(ctx, ix.caller, query, from, to, ix.logRange); err != nil {
+				return max(next, 1) - 1, err
+			}
+		}
+		if err := ix.store(ctx, start, from, to, before.Hash, logs, followed); err != nil {
+			return max(next, 1) - 1, err
+		}
+		next = to + 1
+	}
+	return target, nil
+}
+
+// store writes the logs of [from, to] after checking that they, the first
+// block of the range and its last block all belong to one chain that
+// extends the stored one, and that the last block still has toHash, its
+// hash from before the logs were fetched.
+func (ix *Indexer) store(ctx context.Context, start, from, to uint64, toHash common.Hash, logs []types.Log, followed map[common.Address]contracts.Contract) error {
+	refs := map[uint64]*blockRef{from: nil, to: nil}
+	for _, log := range logs {
+		refs[log.BlockNumber] = nil
+	}
+	if err := ix.blockRefs(ctx, refs); err != nil {
+		return err
+	}
+
+	if refs[to].Hash != toHash {
+		return fmt.Errorf("%w: block %d changed from %s to %s", ErrChainChanged, to, toHash.Hex(), refs[to].Hash.Hex())
+	}
+
+	return ix.db.Update(func(tx *bolt.Tx) error {
+		if from > start {
+			if parent, ok := getHash(tx, from-1); ok && parent != refs[from].ParentHash {
+				return fmt.Errorf("%w: block %d is not a child of the stored block %d", ErrChainChanged, from, from-1)
+			}
+		}
+		for i := range logs {
+			log := &logs[i]
+			if log.BlockHash != refs[log.BlockNumber].Hash {
+				return fmt.Errorf("%w: log in block %d has hash %s", ErrChainChanged, log.BlockNumber, log.BlockHash.Hex())
+			}
+			if _, ok := followed[log.Address].EventName(log); !ok {
+				continue
+			}
+			if err := putLog(tx, log); err != nil {
+				return err
+			}
+		}
+		hashes := tx.Bucket(bucketHashes)
+		for block, ref := range refs {
+			if err := hashes.Put(uint64Key(block), ref.Hash.Bytes()); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bucketMeta).Put(keyNext, uint64Key(to+1))
+	})
+}
+
+// unwind finds the newest stored block hash that is still canonical and
+// rolls back everything after it. If none is, everything is rolled back to
+// the start block. Stored blocks above head, or that the node no longer
+// has, are taken to be off a chain that reorganised to a shorter one.
+func (ix *Indexer) unwind(ctx context.Context, head uint64) error {
+	type stored struct {
+		block uint64
+		hash  common.Hash
+	}
+	var (
+		start  uint64
+		hashes []stored
+	)
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		start, _ = getUint64(tx.Bucket(bucketMeta), keyStart)
+		c := tx.Bucket(bucketHashes).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			hashes = append(hashes, stored{binary.BigEndian.Uint64(k), common.BytesToHash(v)})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, h := range hashes {
+		if h.block > head {
+			continue
+		}
+		var ref *blockRef
+		if err := ix.caller.CallCtx(ctx, blockRefCall{number: h.block, ret: &ref, allowMissing: true}); err != nil {
+			return fmt.Errorf("get block %d: %w", h.block, err)
+		}
+		if ref == nil || ref.Hash != h.hash {
+			continue
+		}
+		if i == 0 {
+			return nil
+		}
+		return ix.db.Update(func(tx *bolt.Tx) error { return rollback(tx, h.block+1) })
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+	return ix.db.Update(func(tx *bolt.Tx) error { return rollback(tx, start) })
+}
+
+// Run syncs every interval until ctx is cancelled. Errors, including
+// ErrChainChanged, are passed to onErr, if set, and retried on the next
+// tick.
+func (ix *Indexer) Run(ctx context.Context, interval time.Duration, onErr func(error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := ix.Sync(ctx); err != nil && onErr != nil {
+			onErr(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// blockRef is the part of an eth_getBlockByNumber result the indexer needs.
+// The hash is taken as reported rather than recomputed from the header, so
+// that chains with extra header fields are handled.
+type blockRef struct {
+	Number     hexutil.Uint64 `json:"number"`
+	Hash       common.Hash    `json:"hash"`
+	ParentHash common.Hash    `json:"parentHash"`
+}
+
+// blockRefCall fetches one blockRef. Unless allowMissing is set, a block
+// the node does not have is an error; otherwise ret is left nil.
+type blockRefCall struct {
+	number       uint64
+	ret          **blockRef
+	allowMissing bool
+}
+
+func (c blockRefCall) CreateRequest() (rpc.BatchElem, error) {
+	return rpc.BatchElem{
+		Method: "eth_getBlockByNumber",
+		Args:   []any{hexutil.Uint64(c.number), false},
+		Result: c.ret,
+	}, nil
+}
+
+func (c blockRefCall) HandleResponse(elem rpc.BatchElem) error {
+	if elem.Error != nil {
+		return elem.Error
+	}
+	if *c.ret == nil && !c.allowMissing {
+		return fmt.Errorf("block %d not found", c.number)
+	}
+	return nil
+}
+
+// blockRefs fills refs with the canonical block of each key.
+func (ix *Indexer) blockRefs(ctx context.Context, refs map[uint64]*blockRef) error {
+	blocks := make([]uint64, 0, len(refs))
+	for block := range refs {
+		blocks = append(blocks, block)
+	}
+	slices.Sort(blocks)
+
+	results := make([]*blockRef, len(blocks))
+	calls := make([]w3types.RPCCaller, len(blocks))
+	for i, block := range blocks {
+		calls[i] = blockRefCall{number: block, ret: &results[i]}
+	}
+	if err := publish.BatchCall(ctx, ix.caller, calls, 0); err != nil {
+		return fmt.Errorf("get blocks: %w", err)
+	}
+	for i, block := range blocks {
+		refs[block] = results[i]
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package indexer_test
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/indexer"
+	"github.com/cosmo-local-credit/protocol/pkg/internal/vmtest"
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/giftabletoken"
+)
+
+var funcMintTo = w3.MustNewFunc("mintTo(address,uint256)", "")
+
+// chain is an Env with a GiftableToken deployed in block 101.
+type chain struct {
+	*vmtest.Env
+	token common.Address
+}
+
+func newChain(t *testing.T) *chain {
+	e := vmtest.New(t)
+	init, err := giftabletoken.EncodeInit(giftabletoken.InitArgs{Name: "Token", Symbol: "TKN", Decimals: 6, Owner: vmtest.Owner, ExpiresAt: new(big.Int)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &chain{Env: e, token: e.Proxy(giftabletoken.Bytecode(), init)}
+	e.Mine()
+	return c
+}
+
+// mine mines one block per value, minting that value in it, or nothing if
+// it is zero.
+func (c *chain) mine(values ...int64) {
+	for _, v := range values {
+		if v != 0 {
+			c.Send(c.token, funcMintTo, []any{vmtest.Owner, big.NewInt(v)})
+		}
+		c.Mine()
+	}
+}
+
+func (c *chain) open(t *testing.T, caller publish.Caller) *indexer.Indexer {
+	t.Helper()
+	ix, err := indexer.Open(filepath.Join(t.TempDir(), "events.db"), caller, 101)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ix.Close() })
+	if err := ix.Follow(context.Background(), c.token, "giftabletoken"); err != nil {
+		t.Fatal(err)
+	}
+	return ix
+}
+
+func mints(t *testing.T, ix *indexer.Indexer) []int64 {
+	t.Helper()
+	events, err := ix.Mints(indexer.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []int64
+	for _, e := range events {
+		values = append(values, e.Value.Int64())
+	}
+	return values
+}
+
+func TestSyncReorg(t *testing.T) {
+	tests := []struct {
+		name  string
+		depth int
+		// fork is mined after the reorg, as in chain.mine.
+		fork []int64
+		want []int64
+	}{
+		{name: "replaced", depth: 2, fork: []int64{20, 30}, want: []int64{1, 20, 30}},
+		{name: "shorter", depth: 2, fork: []int64{0}, want: []int64{1}},
+		{name: "longer", depth: 1, fork: []int64{0, 40}, want: []int64{1, 2, 40}},
+		{name: "removed only", depth: 3, fork: []int64{0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newChain(t)
+			c.mine(1, 2, 3)
+			ix := c.open(t, c.Caller())
+			if _, err := ix.Sync(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got := mints(t, ix); !slices.Equal(got, []int64{1, 2, 3}) {
+				t.Fatalf("mints %v before the reorg", got)
+			}
+
+			c.Reorg(tt.depth)
+			c.mine(tt.fork...)
+			synced, err := ix.Sync(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if synced != c.Header.Number.Uint64() {
+				t.Errorf("synced to %d, head %s", synced, c.Header.Number)
+			}
+			if got := mints(t, ix); !slices.Equal(got, tt.want) {
+				t.Errorf("mints %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// afterLogs runs fn once, after the first eth_getLogs request has been
+// answered.
+type afterLogs struct {
+	publish.Caller
+	fn func()
+}
+
+func (c *afterLogs) CallCtx(ctx context.Context, calls ...w3types.RPCCaller) error {
+	err := c.Caller.CallCtx(ctx, calls...)
+	for _, call := range calls {
+		if elem, _ := call.CreateRequest(); elem.Method == "eth_getLogs" && c.fn != nil {
+			c.fn()
+			c.fn = nil
+		}
+	}
+	return err
+}
+
+func TestSyncReorgDuringGetLogs(t *testing.T) {
+	c := newChain(t)
+	c.mine(1, 0)
+	// The fork has a log in the block that had none when the logs were
+	// fetched, and the blocks before it are unchanged.
+	caller := &afterLogs{Caller: c.Caller(), fn: func() {
+		c.Reorg(1)
+		c.mine(2)
+	}}
+	ix := c.open(t, caller)
+
+	if _, err := ix.Sync(context.Background()); !errors.Is(err, indexer.ErrChainChanged) {
+		t.Fatalf("err %v, want ErrChainChanged", err)
+	}
+	if block, ok := ix.SyncedBlock(); ok {
+		t.Errorf("synced to %d from a changed chain", block)
+	}
+	if _, err := ix.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := mints(t, ix); !slices.Equal(got, []int64{1, 2}) {
+		t.Errorf("mints %v, want [1 2]", got)
+	}
+}
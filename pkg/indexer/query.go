@@ -0,0 +1,290 @@
+package indexer
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"math/big"
+	"slices"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/lmittmann/w3"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/accountsindex"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/cat"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/giftabletoken"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/limiter"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/relativequoter"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/swappool"
+)
+
+// Filter narrows a query. The zero Filter matches every stored log.
+type Filter struct {
+	Address   common.Address // zero for any followed contract
+	FromBlock uint64
+	ToBlock   uint64 // zero for no upper bound
+}
+
+func (f Filter) toBlock() uint64 {
+	if f.ToBlock == 0 {
+		return math.MaxUint64
+	}
+	return f.ToBlock
+}
+
+// Event is a stored log decoded against the package of its contract.
+type Event struct {
+	Log     types.Log
+	Package string
+	Name    string
+	Args    map[string]any
+}
+
+// Meta locates a typed event.
+type Meta struct {
+	Address  common.Address
+	Block    uint64
+	TxHash   common.Hash
+	LogIndex uint
+}
+
+type (
+	Swap struct {
+		Meta
+		Initiator common.Address
+		TokenIn   common.Address
+		TokenOut  common.Address
+		AmountIn  *big.Int
+		AmountOut *big.Int
+		Fee       *big.Int
+	}
+
+	Deposit struct {
+		Meta
+		Initiator common.Address
+		TokenIn   common.Address
+		AmountIn  *big.Int
+	}
+
+	Collect struct {
+		Meta
+		FeeAddress common.Address
+		TokenOut   common.Address
+		AmountOut  *big.Int
+	}
+
+	Mint struct {
+		Meta
+		Minter      common.Address
+		Beneficiary common.Address
+		Value       *big.Int
+	}
+
+	Burn struct {
+		Meta
+		From  common.Address
+		Value *big.Int
+	}
+
+	Transfer struct {
+		Meta
+		From  common.Address
+		To    common.Address
+		Value *big.Int
+	}
+
+	TokensSet struct {
+		Meta
+		Account common.Address
+		Tokens  []common.Address
+	}
+
+	// AddressAdded is emitted by AccountsIndex for accounts and by
+	// TokenUniqueSymbolIndex for tokens.
+	AddressAdded struct {
+		Meta
+		Account common.Address
+	}
+
+	LimitSet struct {
+		Meta
+		Token  common.Address
+		Holder common.Address
+		Value  *big.Int
+	}
+
+	PriceIndexUpdated struct {
+		Meta
+		Token common.Address
+		Rate  *big.Int
+	}
+)
+
+// Events returns the stored events matching f, decoded against the
+// package of the contract that emitted them. name selects one event, e.g.
+// "Swap", and may be empty for all.
+func (ix *Indexer) Events(name string, f Filter) ([]Event, error) {
+	followed := ix.followed()
+
+	var (
+		bucket   = bucketLogs
+		prefixes = [][]byte{nil}
+	)
+	switch {
+	case f.Address != (common.Address{}):
+		bucket, prefixes = bucketByAddress, [][]byte{f.Address.Bytes()}
+	case name != "":
+		topics := make(map[common.Hash]bool)
+		for _, c := range followed {
+			for _, ev := range c.Events() {
+				if n, _, _ := strings.Cut(ev.Signature, "("); n == name {
+					topics[ev.Topic0] = true
+				}
+			}
+		}
+		bucket, prefixes = bucketByTopic, nil
+		for topic := range topics {
+			prefixes = append(prefixes, topic.Bytes())
+		}
+	}
+
+	var events []Event
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		for _, prefix := range prefixes {
+			err := scan(tx, bucket, prefix, f.FromBlock, f.toBlock(), func(log types.Log) error {
+				c, ok := followed[log.Address]
+				if !ok {
+					return nil
+				}
+				evName, args, err := c.DecodeEvent(&log)
+				if err != nil {
+					return fmt.Errorf("%s log %d in block %d: %w", c.Package, log.Index, log.BlockNumber, err)
+				}
+				if name != "" && evName != name {
+					return nil
+				}
+				events = append(events, Event{Log: log, Package: c.Package, Name: evName, Args: args})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(events, func(a, b Event) int {
+		return cmp.Or(cmp.Compare(a.Log.BlockNumber, b.Log.BlockNumber), cmp.Compare(a.Log.Index, b.Log.Index))
+	})
+	return events, nil
+}
+
+func (ix *Indexer) Swaps(f Filter) ([]Swap, error) {
+	return query(ix, swappool.EventSwap, []string{"swappool"}, f, func(m Meta, log *types.Log) (Swap, error) {
+		e := Swap{Meta: m, AmountIn: new(big.Int), AmountOut: new(big.Int), Fee: new(big.Int)}
+		err := swappool.EventSwap.DecodeArgs(log, &e.Initiator, &e.TokenIn, &e.TokenOut, e.AmountIn, e.AmountOut, e.Fee)
+		return e, err
+	})
+}
+
+func (ix *Indexer) Deposits(f Filter) ([]Deposit, error) {
+	return query(ix, swappool.EventDeposit, []string{"swappool"}, f, func(m Meta, log *types.Log) (Deposit, error) {
+		e := Deposit{Meta: m, AmountIn: new(big.Int)}
+		err := swappool.EventDeposit.DecodeArgs(log, &e.Initiator, &e.TokenIn, e.AmountIn)
+		return e, err
+	})
+}
+
+func (ix *Indexer) Collects(f Filter) ([]Collect, error) {
+	return query(ix, swappool.EventCollect, []string{"swappool"}, f, func(m Meta, log *types.Log) (Collect, error) {
+		e := Collect{Meta: m, AmountOut: new(big.Int)}
+		err := swappool.EventCollect.DecodeArgs(log, &e.FeeAddress, &e.TokenOut, e.AmountOut)
+		return e, err
+	})
+}
+
+func (ix *Indexer) Mints(f Filter) ([]Mint, error) {
+	return query(ix, giftabletoken.EventMint, []string{"giftabletoken"}, f, func(m Meta, log *types.Log) (Mint, error) {
+		e := Mint{Meta: m, Value: new(big.Int)}
+		err := giftabletoken.EventMint.DecodeArgs(log, &e.Minter, &e.Beneficiary, e.Value)
+		return e, err
+	})
+}
+
+func (ix *Indexer) Burns(f Filter) ([]Burn, error) {
+	return query(ix, giftabletoken.EventBurn, []string{"giftabletoken"}, f, func(m Meta, log *types.Log) (Burn, error) {
+		e := Burn{Meta: m, Value: new(big.Int)}
+		err := giftabletoken.EventBurn.DecodeArgs(log, &e.From, e.Value)
+		return e, err
+	})
+}
+
+func (ix *Indexer) Transfers(f Filter) ([]Transfer, error) {
+	return query(ix, giftabletoken.EventTransfer, []string{"giftabletoken"}, f, func(m Meta, log *types.Log) (Transfer, error) {
+		e := Transfer{Meta: m, Value: new(big.Int)}
+		err := giftabletoken.EventTransfer.DecodeArgs(log, &e.From, &e.To, e.Value)
+		return e, err
+	})
+}
+
+func (ix *Indexer) TokensSets(f Filter) ([]TokensSet, error) {
+	return query(ix, cat.EventTokensSet, []string{"cat"}, f, func(m Meta, log *types.Log) (TokensSet, error) {
+		e := TokensSet{Meta: m}
+		err := cat.EventTokensSet.DecodeArgs(log, &e.Account, &e.Tokens)
+		return e, err
+	})
+}
+
+func (ix *Indexer) AddressesAdded(f Filter) ([]AddressAdded, error) {
+	return query(ix, accountsindex.EventAddressAdded, []string{"accountsindex", "tokenuniquesymbolindex"}, f, func(m Meta, log *types.Log) (AddressAdded, error) {
+		e := AddressAdded{Meta: m}
+		err := accountsindex.EventAddressAdded.DecodeArgs(log, &e.Account)
+		return e, err
+	})
+}
+
+func (ix *Indexer) LimitSets(f Filter) ([]LimitSet, error) {
+	return query(ix, limiter.EventLimitSet, []string{"limiter"}, f, func(m Meta, log *types.Log) (LimitSet, error) {
+		e := LimitSet{Meta: m, Value: new(big.Int)}
+		err := limiter.EventLimitSet.DecodeArgs(log, &e.Token, &e.Holder, e.Value)
+		return e, err
+	})
+}
+
+func (ix *Indexer) PriceIndexUpdates(f Filter) ([]PriceIndexUpdated, error) {
+	return query(ix, relativequoter.EventPriceIndexUpdated, []string{"relativequoter"}, f, func(m Meta, log *types.Log) (PriceIndexUpdated, error) {
+		e := PriceIndexUpdated{Meta: m, Rate: new(big.Int)}
+		err := relativequoter.EventPriceIndexUpdated.DecodeArgs(log, &e.Token, e.Rate)
+		return e, err
+	})
+}
+
+// query decodes the stored logs with ev's topic that were emitted by
+// followed contracts of packages.
+func query[T any](ix *Indexer, ev *w3.Event, packages []string, f Filter, decode func(Meta, *types.Log) (T, error)) ([]T, error) {
+	followed := ix.followed()
+
+	var out []T
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		return scan(tx, bucketByTopic, ev.Topic0.Bytes(), f.FromBlock, f.toBlock(), func(log types.Log) error {
+			if f.Address != (common.Address{}) && log.Address != f.Address {
+				return nil
+			}
+			if c, ok := followed[log.Address]; !ok || !slices.Contains(packages, c.Package) {
+				return nil
+			}
+			e, err := decode(Meta{Address: log.Address, Block: log.BlockNumber, TxHash: log.TxHash, LogIndex: log.Index}, &log)
+			if err != nil {
+				return fmt.Errorf("decode log %d in block %d: %w", log.Index, log.BlockNumber, err)
+			}
+			out = append(out, e)
+			return nil
+		})
+	})
+	return out, err
+}
@@ -0,0 +1,155 @@
+package indexer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bucket layout. Block numbers and log indexes are big-endian so that keys
+// sort in chain order.
+//
+//	meta        "start", "next" -> uint64, next being the first block not
+//	            yet synced
+//	contracts   address -> package
+//	hashes      block -> block hash, for every block with logs and the end
+//	            of every synced range
+//	logs        block | index -> JSON types.Log
+//	by_address  address | block | index -> nil
+//	by_topic    topic0 | block | index -> nil
+var (
+	bucketMeta      = []byte("meta")
+	bucketContracts = []byte("contracts")
+	bucketHashes    = []byte("hashes")
+	bucketLogs      = []byte("logs")
+	bucketByAddress = []byte("by_address")
+	bucketByTopic   = []byte("by_topic")
+
+	keyStart = []byte("start")
+	keyNext  = []byte("next")
+)
+
+func createBuckets(tx *bolt.Tx) error {
+	for _, name := range [][]byte{bucketMeta, bucketContracts, bucketHashes, bucketLogs, bucketByAddress, bucketByTopic} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return fmt.Errorf("create bucket %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func uint64Key(n uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, n)
+}
+
+// logKey is block | index.
+func logKey(block uint64, index uint) []byte {
+	return binary.BigEndian.AppendUint32(uint64Key(block), uint32(index))
+}
+
+func getUint64(b *bolt.Bucket, key []byte) (uint64, bool) {
+	v := b.Get(key)
+	if len(v) != 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(v), true
+}
+
+func putLog(tx *bolt.Tx, log *types.Log) error {
+	raw, err := json.Marshal(log)
+	if err != nil {
+		return err
+	}
+	key := logKey(log.BlockNumber, log.Index)
+	if err := tx.Bucket(bucketLogs).Put(key, raw); err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketByAddress).Put(append(log.Address.Bytes(), key...), nil); err != nil {
+		return err
+	}
+	return tx.Bucket(bucketByTopic).Put(append(log.Topics[0].Bytes(), key...), nil)
+}
+
+func getLog(tx *bolt.Tx, key []byte) (types.Log, error) {
+	var log types.Log
+	raw := tx.Bucket(bucketLogs).Get(key)
+	if raw == nil {
+		return log, fmt.Errorf("missing log %x", key)
+	}
+	if err := json.Unmarshal(raw, &log); err != nil {
+		return log, fmt.Errorf("decode log %x: %w", key, err)
+	}
+	return log, nil
+}
+
+// rollback deletes every log and block hash from block next on and resumes
+// syncing there.
+func rollback(tx *bolt.Tx, next uint64) error {
+	logs := tx.Bucket(bucketLogs)
+	var keys [][]byte
+	c := logs.Cursor()
+	for k, _ := c.Seek(uint64Key(next)); k != nil; k, _ = c.Next() {
+		keys = append(keys, bytes.Clone(k))
+	}
+	for _, key := range keys {
+		log, err := getLog(tx, key)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketByAddress).Delete(append(log.Address.Bytes(), key...)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketByTopic).Delete(append(log.Topics[0].Bytes(), key...)); err != nil {
+			return err
+		}
+		if err := logs.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	hashes := tx.Bucket(bucketHashes)
+	keys = keys[:0]
+	c = hashes.Cursor()
+	for k, _ := c.Seek(uint64Key(next)); k != nil; k, _ = c.Next() {
+		keys = append(keys, bytes.Clone(k))
+	}
+	for _, key := range keys {
+		if err := hashes.Delete(key); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(bucketMeta).Put(keyNext, uint64Key(next))
+}
+
+// scan calls fn with every stored log whose index key under prefix lies in
+// [fromBlock, toBlock], in chain order.
+func scan(tx *bolt.Tx, bucket, prefix []byte, fromBlock, toBlock uint64, fn func(types.Log) error) error {
+	c := tx.Bucket(bucket).Cursor()
+	for k, _ := c.Seek(append(bytes.Clone(prefix), uint64Key(fromBlock)...)); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		key := k[len(prefix):]
+		if binary.BigEndian.Uint64(key) > toBlock {
+			break
+		}
+		log, err := getLog(tx, key)
+		if err != nil {
+			return err
+		}
+		if err := fn(log); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getHash(tx *bolt.Tx, block uint64) (common.Hash, bool) {
+	v := tx.Bucket(bucketHashes).Get(uint64Key(block))
+	if v == nil {
+		return common.Hash{}, false
+	}
+	return common.BytesToHash(v), true
+}
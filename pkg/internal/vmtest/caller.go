@@ -0,0 +1,428 @@
+package vmtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"slices"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/w3types"
+	"github.com/lmittmann/w3/w3vm"
+)
+
+// Caller returns a publish.Caller served by the Env.
+func (e *Env) Caller() *Caller {
+	return &Caller{env: e}
+}
+
+// Caller is a publish.Caller backed by an Env. It serves the eth_ methods
+// for blocks, state, calls, gas estimates, logs, transactions and
+// receipts. State and calls at a past block see the state after it.
+type Caller struct {
+	env *Env
+
+	// Requests counts CallCtx invocations, i.e. round trips.
+	Requests int
+
+	// Hook, if set, is called with each request before it is served; a
+	// non-nil error is returned as that request's error instead.
+	Hook func(method string, args []any) error
+}
+
+func (c *Caller) CallCtx(ctx context.Context, calls ...w3types.RPCCaller) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.env.mu.Lock()
+	defer c.env.mu.Unlock()
+
+	c.Requests++
+	errs := make(w3.CallErrors, len(calls))
+	failed := false
+	for i, call := range calls {
+		elem, err := call.CreateRequest()
+		if err != nil {
+			return err
+		}
+		if c.Hook != nil {
+			elem.Error = c.Hook(elem.Method, elem.Args)
+		}
+		if elem.Error == nil {
+			if err := c.env.serve(&elem); err != nil {
+				return err
+			}
+		}
+		if errs[i] = call.HandleResponse(elem); errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+// callArgs is the part of an eth_call or eth_estimateGas message that is
+// applied.
+type callArgs struct {
+	From  common.Address  `json:"from"`
+	To    *common.Address `json:"to"`
+	Input hexutil.Bytes   `json:"input"`
+	Data  hexutil.Bytes   `json:"data"`
+	Value *hexutil.Big    `json:"value"`
+}
+
+func (a callArgs) message() *w3types.Message {
+	input := a.Input
+	if input == nil {
+		input = a.Data
+	}
+	return &w3types.Message{From: a.From, To: a.To, Input: input, Value: (*big.Int)(a.Value), Gas: GasLimit}
+}
+
+// filterArgs is an eth_getLogs filter.
+type filterArgs struct {
+	FromBlock string          `json:"fromBlock"`
+	ToBlock   string          `json:"toBlock"`
+	BlockHash *common.Hash    `json:"blockHash"`
+	Address   json.RawMessage `json:"address"`
+	Topics    [][]common.Hash `json:"topics"`
+}
+
+// serve answers elem, setting elem.Error for failed requests. It returns
+// an error only for requests it cannot serve at all.
+func (e *Env) serve(elem *rpc.BatchElem) error {
+	var (
+		result any
+		err    error
+	)
+	switch elem.Method {
+	case "eth_chainId":
+		result = hexutil.Uint64(ChainID)
+	case "eth_blockNumber":
+		result = (*hexutil.Big)(e.Header.Number)
+	case "eth_getBlockByNumber":
+		var n uint64
+		if n, err = e.blockArg(elem, 0); err == nil {
+			if b := e.blockAt(n); b != nil {
+				result = b.header
+			}
+		}
+	case "eth_getBlockByHash":
+		var hash common.Hash
+		if err = arg(elem, 0, &hash); err == nil {
+			for _, b := range e.blocks {
+				if b.header.Hash() == hash {
+					result = b.header
+				}
+			}
+		}
+	case "eth_call", "eth_estimateGas":
+		var (
+			args callArgs
+			n    uint64
+			r    *w3vm.Receipt
+		)
+		if err = arg(elem, 0, &args); err != nil {
+			break
+		}
+		if n, err = e.blockArg(elem, 1); err != nil {
+			break
+		}
+		if r, err = e.stateAt(n).Call(args.message()); err != nil {
+			break
+		}
+		if elem.Method == "eth_call" {
+			result = hexutil.Bytes(r.Output)
+		} else {
+			// Cover the gas refunded and the 63/64 kept back from calls.
+			result = hexutil.Uint64(min(r.MaxGasUsed*5/4, GasLimit))
+		}
+	case "eth_getTransactionCount", "eth_getBalance", "eth_getCode":
+		var (
+			addr common.Address
+			n    uint64
+		)
+		if err = arg(elem, 0, &addr); err != nil {
+			break
+		}
+		var tag string
+		if len(elem.Args) > 1 {
+			arg(elem, 1, &tag)
+		}
+		if tag == "pending" && elem.Method == "eth_getTransactionCount" {
+			var nonce uint64
+			nonce, err = e.pendingNonce(addr)
+			result = hexutil.Uint64(nonce)
+			break
+		}
+		if n, err = e.blockArg(elem, 1); err != nil {
+			break
+		}
+		vm := e.stateAt(n)
+		switch elem.Method {
+		case "eth_getTransactionCount":
+			var nonce uint64
+			nonce, err = vm.Nonce(addr)
+			result = hexutil.Uint64(nonce)
+		case "eth_getBalance":
+			var balance *big.Int
+			balance, err = vm.Balance(addr)
+			result = (*hexutil.Big)(balance)
+		default:
+			var code []byte
+			code, err = vm.Code(addr)
+			result = hexutil.Bytes(code)
+		}
+	case "eth_getStorageAt":
+		var (
+			addr common.Address
+			slot common.Hash
+			n    uint64
+		)
+		if err = arg(elem, 0, &addr); err != nil {
+			break
+		}
+		if err = arg(elem, 1, &slot); err != nil {
+			break
+		}
+		if n, err = e.blockArg(elem, 2); err == nil {
+			result, err = e.stateAt(n).StorageAt(addr, slot)
+		}
+	case "eth_sendRawTransaction":
+		var (
+			raw hexutil.Bytes
+			tx  types.Transaction
+		)
+		if err = arg(elem, 0, &raw); err != nil {
+			break
+		}
+		if err = tx.UnmarshalBinary(raw); err != nil {
+			break
+		}
+		if err = e.submit(&tx); err == nil {
+			result = tx.Hash()
+		}
+	case "eth_getTransactionByHash", "eth_getTransactionReceipt":
+		var hash common.Hash
+		if err = arg(elem, 0, &hash); err != nil {
+			break
+		}
+		tx, receipt, ok := e.lookup(hash)
+		switch {
+		case elem.Method == "eth_getTransactionByHash" && ok:
+			result = tx
+		case elem.Method == "eth_getTransactionReceipt" && receipt != nil:
+			result = receipt
+		}
+	case "eth_getLogs":
+		result, err = e.filterLogs(elem)
+	default:
+		return fmt.Errorf("vmtest: unsupported method %s", elem.Method)
+	}
+	if err != nil {
+		elem.Error = err
+		return nil
+	}
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, elem.Result)
+}
+
+// filterLogs returns the logs of the canonical blocks that match the
+// eth_getLogs filter of elem.
+func (e *Env) filterLogs(elem *rpc.BatchElem) ([]*types.Log, error) {
+	var f filterArgs
+	if err := arg(elem, 0, &f); err != nil {
+		return nil, err
+	}
+	var addrs []common.Address
+	if len(f.Address) > 0 && string(f.Address) != "null" {
+		if err := json.Unmarshal(f.Address, &addrs); err != nil {
+			var addr common.Address
+			if err := json.Unmarshal(f.Address, &addr); err != nil {
+				return nil, err
+			}
+			addrs = []common.Address{addr}
+		}
+	}
+
+	from, to := uint64(0), e.Header.Number.Uint64()
+	var err error
+	if f.FromBlock != "" {
+		if from, err = e.parseBlock(f.FromBlock); err != nil {
+			return nil, err
+		}
+	}
+	if f.ToBlock != "" {
+		if to, err = e.parseBlock(f.ToBlock); err != nil {
+			return nil, err
+		}
+	}
+
+	logs := []*types.Log{}
+	for _, b := range e.blocks {
+		n := b.header.Number.Uint64()
+		if f.BlockHash != nil && b.header.Hash() != *f.BlockHash || f.BlockHash == nil && (n < from || n > to) {
+			continue
+		}
+	logs:
+		for _, log := range b.logs {
+			if len(addrs) > 0 && !slices.Contains(addrs, log.Address) {
+				continue
+			}
+			for i, topics := range f.Topics {
+				if len(topics) > 0 && (i >= len(log.Topics) || !slices.Contains(topics, log.Topics[i])) {
+					continue logs
+				}
+			}
+			logs = append(logs, log)
+		}
+	}
+	return logs, nil
+}
+
+// blockArg returns the block number argument i of elem, the latest block
+// if it is a tag or missing.
+func (e *Env) blockArg(elem *rpc.BatchElem, i int) (uint64, error) {
+	if i >= len(elem.Args) {
+		return e.Header.Number.Uint64(), nil
+	}
+	var s string
+	if err := arg(elem, i, &s); err != nil {
+		return 0, err
+	}
+	return e.parseBlock(s)
+}
+
+func (e *Env) parseBlock(s string) (uint64, error) {
+	switch s {
+	case "latest", "pending", "safe", "finalized":
+		return e.Header.Number.Uint64(), nil
+	case "earliest":
+		return 0, nil
+	}
+	n, err := hexutil.DecodeUint64(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid block %q: %w", s, err)
+	}
+	return n, nil
+}
+
+// arg decodes argument i of elem into v through its JSON encoding, so
+// that requests built by w3 and raw JSON-RPC params are read alike.
+func arg(elem *rpc.BatchElem, i int, v any) error {
+	if i >= len(elem.Args) {
+		return fmt.Errorf("missing argument %d", i)
+	}
+	raw, err := json.Marshal(elem.Args[i])
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+type (
+	jsonrpcRequest struct {
+		ID     json.RawMessage   `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+
+	jsonrpcResponse struct {
+		JSONRPC string          `json:"jsonrpc"`
+		ID      json.RawMessage `json:"id"`
+		Result  json.RawMessage `json:"result,omitempty"`
+		Error   *jsonrpcError   `json:"error,omitempty"`
+	}
+
+	jsonrpcError struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+)
+
+// ServeHTTP serves the Env as a JSON-RPC endpoint over HTTP, so that it can
+// stand behind a w3.Client or a publish.Pool. Each HTTP request counts as
+// one of Requests. Hook errors that implement rpc.Error keep their code.
+func (c *Caller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	batch := len(body) > 0 && body[0] == '['
+	var reqs []jsonrpcRequest
+	if !batch {
+		body = append(append([]byte{'['}, body...), ']')
+	}
+	if err := json.Unmarshal(body, &reqs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.env.mu.Lock()
+	c.Requests++
+	resps := make([]jsonrpcResponse, len(reqs))
+	for i, req := range reqs {
+		args := make([]any, len(req.Params))
+		for j, p := range req.Params {
+			args[j] = p
+		}
+		var result json.RawMessage
+		elem := rpc.BatchElem{Method: req.Method, Args: args, Result: &result}
+		if c.Hook != nil {
+			elem.Error = c.Hook(elem.Method, elem.Args)
+		}
+		if elem.Error == nil {
+			if err := c.env.serve(&elem); err != nil {
+				elem.Error = &rpcError{code: -32601, msg: err.Error()}
+			}
+		}
+		resps[i] = jsonrpcResponse{JSONRPC: "2.0", ID: req.ID, Result: result}
+		if elem.Error != nil {
+			code := -32000
+			var rpcErr rpc.Error
+			if errors.As(elem.Error, &rpcErr) {
+				code = rpcErr.ErrorCode()
+			}
+			resps[i].Result, resps[i].Error = nil, &jsonrpcError{Code: code, Message: elem.Error.Error()}
+		} else if result == nil {
+			resps[i].Result = json.RawMessage("null")
+		}
+	}
+	c.env.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if batch {
+		json.NewEncoder(w).Encode(resps)
+	} else {
+		json.NewEncoder(w).Encode(resps[0])
+	}
+}
+
+// rpcError is an error with a JSON-RPC error code.
+type rpcError struct {
+	code int
+	msg  string
+}
+
+// NewRPCError returns an error that ServeHTTP answers with code, e.g.
+// -32005 for a rate limit, for use in a Hook.
+func NewRPCError(code int, msg string) error {
+	return &rpcError{code: code, msg: msg}
+}
+
+func (e *rpcError) Error() string  { return e.msg }
+func (e *rpcError) ErrorCode() int { return e.code }
@@ -0,0 +1,285 @@
+package vmtest
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"slices"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/lmittmann/w3/w3vm"
+)
+
+// The txpool errors, worded as geth words them.
+var (
+	ErrAlreadyKnown = errors.New("already known")
+	ErrNonceTooLow  = errors.New("nonce too low")
+	ErrUnderpriced  = errors.New("replacement transaction underpriced")
+)
+
+var signer = types.LatestSignerForChainID(big.NewInt(ChainID))
+
+// block is a mined block and the state after it.
+type block struct {
+	header   *types.Header
+	txs      []*types.Transaction
+	receipts []*types.Receipt
+	logs     []*types.Log
+	state    *state.StateDB
+}
+
+// Mine includes the pending transactions that are next in their sender's
+// nonce sequence, up to MaxBlockTxs if set, in a new block along with the
+// logs of messages applied since the last block, and returns its header.
+func (e *Env) Mine() *types.Header {
+	e.t.Helper()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	parent := e.blocks[len(e.blocks)-1]
+	if parent.state == nil {
+		parent.state = e.VM.Snapshot()
+	}
+	header := &types.Header{
+		ParentHash: parent.header.Hash(),
+		Number:     new(big.Int).Add(parent.header.Number, big.NewInt(1)),
+		Time:       parent.header.Time + e.BlockTime,
+		Difficulty: new(big.Int),
+		GasLimit:   parent.header.GasLimit,
+		BaseFee:    new(big.Int),
+		Extra:      []byte{e.fork},
+	}
+	vm := e.vmAt(header, e.VM.Snapshot())
+	b := &block{header: header, logs: e.logs}
+	e.logs = nil
+
+	for included := true; included; {
+		included = false
+		var rest []*types.Transaction
+		for _, tx := range e.pending {
+			from, _ := types.Sender(signer, tx)
+			nonce, err := vm.Nonce(from)
+			if err != nil {
+				e.t.Fatal(err)
+			}
+			switch {
+			case tx.Nonce() < nonce:
+				// Replaced by a transaction mined earlier.
+			case tx.Nonce() > nonce || e.MaxBlockTxs > 0 && len(b.txs) == e.MaxBlockTxs:
+				rest = append(rest, tx)
+			default:
+				b.include(vm, tx)
+				included = true
+			}
+		}
+		e.pending = rest
+	}
+
+	hash := header.Hash()
+	for i, log := range b.logs {
+		log.BlockNumber = header.Number.Uint64()
+		log.BlockHash = hash
+		log.Index = uint(i)
+		if log.TxHash == (common.Hash{}) {
+			// Logs of applied messages get a made-up transaction.
+			log.TxHash = crypto.Keccak256Hash(hash[:], big.NewInt(int64(i)).Bytes())
+		}
+	}
+	for _, r := range b.receipts {
+		r.BlockHash = hash
+	}
+	b.state = vm.Snapshot()
+	e.blocks = append(e.blocks, b)
+	e.VM, e.Header = vm, header
+	return header
+}
+
+// include applies tx and records its receipt and logs.
+func (b *block) include(vm *w3vm.VM, tx *types.Transaction) {
+	r, err := vm.ApplyTx(tx)
+	if r == nil {
+		// Invalid transactions, e.g. with too little gas, are dropped.
+		return
+	}
+	receipt := &types.Receipt{
+		Type:             tx.Type(),
+		Status:           types.ReceiptStatusSuccessful,
+		TxHash:           tx.Hash(),
+		GasUsed:          r.GasUsed,
+		BlockNumber:      b.header.Number,
+		TransactionIndex: uint(len(b.txs)),
+		Logs:             append([]*types.Log{}, r.Logs...),
+	}
+	if err != nil {
+		receipt.Status = types.ReceiptStatusFailed
+	}
+	if tx.To() == nil {
+		receipt.ContractAddress = *r.ContractAddress
+	}
+	receipt.CumulativeGasUsed = r.GasUsed
+	if n := len(b.receipts); n > 0 {
+		receipt.CumulativeGasUsed += b.receipts[n-1].CumulativeGasUsed
+	}
+	for _, log := range r.Logs {
+		log.TxHash = tx.Hash()
+		log.TxIndex = receipt.TransactionIndex
+	}
+	receipt.Bloom = types.CreateBloom(receipt)
+	b.txs = append(b.txs, tx)
+	b.receipts = append(b.receipts, receipt)
+	b.logs = append(b.logs, r.Logs...)
+}
+
+// Reorg drops the latest depth blocks and returns their transactions to
+// the pool, like a node switching to a fork that has not included them
+// yet. Blocks mined afterwards have different hashes than the ones
+// dropped.
+func (e *Env) Reorg(depth int) {
+	e.t.Helper()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if depth >= len(e.blocks) {
+		e.t.Fatalf("reorg of %d blocks past block %s", depth, e.blocks[0].header.Number)
+	}
+	dropped := e.blocks[len(e.blocks)-depth:]
+	e.blocks = e.blocks[:len(e.blocks)-depth]
+	for _, b := range dropped {
+		e.pending = append(e.pending, b.txs...)
+	}
+	head := e.blocks[len(e.blocks)-1]
+	e.VM, e.Header = e.vmAt(head.header, head.state.Copy()), head.header
+	e.logs = nil
+	e.fork++
+}
+
+// AutoMine mines a block whenever transactions are pending, until the test
+// ends.
+func (e *Env) AutoMine() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	e.t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		for ctx.Err() == nil {
+			if len(e.Pending()) > 0 {
+				e.Mine()
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+}
+
+// Pending returns the transactions waiting to be mined.
+func (e *Env) Pending() []*types.Transaction {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*types.Transaction(nil), e.pending...)
+}
+
+// submit adds tx to the pool. A transaction with the nonce of a pending
+// one replaces it if it raises both fees by at least 10%. Like geth, it
+// refuses a pending transaction as already known and a mined one for its
+// nonce.
+func (e *Env) submit(tx *types.Transaction) error {
+	from, err := types.Sender(signer, tx)
+	if err != nil {
+		return err
+	}
+	if slices.ContainsFunc(e.pending, func(p *types.Transaction) bool { return p.Hash() == tx.Hash() }) {
+		return ErrAlreadyKnown
+	}
+	nonce, err := e.VM.Nonce(from)
+	if err != nil {
+		return err
+	}
+	if tx.Nonce() < nonce {
+		return ErrNonceTooLow
+	}
+	for i, old := range e.pending {
+		if other, _ := types.Sender(signer, old); other != from || old.Nonce() != tx.Nonce() {
+			continue
+		}
+		if !bumped(tx.GasFeeCap(), old.GasFeeCap()) || !bumped(tx.GasTipCap(), old.GasTipCap()) {
+			return ErrUnderpriced
+		}
+		e.pending[i] = tx
+		return nil
+	}
+	e.pending = append(e.pending, tx)
+	return nil
+}
+
+// bumped reports whether fee is at least 10% above old.
+func bumped(fee, old *big.Int) bool {
+	min := new(big.Int).Mul(old, big.NewInt(110))
+	return new(big.Int).Mul(fee, big.NewInt(100)).Cmp(min) >= 0
+}
+
+// lookup returns a pending or mined transaction and, if mined, its
+// receipt.
+func (e *Env) lookup(hash common.Hash) (*types.Transaction, *types.Receipt, bool) {
+	for _, tx := range e.pending {
+		if tx.Hash() == hash {
+			return tx, nil, true
+		}
+	}
+	for _, b := range e.blocks {
+		for i, tx := range b.txs {
+			if tx.Hash() == hash {
+				return tx, b.receipts[i], true
+			}
+		}
+	}
+	return nil, nil, false
+}
+
+// pendingNonce is the nonce after the pending transactions of from.
+func (e *Env) pendingNonce(from common.Address) (uint64, error) {
+	nonce, err := e.VM.Nonce(from)
+	if err != nil {
+		return 0, err
+	}
+	for _, tx := range e.pending {
+		if sender, _ := types.Sender(signer, tx); sender == from && tx.Nonce() >= nonce {
+			nonce = tx.Nonce() + 1
+		}
+	}
+	return nonce, nil
+}
+
+// blockAt returns the block number n, or nil if it is not in the chain.
+func (e *Env) blockAt(n uint64) *block {
+	first := e.blocks[0].header.Number.Uint64()
+	if n < first || n-first >= uint64(len(e.blocks)) {
+		return nil
+	}
+	return e.blocks[n-first]
+}
+
+// stateAt returns a VM with the state after block n, or the latest state
+// if n is the latest block or later.
+func (e *Env) stateAt(n uint64) *w3vm.VM {
+	if n >= e.Header.Number.Uint64() {
+		return e.VM
+	}
+	b := e.blockAt(n)
+	if b == nil || b.state == nil {
+		return e.VM
+	}
+	return e.vmAt(b.header, b.state.Copy())
+}
+
+func (e *Env) vmAt(header *types.Header, db *state.StateDB) *w3vm.VM {
+	vm, err := w3vm.New(w3vm.WithNoBaseFee(), w3vm.WithHeader(header), w3vm.WithStateDB(db))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return vm
+}
@@ -0,0 +1,243 @@
+// Package vmtest runs the embedded contract bytecode in an in-memory EVM so
+// that the off-chain ports can be tested against the Solidity they mirror.
+// An Env is also a small chain: Caller serves it over the JSON-RPC methods
+// the publish packages use, signed transactions wait in a pool until Mine
+// includes them in a block, and Reorg replaces the latest blocks.
+package vmtest
+
+import (
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/w3types"
+	"github.com/lmittmann/w3/w3vm"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/erc1967factory"
+)
+
+// GasLimit is the gas given to every message.
+const GasLimit = 16_000_000
+
+// ChainID is the chain ID transactions sent to an Env must be signed for.
+const ChainID = 1
+
+// Owner deploys everything and owns every proxy.
+var Owner = common.HexToAddress("0x000000000000000000000000000000000000a11c")
+
+var funcDeployAndCall = w3.MustNewFunc("deployAndCall(address,address,bytes)", "address")
+
+// Env is one VM with an ERC1967Factory deployed. Calls run against the
+// latest block, which Header describes; it is block 100 until Mine is
+// called. BlockTime is the number of seconds between mined blocks, and
+// MaxBlockTxs limits the transactions of a block if set.
+type Env struct {
+	t           testing.TB
+	VM          *w3vm.VM
+	Header      *types.Header
+	Factory     common.Address
+	BlockTime   uint64
+	MaxBlockTxs int
+
+	mu      sync.Mutex
+	blocks  []*block
+	pending []*types.Transaction
+	logs    []*types.Log
+	fork    byte
+}
+
+// New returns an Env at block 100 with a funded Owner.
+func New(t testing.TB) *Env {
+	t.Helper()
+	header := &types.Header{
+		Number:     big.NewInt(100),
+		Time:       1_700_000_000,
+		Difficulty: new(big.Int),
+		GasLimit:   30_000_000,
+		BaseFee:    new(big.Int),
+	}
+	vm, err := w3vm.New(
+		w3vm.WithNoBaseFee(),
+		w3vm.WithHeader(header),
+		w3vm.WithState(w3types.State{Owner: {Balance: w3.I("1000 ether")}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Env{t: t, VM: vm, Header: header, BlockTime: 12, blocks: []*block{{header: header}}}
+	e.Factory = e.Create(erc1967factory.Bytecode())
+	return e
+}
+
+// Deployer returns a Deployer with a new funded key that sends through
+// caller, or straight to e if caller is nil, and polls for receipts every
+// millisecond.
+func (e *Env) Deployer(caller publish.Caller) *publish.Deployer {
+	e.t.Helper()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	if caller == nil {
+		caller = e.Caller()
+	}
+	d := publish.NewDeployerWithCaller(caller, ChainID, key, big.NewInt(100), big.NewInt(10))
+	d.SetReceiptConfig(publish.ReceiptConfig{PollInterval: time.Millisecond})
+	e.VM.SetBalance(d.Address(), w3.I("1 ether"))
+	return d
+}
+
+// Apply applies msg to the latest state. Its logs are emitted in the next
+// mined block.
+func (e *Env) Apply(msg *w3types.Message) (*w3vm.Receipt, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	r, err := e.VM.Apply(msg)
+	if err == nil {
+		e.logs = append(e.logs, r.Logs...)
+	}
+	return r, err
+}
+
+// Create deploys code from Owner and returns the contract address.
+func (e *Env) Create(code []byte) common.Address {
+	e.t.Helper()
+	r, err := e.Apply(&w3types.Message{From: Owner, Input: code, Gas: GasLimit})
+	if err != nil {
+		e.t.Fatalf("create: %v", err)
+	}
+	return *r.ContractAddress
+}
+
+// Proxy deploys code as an implementation and an ERC1967 proxy for it,
+// initialized with init and administered by Owner.
+func (e *Env) Proxy(code, init []byte) common.Address {
+	e.t.Helper()
+	var proxy common.Address
+	e.Send(e.Factory, funcDeployAndCall, []any{e.Create(code), Owner, init}, &proxy)
+	return proxy
+}
+
+// Send applies a call to fn from Owner and fails the test if it reverts.
+func (e *Env) Send(to common.Address, fn *w3.Func, args []any, returns ...any) {
+	e.t.Helper()
+	input, err := fn.EncodeArgs(args...)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	r, err := e.Apply(&w3types.Message{From: Owner, To: &to, Input: input, Gas: GasLimit})
+	if err != nil {
+		e.t.Fatalf("%s: %v", fn.Signature, err)
+	}
+	if len(returns) > 0 {
+		if err := fn.DecodeReturns(r.Output, returns...); err != nil {
+			e.t.Fatal(err)
+		}
+	}
+}
+
+// Call runs fn without keeping state changes, so it also works for the
+// non-view quote functions. Reverts are returned, not fatal.
+func (e *Env) Call(to common.Address, fn *w3.Func, args []any, returns ...any) error {
+	input, err := fn.EncodeArgs(args...)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	r, err := e.VM.Call(&w3types.Message{From: Owner, To: &to, Input: input, Gas: GasLimit})
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return fn.DecodeReturns(r.Output, returns...)
+}
+
+// SetReturnData installs code at addr that returns data for any call, e.g.
+// to stand in for a token's decimals() or an aggregator's
+// latestRoundData(). data must be shorter than 256 bytes.
+func (e *Env) SetReturnData(addr common.Address, data []byte) {
+	n := byte(len(data))
+	// CODECOPY the data after these 12 bytes to memory and RETURN it.
+	code := []byte{0x60, n, 0x60, 12, 0x60, 0, 0x39, 0x60, n, 0x60, 0, 0xf3}
+	e.VM.SetCode(addr, append(code, data...))
+}
+
+// Word encodes x as one ABI word, in two's complement if negative.
+func Word(x *big.Int) []byte {
+	word := make([]byte, 32)
+	if x.Sign() < 0 {
+		x = new(big.Int).Add(x, new(big.Int).Lsh(big.NewInt(1), 256))
+	}
+	return x.FillBytes(word)
+}
+
+// Amounts returns values around the rounding edges of decimal and PPM
+// scaling, and values large enough to overflow the products.
+func Amounts() []*big.Int {
+	var amounts []*big.Int
+	for _, x := range []int64{0, 1, 2, 9, 10, 11, 99, 100, 101, 999_999, 1_000_000, 1_000_001, 123_456_789, 999_999_999_999} {
+		amounts = append(amounts, big.NewInt(x))
+	}
+	return append(amounts,
+		new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil),
+		new(big.Int).Exp(big.NewInt(10), big.NewInt(30), nil),
+		new(big.Int).Lsh(big.NewInt(1), 128),
+		new(big.Int).Lsh(big.NewInt(1), 200),
+		new(big.Int).Rsh(publish.MaxUint256, 1),
+		publish.MaxUint256,
+	)
+}
+
+// Quoter is the off-chain side of an IQuoter.
+type Quoter interface {
+	ValueFor(outToken, inToken common.Address, value *big.Int) (*big.Int, error)
+	ReverseValueFor(outToken, inToken common.Address, value *big.Int) (*big.Int, error)
+}
+
+var (
+	funcValueFor        = w3.MustNewFunc("valueFor(address,address,uint256)", "uint256")
+	funcReverseValueFor = w3.MustNewFunc("reverseValueFor(address,address,uint256)", "uint256")
+)
+
+// CompareQuoter checks that q returns what the quoter contract at address
+// does for every ordered pair of tokens and every amount: the same value,
+// or an error where the contract reverts. It returns the number of
+// successful quotes so callers can tell the pairs were not all rejected.
+func (e *Env) CompareQuoter(t testing.TB, address common.Address, q Quoter, tokens []common.Address, amounts []*big.Int) int {
+	t.Helper()
+	ok := 0
+	for _, out := range tokens {
+		for _, in := range tokens {
+			for _, amount := range amounts {
+				for _, fn := range []*w3.Func{funcValueFor, funcReverseValueFor} {
+					want := new(big.Int)
+					chainErr := e.Call(address, fn, []any{out, in, amount}, want)
+					var (
+						got *big.Int
+						err error
+					)
+					if fn == funcValueFor {
+						got, err = q.ValueFor(out, in, amount)
+					} else {
+						got, err = q.ReverseValueFor(out, in, amount)
+					}
+					switch {
+					case (chainErr == nil) != (err == nil):
+						t.Fatalf("%s(%s, %s, %s): contract err %v, got err %v", fn.Signature, out.Hex(), in.Hex(), amount, chainErr, err)
+					case err == nil && got.Cmp(want) != 0:
+						t.Fatalf("%s(%s, %s, %s) = %s, contract %s", fn.Signature, out.Hex(), in.Hex(), amount, got, want)
+					case err == nil:
+						ok++
+					}
+				}
+			}
+		}
+	}
+	return ok
+}
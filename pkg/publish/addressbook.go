@@ -0,0 +1,133 @@
+package publish
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type (
+	// AddressBook records the contracts of one deployment on one chain,
+	// keyed by a deployment-specific name such as "SwapPool" or "SRF".
+	AddressBook struct {
+		ChainID   int64                `json:"chain_id"`
+		Factory   common.Address       `json:"factory,omitzero"`
+		Contracts map[string]BookEntry `json:"contracts"`
+	}
+
+	// BookEntry is one deployed contract. Contract is the package name under
+	// pkg/publish/contracts (e.g. "swappool"). Implementation is set for
+	// proxies and zero for plain contracts.
+	BookEntry struct {
+		Contract       string         `json:"contract"`
+		Address        common.Address `json:"address"`
+		Implementation common.Address `json:"implementation,omitzero"`
+	}
+)
+
+func NewAddressBook(chainID int64) *AddressBook {
+	return &AddressBook{ChainID: chainID, Contracts: make(map[string]BookEntry)}
+}
+
+func LoadAddressBook(path string) (*AddressBook, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read address book: %w", err)
+	}
+	var book AddressBook
+	if err := json.Unmarshal(data, &book); err != nil {
+		return nil, fmt.Errorf("decode address book %s: %w", path, err)
+	}
+	if book.Contracts == nil {
+		book.Contracts = make(map[string]BookEntry)
+	}
+	return &book, nil
+}
+
+func (b *AddressBook) Save(path string) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode address book: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write address book: %w", err)
+	}
+	return nil
+}
+
+func (b *AddressBook) Set(name string, entry BookEntry) {
+	if b.Contracts == nil {
+		b.Contracts = make(map[string]BookEntry)
+	}
+	b.Contracts[name] = entry
+}
+
+// Names returns the entry names in sorted order.
+func (b *AddressBook) Names() []string {
+	names := make([]string, 0, len(b.Contracts))
+	for name := range b.Contracts {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// ByContract returns the names of all entries of the given contract package,
+// sorted.
+func (b *AddressBook) ByContract(contract string) []string {
+	var names []string
+	for _, name := range b.Names() {
+		if b.Contracts[name].Contract == contract {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ChainBooks combines the address books of one deployment on several
+// chains, keyed by chain ID.
+type ChainBooks map[int64]*AddressBook
+
+func LoadChainBooks(path string) (ChainBooks, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read address books: %w", err)
+	}
+	var books ChainBooks
+	if err := json.Unmarshal(data, &books); err != nil {
+		return nil, fmt.Errorf("decode address books %s: %w", path, err)
+	}
+	for chainID, book := range books {
+		if book == nil || book.ChainID != chainID {
+			return nil, fmt.Errorf("decode address books %s: entry %d is not for chain %d", path, chainID, chainID)
+		}
+		if book.Contracts == nil {
+			book.Contracts = make(map[string]BookEntry)
+		}
+	}
+	return books, nil
+}
+
+func (b ChainBooks) Save(path string) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode address books: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write address books: %w", err)
+	}
+	return nil
+}
+
+// ChainIDs returns the chain IDs in ascending order.
+func (b ChainBooks) ChainIDs() []int64 {
+	ids := make([]int64, 0, len(b))
+	for id := range b {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
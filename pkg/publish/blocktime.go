@@ -0,0 +1,41 @@
+package publish
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/lmittmann/w3/module/eth"
+)
+
+// BlockAt returns the first block with a timestamp at or after t, found by
+// binary search over headers. If t is later than the head, the head's
+// number plus one is returned, so [BlockAt(from), BlockAt(to)-1] is the
+// block range covering [from, to).
+func BlockAt(ctx context.Context, caller Caller, t time.Time) (uint64, error) {
+	var head *types.Header
+	if err := caller.CallCtx(ctx, eth.HeaderByNumber(nil).Returns(&head)); err != nil {
+		return 0, fmt.Errorf("get head: %w", err)
+	}
+	target := uint64(max(t.Unix(), 0))
+	if head.Time < target {
+		return head.Number.Uint64() + 1, nil
+	}
+
+	lo, hi := uint64(0), head.Number.Uint64()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		var header *types.Header
+		if err := caller.CallCtx(ctx, eth.HeaderByNumber(new(big.Int).SetUint64(mid)).Returns(&header)); err != nil {
+			return 0, fmt.Errorf("get header %d: %w", mid, err)
+		}
+		if header.Time < target {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
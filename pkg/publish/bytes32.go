@@ -0,0 +1,46 @@
+package publish
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var ErrEmptyBytes32 = errors.New("bytes32 key is empty")
+
+// EncodeBytes32 right-pads value into a bytes32 key, the layout Solidity
+// produces for bytes32(bytes(s)). Values longer than 32 bytes are rejected
+// rather than cropped.
+func EncodeBytes32(value []byte) ([32]byte, error) {
+	var key [32]byte
+	if len(value) == 0 {
+		return key, ErrEmptyBytes32
+	}
+	if len(value) > 32 {
+		return key, fmt.Errorf("%q is %d bytes, bytes32 keys hold at most 32", value, len(value))
+	}
+	copy(key[:], value)
+	return key, nil
+}
+
+func EncodeBytes32String(value string) ([32]byte, error) {
+	return EncodeBytes32([]byte(value))
+}
+
+// EncodeBytes32Slice encodes each value with EncodeBytes32.
+func EncodeBytes32Slice(values [][]byte) ([][32]byte, error) {
+	out := make([][32]byte, len(values))
+	for i, value := range values {
+		key, err := EncodeBytes32(value)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", i, err)
+		}
+		out[i] = key
+	}
+	return out, nil
+}
+
+// DecodeBytes32 returns the key with its right zero-padding removed.
+func DecodeBytes32(key [32]byte) string {
+	return string(bytes.TrimRight(key[:], "\x00"))
+}
@@ -25,6 +25,12 @@ var funcInitialize = w3.MustNewFunc(
 	"initialize(address)", "",
 )
 
+// AddressAddedEventSignature is the event AccountsIndex emits for a new
+// account. TokenUniqueSymbolIndex emits the same event for a new token.
+const AddressAddedEventSignature = "AddressAdded(address _account)"
+
+var EventAddressAdded = w3.MustNewEvent(AddressAddedEventSignature)
+
 type InitArgs struct {
 	Owner common.Address
 }
@@ -0,0 +1,291 @@
+package accountsindex
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+)
+
+var (
+	funcEntryCount = w3.MustNewFunc("entryCount()", "uint256")
+	funcEntry      = w3.MustNewFunc("entry(uint256)", "address")
+	funcTime       = w3.MustNewFunc("time(address)", "uint256")
+	funcHave       = w3.MustNewFunc("have(address)", "bool")
+	funcIsActive   = w3.MustNewFunc("isActive(address)", "bool")
+	funcIsWriter   = w3.MustNewFunc("isWriter(address)", "bool")
+	funcAdd        = w3.MustNewFunc("add(address)", "bool")
+	funcActivate   = w3.MustNewFunc("activate(address)", "bool")
+	funcDeactivate = w3.MustNewFunc("deactivate(address)", "bool")
+)
+
+// timeMask strips the BLOCKED_FIELD bit, which time() returns shifted into
+// bit 64 for deactivated accounts.
+var timeMask = new(big.Int).SetUint64(^uint64(0))
+
+var ErrNotWriter = errors.New("sender is not an AccountsIndex writer")
+
+type Action int
+
+const (
+	Add Action = iota
+	Activate
+	Deactivate
+)
+
+func (a Action) String() string {
+	switch a {
+	case Add:
+		return "add"
+	case Activate:
+		return "activate"
+	case Deactivate:
+		return "deactivate"
+	default:
+		return "unknown"
+	}
+}
+
+// Entry is one indexed account.
+type Entry struct {
+	Index   uint64         `json:"index"`
+	Account common.Address `json:"account"`
+	AddedAt time.Time      `json:"added_at"`
+	Active  bool           `json:"active"`
+}
+
+// BulkResult is the outcome of one bulk action. Skipped is set when the
+// account was already in the requested state; Err when the action could not
+// be applied or reverted.
+type BulkResult struct {
+	Account common.Address
+	TxHash  common.Hash
+	Skipped bool
+	Err     error
+}
+
+type Client struct {
+	caller  publish.Caller
+	address common.Address
+}
+
+func NewClient(caller publish.Caller, address common.Address) *Client {
+	return &Client{caller: caller, address: address}
+}
+
+func (c *Client) Address() common.Address {
+	return c.address
+}
+
+func (c *Client) Count(ctx context.Context) (uint64, error) {
+	var count big.Int
+	if err := c.caller.CallCtx(ctx, eth.CallFunc(c.address, funcEntryCount).Returns(&count)); err != nil {
+		return 0, fmt.Errorf("entryCount: %w", err)
+	}
+	return count.Uint64(), nil
+}
+
+// Entries enumerates the whole index with batched calls. All reads are
+// pinned to the same block so that concurrent add / remove calls cannot
+// shift entries between batches.
+func (c *Client) Entries(ctx context.Context) ([]Entry, error) {
+	var head *big.Int
+	if err := c.caller.CallCtx(ctx, eth.BlockNumber().Returns(&head)); err != nil {
+		return nil, fmt.Errorf("get block number: %w", err)
+	}
+
+	var count big.Int
+	if err := c.caller.CallCtx(ctx, eth.CallFunc(c.address, funcEntryCount).AtBlock(head).Returns(&count)); err != nil {
+		return nil, fmt.Errorf("entryCount: %w", err)
+	}
+
+	n := count.Uint64()
+	entries := make([]Entry, n)
+	calls := make([]w3types.RPCCaller, n)
+	for i := range entries {
+		entries[i].Index = uint64(i)
+		calls[i] = eth.CallFunc(c.address, funcEntry, new(big.Int).SetUint64(uint64(i))).AtBlock(head).Returns(&entries[i].Account)
+	}
+	if err := publish.BatchCall(ctx, c.caller, calls, 0); err != nil {
+		return nil, fmt.Errorf("entry: %w", err)
+	}
+
+	times := make([]big.Int, n)
+	calls = make([]w3types.RPCCaller, 0, 2*n)
+	for i := range entries {
+		calls = append(calls,
+			eth.CallFunc(c.address, funcTime, entries[i].Account).AtBlock(head).Returns(&times[i]),
+			eth.CallFunc(c.address, funcIsActive, entries[i].Account).AtBlock(head).Returns(&entries[i].Active),
+		)
+	}
+	if err := publish.BatchCall(ctx, c.caller, calls, 0); err != nil {
+		return nil, fmt.Errorf("time / isActive: %w", err)
+	}
+	for i := range entries {
+		entries[i].AddedAt = time.Unix(new(big.Int).And(&times[i], timeMask).Int64(), 0).UTC()
+	}
+	return entries, nil
+}
+
+// ExportCSV writes entries with the header index,account,added_at,active.
+// added_at is a unix timestamp.
+func ExportCSV(w io.Writer, entries []Entry) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"index", "account", "added_at", "active"}); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		record := []string{
+			strconv.FormatUint(e.Index, 10),
+			e.Account.Hex(),
+			strconv.FormatInt(e.AddedAt.Unix(), 10),
+			strconv.FormatBool(e.Active),
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func ExportJSON(w io.Writer, entries []Entry) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
+
+// ParseAccounts reads one address per line. Only the first comma-separated
+// field of a line is used, so an ExportCSV file can be fed back in. Blank
+// lines, lines starting with '#' and non-address header rows are skipped.
+func ParseAccounts(r io.Reader) ([]common.Address, error) {
+	var accounts []common.Address
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		field, _, _ := strings.Cut(scanner.Text(), ",")
+		field = strings.TrimSpace(field)
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue
+		}
+		if !common.IsHexAddress(field) {
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("line %d: invalid address %q", line, field)
+		}
+		accounts = append(accounts, common.HexToAddress(field))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read accounts: %w", err)
+	}
+	return accounts, nil
+}
+
+func (c *Client) IsWriter(ctx context.Context, writer common.Address) (bool, error) {
+	var ok bool
+	if err := c.caller.CallCtx(ctx, eth.CallFunc(c.address, funcIsWriter, writer).Returns(&ok)); err != nil {
+		return false, fmt.Errorf("isWriter: %w", err)
+	}
+	return ok, nil
+}
+
+// Bulk applies action to each account. Current membership and active state
+// are read up front so that accounts already in the requested state are
+// skipped instead of reverting with AlreadyExists / NotBlocked / NotActive.
+// Activating or deactivating an account that is not indexed is reported as
+// an error for that account. Transactions are sent back to back, then all
+// receipts are awaited.
+func (c *Client) Bulk(ctx context.Context, d *publish.Deployer, action Action, accounts []common.Address) ([]BulkResult, error) {
+	var fn *w3.Func
+	switch action {
+	case Add:
+		fn = funcAdd
+	case Activate:
+		fn = funcActivate
+	case Deactivate:
+		fn = funcDeactivate
+	default:
+		return nil, fmt.Errorf("unknown action %d", action)
+	}
+
+	ok, err := c.IsWriter(ctx, d.Address())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotWriter
+	}
+
+	have := make([]bool, len(accounts))
+	active := make([]bool, len(accounts))
+	calls := make([]w3types.RPCCaller, 0, 2*len(accounts))
+	for i, account := range accounts {
+		calls = append(calls,
+			eth.CallFunc(c.address, funcHave, account).Returns(&have[i]),
+			eth.CallFunc(c.address, funcIsActive, account).Returns(&active[i]),
+		)
+	}
+	if err := publish.BatchCall(ctx, c.caller, calls, 0); err != nil {
+		return nil, fmt.Errorf("have / isActive: %w", err)
+	}
+
+	results := make([]BulkResult, len(accounts))
+	seen := make(map[common.Address]struct{}, len(accounts))
+	for i, account := range accounts {
+		results[i].Account = account
+		if _, dup := seen[account]; dup {
+			results[i].Skipped = true
+			continue
+		}
+		seen[account] = struct{}{}
+
+		switch {
+		case action == Add && have[i],
+			action == Activate && have[i] && active[i],
+			action == Deactivate && have[i] && !active[i]:
+			results[i].Skipped = true
+			continue
+		case action != Add && !have[i]:
+			results[i].Err = errors.New("account is not indexed")
+			continue
+		}
+
+		calldata, err := fn.EncodeArgs(account)
+		if err != nil {
+			results[i].Err = fmt.Errorf("encode %s: %w", action, err)
+			continue
+		}
+		// A failed send gives its nonce back, so the accounts after it are
+		// not queued behind a gap and can still be sent.
+		results[i].TxHash, results[i].Err = d.Transact(ctx, c.address, nil, calldata, 0)
+	}
+
+	for i := range results {
+		if results[i].Skipped || results[i].Err != nil {
+			continue
+		}
+		receipt, err := d.WaitForReceipt(ctx, results[i].TxHash)
+		if err != nil {
+			return results, fmt.Errorf("wait for %s: %w", results[i].TxHash.Hex(), err)
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			results[i].Err = fmt.Errorf("%s reverted in tx %s", action, results[i].TxHash.Hex())
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,156 @@
+package cat
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/lmittmann/w3/module/eth"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+)
+
+// DefaultConfirmations is the number of blocks, counting its own, a block
+// must have before Run applies its events. Applied events are never
+// reverted, so this is what keeps reorged TokensSet events out of the cache.
+const DefaultConfirmations = 5
+
+// Cache holds settlement tokens per account and stays current by applying
+// TokensSet events. Each event carries the account's full token list, so
+// replaying them in order reproduces CAT storage.
+type Cache struct {
+	client        *Client
+	logRange      uint64
+	confirmations uint64
+
+	mu     sync.RWMutex
+	tokens map[common.Address][]common.Address
+	synced uint64
+}
+
+// NewCache returns an empty cache that starts following events after block
+// fromBlock. Use fromBlock = deployment block - 1 to rebuild the full state
+// from events, or Load to seed it from storage first.
+func NewCache(client *Client, fromBlock uint64) *Cache {
+	return &Cache{
+		client:        client,
+		logRange:      publish.DefaultLogRange,
+		confirmations: DefaultConfirmations,
+		tokens:        make(map[common.Address][]common.Address),
+		synced:        fromBlock,
+	}
+}
+
+// SetLogRange overrides publish.DefaultLogRange for providers with tighter limits.
+func (c *Cache) SetLogRange(blocks uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logRange = max(blocks, 1)
+}
+
+// SetConfirmations overrides DefaultConfirmations; zero is the same as one,
+// i.e. following the head.
+func (c *Cache) SetConfirmations(blocks uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.confirmations = max(blocks, 1)
+}
+
+// Load seeds the cache with the tokens of accounts as of the last synced
+// block, so that later events apply on top of a consistent snapshot.
+func (c *Cache) Load(ctx context.Context, accounts []common.Address) error {
+	c.mu.RLock()
+	block := new(big.Int).SetUint64(c.synced)
+	c.mu.RUnlock()
+
+	tokens, err := c.client.tokensAt(ctx, accounts, block)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, account := range accounts {
+		if len(tokens[i]) > 0 {
+			c.tokens[account] = tokens[i]
+		}
+	}
+	return nil
+}
+
+// Tokens returns the cached tokens of account and whether any are set.
+func (c *Cache) Tokens(account common.Address) ([]common.Address, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	tokens, ok := c.tokens[account]
+	return slices.Clone(tokens), ok
+}
+
+// SyncedBlock returns the last block whose events have been applied.
+func (c *Cache) SyncedBlock() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.synced
+}
+
+// Sync applies TokensSet events up to and including toBlock. Callers that
+// pass the head themselves take the reorg risk Run avoids.
+func (c *Cache) Sync(ctx context.Context, toBlock uint64) error {
+	c.mu.RLock()
+	from, logRange := c.synced+1, c.logRange
+	c.mu.RUnlock()
+
+	query := ethereum.FilterQuery{Addresses: []common.Address{c.client.address}, Topics: [][]common.Hash{{EventTokensSet.Topic0}}}
+	return publish.ScanLogs(ctx, c.client.caller, query, from, toBlock, logRange, func(_, to uint64, logs []types.Log) error {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for i := range logs {
+			var (
+				account common.Address
+				tokens  []common.Address
+			)
+			if err := EventTokensSet.DecodeArgs(&logs[i], &account, &tokens); err != nil {
+				return fmt.Errorf("decode TokensSet in tx %s: %w", logs[i].TxHash.Hex(), err)
+			}
+			c.tokens[account] = tokens
+		}
+		c.synced = to
+		return nil
+	})
+}
+
+// Run syncs to the last block with the configured confirmations every
+// interval until ctx is cancelled. Errors are passed to onErr, if set, and
+// retried on the next tick.
+func (c *Cache) Run(ctx context.Context, interval time.Duration, onErr func(error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var head *big.Int
+		err := c.client.caller.CallCtx(ctx, eth.BlockNumber().Returns(&head))
+		if err == nil {
+			c.mu.RLock()
+			confirmations := c.confirmations
+			c.mu.RUnlock()
+			if head.Uint64()+1 >= confirmations {
+				err = c.Sync(ctx, head.Uint64()+1-confirmations)
+			}
+		}
+		if err != nil && onErr != nil {
+			onErr(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
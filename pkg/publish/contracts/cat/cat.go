@@ -25,6 +25,12 @@ var funcInitialize = w3.MustNewFunc(
 	"initialize(address)", "",
 )
 
+// TokensSetEventSignature is the event CAT emits with an account's full
+// new token list.
+const TokensSetEventSignature = "TokensSet(address indexed account, address[] tokens)"
+
+var EventTokensSet = w3.MustNewEvent(TokensSetEventSignature)
+
 type InitArgs struct {
 	Owner common.Address
 }
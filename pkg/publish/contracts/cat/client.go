@@ -0,0 +1,227 @@
+package cat
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"slices"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+)
+
+// MaxTokens mirrors CAT.MAX_TOKENS.
+const MaxTokens = 5
+
+var (
+	funcGetTokens    = w3.MustNewFunc("getTokens(address)", "address[]")
+	funcSetTokensFor = w3.MustNewFunc("setTokensFor(address,address[])", "")
+	funcIsWriter     = w3.MustNewFunc("isWriter(address)", "bool")
+)
+
+var ErrNotWriter = errors.New("sender is not a CAT writer")
+
+// Update replaces an account's settlement tokens. CAT has full-replace
+// semantics: the new list overwrites the old one entirely.
+type Update struct {
+	Account common.Address
+	Tokens  []common.Address
+}
+
+// UpdateResult is the outcome of one bulk update. TxHash is zero if the
+// update was skipped because the account already had the requested tokens.
+type UpdateResult struct {
+	Update  Update
+	TxHash  common.Hash
+	Skipped bool
+	Err     error
+}
+
+type Client struct {
+	caller  publish.Caller
+	address common.Address
+}
+
+func NewClient(caller publish.Caller, address common.Address) *Client {
+	return &Client{caller: caller, address: address}
+}
+
+func (c *Client) Address() common.Address {
+	return c.address
+}
+
+// ValidateTokens applies the same checks as CAT._setTokens.
+func ValidateTokens(tokens []common.Address) error {
+	if len(tokens) == 0 {
+		return errors.New("empty token list")
+	}
+	if len(tokens) > MaxTokens {
+		return fmt.Errorf("%d tokens exceeds maximum of %d", len(tokens), MaxTokens)
+	}
+	for i, token := range tokens {
+		if token == (common.Address{}) {
+			return fmt.Errorf("token %d is the zero address", i)
+		}
+	}
+	return nil
+}
+
+// Tokens returns the ordered settlement tokens of account.
+func (c *Client) Tokens(ctx context.Context, account common.Address) ([]common.Address, error) {
+	tokens, err := c.TokensOf(ctx, []common.Address{account})
+	if err != nil {
+		return nil, err
+	}
+	return tokens[0], nil
+}
+
+// TokensOf returns the settlement tokens of each account, in the same order
+// as accounts, using batched calls.
+func (c *Client) TokensOf(ctx context.Context, accounts []common.Address) ([][]common.Address, error) {
+	return c.tokensAt(ctx, accounts, nil)
+}
+
+func (c *Client) IsWriter(ctx context.Context, writer common.Address) (bool, error) {
+	var ok bool
+	if err := c.caller.CallCtx(ctx, eth.CallFunc(c.address, funcIsWriter, writer).Returns(&ok)); err != nil {
+		return false, fmt.Errorf("isWriter: %w", err)
+	}
+	return ok, nil
+}
+
+func (c *Client) SetTokensFor(ctx context.Context, d *publish.Deployer, account common.Address, tokens []common.Address) (common.Hash, error) {
+	if err := ValidateTokens(tokens); err != nil {
+		return common.Hash{}, err
+	}
+	calldata, err := funcSetTokensFor.EncodeArgs(account, tokens)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("encode setTokensFor: %w", err)
+	}
+	return d.Transact(ctx, c.address, nil, calldata, 0)
+}
+
+// ParseUpdatesCSV reads one update per row: the account followed by one to
+// MaxTokens token addresses in settlement order. Blank trailing cells are
+// ignored and a header row starting with "account" is skipped.
+func ParseUpdatesCSV(r io.Reader) ([]Update, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var updates []Update
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read csv: %w", err)
+		}
+		if line == 1 && strings.EqualFold(strings.TrimSpace(record[0]), "account") {
+			continue
+		}
+
+		var fields []string
+		for _, field := range record {
+			if field = strings.TrimSpace(field); field != "" {
+				fields = append(fields, field)
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		var update Update
+		for i, field := range fields {
+			if !common.IsHexAddress(field) {
+				return nil, fmt.Errorf("line %d: invalid address %q", line, field)
+			}
+			if i == 0 {
+				update.Account = common.HexToAddress(field)
+			} else {
+				update.Tokens = append(update.Tokens, common.HexToAddress(field))
+			}
+		}
+		if err := ValidateTokens(update.Tokens); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		updates = append(updates, update)
+	}
+	return updates, nil
+}
+
+// BulkSetTokensFor applies updates through setTokensFor. It checks that the
+// deployer is a writer, skips accounts whose current tokens already match,
+// sends the remaining transactions back to back and then waits for all
+// receipts. Per-update failures are reported in the results.
+func (c *Client) BulkSetTokensFor(ctx context.Context, d *publish.Deployer, updates []Update) ([]UpdateResult, error) {
+	for i, update := range updates {
+		if err := ValidateTokens(update.Tokens); err != nil {
+			return nil, fmt.Errorf("update %d (%s): %w", i, update.Account.Hex(), err)
+		}
+	}
+
+	ok, err := c.IsWriter(ctx, d.Address())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotWriter
+	}
+
+	accounts := make([]common.Address, len(updates))
+	for i, update := range updates {
+		accounts[i] = update.Account
+	}
+	current, err := c.TokensOf(ctx, accounts)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]UpdateResult, len(updates))
+	for i, update := range updates {
+		results[i].Update = update
+		if slices.Equal(current[i], update.Tokens) {
+			results[i].Skipped = true
+			continue
+		}
+		// A failed send gives its nonce back, so the updates after it are
+		// not queued behind a gap and can still be sent.
+		results[i].TxHash, results[i].Err = c.SetTokensFor(ctx, d, update.Account, update.Tokens)
+	}
+
+	for i := range results {
+		if results[i].Skipped || results[i].Err != nil {
+			continue
+		}
+		receipt, err := d.WaitForReceipt(ctx, results[i].TxHash)
+		if err != nil {
+			return results, fmt.Errorf("wait for %s: %w", results[i].TxHash.Hex(), err)
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			results[i].Err = fmt.Errorf("setTokensFor reverted in tx %s", results[i].TxHash.Hex())
+		}
+	}
+	return results, nil
+}
+
+func (c *Client) tokensAt(ctx context.Context, accounts []common.Address, blockNumber *big.Int) ([][]common.Address, error) {
+	tokens := make([][]common.Address, len(accounts))
+	calls := make([]w3types.RPCCaller, len(accounts))
+	for i, account := range accounts {
+		calls[i] = eth.CallFunc(c.address, funcGetTokens, account).AtBlock(blockNumber).Returns(&tokens[i])
+	}
+	if err := publish.BatchCall(ctx, c.caller, calls, 0); err != nil {
+		return nil, fmt.Errorf("getTokens: %w", err)
+	}
+	return tokens, nil
+}
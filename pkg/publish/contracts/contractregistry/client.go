@@ -0,0 +1,321 @@
+package contractregistry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"text/tabwriter"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+)
+
+var (
+	funcSet             = w3.MustNewFunc("set(bytes32,address)", "bool")
+	funcAddressOf       = w3.MustNewFunc("addressOf(bytes32)", "address")
+	funcIdentifier      = w3.MustNewFunc("identifier(uint256)", "bytes32")
+	funcIdentifierCount = w3.MustNewFunc("identifierCount()", "uint256")
+	funcOwner           = w3.MustNewFunc("owner()", "address")
+)
+
+var ErrNotOwner = errors.New("sender is not the registry owner")
+
+// Status classifies a planned registry change.
+type Status int
+
+const (
+	// StatusSet means the identifier is unset and will be set.
+	StatusSet Status = iota
+	// StatusUnchanged means the identifier already holds the target.
+	StatusUnchanged
+	// StatusConflict means the identifier holds a different address. Entries
+	// are write-once, so this cannot be fixed by the bootstrap.
+	StatusConflict
+	// StatusUnknownIdentifier means the identifier was not passed to
+	// initialize and set would revert with IdentifierNotFound.
+	StatusUnknownIdentifier
+	// StatusInvalidTarget means the target failed verification.
+	StatusInvalidTarget
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusSet:
+		return "set"
+	case StatusUnchanged:
+		return "unchanged"
+	case StatusConflict:
+		return "conflict"
+	case StatusUnknownIdentifier:
+		return "unknown identifier"
+	case StatusInvalidTarget:
+		return "invalid target"
+	default:
+		return "unknown"
+	}
+}
+
+// Target is an identifier the registry should point at a deployed contract.
+// Contract is the expected package name, e.g. "swappool".
+type Target struct {
+	Identifier string
+	Address    common.Address
+	Contract   string
+}
+
+// Change is the planned action for one target.
+type Change struct {
+	Target  Target
+	Current common.Address
+	Status  Status
+	Err     error
+	TxHash  common.Hash
+}
+
+type Client struct {
+	caller  publish.Caller
+	address common.Address
+}
+
+func NewClient(caller publish.Caller, address common.Address) *Client {
+	return &Client{caller: caller, address: address}
+}
+
+func (c *Client) Address() common.Address {
+	return c.address
+}
+
+func (c *Client) AddressOf(ctx context.Context, identifier string) (common.Address, error) {
+	key, err := publish.EncodeBytes32String(identifier)
+	if err != nil {
+		return common.Address{}, err
+	}
+	var addr common.Address
+	if err := c.caller.CallCtx(ctx, eth.CallFunc(c.address, funcAddressOf, key).Returns(&addr)); err != nil {
+		return common.Address{}, fmt.Errorf("addressOf: %w", err)
+	}
+	return addr, nil
+}
+
+// Identifiers returns the identifiers fixed at initialize, decoded to
+// strings.
+func (c *Client) Identifiers(ctx context.Context) ([]string, error) {
+	var count big.Int
+	if err := c.caller.CallCtx(ctx, eth.CallFunc(c.address, funcIdentifierCount).Returns(&count)); err != nil {
+		return nil, fmt.Errorf("identifierCount: %w", err)
+	}
+
+	keys := make([][32]byte, count.Uint64())
+	calls := make([]w3types.RPCCaller, len(keys))
+	for i := range keys {
+		calls[i] = eth.CallFunc(c.address, funcIdentifier, big.NewInt(int64(i))).Returns(&keys[i])
+	}
+	if err := publish.BatchCall(ctx, c.caller, calls, 0); err != nil {
+		return nil, fmt.Errorf("identifier: %w", err)
+	}
+
+	identifiers := make([]string, len(keys))
+	for i, key := range keys {
+		identifiers[i] = publish.DecodeBytes32(key)
+	}
+	return identifiers, nil
+}
+
+func (c *Client) Set(ctx context.Context, d *publish.Deployer, identifier string, target common.Address) (common.Hash, error) {
+	key, err := publish.EncodeBytes32String(identifier)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	calldata, err := funcSet.EncodeArgs(key, target)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("encode set: %w", err)
+	}
+	return d.Transact(ctx, c.address, nil, calldata, 0)
+}
+
+// TargetsFromBook maps address book entries to registry identifiers.
+// identifiers maps book entry names to identifiers; if nil, every book entry
+// is used with its name as the identifier. Entries are returned in book name
+// order.
+func TargetsFromBook(book *publish.AddressBook, identifiers map[string]string) ([]Target, error) {
+	var targets []Target
+	for _, name := range book.Names() {
+		identifier := name
+		if identifiers != nil {
+			var ok bool
+			if identifier, ok = identifiers[name]; !ok {
+				continue
+			}
+		}
+		entry := book.Contracts[name]
+		targets = append(targets, Target{Identifier: identifier, Address: entry.Address, Contract: entry.Contract})
+	}
+	for name := range identifiers {
+		if _, ok := book.Contracts[name]; !ok {
+			return nil, fmt.Errorf("address book has no entry %q", name)
+		}
+	}
+	return targets, nil
+}
+
+// Plan compares targets with the registry. Each target address is checked
+// with verify, which should confirm the address holds code of the expected
+// package; contracts.Verifier provides one. verify may be nil to only check
+// that code exists.
+func (c *Client) Plan(ctx context.Context, targets []Target, verify func(context.Context, common.Address, string) error) ([]Change, error) {
+	onChain, err := c.Identifiers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	allowed := make(map[string]bool, len(onChain))
+	for _, identifier := range onChain {
+		allowed[identifier] = true
+	}
+
+	changes := make([]Change, len(targets))
+	codes := make([][]byte, len(targets))
+	var calls []w3types.RPCCaller
+	for i, target := range targets {
+		changes[i].Target = target
+		key, err := publish.EncodeBytes32String(target.Identifier)
+		if err != nil {
+			return nil, fmt.Errorf("target %q: %w", target.Identifier, err)
+		}
+		calls = append(calls,
+			eth.CallFunc(c.address, funcAddressOf, key).Returns(&changes[i].Current),
+			eth.Code(target.Address, nil).Returns(&codes[i]),
+		)
+	}
+	if err := publish.BatchCall(ctx, c.caller, calls, 0); err != nil {
+		return nil, fmt.Errorf("addressOf / code: %w", err)
+	}
+
+	for i := range changes {
+		ch := &changes[i]
+		switch {
+		case !allowed[ch.Target.Identifier]:
+			ch.Status = StatusUnknownIdentifier
+		case ch.Current == ch.Target.Address:
+			ch.Status = StatusUnchanged
+		case ch.Current != (common.Address{}):
+			ch.Status = StatusConflict
+		case ch.Target.Address == (common.Address{}):
+			ch.Status, ch.Err = StatusInvalidTarget, errors.New("zero address")
+		case len(codes[i]) == 0:
+			ch.Status, ch.Err = StatusInvalidTarget, errors.New("no code at target")
+		default:
+			ch.Status = StatusSet
+			if verify != nil {
+				if err := verify(ctx, ch.Target.Address, ch.Target.Contract); err != nil {
+					ch.Status, ch.Err = StatusInvalidTarget, err
+				}
+			}
+		}
+	}
+	return changes, nil
+}
+
+// WritePlan renders changes as a diff: '+' for identifiers that will be set,
+// '=' for unchanged ones and '!' for those that need attention.
+func WritePlan(w io.Writer, changes []Change) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, ch := range changes {
+		var line string
+		switch ch.Status {
+		case StatusSet:
+			line = fmt.Sprintf("+\t%s\t%s\t%s\t", ch.Target.Identifier, ch.Target.Address.Hex(), ch.Target.Contract)
+		case StatusUnchanged:
+			line = fmt.Sprintf("=\t%s\t%s\t%s\t", ch.Target.Identifier, ch.Target.Address.Hex(), ch.Target.Contract)
+		case StatusConflict:
+			line = fmt.Sprintf("!\t%s\t%s\tregistry has %s (write-once)\t", ch.Target.Identifier, ch.Target.Address.Hex(), ch.Current.Hex())
+		default:
+			reason := ch.Status.String()
+			if ch.Err != nil {
+				reason += ": " + ch.Err.Error()
+			}
+			line = fmt.Sprintf("!\t%s\t%s\t%s\t", ch.Target.Identifier, ch.Target.Address.Hex(), reason)
+		}
+		if _, err := fmt.Fprintln(tw, line); err != nil {
+			return err
+		}
+	}
+	return tw.Flush()
+}
+
+// Apply sends set for every change with StatusSet, then waits for the
+// receipts. Identifiers are re-read first so an entry filled since Plan is
+// skipped rather than reverting. The updated changes are returned.
+func (c *Client) Apply(ctx context.Context, d *publish.Deployer, changes []Change) ([]Change, error) {
+	var owner common.Address
+	if err := c.caller.CallCtx(ctx, eth.CallFunc(c.address, funcOwner).Returns(&owner)); err != nil {
+		return nil, fmt.Errorf("owner: %w", err)
+	}
+	if owner != d.Address() {
+		return nil, ErrNotOwner
+	}
+
+	out := append([]Change(nil), changes...)
+	for i := range out {
+		ch := &out[i]
+		if ch.Status != StatusSet {
+			continue
+		}
+		current, err := c.AddressOf(ctx, ch.Target.Identifier)
+		if err != nil {
+			return out, err
+		}
+		if current != (common.Address{}) {
+			ch.Current = current
+			ch.Status = StatusConflict
+			if current == ch.Target.Address {
+				ch.Status = StatusUnchanged
+			}
+			continue
+		}
+		// A failed send gives its nonce back, so the entries after it are
+		// not queued behind a gap and can still be sent.
+		if ch.TxHash, err = c.Set(ctx, d, ch.Target.Identifier, ch.Target.Address); err != nil {
+			ch.Err = err
+		}
+	}
+
+	for i := range out {
+		ch := &out[i]
+		if ch.Status != StatusSet || ch.Err != nil {
+			continue
+		}
+		receipt, err := d.WaitForReceipt(ctx, ch.TxHash)
+		if err != nil {
+			return out, fmt.Errorf("wait for %s: %w", ch.TxHash.Hex(), err)
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			ch.Err = fmt.Errorf("set reverted in tx %s", ch.TxHash.Hex())
+		}
+	}
+	return out, nil
+}
+
+// Bootstrap plans the targets, passes the plan to confirm and applies it
+// only if confirm returns true. Nothing is sent if no change has StatusSet.
+func (c *Client) Bootstrap(ctx context.Context, d *publish.Deployer, targets []Target, verify func(context.Context, common.Address, string) error, confirm func([]Change) bool) ([]Change, error) {
+	changes, err := c.Plan(ctx, targets, verify)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := false
+	for _, ch := range changes {
+		pending = pending || ch.Status == StatusSet
+	}
+	if !pending || !confirm(changes) {
+		return changes, nil
+	}
+	return c.Apply(ctx, d, changes)
+}
@@ -2,6 +2,7 @@ package contractregistry
 
 import (
 	_ "embed"
+	"fmt"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/lmittmann/w3"
@@ -42,13 +43,9 @@ func Bytecode() []byte {
 }
 
 func EncodeInit(args InitArgs) ([]byte, error) {
-	return funcInitialize.EncodeArgs(args.Owner, toBytes32Slice(args.Identifiers))
-}
-
-func toBytes32Slice(values [][]byte) [][32]byte {
-	out := make([][32]byte, len(values))
-	for i, value := range values {
-		out[i] = common.BytesToHash(common.RightPadBytes(value, 32))
+	identifiers, err := publish.EncodeBytes32Slice(args.Identifiers)
+	if err != nil {
+		return nil, fmt.Errorf("encode identifiers: %w", err)
 	}
-	return out
+	return funcInitialize.EncodeArgs(args.Owner, identifiers)
 }
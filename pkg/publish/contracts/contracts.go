@@ -0,0 +1,247 @@
+// Package contracts catalogues the contract packages under this directory and
+// identifies deployed contracts by their runtime code.
+package contracts
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+	"github.com/lmittmann/w3/w3vm"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/accountsindex"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/cat"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/contractregistry"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/decimalquoter"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/erc1967factory"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/ethfaucet"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/feepolicy"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/giftabletoken"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/limiter"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/oraclequoter"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/periodsimple"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/protocolfeecontroller"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/relativequoter"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/splitter"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/swappool"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/swaprouter"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/tokenuniquesymbolindex"
+)
+
+// Contract describes one contract package.
+type Contract struct {
+	Package  string
+	Name     string
+	Proxied  bool
+	Bytecode func() []byte
+}
+
+var all = []Contract{
+	{"erc1967factory", erc1967factory.Name(), false, erc1967factory.Bytecode},
+	{"accountsindex", accountsindex.Name(), true, accountsindex.Bytecode},
+	{"cat", cat.Name(), true, cat.Bytecode},
+	{"contractregistry", contractregistry.Name(), true, contractregistry.Bytecode},
+	{"decimalquoter", decimalquoter.Name(), false, decimalquoter.Bytecode},
+	{"ethfaucet", ethfaucet.Name(), true, ethfaucet.Bytecode},
+	{"feepolicy", feepolicy.Name(), true, feepolicy.Bytecode},
+	{"giftabletoken", giftabletoken.Name(), true, giftabletoken.Bytecode},
+	{"limiter", limiter.Name(), true, limiter.Bytecode},
+	{"oraclequoter", oraclequoter.Name(), true, oraclequoter.Bytecode},
+	{"periodsimple", periodsimple.Name(), true, periodsimple.Bytecode},
+	{"protocolfeecontroller", protocolfeecontroller.Name(), true, protocolfeecontroller.Bytecode},
+	{"relativequoter", relativequoter.Name(), true, relativequoter.Bytecode},
+	{"splitter", splitter.Name(), true, splitter.Bytecode},
+	{"swappool", swappool.Name(), true, swappool.Bytecode},
+	{"swaprouter", swaprouter.Name(), false, swaprouter.Bytecode},
+	{"tokenuniquesymbolindex", tokenuniquesymbolindex.Name(), true, tokenuniquesymbolindex.Bytecode},
+}
+
+var (
+	runtimeOnce sync.Once
+	runtimeCode map[string][]byte
+	runtimeErr  error
+)
+
+// All returns every catalogued contract.
+func All() []Contract {
+	return append([]Contract(nil), all...)
+}
+
+// ByPackage looks up a contract by package name, e.g. "swappool".
+func ByPackage(pkg string) (Contract, bool) {
+	for _, c := range all {
+		if c.Package == pkg {
+			return c, true
+		}
+	}
+	return Contract{}, false
+}
+
+// RuntimeCode returns the code the package's bytecode deploys, obtained by
+// running its constructor in an in-memory EVM.
+func (c Contract) RuntimeCode() ([]byte, error) {
+	runtimeOnce.Do(buildRuntimeCode)
+	if runtimeErr != nil {
+		return nil, runtimeErr
+	}
+	return runtimeCode[c.Package], nil
+}
+
+// Identify returns the contract whose runtime code matches code. The
+// trailing CBOR metadata is ignored on both sides, so builds that differ
+// only in source paths or comments still match.
+func Identify(code []byte) (Contract, bool) {
+	runtimeOnce.Do(buildRuntimeCode)
+	if runtimeErr != nil || len(code) == 0 {
+		return Contract{}, false
+	}
+	stripped := StripMetadata(code)
+	for _, c := range all {
+		if bytes.Equal(StripMetadata(runtimeCode[c.Package]), stripped) {
+			return c, true
+		}
+	}
+	return Contract{}, false
+}
+
+// IdentifyAt identifies the contract at address at blockNumber (nil for
+// latest). For ERC1967 proxies the implementation is identified and returned
+// alongside.
+func IdentifyAt(ctx context.Context, caller publish.Caller, address common.Address, blockNumber *big.Int) (Contract, common.Address, error) {
+	impl, err := publish.ImplementationOf(ctx, caller, address, blockNumber)
+	if err != nil {
+		return Contract{}, common.Address{}, err
+	}
+	target := address
+	if impl != (common.Address{}) {
+		target = impl
+	}
+
+	var code []byte
+	if err := caller.CallCtx(ctx, eth.Code(target, blockNumber).Returns(&code)); err != nil {
+		return Contract{}, impl, fmt.Errorf("get code at %s: %w", target.Hex(), err)
+	}
+	if len(code) == 0 {
+		return Contract{}, impl, fmt.Errorf("no code at %s", target.Hex())
+	}
+	c, ok := Identify(code)
+	if !ok {
+		return Contract{}, impl, fmt.Errorf("code at %s matches no known contract", target.Hex())
+	}
+	return c, impl, nil
+}
+
+// StripMetadata removes the solc CBOR metadata suffix, whose length is
+// encoded in the final two bytes. Code without a plausible suffix is
+// returned unchanged.
+func StripMetadata(code []byte) []byte {
+	if len(code) < 2 {
+		return code
+	}
+	n := int(code[len(code)-2])<<8 | int(code[len(code)-1])
+	if n+2 > len(code) {
+		return code
+	}
+	return code[:len(code)-n-2]
+}
+
+func buildRuntimeCode() {
+	vm, err := w3vm.New(w3vm.WithNoBaseFee())
+	if err != nil {
+		runtimeErr = fmt.Errorf("create vm: %w", err)
+		return
+	}
+
+	deployer := common.HexToAddress("0x000000000000000000000000000000000000dEaD")
+	runtimeCode = make(map[string][]byte, len(all))
+	for _, c := range all {
+		receipt, err := vm.Apply(&w3types.Message{From: deployer, Input: c.Bytecode(), Gas: 30_000_000})
+		if err != nil {
+			runtimeErr = fmt.Errorf("deploy %s: %w", c.Name, err)
+			return
+		}
+		code, err := vm.Code(*receipt.ContractAddress)
+		if err != nil {
+			runtimeErr = fmt.Errorf("read %s code: %w", c.Name, err)
+			return
+		}
+		runtimeCode[c.Package] = code
+	}
+}
+
+// VerifyAt checks that the contract at address, or its implementation if it
+// is an ERC1967 proxy, is an instance of the package pkg.
+func VerifyAt(ctx context.Context, caller publish.Caller, address common.Address, pkg string) error {
+	c, _, err := IdentifyAt(ctx, caller, address, nil)
+	if err != nil {
+		return err
+	}
+	if c.Package != pkg {
+		return fmt.Errorf("%s is a %s, want %s", address.Hex(), c.Package, pkg)
+	}
+	return nil
+}
+
+// Verifier binds VerifyAt to caller, e.g. for contractregistry.Client.Plan.
+func Verifier(caller publish.Caller) func(context.Context, common.Address, string) error {
+	return func(ctx context.Context, address common.Address, pkg string) error {
+		return VerifyAt(ctx, caller, address, pkg)
+	}
+}
+
+// IdentifyPackage is Identify returning only the package name, e.g. for
+// publish.BuildInventory.
+func IdentifyPackage(code []byte) (string, bool) {
+	c, ok := Identify(code)
+	return c.Package, ok
+}
+
+// LoadQuoter identifies the quoter at address and loads the matching
+// off-chain model for tokens at blockNumber.
+func LoadQuoter(ctx context.Context, caller publish.Caller, quoter common.Address, tokens []common.Address, blockNumber *big.Int) (swappool.Quoter, error) {
+	return loadQuoter(ctx, caller, quoter, tokens, blockNumber, oraclequoter.NewClient)
+}
+
+func loadQuoter(ctx context.Context, caller publish.Caller, quoter common.Address, tokens []common.Address, blockNumber *big.Int, oracleClient func(publish.Caller, common.Address) *oraclequoter.Client) (swappool.Quoter, error) {
+	c, _, err := IdentifyAt(ctx, caller, quoter, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	switch c.Package {
+	case "decimalquoter":
+		return decimalquoter.NewClient(caller, quoter).Load(ctx, tokens, blockNumber)
+	case "relativequoter":
+		return relativequoter.NewClient(caller, quoter).Load(ctx, tokens, blockNumber)
+	case "oraclequoter":
+		return oracleClient(caller, quoter).Load(ctx, tokens, blockNumber)
+	default:
+		return nil, fmt.Errorf("%s is a %s, not a quoter", quoter.Hex(), c.Package)
+	}
+}
+
+// QuoterLoader binds LoadQuoter to caller, e.g. for swaprouter.BuildGraph.
+// It keeps one oraclequoter.Client per quoter, so that graphs built again
+// with the same loader read each OracleQuoter's feeds in one batch.
+func QuoterLoader(caller publish.Caller) swaprouter.QuoterLoader {
+	var (
+		mu      sync.Mutex
+		clients = make(map[common.Address]*oraclequoter.Client)
+	)
+	oracleClient := func(caller publish.Caller, quoter common.Address) *oraclequoter.Client {
+		mu.Lock()
+		defer mu.Unlock()
+		if clients[quoter] == nil {
+			clients[quoter] = oraclequoter.NewClient(caller, quoter)
+		}
+		return clients[quoter]
+	}
+	return func(ctx context.Context, quoter common.Address, tokens []common.Address, blockNumber *big.Int) (swappool.Quoter, error) {
+		return loadQuoter(ctx, caller, quoter, tokens, blockNumber, oracleClient)
+	}
+}
@@ -0,0 +1,124 @@
+package decimalquoter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+)
+
+var funcDecimals = w3.MustNewFunc("decimals()", "uint8")
+
+var ErrUnknownToken = errors.New("token decimals not in state")
+
+type Client struct {
+	caller  publish.Caller
+	address common.Address
+}
+
+func NewClient(caller publish.Caller, address common.Address) *Client {
+	return &Client{caller: caller, address: address}
+}
+
+func (c *Client) Address() common.Address {
+	return c.address
+}
+
+// State is an off-chain DecimalQuoter. The contract holds no storage, so
+// all it needs are the decimals of the tokens being quoted. It implements
+// swappool.Quoter.
+type State struct {
+	Decimals map[common.Address]uint8
+}
+
+// Load reads the decimals of tokens at blockNumber (nil for latest) in one
+// batch. The quoter itself has no storage to read.
+func (c *Client) Load(ctx context.Context, tokens []common.Address, blockNumber *big.Int) (*State, error) {
+	decimals := make([]uint8, len(tokens))
+	calls := make([]w3types.RPCCaller, len(tokens))
+	for i, token := range tokens {
+		calls[i] = eth.CallFunc(token, funcDecimals).AtBlock(blockNumber).Returns(&decimals[i])
+	}
+	if err := publish.BatchCall(ctx, c.caller, calls, 0); err != nil {
+		return nil, fmt.Errorf("decimals: %w", err)
+	}
+
+	s := &State{Decimals: make(map[common.Address]uint8, len(tokens))}
+	for i, token := range tokens {
+		s.Decimals[token] = decimals[i]
+	}
+	return s, nil
+}
+
+// ValueFor mirrors DecimalQuoter.valueFor: value rescaled from the decimals
+// of inToken to those of outToken, rounding down.
+func (s *State) ValueFor(outToken, inToken common.Address, value *big.Int) (*big.Int, error) {
+	dout, din, err := s.pair(outToken, inToken)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case din == dout:
+		return new(big.Int).Set(value), nil
+	case din > dout:
+		scale, err := publish.Pow10(uint64(din - dout))
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).Div(value, scale), nil
+	default:
+		scale, err := publish.Pow10(uint64(dout - din))
+		if err != nil {
+			return nil, err
+		}
+		return publish.CheckedMul(value, scale)
+	}
+}
+
+// ReverseValueFor mirrors DecimalQuoter.reverseValueFor: the inToken amount
+// for a desired outToken amount, rounding up.
+func (s *State) ReverseValueFor(outToken, inToken common.Address, value *big.Int) (*big.Int, error) {
+	dout, din, err := s.pair(outToken, inToken)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case din == dout:
+		return new(big.Int).Set(value), nil
+	case din > dout:
+		scale, err := publish.Pow10(uint64(din - dout))
+		if err != nil {
+			return nil, err
+		}
+		return publish.CheckedMul(value, scale)
+	default:
+		scale, err := publish.Pow10(uint64(dout - din))
+		if err != nil {
+			return nil, err
+		}
+		sum, err := publish.CheckedAdd(value, scale)
+		if err != nil {
+			return nil, err
+		}
+		return sum.Div(sum.Sub(sum, big.NewInt(1)), scale), nil
+	}
+}
+
+func (s *State) pair(outToken, inToken common.Address) (dout, din uint8, err error) {
+	dout, ok := s.Decimals[outToken]
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: %s", ErrUnknownToken, outToken.Hex())
+	}
+	din, ok = s.Decimals[inToken]
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: %s", ErrUnknownToken, inToken.Hex())
+	}
+	return dout, din, nil
+}
@@ -0,0 +1,81 @@
+package decimalquoter_test
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/cosmo-local-credit/protocol/pkg/internal/vmtest"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/decimalquoter"
+)
+
+// newTokens installs a token answering decimals() for each of decimals.
+func newTokens(e *vmtest.Env, decimals ...int64) []common.Address {
+	tokens := make([]common.Address, len(decimals))
+	for i, d := range decimals {
+		tokens[i] = common.BigToAddress(big.NewInt(0x7000 + int64(i)))
+		e.SetReturnData(tokens[i], vmtest.Word(big.NewInt(d)))
+	}
+	return tokens
+}
+
+func TestQuoteMatchesContract(t *testing.T) {
+	e := vmtest.New(t)
+	quoter := e.Create(decimalquoter.Bytecode())
+
+	// 77 is the largest power of ten that fits in uint256; the 0 <-> 78 and
+	// 0 <-> 255 pairs overflow.
+	tokens := newTokens(e, 0, 6, 18, 77, 78, 255)
+	caller := e.Caller()
+	s, err := decimalquoter.NewClient(caller, quoter).Load(context.Background(), tokens, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caller.Requests != 1 {
+		t.Errorf("Load made %d requests, want 1", caller.Requests)
+	}
+	if n := e.CompareQuoter(t, quoter, s, tokens, vmtest.Amounts()); n == 0 {
+		t.Fatal("no successful quotes")
+	}
+}
+
+func TestQuoteRounding(t *testing.T) {
+	e := vmtest.New(t)
+	tokens := newTokens(e, 6, 18)
+	six, eighteen := tokens[0], tokens[1]
+	s, err := decimalquoter.NewClient(e.Caller(), common.Address{}).Load(context.Background(), tokens, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		reverse bool
+		out, in common.Address
+		value   int64
+		want    int64
+	}{
+		{"down to fewer decimals", false, six, eighteen, 1_999_999_999_999, 1},
+		{"up to more decimals", false, eighteen, six, 1, 1_000_000_000_000},
+		{"reverse from fewer decimals", true, six, eighteen, 1, 1_000_000_000_000},
+		{"reverse to fewer decimals rounds up", true, eighteen, six, 1_000_000_000_001, 2},
+		{"reverse exact", true, eighteen, six, 2_000_000_000_000, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quote := s.ValueFor
+			if tt.reverse {
+				quote = s.ReverseValueFor
+			}
+			got, err := quote(tt.out, tt.in, big.NewInt(tt.value))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Int64() != tt.want {
+				t.Errorf("got %s, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package ethfaucet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/periodsimple"
+)
+
+// Seal state bits, mirroring EthFaucet.
+const (
+	RegistryState      uint8 = 1
+	PeriodCheckerState uint8 = 2
+	ValueState         uint8 = 4
+	MaxSealState       uint8 = 7
+)
+
+var (
+	funcOwner         = w3.MustNewFunc("owner()", "address")
+	funcAmount        = w3.MustNewFunc("amount()", "uint256")
+	funcRegistry      = w3.MustNewFunc("registry()", "address")
+	funcPeriodChecker = w3.MustNewFunc("periodChecker()", "address")
+	funcSealState     = w3.MustNewFunc("sealState()", "uint8")
+	funcCheck         = w3.MustNewFunc("check(address)", "bool")
+	funcNextTime      = w3.MustNewFunc("nextTime(address)", "uint256")
+	funcGiveTo        = w3.MustNewFunc("giveTo(address)", "uint256")
+	funcHave          = w3.MustNewFunc("have(address)", "bool")
+)
+
+// Reason is why an address cannot currently be given to.
+type Reason int
+
+const (
+	// ReasonFaucetBalance: the faucet holds less than amount
+	// (InsufficientBalance).
+	ReasonFaucetBalance Reason = iota
+	// ReasonNotInRegistry: registry.have(recipient) is false
+	// (NotInWhitelist).
+	ReasonNotInRegistry
+	// ReasonBalanceThreshold: the recipient's balance is at or above the
+	// period checker's balanceThreshold (PeriodBackend).
+	ReasonBalanceThreshold
+	// ReasonPeriod: the recipient claimed within the last period
+	// (PeriodBackend).
+	ReasonPeriod
+	// ReasonNotPoker: the faucet is neither owner nor poker of the period
+	// checker, so poke reverts (PeriodBackend).
+	ReasonNotPoker
+)
+
+func (r Reason) String() string {
+	switch r {
+	case ReasonFaucetBalance:
+		return "faucet balance below amount"
+	case ReasonNotInRegistry:
+		return "recipient not in registry"
+	case ReasonBalanceThreshold:
+		return "recipient balance at or above threshold"
+	case ReasonPeriod:
+		return "period not elapsed"
+	case ReasonNotPoker:
+		return "faucet cannot poke period checker"
+	default:
+		return "unknown"
+	}
+}
+
+// Seal is the decoded sealState.
+type Seal struct {
+	State         uint8
+	Registry      bool
+	PeriodChecker bool
+	Amount        bool
+}
+
+// Status is the faucet configuration and funding.
+type Status struct {
+	Owner         common.Address
+	Amount        *big.Int
+	Balance       *big.Int
+	Registry      common.Address
+	PeriodChecker common.Address
+	Seal          Seal
+	// ClaimsRemaining is Balance / Amount, or nil if Amount is zero.
+	ClaimsRemaining *big.Int
+}
+
+// Eligibility explains whether giveTo(Recipient) would succeed now. Check is
+// the faucet's own check() result; Reasons lists every failed condition.
+// NextTime is when the period elapses, zero if no period applies.
+type Eligibility struct {
+	Recipient common.Address
+	Check     bool
+	Reasons   []Reason
+	NextTime  time.Time
+}
+
+// IneligibleError is returned by GiveTo when pre-checks fail.
+type IneligibleError struct {
+	Eligibility Eligibility
+}
+
+func (e *IneligibleError) Error() string {
+	reasons := make([]string, len(e.Eligibility.Reasons))
+	for i, r := range e.Eligibility.Reasons {
+		reasons[i] = r.String()
+	}
+	msg := fmt.Sprintf("%s is not eligible: %s", e.Eligibility.Recipient.Hex(), strings.Join(reasons, ", "))
+	if !e.Eligibility.NextTime.IsZero() {
+		msg += fmt.Sprintf(" (next claim after %s)", e.Eligibility.NextTime.Format(time.RFC3339))
+	}
+	return msg
+}
+
+func (e Eligibility) Eligible() bool {
+	return len(e.Reasons) == 0
+}
+
+type Client struct {
+	caller  publish.Caller
+	address common.Address
+}
+
+func NewClient(caller publish.Caller, address common.Address) *Client {
+	return &Client{caller: caller, address: address}
+}
+
+func (c *Client) Address() common.Address {
+	return c.address
+}
+
+func DecodeSeal(state uint8) Seal {
+	return Seal{
+		State:         state,
+		Registry:      state&RegistryState != 0,
+		PeriodChecker: state&PeriodCheckerState != 0,
+		Amount:        state&ValueState != 0,
+	}
+}
+
+func (c *Client) Status(ctx context.Context) (Status, error) {
+	s := Status{Amount: new(big.Int)}
+	var sealState uint8
+	if err := c.caller.CallCtx(ctx,
+		eth.CallFunc(c.address, funcOwner).Returns(&s.Owner),
+		eth.CallFunc(c.address, funcAmount).Returns(s.Amount),
+		eth.CallFunc(c.address, funcRegistry).Returns(&s.Registry),
+		eth.CallFunc(c.address, funcPeriodChecker).Returns(&s.PeriodChecker),
+		eth.CallFunc(c.address, funcSealState).Returns(&sealState),
+		eth.Balance(c.address, nil).Returns(&s.Balance),
+	); err != nil {
+		return Status{}, fmt.Errorf("read faucet status: %w", err)
+	}
+	s.Seal = DecodeSeal(sealState)
+	if s.Amount.Sign() > 0 {
+		s.ClaimsRemaining = new(big.Int).Div(s.Balance, s.Amount)
+	}
+	return s, nil
+}
+
+// Eligibility evaluates the same conditions giveTo enforces, against the
+// latest block. The period checker is assumed to be a PeriodSimple.
+func (c *Client) Eligibility(ctx context.Context, recipient common.Address) (Eligibility, error) {
+	status, err := c.Status(ctx)
+	if err != nil {
+		return Eligibility{}, err
+	}
+
+	e := Eligibility{Recipient: recipient}
+	if err := c.caller.CallCtx(ctx, eth.CallFunc(c.address, funcCheck, recipient).Returns(&e.Check)); err != nil {
+		return Eligibility{}, fmt.Errorf("check: %w", err)
+	}
+
+	if status.Balance.Cmp(status.Amount) < 0 {
+		e.Reasons = append(e.Reasons, ReasonFaucetBalance)
+	}
+
+	if status.Registry != (common.Address{}) {
+		var have bool
+		if err := c.caller.CallCtx(ctx, eth.CallFunc(status.Registry, funcHave, recipient).Returns(&have)); err != nil {
+			return Eligibility{}, fmt.Errorf("registry have: %w", err)
+		}
+		if !have {
+			e.Reasons = append(e.Reasons, ReasonNotInRegistry)
+		}
+	}
+
+	if status.PeriodChecker != (common.Address{}) {
+		period := periodsimple.NewClient(c.caller, status.PeriodChecker)
+		cfg, err := period.Config(ctx)
+		if err != nil {
+			return Eligibility{}, err
+		}
+		subject, err := period.Subject(ctx, recipient)
+		if err != nil {
+			return Eligibility{}, err
+		}
+
+		var (
+			head     *types.Header
+			nextTime big.Int
+		)
+		if err := c.caller.CallCtx(ctx,
+			eth.HeaderByNumber(nil).Returns(&head),
+			eth.CallFunc(c.address, funcNextTime, recipient).Returns(&nextTime),
+		); err != nil {
+			return Eligibility{}, fmt.Errorf("get latest header / nextTime: %w", err)
+		}
+
+		if cfg.BalanceThreshold.Sign() > 0 && subject.Balance.Cmp(cfg.BalanceThreshold) >= 0 {
+			e.Reasons = append(e.Reasons, ReasonBalanceThreshold)
+		}
+		if subject.LastUsed.Sign() != 0 && new(big.Int).SetUint64(head.Time).Cmp(&nextTime) <= 0 {
+			e.Reasons = append(e.Reasons, ReasonPeriod)
+			e.NextTime = time.Unix(nextTime.Int64(), 0).UTC()
+		}
+		if !cfg.CanPoke(c.address) {
+			e.Reasons = append(e.Reasons, ReasonNotPoker)
+		}
+	}
+	return e, nil
+}
+
+// GiveTo sends giveTo(recipient) after the eligibility pre-checks pass.
+// Otherwise it returns an *IneligibleError without sending.
+func (c *Client) GiveTo(ctx context.Context, d *publish.Deployer, recipient common.Address) (common.Hash, error) {
+	e, err := c.Eligibility(ctx, recipient)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if !e.Eligible() {
+		return common.Hash{}, &IneligibleError{Eligibility: e}
+	}
+
+	calldata, err := funcGiveTo.EncodeArgs(recipient)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("encode giveTo: %w", err)
+	}
+	return d.Transact(ctx, c.address, nil, calldata, 0)
+}
+
+// IsIneligible reports whether err is an *IneligibleError.
+func IsIneligible(err error) bool {
+	var ie *IneligibleError
+	return errors.As(err, &ie)
+}
@@ -0,0 +1,194 @@
+package contracts
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/lmittmann/w3"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/accountsindex"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/cat"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/giftabletoken"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/limiter"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/relativequoter"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/swappool"
+)
+
+// Event signatures per package, as declared in src/ and the solady bases
+// each contract inherits. Topics are not unique across packages: solady's
+// WriterAdded(address indexed) and AccountsIndex's WriterAdded(address) share
+// a topic but decode differently, so logs are decoded against the package of
+// the contract that emitted them.
+var (
+	ownableEvents = []string{
+		"OwnershipTransferred(address indexed oldOwner, address indexed newOwner)",
+		"OwnershipHandoverRequested(address indexed pendingOwner)",
+		"OwnershipHandoverCanceled(address indexed pendingOwner)",
+		"Initialized(uint64 version)",
+	}
+	erc20Events = []string{
+		giftabletoken.TransferEventSignature,
+		"Approval(address indexed owner, address indexed spender, uint256 amount)",
+	}
+
+	eventSignatures = map[string][]string{
+		"erc1967factory": {
+			"AdminChanged(address indexed proxy, address indexed admin)",
+			"Upgraded(address indexed proxy, address indexed implementation)",
+			"Deployed(address indexed proxy, address indexed implementation, address indexed admin)",
+		},
+		"accountsindex": {
+			accountsindex.AddressAddedEventSignature,
+			"AddressActive(address indexed _account, bool _active)",
+			"AddressRemoved(address _account)",
+			"WriterAdded(address _account)",
+			"WriterDeleted(address _account)",
+		},
+		"cat": {
+			cat.TokensSetEventSignature,
+			"WriterAdded(address indexed writer)",
+			"WriterRemoved(address indexed writer)",
+		},
+		"contractregistry": {
+			"AddressKey(bytes32 indexed _key, address _address)",
+		},
+		"decimalquoter": nil,
+		"ethfaucet": {
+			"Give(address indexed _recipient, address indexed _token, uint256 _amount)",
+			"FaucetAmountChange(uint256 _amount)",
+			"SealStateChange(uint256 indexed _sealState, address _registry, address _periodChecker)",
+		},
+		"feepolicy": {
+			"DefaultFeeUpdated(uint256 oldFee, uint256 newFee)",
+			"PairFeeUpdated(address indexed tokenIn, address indexed tokenOut, uint256 oldFee, uint256 newFee)",
+			"PairFeeRemoved(address indexed tokenIn, address indexed tokenOut)",
+		},
+		"giftabletoken": append([]string{
+			giftabletoken.MintEventSignature,
+			giftabletoken.BurnEventSignature,
+			"Expired(uint256 timestamp)",
+			"WriterAdded(address indexed writer)",
+			"WriterRemoved(address indexed writer)",
+		}, erc20Events...),
+		"limiter": {
+			limiter.LimitSetEventSignature,
+			"WriterAdded(address indexed writer)",
+			"WriterRemoved(address indexed writer)",
+		},
+		"oraclequoter": {
+			"Initialized(address indexed owner, address indexed baseCurrency)",
+			"OracleUpdated(address indexed token, address indexed oracle)",
+			"OracleRemoved(address indexed token)",
+			"MaxStalenessUpdated(uint256 maxStaleness)",
+			"MultiplierUpdated(uint256 oldMultiplier, uint256 newMultiplier)",
+		},
+		"periodsimple": {
+			"PeriodChange(uint256 _value)",
+			"BalanceThresholdChange(uint256 _value)",
+		},
+		"protocolfeecontroller": {
+			"ProtocolFeeUpdated(uint256 oldFee, uint256 newFee)",
+			"ProtocolFeeRecipientUpdated(address indexed oldRecipient, address indexed newRecipient)",
+			"ActiveStateUpdated(bool active)",
+		},
+		"relativequoter": {
+			relativequoter.PriceIndexUpdatedEventSignature,
+		},
+		"splitter": nil,
+		"swappool": {
+			"SealStateChange(bool indexed _final, uint256 _sealState)",
+			swappool.SwapEventSignature,
+			swappool.DepositEventSignature,
+			swappool.CollectEventSignature,
+		},
+		"swaprouter": nil,
+		"tokenuniquesymbolindex": {
+			"AddressKey(bytes32 indexed _symbol, address _token)",
+			"AddressAdded(address _token)",
+			"AddressRemoved(address _token)",
+			"WriterAdded(address _writer)",
+			"WriterDeleted(address _writer)",
+		},
+	}
+)
+
+var (
+	eventsOnce sync.Once
+	events     map[string]map[common.Hash]*w3.Event
+)
+
+func buildEvents() {
+	events = make(map[string]map[common.Hash]*w3.Event, len(all))
+	for _, c := range all {
+		sigs := eventSignatures[c.Package]
+		if c.Proxied {
+			sigs = append(slices.Clone(sigs), ownableEvents...)
+		}
+		byTopic := make(map[common.Hash]*w3.Event, len(sigs))
+		for _, sig := range sigs {
+			ev := w3.MustNewEvent(sig)
+			byTopic[ev.Topic0] = ev
+		}
+		events[c.Package] = byTopic
+	}
+}
+
+// Events returns the events the package's contract can emit, including
+// those of the solady Ownable and Initializable bases of proxied contracts.
+func (c Contract) Events() []*w3.Event {
+	eventsOnce.Do(buildEvents)
+	evs := slices.Collect(maps.Values(events[c.Package]))
+	slices.SortFunc(evs, func(a, b *w3.Event) int { return a.Topic0.Cmp(b.Topic0) })
+	return evs
+}
+
+// EventName returns the name of the event log encodes, as emitted by a
+// contract of the package, e.g. "Swap".
+func (c Contract) EventName(log *types.Log) (string, bool) {
+	ev, ok := c.event(log)
+	if !ok {
+		return "", false
+	}
+	name, _, _ := strings.Cut(ev.Signature, "(")
+	return name, true
+}
+
+// DecodeEvent decodes log as emitted by a contract of the package into a
+// map of argument names to values, indexed and non-indexed alike.
+func (c Contract) DecodeEvent(log *types.Log) (string, map[string]any, error) {
+	name, ok := c.EventName(log)
+	if !ok {
+		return "", nil, fmt.Errorf("unknown %s event", c.Package)
+	}
+	ev, _ := c.event(log)
+
+	args := make(map[string]any, len(ev.Args))
+	if err := ev.Args.NonIndexed().UnpackIntoMap(args, log.Data); err != nil {
+		return "", nil, fmt.Errorf("decode %s data: %w", name, err)
+	}
+	var indexed abi.Arguments
+	for _, arg := range ev.Args {
+		if arg.Indexed {
+			indexed = append(indexed, arg)
+		}
+	}
+	if err := abi.ParseTopicsIntoMap(args, indexed, log.Topics[1:]); err != nil {
+		return "", nil, fmt.Errorf("decode %s topics: %w", name, err)
+	}
+	return name, args, nil
+}
+
+func (c Contract) event(log *types.Log) (*w3.Event, bool) {
+	if len(log.Topics) == 0 {
+		return nil, false
+	}
+	eventsOnce.Do(buildEvents)
+	ev, ok := events[c.Package][log.Topics[0]]
+	return ev, ok
+}
@@ -0,0 +1,142 @@
+package giftabletoken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+)
+
+// ExpiresSlot is the storage slot of GiftableToken._expires, which has no
+// getter. Solady's ERC20, Ownable and Initializable keep their state in
+// hashed slots, so the declared variables start at slot 0: writers,
+// expired, totalBurned, totalMinted, _name, _symbol, _decimals, _expires.
+var ExpiresSlot = common.BigToHash(big.NewInt(7))
+
+var (
+	funcExpired     = w3.MustNewFunc("expired()", "bool")
+	funcApplyExpiry = w3.MustNewFunc("applyExpiry()", "uint8")
+	funcSymbol      = w3.MustNewFunc("symbol()", "string")
+	funcBalanceOf   = w3.MustNewFunc("balanceOf(address)", "uint256")
+
+	eventExpired = w3.MustNewEvent("Expired(uint256 timestamp)")
+)
+
+var ErrNoExpiredEvent = errors.New("no Expired event")
+
+// Expiry is a token's expiry state at a block. ExpiresAt is zero for tokens
+// that never expire. Due is set when the token has not been marked expired
+// but applyExpiry would mark it at the next block. Err is set instead if the
+// state could not be read; Symbol is left empty if only symbol() failed.
+type Expiry struct {
+	Token     common.Address
+	Symbol    string
+	ExpiresAt uint64
+	Expired   bool
+	Due       bool
+	Err       error
+}
+
+type Client struct {
+	caller  publish.Caller
+	address common.Address
+}
+
+func NewClient(caller publish.Caller, address common.Address) *Client {
+	return &Client{caller: caller, address: address}
+}
+
+func (c *Client) Address() common.Address {
+	return c.address
+}
+
+// Expiry reads the token's expiry state at blockNumber (nil for latest).
+func (c *Client) Expiry(ctx context.Context, blockNumber *big.Int) (Expiry, error) {
+	expiries, err := Expiries(ctx, c.caller, []common.Address{c.address}, blockNumber)
+	if err != nil {
+		return Expiry{}, err
+	}
+	return expiries[0], expiries[0].Err
+}
+
+// Expiries reads the expiry state of each token at blockNumber (nil for
+// latest) in one batch, judging Due against that block's timestamp. A token
+// whose state cannot be read gets an Err and does not fail the others.
+func Expiries(ctx context.Context, caller publish.Caller, tokens []common.Address, blockNumber *big.Int) ([]Expiry, error) {
+	var header *types.Header
+	if err := caller.CallCtx(ctx, eth.HeaderByNumber(blockNumber).Returns(&header)); err != nil {
+		return nil, fmt.Errorf("get header: %w", err)
+	}
+
+	var (
+		expiries = make([]Expiry, len(tokens))
+		slots    = make([]common.Hash, len(tokens))
+		calls    = make([]w3types.RPCCaller, 0, 3*len(tokens))
+	)
+	for i, token := range tokens {
+		expiries[i].Token = token
+		calls = append(calls,
+			eth.StorageAt(token, ExpiresSlot, header.Number).Returns(&slots[i]),
+			eth.CallFunc(token, funcExpired).AtBlock(header.Number).Returns(&expiries[i].Expired),
+			eth.CallFunc(token, funcSymbol).AtBlock(header.Number).Returns(&expiries[i].Symbol),
+		)
+	}
+	errs, err := publish.BatchCallEach(ctx, caller, calls, 0)
+	if err != nil {
+		return nil, fmt.Errorf("get expiries: %w", err)
+	}
+
+	for i := range expiries {
+		e := &expiries[i]
+		expires := slots[i].Big()
+		switch {
+		case errs[3*i] != nil:
+			e.Err = fmt.Errorf("get expiry: %w", errs[3*i])
+		case errs[3*i+1] != nil:
+			e.Err = fmt.Errorf("expired: %w", errs[3*i+1])
+		case !expires.IsUint64():
+			e.Err = fmt.Errorf("expiry %s out of range", expires)
+		}
+		if e.Err != nil {
+			*e = Expiry{Token: e.Token, Err: e.Err}
+			continue
+		}
+		e.ExpiresAt = expires.Uint64()
+		e.Due = !e.Expired && e.ExpiresAt != 0 && header.Time >= e.ExpiresAt
+	}
+	return expiries, nil
+}
+
+// ApplyExpiry sends applyExpiry(). Anyone may call it; it only changes state
+// once the expiry time has passed.
+func (c *Client) ApplyExpiry(ctx context.Context, d *publish.Deployer) (common.Hash, error) {
+	calldata, err := funcApplyExpiry.EncodeArgs()
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("encode applyExpiry: %w", err)
+	}
+	return d.Transact(ctx, c.address, nil, calldata, 0)
+}
+
+// ExpiredAt returns the timestamp of the Expired event the token emitted in
+// receipt, or ErrNoExpiredEvent.
+func (c *Client) ExpiredAt(receipt *types.Receipt) (uint64, error) {
+	for _, log := range receipt.Logs {
+		if log.Address != c.address || len(log.Topics) == 0 || log.Topics[0] != eventExpired.Topic0 {
+			continue
+		}
+		timestamp := new(big.Int)
+		if err := eventExpired.DecodeArgs(log, timestamp); err != nil {
+			return 0, fmt.Errorf("decode Expired: %w", err)
+		}
+		return timestamp.Uint64(), nil
+	}
+	return 0, fmt.Errorf("%w in tx %s", ErrNoExpiredEvent, receipt.TxHash.Hex())
+}
@@ -26,6 +26,24 @@ var funcInitialize = w3.MustNewFunc(
 	"initialize(string,string,uint8,address,uint256)", "",
 )
 
+// TransferEventSignature is the ERC20 Transfer event. It decodes the
+// transfers of any ERC20, not only GiftableToken.
+const TransferEventSignature = "Transfer(address indexed from, address indexed to, uint256 amount)"
+
+var EventTransfer = w3.MustNewEvent(TransferEventSignature)
+
+// MintEventSignature and BurnEventSignature are emitted alongside the
+// Transfer from and to the zero address.
+const (
+	MintEventSignature = "Mint(address indexed minter, address indexed beneficiary, uint256 value)"
+	BurnEventSignature = "Burn(address indexed from, uint256 value)"
+)
+
+var (
+	EventMint = w3.MustNewEvent(MintEventSignature)
+	EventBurn = w3.MustNewEvent(BurnEventSignature)
+)
+
 type InitArgs struct {
 	Name      string
 	Symbol    string
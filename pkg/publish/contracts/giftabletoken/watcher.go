@@ -0,0 +1,206 @@
+package giftabletoken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+)
+
+// Notice reports a token that has expired. TxHash and ExpiredAt are zero if
+// the token was already marked expired, by a transfer or another caller of
+// applyExpiry. Holdings lists the watched pools that still hold the token.
+type Notice struct {
+	Token     common.Address `json:"token"`
+	Symbol    string         `json:"symbol"`
+	ExpiresAt uint64         `json:"expires_at"`
+	ExpiredAt uint64         `json:"expired_at,omitempty"`
+	TxHash    common.Hash    `json:"tx_hash,omitzero"`
+	Holdings  []Holding      `json:"holdings,omitempty"`
+}
+
+// Holding is a pool's balance of an expired token.
+type Holding struct {
+	Pool    common.Address `json:"pool"`
+	Balance *big.Int       `json:"balance"`
+}
+
+// Watcher marks watched tokens expired as soon as their expiry passes,
+// since GiftableToken only does so on the next transfer, and reports each
+// expired token once.
+type Watcher struct {
+	caller   publish.Caller
+	d        *publish.Deployer
+	tokens   []common.Address
+	pools    []common.Address
+	notified map[common.Address]bool
+}
+
+// NewWatcher watches tokens, sending applyExpiry from d. pools are checked
+// for remaining balances of each expired token.
+func NewWatcher(caller publish.Caller, d *publish.Deployer, tokens, pools []common.Address) *Watcher {
+	return &Watcher{
+		caller:   caller,
+		d:        d,
+		tokens:   tokens,
+		pools:    pools,
+		notified: make(map[common.Address]bool),
+	}
+}
+
+// WatchAddressBook watches every GiftableToken in book and checks every
+// SwapPool in it for balances.
+func WatchAddressBook(caller publish.Caller, d *publish.Deployer, book *publish.AddressBook) *Watcher {
+	var tokens, pools []common.Address
+	for _, name := range book.ByContract("giftabletoken") {
+		tokens = append(tokens, book.Contracts[name].Address)
+	}
+	for _, name := range book.ByContract("swappool") {
+		pools = append(pools, book.Contracts[name].Address)
+	}
+	return NewWatcher(caller, d, tokens, pools)
+}
+
+// Check applies the expiry of every token that is due, waits for each
+// receipt and verifies its Expired event. It returns a notice for each token
+// that expired since the last Check, including tokens found already
+// expired. A failure for one token, whether reading its state or applying
+// its expiry, does not stop the others; the token is retried on the next
+// Check and the errors are joined. Pool balances that cannot be read are
+// left out of Holdings and reported in the error.
+func (w *Watcher) Check(ctx context.Context) ([]Notice, error) {
+	expiries, err := Expiries(ctx, w.caller, w.tokens, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		notices []Notice
+		errs    []error
+	)
+	for _, e := range expiries {
+		if e.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", e.Token.Hex(), e.Err))
+			continue
+		}
+		if w.notified[e.Token] || !e.Expired && !e.Due {
+			continue
+		}
+		n := Notice{Token: e.Token, Symbol: e.Symbol, ExpiresAt: e.ExpiresAt}
+		if e.Due {
+			if n.TxHash, n.ExpiredAt, err = w.apply(ctx, e.Token); err != nil {
+				errs = append(errs, fmt.Errorf("%s (%s): %w", e.Symbol, e.Token.Hex(), err))
+				continue
+			}
+		}
+		notices = append(notices, n)
+	}
+
+	// The expiries are applied by now, so the notices are returned and not
+	// repeated even if some pool balances cannot be read.
+	errs = append(errs, w.holdings(ctx, notices)...)
+	for _, n := range notices {
+		w.notified[n.Token] = true
+	}
+	return notices, errors.Join(errs...)
+}
+
+// Run checks every interval until ctx is cancelled, passing each notice to
+// notify. Errors are passed to onErr, if set, and retried on the next tick.
+func (w *Watcher) Run(ctx context.Context, interval time.Duration, notify func(Notice), onErr func(error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		notices, err := w.Check(ctx)
+		for _, n := range notices {
+			notify(n)
+		}
+		if err != nil && onErr != nil {
+			onErr(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// apply sends applyExpiry and returns the timestamp of the Expired event.
+// If the transaction emitted none, the token must have been marked expired
+// by someone else in the meantime; that is verified and reported as a zero
+// timestamp.
+func (w *Watcher) apply(ctx context.Context, token common.Address) (common.Hash, uint64, error) {
+	c := NewClient(w.caller, token)
+	txHash, err := c.ApplyExpiry(ctx, w.d)
+	if err != nil {
+		return common.Hash{}, 0, fmt.Errorf("apply expiry: %w", err)
+	}
+	receipt, err := w.d.WaitForReceipt(ctx, txHash)
+	if err != nil {
+		return common.Hash{}, 0, fmt.Errorf("wait for applyExpiry: %w", err)
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return common.Hash{}, 0, fmt.Errorf("applyExpiry reverted in tx %s", txHash.Hex())
+	}
+
+	expiredAt, err := c.ExpiredAt(receipt)
+	if errors.Is(err, ErrNoExpiredEvent) {
+		e, expiryErr := c.Expiry(ctx, receipt.BlockNumber)
+		if expiryErr != nil {
+			return common.Hash{}, 0, expiryErr
+		}
+		if !e.Expired {
+			return common.Hash{}, 0, err
+		}
+		return common.Hash{}, 0, nil
+	}
+	if err != nil {
+		return common.Hash{}, 0, err
+	}
+	return txHash, expiredAt, nil
+}
+
+// holdings fills in the watched pools' balances of each notice's token and
+// returns an error for each balance that could not be read.
+func (w *Watcher) holdings(ctx context.Context, notices []Notice) []error {
+	if len(notices) == 0 || len(w.pools) == 0 {
+		return nil
+	}
+	balances := make([]*big.Int, len(notices)*len(w.pools))
+	calls := make([]w3types.RPCCaller, len(balances))
+	for i, n := range notices {
+		for j, pool := range w.pools {
+			k := i*len(w.pools) + j
+			balances[k] = new(big.Int)
+			calls[k] = eth.CallFunc(n.Token, funcBalanceOf, pool).Returns(balances[k])
+		}
+	}
+	callErrs, err := publish.BatchCallEach(ctx, w.caller, calls, 0)
+	if err != nil {
+		return []error{fmt.Errorf("get pool balances: %w", err)}
+	}
+	var errs []error
+	for i, n := range notices {
+		for j, pool := range w.pools {
+			k := i*len(w.pools) + j
+			switch {
+			case callErrs[k] != nil:
+				errs = append(errs, fmt.Errorf("%s balance of pool %s: %w", n.Token.Hex(), pool.Hex(), callErrs[k]))
+			case balances[k].Sign() > 0:
+				notices[i].Holdings = append(notices[i].Holdings, Holding{Pool: pool, Balance: balances[k]})
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,130 @@
+package giftabletoken_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/internal/vmtest"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/giftabletoken"
+)
+
+var (
+	funcMintTo    = w3.MustNewFunc("mintTo(address,uint256)", "")
+	funcBalanceOf = w3.MustNewFunc("balanceOf(address)", "uint256")
+)
+
+func newToken(t *testing.T, e *vmtest.Env, symbol string, expiresAt uint64) common.Address {
+	t.Helper()
+	init, err := giftabletoken.EncodeInit(giftabletoken.InitArgs{
+		Name:      symbol,
+		Symbol:    symbol,
+		Decimals:  6,
+		Owner:     vmtest.Owner,
+		ExpiresAt: new(big.Int).SetUint64(expiresAt),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e.Proxy(giftabletoken.Bytecode(), init)
+}
+
+// failBalanceOf is a Hook that fails balanceOf(holder) calls.
+func failBalanceOf(holder common.Address) func(string, []any) error {
+	return func(method string, args []any) error {
+		if msg, ok := args[0].(*w3types.Message); ok && method == "eth_call" &&
+			bytes.HasPrefix(msg.Input, funcBalanceOf.Selector[:]) && bytes.HasSuffix(msg.Input, holder.Bytes()) {
+			return errors.New("balanceOf failed")
+		}
+		return nil
+	}
+}
+
+func TestWatcherCheck(t *testing.T) {
+	pool, otherPool := common.Address{0x70}, common.Address{0x71}
+	tests := []struct {
+		name string
+		hook func(string, []any) error
+		// holdings are the expected Holdings of the expired token.
+		holdings []giftabletoken.Holding
+		// errs are substrings of the error of the first Check.
+		errs []string
+	}{
+		{
+			name:     "broken token",
+			holdings: []giftabletoken.Holding{{Pool: pool, Balance: big.NewInt(5)}, {Pool: otherPool, Balance: big.NewInt(7)}},
+			errs:     []string{"expired:"},
+		},
+		{
+			name:     "balance unreadable",
+			hook:     failBalanceOf(pool),
+			holdings: []giftabletoken.Holding{{Pool: otherPool, Balance: big.NewInt(7)}},
+			errs:     []string{"expired:", "balance of pool " + pool.Hex()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := vmtest.New(t)
+			d := e.Deployer(nil)
+			e.AutoMine()
+
+			expiring := newToken(t, e, "EXP", e.Header.Time+30)
+			never := newToken(t, e, "NVR", 0)
+			// broken reverts every call.
+			broken := common.Address{0xbb}
+			e.VM.SetCode(broken, common.FromHex("0x60006000fd"))
+			e.Send(expiring, funcMintTo, []any{pool, big.NewInt(5)})
+			e.Send(expiring, funcMintTo, []any{otherPool, big.NewInt(7)})
+			for range 3 {
+				e.Mine()
+			}
+
+			caller := e.Caller()
+			caller.Hook = tt.hook
+			w := giftabletoken.NewWatcher(caller, d, []common.Address{broken, expiring, never}, []common.Address{pool, otherPool})
+			notices, err := w.Check(context.Background())
+			if err == nil {
+				t.Fatal("no error")
+			}
+			for _, want := range append(tt.errs, broken.Hex()) {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("err %q does not mention %q", err, want)
+				}
+			}
+			if len(notices) != 1 {
+				t.Fatalf("notices %+v, want one for %s", notices, expiring.Hex())
+			}
+			n := notices[0]
+			if n.Token != expiring || n.Symbol != "EXP" || n.TxHash == (common.Hash{}) || n.ExpiredAt < n.ExpiresAt {
+				t.Errorf("notice %+v", n)
+			}
+			if len(n.Holdings) != len(tt.holdings) {
+				t.Fatalf("holdings %v, want %v", n.Holdings, tt.holdings)
+			}
+			for i, h := range n.Holdings {
+				if h.Pool != tt.holdings[i].Pool || h.Balance.Cmp(tt.holdings[i].Balance) != 0 {
+					t.Errorf("holdings %v, want %v", n.Holdings, tt.holdings)
+				}
+			}
+
+			expiry, err := giftabletoken.NewClient(e.Caller(), expiring).Expiry(context.Background(), nil)
+			if err != nil || !expiry.Expired {
+				t.Errorf("expiry %+v, err %v after Check", expiry, err)
+			}
+
+			// The expired token is reported once; the broken one keeps
+			// failing.
+			notices, err = w.Check(context.Background())
+			if len(notices) != 0 || err == nil || !strings.Contains(err.Error(), broken.Hex()) {
+				t.Errorf("second Check: notices %+v, err %v", notices, err)
+			}
+		})
+	}
+}
@@ -25,6 +25,12 @@ var funcInitialize = w3.MustNewFunc(
 	"initialize(address)", "",
 )
 
+// LimitSetEventSignature is the event Limiter emits when a holder's limit
+// for a token changes.
+const LimitSetEventSignature = "LimitSet(address indexed token, address indexed holder, uint256 value)"
+
+var EventLimitSet = w3.MustNewEvent(LimitSetEventSignature)
+
 type InitArgs struct {
 	Owner common.Address
 }
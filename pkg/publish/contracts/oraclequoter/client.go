@@ -0,0 +1,356 @@
+package oraclequoter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+)
+
+// PPM mirrors OracleQuoter.PPM; a zero multiplier is treated as PPM (1x).
+const PPM = 1_000_000
+
+var (
+	funcOracles         = w3.MustNewFunc("oracles(address)", "address")
+	funcMaxStaleness    = w3.MustNewFunc("maxStaleness()", "uint256")
+	funcMultiplier      = w3.MustNewFunc("multiplier()", "uint256")
+	funcDecimals        = w3.MustNewFunc("decimals()", "uint8")
+	funcLatestRoundData = w3.MustNewFunc("latestRoundData()", "uint80,int256,uint256,uint256,uint80")
+)
+
+var (
+	ErrUnknownToken       = errors.New("token not in state")
+	ErrTokenCallFailed    = errors.New("token decimals call failed")
+	ErrOracleNotSet       = errors.New("oracle not set")
+	ErrOracleCallFailed   = errors.New("oracle call failed")
+	ErrInvalidOraclePrice = errors.New("invalid oracle price")
+	ErrStaleOraclePrice   = errors.New("stale oracle price")
+	ErrInvalidDecimals    = errors.New("invalid decimals")
+)
+
+var bigPPM = big.NewInt(PPM)
+
+type Client struct {
+	caller  publish.Caller
+	address common.Address
+
+	mu sync.Mutex
+	// feeds are the oracles configured when the client last loaded.
+	feeds []common.Address
+}
+
+func NewClient(caller publish.Caller, address common.Address) *Client {
+	return &Client{caller: caller, address: address}
+}
+
+func (c *Client) Address() common.Address {
+	return c.address
+}
+
+// Feed is the latest round of a Chainlink aggregator as OracleQuoter reads
+// it. Err is set if latestRoundData() or decimals() failed.
+type Feed struct {
+	Oracle    common.Address
+	Answer    *big.Int
+	UpdatedAt *big.Int
+	Decimals  uint8
+	Err       error
+}
+
+// Token is one token's decimals and the feed configured for it. Oracle is
+// zero if none is set. DecimalsErr is set if decimals() failed.
+type Token struct {
+	Decimals    uint8
+	DecimalsErr error
+	Oracle      common.Address
+}
+
+// State is an off-chain OracleQuoter at one block. Timestamp is that block's
+// timestamp, against which feed staleness is judged. It implements
+// swappool.Quoter.
+type State struct {
+	Timestamp    uint64
+	MaxStaleness *big.Int
+	Multiplier   *big.Int
+	Tokens       map[common.Address]Token
+	Feeds        map[common.Address]Feed
+}
+
+// Load reads the quoter configuration, token decimals, the header whose
+// timestamp staleness is judged against and the latest round of every
+// configured feed in one batch at blockNumber. Callers that need the reads
+// to agree pin blockNumber; nil reads each call at the head.
+//
+// The feeds read are those configured when c last loaded. An oracle that
+// was not among them, as on the first Load, is read in a second batch at
+// the same block.
+func (c *Client) Load(ctx context.Context, tokens []common.Address, blockNumber *big.Int) (*State, error) {
+	s := &State{
+		MaxStaleness: new(big.Int),
+		Multiplier:   new(big.Int),
+		Tokens:       make(map[common.Address]Token, len(tokens)),
+		Feeds:        make(map[common.Address]Feed),
+	}
+
+	var header *types.Header
+	oracles := make([]common.Address, len(tokens))
+	decimals := make([]uint8, len(tokens))
+	calls := []w3types.RPCCaller{
+		eth.HeaderByNumber(blockNumber).Returns(&header),
+		eth.CallFunc(c.address, funcMaxStaleness).AtBlock(blockNumber).Returns(s.MaxStaleness),
+		eth.CallFunc(c.address, funcMultiplier).AtBlock(blockNumber).Returns(s.Multiplier),
+	}
+	const fixed = 3
+	for i, token := range tokens {
+		calls = append(calls,
+			eth.CallFunc(c.address, funcOracles, token).AtBlock(blockNumber).Returns(&oracles[i]),
+			eth.CallFunc(token, funcDecimals).AtBlock(blockNumber).Returns(&decimals[i]),
+		)
+	}
+	c.mu.Lock()
+	known := c.feeds
+	c.mu.Unlock()
+	rounds := c.feedCalls(&calls, known, blockNumber)
+	errs, err := publish.BatchCallEach(ctx, c.caller, calls, 0)
+	if err != nil {
+		return nil, fmt.Errorf("get quoter state: %w", err)
+	}
+	if errs[0] != nil {
+		return nil, fmt.Errorf("get header: %w", errs[0])
+	}
+	for i, callErr := range errs[1:fixed] {
+		if callErr != nil {
+			return nil, fmt.Errorf("get quoter config (call %d): %w", i, callErr)
+		}
+	}
+	s.Timestamp = header.Time
+	for i, token := range tokens {
+		if callErr := errs[fixed+2*i]; callErr != nil {
+			return nil, fmt.Errorf("oracles(%s): %w", token.Hex(), callErr)
+		}
+		s.Tokens[token] = Token{Decimals: decimals[i], DecimalsErr: errs[fixed+1+2*i], Oracle: oracles[i]}
+	}
+	read := make(map[common.Address]Feed, len(known))
+	for i, round := range setFeedErrs(rounds, errs[fixed+2*len(tokens):]) {
+		read[known[i]] = round
+	}
+
+	var feeds, missing []common.Address
+	for _, t := range s.Tokens {
+		if _, ok := s.Feeds[t.Oracle]; t.Oracle == (common.Address{}) || ok {
+			continue
+		}
+		feeds = append(feeds, t.Oracle)
+		if round, ok := read[t.Oracle]; ok {
+			s.Feeds[t.Oracle] = round
+		} else {
+			s.Feeds[t.Oracle] = Feed{}
+			missing = append(missing, t.Oracle)
+		}
+	}
+	if len(missing) > 0 {
+		// Pin the follow-up to the block the first batch was read at.
+		calls = calls[:0]
+		rounds := c.feedCalls(&calls, missing, header.Number)
+		if errs, err = publish.BatchCallEach(ctx, c.caller, calls, 0); err != nil {
+			return nil, fmt.Errorf("get feeds: %w", err)
+		}
+		for i, round := range setFeedErrs(rounds, errs) {
+			s.Feeds[missing[i]] = round
+		}
+	}
+	c.mu.Lock()
+	c.feeds = feeds
+	c.mu.Unlock()
+	return s, nil
+}
+
+// feedCalls appends the latestRoundData() and decimals() calls of each of
+// feeds to calls and returns the rounds they decode into.
+func (c *Client) feedCalls(calls *[]w3types.RPCCaller, feeds []common.Address, blockNumber *big.Int) []Feed {
+	rounds := make([]Feed, len(feeds))
+	for i, oracle := range feeds {
+		rounds[i] = Feed{Oracle: oracle, Answer: new(big.Int), UpdatedAt: new(big.Int)}
+		*calls = append(*calls,
+			eth.CallFunc(oracle, funcLatestRoundData).AtBlock(blockNumber).Returns(nil, rounds[i].Answer, nil, rounds[i].UpdatedAt, nil),
+			eth.CallFunc(oracle, funcDecimals).AtBlock(blockNumber).Returns(&rounds[i].Decimals),
+		)
+	}
+	return rounds
+}
+
+// setFeedErrs sets the Err of each of rounds from the errors of its calls,
+// as appended by feedCalls.
+func setFeedErrs(rounds []Feed, errs []error) []Feed {
+	for i := range rounds {
+		switch oracle := rounds[i].Oracle; {
+		case errs[2*i] != nil:
+			rounds[i].Err = fmt.Errorf("%w: %s latestRoundData: %v", ErrOracleCallFailed, oracle.Hex(), errs[2*i])
+		case errs[2*i+1] != nil:
+			rounds[i].Err = fmt.Errorf("%w: %s decimals: %v", ErrOracleCallFailed, oracle.Hex(), errs[2*i+1])
+		}
+	}
+	return rounds
+}
+
+// ValueFor mirrors OracleQuoter.valueFor:
+//
+//	value * inRate * 10^outDecimals * 10^outRateDecimals
+//	  / (10^inRateDecimals * 10^inDecimals * outRate)
+//
+// rounded down, then scaled by multiplier / PPM, rounded down.
+func (s *State) ValueFor(outToken, inToken common.Address, value *big.Int) (*big.Int, error) {
+	q, err := s.pair(outToken, inToken)
+	if err != nil {
+		return nil, err
+	}
+	num, err := product(q.inRate, q.outScale, q.outRateScale)
+	if err != nil {
+		return nil, err
+	}
+	den, err := product(q.inRateScale, q.inScale, q.outRate)
+	if err != nil {
+		return nil, err
+	}
+	output, err := publish.FullMulDiv(value, num, den)
+	if err != nil {
+		return nil, err
+	}
+	return publish.FullMulDiv(output, s.multiplier(), bigPPM)
+}
+
+// ReverseValueFor mirrors OracleQuoter.reverseValueFor: the inverse of
+// ValueFor, rounding up at both steps.
+func (s *State) ReverseValueFor(outToken, inToken common.Address, value *big.Int) (*big.Int, error) {
+	q, err := s.pair(outToken, inToken)
+	if err != nil {
+		return nil, err
+	}
+	num, err := product(q.outRate, q.inScale, q.inRateScale)
+	if err != nil {
+		return nil, err
+	}
+	den, err := product(q.inRate, q.outScale, q.outRateScale)
+	if err != nil {
+		return nil, err
+	}
+	output, err := publish.FullMulDivUp(value, num, den)
+	if err != nil {
+		return nil, err
+	}
+	return publish.FullMulDivUp(output, bigPPM, s.multiplier())
+}
+
+// Rate applies getOracleRate's checks to the feed of token and returns its
+// answer and decimals.
+func (s *State) Rate(token common.Address) (*big.Int, uint8, error) {
+	t, ok := s.Tokens[token]
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: %s", ErrUnknownToken, token.Hex())
+	}
+	if t.Oracle == (common.Address{}) {
+		return nil, 0, fmt.Errorf("%w: %s", ErrOracleNotSet, token.Hex())
+	}
+	feed, ok := s.Feeds[t.Oracle]
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: feed %s", ErrUnknownToken, t.Oracle.Hex())
+	}
+	if feed.Err != nil {
+		return nil, 0, feed.Err
+	}
+	if feed.Answer.Sign() <= 0 {
+		return nil, 0, fmt.Errorf("%w: %s", ErrInvalidOraclePrice, t.Oracle.Hex())
+	}
+	age, err := publish.CheckedSub(new(big.Int).SetUint64(s.Timestamp), feed.UpdatedAt)
+	if err != nil {
+		return nil, 0, err
+	}
+	if age.Cmp(s.MaxStaleness) > 0 {
+		return nil, 0, fmt.Errorf("%w: %s", ErrStaleOraclePrice, t.Oracle.Hex())
+	}
+	return feed.Answer, feed.Decimals, nil
+}
+
+type quotePair struct {
+	inRate, outRate                              *big.Int
+	inScale, outScale, inRateScale, outRateScale *big.Int
+}
+
+func (s *State) pair(outToken, inToken common.Address) (quotePair, error) {
+	var q quotePair
+	out, ok := s.Tokens[outToken]
+	if !ok {
+		return q, fmt.Errorf("%w: %s", ErrUnknownToken, outToken.Hex())
+	}
+	if out.DecimalsErr != nil {
+		return q, fmt.Errorf("%w: %s", ErrTokenCallFailed, outToken.Hex())
+	}
+	in, ok := s.Tokens[inToken]
+	if !ok {
+		return q, fmt.Errorf("%w: %s", ErrUnknownToken, inToken.Hex())
+	}
+	if in.DecimalsErr != nil {
+		return q, fmt.Errorf("%w: %s", ErrTokenCallFailed, inToken.Hex())
+	}
+
+	var (
+		inRateDecimals, outRateDecimals uint8
+		err                             error
+	)
+	if q.inRate, inRateDecimals, err = s.Rate(inToken); err != nil {
+		return q, err
+	}
+	if q.outRate, outRateDecimals, err = s.Rate(outToken); err != nil {
+		return q, err
+	}
+
+	if q.outScale, err = scale(out.Decimals); err != nil {
+		return q, err
+	}
+	if q.inScale, err = scale(in.Decimals); err != nil {
+		return q, err
+	}
+	if q.outRateScale, err = scale(outRateDecimals); err != nil {
+		return q, err
+	}
+	if q.inRateScale, err = scale(inRateDecimals); err != nil {
+		return q, err
+	}
+	return q, nil
+}
+
+func (s *State) multiplier() *big.Int {
+	if s.Multiplier == nil || s.Multiplier.Sign() == 0 {
+		return bigPPM
+	}
+	return s.Multiplier
+}
+
+// scale mirrors getScale.
+func scale(decimals uint8) (*big.Int, error) {
+	if decimals > 77 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidDecimals, decimals)
+	}
+	return publish.Pow10(uint64(decimals))
+}
+
+// product multiplies left to right with checked uint256 arithmetic.
+func product(xs ...*big.Int) (*big.Int, error) {
+	p := big.NewInt(1)
+	for _, x := range xs {
+		var err error
+		if p, err = publish.CheckedMul(p, x); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
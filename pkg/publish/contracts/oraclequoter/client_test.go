@@ -0,0 +1,235 @@
+package oraclequoter_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lmittmann/w3"
+
+	"github.com/cosmo-local-credit/protocol/pkg/internal/vmtest"
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/oraclequoter"
+)
+
+var (
+	funcSetOracle       = w3.MustNewFunc("setOracle(address,address)", "")
+	funcSetMultiplier   = w3.MustNewFunc("setMultiplier(uint256)", "")
+	funcSetMaxStaleness = w3.MustNewFunc("setMaxStaleness(uint256)", "")
+)
+
+// feed is a mock aggregator round. Its code returns the same five words for
+// every call, so decimals() reads the first one, which doubles as roundId.
+type feed struct {
+	decimals  int64
+	answer    *big.Int
+	updatedAt int64 // relative to the block timestamp
+}
+
+func (f feed) install(e *vmtest.Env, addr common.Address) {
+	var data []byte
+	for _, word := range []*big.Int{
+		big.NewInt(f.decimals),
+		f.answer,
+		new(big.Int),
+		new(big.Int).SetUint64(uint64(int64(e.Header.Time) + f.updatedAt)),
+		new(big.Int),
+	} {
+		data = append(data, vmtest.Word(word)...)
+	}
+	e.SetReturnData(addr, data)
+}
+
+// token is a token with its decimals (nil for one without code) and the
+// feed configured for it (nil for none).
+type token struct {
+	decimals *big.Int
+	feed     *feed
+}
+
+type fixture struct {
+	e      *vmtest.Env
+	quoter common.Address
+	tokens []common.Address
+}
+
+func newFixture(t *testing.T, tokens []token) *fixture {
+	e := vmtest.New(t)
+	init, err := oraclequoter.EncodeInit(oraclequoter.InitArgs{Owner: vmtest.Owner, BaseCurrency: common.Address{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fixture{e: e, quoter: e.Proxy(oraclequoter.Bytecode(), init)}
+	for i, tok := range tokens {
+		addr := common.BigToAddress(big.NewInt(0x7000 + int64(i)))
+		f.tokens = append(f.tokens, addr)
+		if tok.decimals != nil {
+			e.SetReturnData(addr, vmtest.Word(tok.decimals))
+		}
+		if tok.feed != nil {
+			oracle := common.BigToAddress(big.NewInt(0xf000 + int64(i)))
+			tok.feed.install(e, oracle)
+			e.Send(f.quoter, funcSetOracle, []any{addr, oracle})
+		}
+	}
+	return f
+}
+
+func (f *fixture) load(t *testing.T) *oraclequoter.State {
+	t.Helper()
+	s, err := oraclequoter.NewClient(f.e.Caller(), f.quoter).Load(context.Background(), f.tokens, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestQuoteMatchesContract(t *testing.T) {
+	f := newFixture(t, []token{
+		{big.NewInt(0), &feed{8, big.NewInt(100_000_000), -10}},
+		{big.NewInt(6), &feed{18, w3.I("2.5 ether"), 0}},
+		{big.NewInt(18), &feed{0, big.NewInt(7), -500}},
+		{big.NewInt(77), &feed{8, big.NewInt(123_456_789), -1}},
+		{big.NewInt(6), &feed{8, big.NewInt(99_000_000), -90_000}}, // stale at the default
+		{big.NewInt(6), &feed{8, big.NewInt(-5), 0}},
+		{big.NewInt(6), &feed{8, new(big.Int), 0}},
+		{big.NewInt(6), &feed{8, big.NewInt(5), 10}}, // updated in the future
+		{big.NewInt(6), &feed{78, big.NewInt(5), 0}}, // decimals too large
+		{big.NewInt(18), &feed{8, new(big.Int).Lsh(big.NewInt(1), 200), 0}},
+		{nil, &feed{8, big.NewInt(100_000_000), 0}},
+		{big.NewInt(6), nil},
+	})
+
+	for _, multiplier := range []int64{0, 900_000, 1_000_001, 1_100_000} {
+		if multiplier > 0 {
+			f.e.Send(f.quoter, funcSetMultiplier, []any{big.NewInt(multiplier)})
+		}
+		for _, staleness := range []int64{86_400, 100_000, 0} {
+			f.e.Send(f.quoter, funcSetMaxStaleness, []any{big.NewInt(staleness)})
+			t.Run(fmt.Sprintf("multiplier=%d/staleness=%d", multiplier, staleness), func(t *testing.T) {
+				if n := f.e.CompareQuoter(t, f.quoter, f.load(t), f.tokens, vmtest.Amounts()); n == 0 {
+					t.Fatal("no successful quotes")
+				}
+			})
+		}
+	}
+}
+
+func TestRateErrors(t *testing.T) {
+	f := newFixture(t, []token{
+		{big.NewInt(6), &feed{8, big.NewInt(100_000_000), 0}},
+		{big.NewInt(6), &feed{8, big.NewInt(100_000_000), -86_401}},
+		{big.NewInt(6), &feed{8, big.NewInt(-1), 0}},
+		{big.NewInt(6), &feed{8, new(big.Int), 0}},
+		{big.NewInt(6), &feed{8, big.NewInt(100_000_000), 1}},
+		{big.NewInt(6), nil},
+		{nil, &feed{8, big.NewInt(100_000_000), 0}},
+		{big.NewInt(6), &feed{78, big.NewInt(100_000_000), 0}},
+	})
+	s := f.load(t)
+	good := f.tokens[0]
+
+	tests := []struct {
+		name  string
+		token common.Address
+		want  error
+	}{
+		{"stale", f.tokens[1], oraclequoter.ErrStaleOraclePrice},
+		{"negative", f.tokens[2], oraclequoter.ErrInvalidOraclePrice},
+		{"zero", f.tokens[3], oraclequoter.ErrInvalidOraclePrice},
+		{"future", f.tokens[4], publish.ErrOverflow},
+		{"no oracle", f.tokens[5], oraclequoter.ErrOracleNotSet},
+		{"no decimals", f.tokens[6], oraclequoter.ErrTokenCallFailed},
+		{"feed decimals", f.tokens[7], oraclequoter.ErrInvalidDecimals},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.ValueFor(good, tt.token, big.NewInt(1)); !errors.Is(err, tt.want) {
+				t.Errorf("ValueFor: got %v, want %v", err, tt.want)
+			}
+			if _, err := s.ReverseValueFor(tt.token, good, big.NewInt(1)); !errors.Is(err, tt.want) {
+				t.Errorf("ReverseValueFor: got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuoteRounding(t *testing.T) {
+	// A 6 decimal token at 1.00 and one at 3.00, so 1 wei of the first is
+	// worth a third of a wei of the second.
+	f := newFixture(t, []token{
+		{big.NewInt(6), &feed{8, big.NewInt(100_000_000), 0}},
+		{big.NewInt(6), &feed{8, big.NewInt(300_000_000), 0}},
+	})
+	s := f.load(t)
+	one, three := f.tokens[0], f.tokens[1]
+
+	got, err := s.ValueFor(three, one, big.NewInt(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Sign() != 0 {
+		t.Errorf("ValueFor rounds down: got %s, want 0", got)
+	}
+	got, err = s.ReverseValueFor(three, one, big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Int64() != 3 {
+		t.Errorf("ReverseValueFor: got %s, want 3", got)
+	}
+	got, err = s.ReverseValueFor(one, three, big.NewInt(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Int64() != 1 {
+		t.Errorf("ReverseValueFor rounds up: got %s, want 1", got)
+	}
+}
+
+func TestLoadRoundTrips(t *testing.T) {
+	f := newFixture(t, []token{
+		{big.NewInt(6), &feed{8, big.NewInt(100_000_000), 0}},
+		{big.NewInt(18), &feed{8, big.NewInt(100_000_000), 0}},
+	})
+	caller := f.e.Caller()
+	client := oraclequoter.NewClient(caller, f.quoter)
+	load := func(requests int) *oraclequoter.State {
+		t.Helper()
+		caller.Requests = 0
+		s, err := client.Load(context.Background(), f.tokens, f.e.Header.Number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if caller.Requests != requests {
+			t.Errorf("Load made %d requests, want %d", caller.Requests, requests)
+		}
+		if s.Timestamp != f.e.Header.Time {
+			t.Errorf("Timestamp = %d, want %d", s.Timestamp, f.e.Header.Time)
+		}
+		return s
+	}
+
+	// The feeds are not known yet, so they follow the quoter state.
+	load(2)
+	// Once known, they are read in the same batch.
+	load(1)
+
+	// A replaced feed is read in a second batch again, and the new answer
+	// is used.
+	oracle := common.Address{0xfe}
+	(&feed{8, big.NewInt(300_000_000), 0}).install(f.e, oracle)
+	f.e.Send(f.quoter, funcSetOracle, []any{f.tokens[0], oracle})
+	f.e.Mine()
+	s := load(2)
+	if got := s.Feeds[oracle].Answer; got == nil || got.Int64() != 300_000_000 {
+		t.Errorf("answer of the new feed %v, want 300000000", got)
+	}
+	if len(s.Feeds) != 2 {
+		t.Errorf("feeds %v, want two", s.Feeds)
+	}
+	load(1)
+}
@@ -0,0 +1,362 @@
+package oraclequoter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"slices"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+)
+
+var (
+	eventOracleUpdated = w3.MustNewEvent("OracleUpdated(address indexed token, address indexed oracle)")
+	eventOracleRemoved = w3.MustNewEvent("OracleRemoved(address indexed token)")
+)
+
+// DefaultConfirmations is the number of blocks, counting its own, a block
+// must have before Monitor applies its oracle logs. Applied logs are never
+// reverted, so this is what keeps a reorged OracleUpdated out of the
+// mapping.
+const DefaultConfirmations = 5
+
+// Severity ranks an alert: critical means swaps through the quoter revert now.
+type Severity string
+
+const (
+	SeverityInfo     Severity = "info"
+	SeverityWarning  Severity = "warning"
+	SeverityCritical Severity = "critical"
+)
+
+// AlertKind says what is wrong with a feed. Every kind except
+// AlertNearStale, AlertDeviation and AlertResolved makes OracleQuoter revert
+// for swaps involving the token.
+type AlertKind string
+
+const (
+	AlertNearStale       AlertKind = "near_stale"
+	AlertStale           AlertKind = "stale"
+	AlertFutureTimestamp AlertKind = "future_timestamp"
+	AlertInvalidPrice    AlertKind = "invalid_price"
+	AlertCallFailed      AlertKind = "call_failed"
+	AlertDeviation       AlertKind = "deviation"
+	AlertResolved        AlertKind = "resolved"
+)
+
+// Alert is one finding about a token's feed, tagged for JSON output.
+// Resolved alerts repeat the kind that cleared in Cleared.
+type Alert struct {
+	Time         time.Time      `json:"time"`
+	Block        uint64         `json:"block"`
+	Quoter       common.Address `json:"quoter"`
+	Token        common.Address `json:"token"`
+	Oracle       common.Address `json:"oracle"`
+	Kind         AlertKind      `json:"kind"`
+	Severity     Severity       `json:"severity"`
+	Cleared      AlertKind      `json:"cleared,omitempty"`
+	Answer       *big.Int       `json:"answer,omitempty"`
+	Previous     *big.Int       `json:"previous,omitempty"`
+	UpdatedAt    uint64         `json:"updated_at,omitempty"`
+	Age          uint64         `json:"age,omitempty"`
+	MaxStaleness uint64         `json:"max_staleness,omitempty"`
+	DeviationPPM uint64         `json:"deviation_ppm,omitempty"`
+	Message      string         `json:"message"`
+}
+
+// MonitorConfig tunes Monitor. WarnFraction is the fraction of
+// maxStaleness after which a feed is reported as near stale, 0.8 if zero.
+// MaxDeviationPPM is the largest change between two successive answers of
+// a feed that is not reported; zero disables the check. LogRange bounds
+// each eth_getLogs request; zero uses publish.DefaultLogRange.
+// Confirmations is the depth at which oracle logs are applied; zero uses
+// DefaultConfirmations and one follows the head.
+type MonitorConfig struct {
+	WarnFraction    float64
+	MaxDeviationPPM uint64
+	LogRange        uint64
+	Confirmations   uint64
+}
+
+// Monitor watches the feeds of one OracleQuoter. The token to feed mapping
+// is discovered from OracleUpdated and OracleRemoved logs rather than
+// configured, so feeds added later are picked up on the next Check.
+type Monitor struct {
+	client *Client
+	cfg    MonitorConfig
+
+	next    uint64
+	oracles map[common.Address]common.Address
+	answers map[common.Address]*big.Int
+	active  map[alertKey]bool
+}
+
+type alertKey struct {
+	token common.Address
+	kind  AlertKind
+}
+
+// NewMonitor returns a monitor that reads the quoter's logs from fromBlock,
+// the block it was deployed in or earlier.
+func NewMonitor(client *Client, fromBlock uint64, cfg MonitorConfig) *Monitor {
+	if cfg.WarnFraction <= 0 {
+		cfg.WarnFraction = 0.8
+	}
+	if cfg.Confirmations == 0 {
+		cfg.Confirmations = DefaultConfirmations
+	}
+	return &Monitor{
+		client:  client,
+		cfg:     cfg,
+		next:    fromBlock,
+		oracles: make(map[common.Address]common.Address),
+		answers: make(map[common.Address]*big.Int),
+		active:  make(map[alertKey]bool),
+	}
+}
+
+// Oracles returns the discovered token to feed mapping.
+func (m *Monitor) Oracles() map[common.Address]common.Address {
+	out := make(map[common.Address]common.Address, len(m.oracles))
+	for token, oracle := range m.oracles {
+		out[token] = oracle
+	}
+	return out
+}
+
+// State applies new OracleUpdated and OracleRemoved logs up to the last
+// block with the configured confirmations and loads the quoter with every
+// discovered token at the head, which it returns alongside. A feed set or
+// removed within the confirmation depth is read as the head has it, but a
+// token set there is only discovered once confirmed.
+func (m *Monitor) State(ctx context.Context) (*State, uint64, error) {
+	var head *big.Int
+	if err := m.client.caller.CallCtx(ctx, eth.BlockNumber().Returns(&head)); err != nil {
+		return nil, 0, fmt.Errorf("get block number: %w", err)
+	}
+	if head.Uint64()+1 >= m.cfg.Confirmations {
+		if err := m.sync(ctx, head.Uint64()+1-m.cfg.Confirmations); err != nil {
+			return nil, 0, err
+		}
+	}
+	s, err := m.client.Load(ctx, m.tokens(), head)
+	if err != nil {
+		return nil, 0, err
+	}
+	return s, head.Uint64(), nil
+}
+
+// Check reports every current problem with the configured feeds at the
+// head, judged as getOracleRate would at that block's timestamp. A
+// deviation is reported once, when the answer that deviates is first seen.
+func (m *Monitor) Check(ctx context.Context) ([]Alert, error) {
+	alerts, _, err := m.check(ctx)
+	return alerts, err
+}
+
+// check is Check, also returning the state the alerts were judged at.
+func (m *Monitor) check(ctx context.Context) ([]Alert, *checked, error) {
+	s, block, err := m.State(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	tokens := m.tokens()
+
+	var (
+		alerts    []Alert
+		now       = new(big.Int).SetUint64(s.Timestamp)
+		warnAfter = m.warnAfter(s.MaxStaleness)
+	)
+	for _, token := range tokens {
+		oracle := s.Tokens[token].Oracle
+		feed := s.Feeds[oracle]
+		base := Alert{
+			Time:         time.Unix(int64(s.Timestamp), 0).UTC(),
+			Block:        block,
+			Quoter:       m.client.address,
+			Token:        token,
+			Oracle:       oracle,
+			MaxStaleness: s.MaxStaleness.Uint64(),
+		}
+		alert := func(kind AlertKind, severity Severity, format string, args ...any) Alert {
+			a := base
+			a.Kind, a.Severity, a.Message = kind, severity, fmt.Sprintf(format, args...)
+			return a
+		}
+
+		switch {
+		case oracle == (common.Address{}):
+			// Removed within the confirmation depth.
+			feed.Err = fmt.Errorf("%w: %s", ErrOracleNotSet, token.Hex())
+		case feed.Err == nil && (feed.Answer == nil || feed.UpdatedAt == nil):
+			feed.Err = fmt.Errorf("%w: %s: no round read", ErrOracleCallFailed, oracle.Hex())
+		}
+		if feed.Err != nil {
+			alerts = append(alerts, alert(AlertCallFailed, SeverityCritical, "%v", feed.Err))
+			continue
+		}
+		base.Answer, base.UpdatedAt = feed.Answer, feed.UpdatedAt.Uint64()
+
+		if feed.Answer.Sign() <= 0 {
+			alerts = append(alerts, alert(AlertInvalidPrice, SeverityCritical, "answer %s is not positive", feed.Answer))
+		}
+		if feed.UpdatedAt.Cmp(now) > 0 {
+			alerts = append(alerts, alert(AlertFutureTimestamp, SeverityCritical, "updatedAt %s is after block time %d", feed.UpdatedAt, s.Timestamp))
+		} else {
+			age := new(big.Int).Sub(now, feed.UpdatedAt)
+			base.Age = age.Uint64()
+			switch {
+			case age.Cmp(s.MaxStaleness) > 0:
+				alerts = append(alerts, alert(AlertStale, SeverityCritical, "last update %ds ago exceeds maxStaleness %ss", base.Age, s.MaxStaleness))
+			case age.Cmp(warnAfter) > 0:
+				alerts = append(alerts, alert(AlertNearStale, SeverityWarning, "last update %ds ago, stale after %ss", base.Age, s.MaxStaleness))
+			}
+		}
+
+		previous := m.answers[oracle]
+		if previous != nil && previous.Sign() > 0 && feed.Answer.Cmp(previous) != 0 && m.cfg.MaxDeviationPPM > 0 {
+			diff := new(big.Int).Sub(feed.Answer, previous)
+			diff.Abs(diff).Mul(diff, bigPPM).Div(diff, previous)
+			if !diff.IsUint64() || diff.Uint64() > m.cfg.MaxDeviationPPM {
+				a := alert(AlertDeviation, SeverityWarning, "answer moved from %s to %s", previous, feed.Answer)
+				a.Previous = previous
+				if diff.IsUint64() {
+					a.DeviationPPM = diff.Uint64()
+				}
+				alerts = append(alerts, a)
+			}
+		}
+		m.answers[oracle] = feed.Answer
+	}
+	return alerts, &checked{block: block, timestamp: s.Timestamp}, nil
+}
+
+// checked is the block a check judged the feeds at.
+type checked struct {
+	block     uint64
+	timestamp uint64
+}
+
+// Run checks every interval until ctx is cancelled and passes alerts to
+// emit when a condition starts, and an AlertResolved alert when it clears.
+// Deviations are passed on every time. Errors are passed to onErr, if set,
+// and retried on the next tick.
+func (m *Monitor) Run(ctx context.Context, interval time.Duration, emit func(Alert), onErr func(error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		alerts, at, err := m.check(ctx)
+		if err != nil {
+			if onErr != nil {
+				onErr(err)
+			}
+		} else {
+			m.transitions(alerts, at, emit)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// transitions emits the alerts that started and the resolutions of those
+// that cleared at the check at.
+func (m *Monitor) transitions(alerts []Alert, at *checked, emit func(Alert)) {
+	current := make(map[alertKey]Alert)
+	for _, a := range alerts {
+		if a.Kind == AlertDeviation {
+			emit(a)
+			continue
+		}
+		key := alertKey{a.Token, a.Kind}
+		current[key] = a
+		if !m.active[key] {
+			emit(a)
+		}
+	}
+	for key := range m.active {
+		if _, ok := current[key]; !ok {
+			emit(Alert{
+				Time:     time.Unix(int64(at.timestamp), 0).UTC(),
+				Block:    at.block,
+				Quoter:   m.client.address,
+				Token:    key.token,
+				Oracle:   m.oracles[key.token],
+				Kind:     AlertResolved,
+				Severity: SeverityInfo,
+				Cleared:  key.kind,
+				Message:  fmt.Sprintf("%s cleared", key.kind),
+			})
+		}
+	}
+	m.active = make(map[alertKey]bool, len(current))
+	for key := range current {
+		m.active[key] = true
+	}
+}
+
+func (m *Monitor) tokens() []common.Address {
+	tokens := make([]common.Address, 0, len(m.oracles))
+	for token := range m.oracles {
+		tokens = append(tokens, token)
+	}
+	slices.SortFunc(tokens, func(a, b common.Address) int { return a.Cmp(b) })
+	return tokens
+}
+
+// warnAfter is maxStaleness scaled by WarnFraction, in whole seconds.
+func (m *Monitor) warnAfter(maxStaleness *big.Int) *big.Int {
+	ppm := big.NewInt(int64(m.cfg.WarnFraction * PPM))
+	return ppm.Mul(ppm, maxStaleness).Div(ppm, bigPPM)
+}
+
+// sync applies the quoter's oracle logs up to toBlock.
+func (m *Monitor) sync(ctx context.Context, toBlock uint64) error {
+	query := ethereum.FilterQuery{
+		Addresses: []common.Address{m.client.address},
+		Topics:    [][]common.Hash{{eventOracleUpdated.Topic0, eventOracleRemoved.Topic0}},
+	}
+	return publish.ScanLogs(ctx, m.client.caller, query, m.next, toBlock, m.cfg.LogRange, func(_, to uint64, logs []types.Log) error {
+		for i := range logs {
+			var token, oracle common.Address
+			switch logs[i].Topics[0] {
+			case eventOracleUpdated.Topic0:
+				if err := eventOracleUpdated.DecodeArgs(&logs[i], &token, &oracle); err != nil {
+					return fmt.Errorf("decode OracleUpdated in tx %s: %w", logs[i].TxHash.Hex(), err)
+				}
+				m.oracles[token] = oracle
+			case eventOracleRemoved.Topic0:
+				if err := eventOracleRemoved.DecodeArgs(&logs[i], &token); err != nil {
+					return fmt.Errorf("decode OracleRemoved in tx %s: %w", logs[i].TxHash.Hex(), err)
+				}
+				delete(m.oracles, token)
+			}
+		}
+		m.next = to + 1
+		return nil
+	})
+}
+
+// JSONLines returns an emit func for Run that writes each alert as one line
+// of JSON to w. Write errors are passed to onErr, if set.
+func JSONLines(w io.Writer, onErr func(error)) func(Alert) {
+	enc := json.NewEncoder(w)
+	return func(a Alert) {
+		if err := enc.Encode(a); err != nil && onErr != nil {
+			onErr(fmt.Errorf("write %s alert for %s: %w", a.Kind, a.Token.Hex(), err))
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package oraclequoter_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/oraclequoter"
+)
+
+var funcRemoveOracle = w3.MustNewFunc("removeOracle(address)", "")
+
+func oracleTokens(m *oraclequoter.Monitor) []common.Address {
+	var tokens []common.Address
+	for token := range m.Oracles() {
+		tokens = append(tokens, token)
+	}
+	slices.SortFunc(tokens, func(a, b common.Address) int { return a.Cmp(b) })
+	return tokens
+}
+
+func TestMonitorConfirmations(t *testing.T) {
+	f := newFixture(t, []token{
+		{big.NewInt(6), &feed{8, big.NewInt(100_000_000), 0}},
+		{big.NewInt(6), &feed{8, big.NewInt(100_000_000), 0}},
+	})
+	m := oraclequoter.NewMonitor(oraclequoter.NewClient(f.e.Caller(), f.quoter), 0, oraclequoter.MonitorConfig{Confirmations: 3})
+	check := func(want []common.Address) []oraclequoter.Alert {
+		t.Helper()
+		alerts, err := m.Check(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := oracleTokens(m); !slices.Equal(got, want) {
+			t.Errorf("tokens %v, want %v", got, want)
+		}
+		return alerts
+	}
+	mine := func(n int) {
+		for range n {
+			f.e.Mine()
+		}
+	}
+	mine(3)
+	check(f.tokens)
+
+	// An update that is reorged out never enters the mapping.
+	orphan := common.Address{0x0e}
+	f.e.Send(f.quoter, funcSetOracle, []any{orphan, common.Address{0xfe}})
+	mine(2)
+	f.e.Reorg(2)
+	mine(3)
+	check(f.tokens)
+
+	// A removal within the confirmation depth is judged as at the head,
+	// while the token stays in the mapping.
+	f.e.Send(f.quoter, funcRemoveOracle, []any{f.tokens[1]})
+	mine(1)
+	alerts := check(f.tokens)
+	if len(alerts) != 1 || alerts[0].Token != f.tokens[1] || alerts[0].Kind != oraclequoter.AlertCallFailed ||
+		!strings.Contains(alerts[0].Message, oraclequoter.ErrOracleNotSet.Error()) {
+		t.Errorf("alerts %+v, want call_failed for the removed oracle", alerts)
+	}
+
+	mine(2)
+	if alerts := check(f.tokens[:1]); len(alerts) != 0 {
+		t.Errorf("alerts %+v once the removal is confirmed", alerts)
+	}
+}
+
+// beforeChecks runs steps[i] before the i-th check of a Monitor, which
+// starts with eth_blockNumber, and cancels once they are used up.
+type beforeChecks struct {
+	publish.Caller
+	steps  []func()
+	cancel context.CancelFunc
+}
+
+func (c *beforeChecks) CallCtx(ctx context.Context, calls ...w3types.RPCCaller) error {
+	if elem, _ := calls[0].CreateRequest(); elem.Method == "eth_blockNumber" {
+		if len(c.steps) == 0 {
+			c.cancel()
+		} else {
+			c.steps[0]()
+			c.steps = c.steps[1:]
+		}
+	}
+	return c.Caller.CallCtx(ctx, calls...)
+}
+
+func TestMonitorRun(t *testing.T) {
+	f := newFixture(t, []token{
+		{big.NewInt(6), &feed{8, big.NewInt(100_000_000), -90_000}},
+	})
+	f.e.Mine()
+	oracle := common.BigToAddress(big.NewInt(0xf000))
+
+	var resolvedAt [2]uint64
+	ctx, cancel := context.WithCancel(context.Background())
+	caller := &beforeChecks{Caller: f.e.Caller(), cancel: cancel, steps: []func(){
+		func() {},
+		func() {
+			(&feed{8, big.NewInt(100_000_000), 0}).install(f.e, oracle)
+			h := f.e.Mine()
+			resolvedAt = [2]uint64{h.Number.Uint64(), h.Time}
+		},
+	}}
+	m := oraclequoter.NewMonitor(oraclequoter.NewClient(caller, f.quoter), 0, oraclequoter.MonitorConfig{Confirmations: 1})
+
+	var (
+		out  bytes.Buffer
+		errs []error
+	)
+	onErr := func(err error) { errs = append(errs, err) }
+	if err := m.Run(ctx, 1, oraclequoter.JSONLines(&out, onErr), onErr); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Run: %v", err)
+	}
+
+	var alerts []oraclequoter.Alert
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var a oraclequoter.Alert
+		if err := dec.Decode(&a); err != nil {
+			t.Fatal(err)
+		}
+		alerts = append(alerts, a)
+	}
+	if len(alerts) != 2 || alerts[0].Kind != oraclequoter.AlertStale || alerts[1].Kind != oraclequoter.AlertResolved {
+		t.Fatalf("alerts %+v, want stale then resolved", alerts)
+	}
+	if r := alerts[1]; r.Cleared != oraclequoter.AlertStale || r.Block != resolvedAt[0] || uint64(r.Time.Unix()) != resolvedAt[1] {
+		t.Errorf("resolved %+v, want block %d at %d", r, resolvedAt[0], resolvedAt[1])
+	}
+	// Only the cancelled checks fail.
+	for _, err := range errs {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("error %v", err)
+		}
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestJSONLinesError(t *testing.T) {
+	var got error
+	oraclequoter.JSONLines(failingWriter{}, func(err error) { got = err })(oraclequoter.Alert{Kind: oraclequoter.AlertStale})
+	if got == nil || !strings.Contains(got.Error(), "disk full") {
+		t.Errorf("onErr got %v", got)
+	}
+}
@@ -0,0 +1,86 @@
+package periodsimple
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+)
+
+var (
+	funcOwner            = w3.MustNewFunc("owner()", "address")
+	funcPoker            = w3.MustNewFunc("poker()", "address")
+	funcPeriod           = w3.MustNewFunc("period()", "uint256")
+	funcBalanceThreshold = w3.MustNewFunc("balanceThreshold()", "uint256")
+	funcLastUsed         = w3.MustNewFunc("lastUsed(address)", "uint256")
+	funcNext             = w3.MustNewFunc("next(address)", "uint256")
+	funcHave             = w3.MustNewFunc("have(address)", "bool")
+)
+
+// Config is the contract-wide configuration.
+type Config struct {
+	Owner            common.Address
+	Poker            common.Address
+	Period           *big.Int
+	BalanceThreshold *big.Int
+}
+
+// SubjectState is the period state of one subject. Next is lastUsed + period
+// and only meaningful if LastUsed is non-zero.
+type SubjectState struct {
+	LastUsed *big.Int
+	Next     *big.Int
+	Balance  *big.Int
+	Have     bool
+}
+
+type Client struct {
+	caller  publish.Caller
+	address common.Address
+}
+
+func NewClient(caller publish.Caller, address common.Address) *Client {
+	return &Client{caller: caller, address: address}
+}
+
+func (c *Client) Address() common.Address {
+	return c.address
+}
+
+func (c *Client) Config(ctx context.Context) (Config, error) {
+	cfg := Config{Period: new(big.Int), BalanceThreshold: new(big.Int)}
+	if err := c.caller.CallCtx(ctx,
+		eth.CallFunc(c.address, funcOwner).Returns(&cfg.Owner),
+		eth.CallFunc(c.address, funcPoker).Returns(&cfg.Poker),
+		eth.CallFunc(c.address, funcPeriod).Returns(cfg.Period),
+		eth.CallFunc(c.address, funcBalanceThreshold).Returns(cfg.BalanceThreshold),
+	); err != nil {
+		return Config{}, fmt.Errorf("read period config: %w", err)
+	}
+	return cfg, nil
+}
+
+// Subject reads lastUsed, next, have and the subject's native balance, which
+// have() compares against balanceThreshold.
+func (c *Client) Subject(ctx context.Context, subject common.Address) (SubjectState, error) {
+	state := SubjectState{LastUsed: new(big.Int), Next: new(big.Int)}
+	if err := c.caller.CallCtx(ctx,
+		eth.CallFunc(c.address, funcLastUsed, subject).Returns(state.LastUsed),
+		eth.CallFunc(c.address, funcNext, subject).Returns(state.Next),
+		eth.CallFunc(c.address, funcHave, subject).Returns(&state.Have),
+		eth.Balance(subject, nil).Returns(&state.Balance),
+	); err != nil {
+		return SubjectState{}, fmt.Errorf("read period state of %s: %w", subject.Hex(), err)
+	}
+	return state, nil
+}
+
+// CanPoke reports whether account may call poke, i.e. is owner or poker.
+func (cfg Config) CanPoke(account common.Address) bool {
+	return account == cfg.Owner || account == cfg.Poker
+}
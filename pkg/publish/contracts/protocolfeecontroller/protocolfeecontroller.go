@@ -22,6 +22,13 @@ const (
 //go:embed ProtocolFeeController.bin
 var bytecodeHex string
 
+// ProtocolFeeSlot is the storage slot of ProtocolFeeController.protocolFee,
+// which getProtocolFee() reports as 0 while the controller is inactive.
+// Solady's Ownable and Initializable keep their state in hashed slots, so
+// the declared variables start at slot 0: protocolFee,
+// protocolFeeRecipient, active.
+var ProtocolFeeSlot = common.BigToHash(big.NewInt(0))
+
 var funcInitialize = w3.MustNewFunc(
 	"initialize(address,uint256,address)", "",
 )
@@ -0,0 +1,186 @@
+package relativequoter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+)
+
+// PPM mirrors RelativeQuoter.PPM, the exchange rate of tokens without a
+// price index entry.
+const PPM = 1_000_000
+
+var (
+	funcPriceIndex = w3.MustNewFunc("priceIndex(address)", "uint256")
+	funcDecimals   = w3.MustNewFunc("decimals()", "uint8")
+)
+
+var ErrUnknownToken = errors.New("token not in state")
+
+var bigPPM = big.NewInt(PPM)
+
+type Client struct {
+	caller  publish.Caller
+	address common.Address
+}
+
+func NewClient(caller publish.Caller, address common.Address) *Client {
+	return &Client{caller: caller, address: address}
+}
+
+func (c *Client) Address() common.Address {
+	return c.address
+}
+
+// State is an off-chain RelativeQuoter: the priceIndex entry and decimals of
+// each token. It implements swappool.Quoter.
+type State struct {
+	PriceIndex map[common.Address]*big.Int
+	Decimals   map[common.Address]uint8
+}
+
+// Load reads priceIndex and decimals for tokens at blockNumber (nil for
+// latest) in one batch.
+func (c *Client) Load(ctx context.Context, tokens []common.Address, blockNumber *big.Int) (*State, error) {
+	rates := make([]big.Int, len(tokens))
+	decimals := make([]uint8, len(tokens))
+	calls := make([]w3types.RPCCaller, 0, 2*len(tokens))
+	for i, token := range tokens {
+		calls = append(calls,
+			eth.CallFunc(c.address, funcPriceIndex, token).AtBlock(blockNumber).Returns(&rates[i]),
+			eth.CallFunc(token, funcDecimals).AtBlock(blockNumber).Returns(&decimals[i]),
+		)
+	}
+	if err := publish.BatchCall(ctx, c.caller, calls, 0); err != nil {
+		return nil, fmt.Errorf("priceIndex / decimals: %w", err)
+	}
+
+	s := &State{
+		PriceIndex: make(map[common.Address]*big.Int, len(tokens)),
+		Decimals:   make(map[common.Address]uint8, len(tokens)),
+	}
+	for i, token := range tokens {
+		s.PriceIndex[token] = &rates[i]
+		s.Decimals[token] = decimals[i]
+	}
+	return s, nil
+}
+
+// Rate returns the exchange rate valueFor uses for token: its priceIndex
+// entry, or PPM if unset.
+func (s *State) Rate(token common.Address) (*big.Int, error) {
+	rate, ok := s.PriceIndex[token]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownToken, token.Hex())
+	}
+	if rate.Sign() > 0 {
+		return rate, nil
+	}
+	return bigPPM, nil
+}
+
+// ValueFor mirrors RelativeQuoter.valueFor: the value is first rescaled
+// between the token decimals, then converted at inRate / outRate, rounding
+// down at each step.
+func (s *State) ValueFor(outToken, inToken common.Address, value *big.Int) (*big.Int, error) {
+	inRate, outRate, dout, din, err := s.pair(outToken, inToken)
+	if err != nil {
+		return nil, err
+	}
+
+	scaled := value
+	if din != dout {
+		d, err := publish.Pow10(uint64(absDiff(din, dout)))
+		if err != nil {
+			return nil, err
+		}
+		if din > dout {
+			scaled = new(big.Int).Div(value, d)
+		} else if scaled, err = publish.CheckedMul(value, d); err != nil {
+			return nil, err
+		}
+	}
+
+	product, err := publish.CheckedMul(scaled, inRate)
+	if err != nil {
+		return nil, err
+	}
+	return product.Div(product, outRate), nil
+}
+
+// ReverseValueFor mirrors RelativeQuoter.reverseValueFor: the inverse of
+// ValueFor with ceiling division.
+func (s *State) ReverseValueFor(outToken, inToken common.Address, value *big.Int) (*big.Int, error) {
+	inRate, outRate, dout, din, err := s.pair(outToken, inToken)
+	if err != nil {
+		return nil, err
+	}
+	if din == dout {
+		return reverseOutput(value, inRate, outRate)
+	}
+
+	d, err := publish.Pow10(uint64(absDiff(din, dout)))
+	if err != nil {
+		return nil, err
+	}
+	if din > dout {
+		scaled, err := publish.CheckedMul(value, d)
+		if err != nil {
+			return nil, err
+		}
+		return reverseOutput(scaled, inRate, outRate)
+	}
+	out, err := reverseOutput(value, inRate, outRate)
+	if err != nil {
+		return nil, err
+	}
+	if out, err = publish.CheckedAdd(out, d); err != nil {
+		return nil, err
+	}
+	return out.Div(out.Sub(out, big.NewInt(1)), d), nil
+}
+
+// reverseOutput is ceil(value * outRate / inRate).
+func reverseOutput(value, inRate, outRate *big.Int) (*big.Int, error) {
+	product, err := publish.CheckedMul(value, outRate)
+	if err != nil {
+		return nil, err
+	}
+	if product, err = publish.CheckedAdd(product, inRate); err != nil {
+		return nil, err
+	}
+	return product.Div(product.Sub(product, big.NewInt(1)), inRate), nil
+}
+
+func (s *State) pair(outToken, inToken common.Address) (inRate, outRate *big.Int, dout, din uint8, err error) {
+	if inRate, err = s.Rate(inToken); err != nil {
+		return nil, nil, 0, 0, err
+	}
+	if outRate, err = s.Rate(outToken); err != nil {
+		return nil, nil, 0, 0, err
+	}
+	dout, ok := s.Decimals[outToken]
+	if !ok {
+		return nil, nil, 0, 0, fmt.Errorf("%w: %s", ErrUnknownToken, outToken.Hex())
+	}
+	din, ok = s.Decimals[inToken]
+	if !ok {
+		return nil, nil, 0, 0, fmt.Errorf("%w: %s", ErrUnknownToken, inToken.Hex())
+	}
+	return inRate, outRate, dout, din, nil
+}
+
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
@@ -0,0 +1,84 @@
+package relativequoter_test
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lmittmann/w3"
+
+	"github.com/cosmo-local-credit/protocol/pkg/internal/vmtest"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/relativequoter"
+)
+
+var funcSetPriceIndexValue = w3.MustNewFunc("setPriceIndexValue(address,uint256)", "uint256")
+
+func TestQuoteMatchesContract(t *testing.T) {
+	e := vmtest.New(t)
+	init, err := relativequoter.EncodeInit(relativequoter.InitArgs{Owner: vmtest.Owner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	quoter := e.Proxy(relativequoter.Bytecode(), init)
+
+	// Each token's decimals and priceIndex entry; nil leaves the entry
+	// unset so the PPM default applies. 2^200 overflows the rate product
+	// for all but the smallest amounts.
+	tokens := []struct {
+		decimals int64
+		rate     *big.Int
+	}{
+		{0, big.NewInt(1_234_567)},
+		{6, nil},
+		{6, big.NewInt(1)},
+		{18, big.NewInt(3)},
+		{18, big.NewInt(999_999)},
+		{77, nil},
+		{0, new(big.Int).Lsh(big.NewInt(1), 200)},
+	}
+	addrs := make([]common.Address, len(tokens))
+	for i, tok := range tokens {
+		addrs[i] = common.BigToAddress(big.NewInt(0x7000 + int64(i)))
+		e.SetReturnData(addrs[i], vmtest.Word(big.NewInt(tok.decimals)))
+		if tok.rate != nil {
+			e.Send(quoter, funcSetPriceIndexValue, []any{addrs[i], tok.rate})
+		}
+	}
+
+	caller := e.Caller()
+	s, err := relativequoter.NewClient(caller, quoter).Load(context.Background(), addrs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caller.Requests != 1 {
+		t.Errorf("Load made %d requests, want 1", caller.Requests)
+	}
+	if n := e.CompareQuoter(t, quoter, s, addrs, vmtest.Amounts()); n == 0 {
+		t.Fatal("no successful quotes")
+	}
+}
+
+func TestQuoteRounding(t *testing.T) {
+	// 1 of a token at rate 3 is worth 3/PPM of one at the default rate.
+	cheap, unit := common.Address{1}, common.Address{2}
+	s := &relativequoter.State{
+		PriceIndex: map[common.Address]*big.Int{cheap: big.NewInt(3), unit: new(big.Int)},
+		Decimals:   map[common.Address]uint8{cheap: 6, unit: 6},
+	}
+
+	got, err := s.ValueFor(unit, cheap, big.NewInt(333_333))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Sign() != 0 {
+		t.Errorf("ValueFor rounds down: got %s, want 0", got)
+	}
+	got, err = s.ReverseValueFor(unit, cheap, big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Int64() != 333_334 {
+		t.Errorf("ReverseValueFor rounds up: got %s, want 333334", got)
+	}
+}
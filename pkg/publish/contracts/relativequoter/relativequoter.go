@@ -25,6 +25,12 @@ var funcInitialize = w3.MustNewFunc(
 	"initialize(address)", "",
 )
 
+// PriceIndexUpdatedEventSignature is the event RelativeQuoter emits when a
+// token's exchange rate changes.
+const PriceIndexUpdatedEventSignature = "PriceIndexUpdated(address indexed tokenAddress, uint256 exchangeRate)"
+
+var EventPriceIndexUpdated = w3.MustNewEvent(PriceIndexUpdatedEventSignature)
+
 type InitArgs struct {
 	Owner common.Address
 }
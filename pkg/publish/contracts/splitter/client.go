@@ -0,0 +1,336 @@
+package splitter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+)
+
+// PercentageScale mirrors Splitter.PERCENTAGE_SCALE.
+const PercentageScale = 1_000_000
+
+var (
+	funcGetHash         = w3.MustNewFunc("getHash()", "bytes32")
+	funcUpdateSplit     = w3.MustNewFunc("updateSplit(address[],uint32[])", "")
+	funcDistributeETH   = w3.MustNewFunc("distributeETH(address[],uint32[])", "")
+	funcDistributeERC20 = w3.MustNewFunc("distributeERC20(address,address[],uint32[])", "")
+	funcBalanceOf       = w3.MustNewFunc("balanceOf(address)", "uint256")
+)
+
+var (
+	ErrSplitNotFound = errors.New("no candidate split matches getHash()")
+	ErrHashMismatch  = errors.New("split does not match getHash()")
+)
+
+// Split is the accounts / allocations pair that distributeETH and
+// distributeERC20 must be called with.
+type Split struct {
+	Accounts           []common.Address
+	PercentAllocations []uint32
+}
+
+// Payout is one recipient's share of a distribution.
+type Payout struct {
+	Account common.Address
+	Amount  *big.Int
+}
+
+// AssetPreview is the expected distribution of one asset. Token is the zero
+// address for ETH.
+type AssetPreview struct {
+	Token   common.Address
+	Balance *big.Int
+	Payouts []Payout
+}
+
+// Distribution is the outcome of a single distribute transaction. TxHash is
+// zero if the distribution was skipped because the balance was zero.
+type Distribution struct {
+	Token  common.Address
+	TxHash common.Hash
+}
+
+type Client struct {
+	caller  publish.Caller
+	address common.Address
+}
+
+func NewClient(caller publish.Caller, address common.Address) *Client {
+	return &Client{caller: caller, address: address}
+}
+
+func (c *Client) Address() common.Address {
+	return c.address
+}
+
+// Validate applies the same checks as Splitter._validateSplit.
+func (s Split) Validate() error {
+	if len(s.Accounts) < 2 {
+		return errors.New("too few accounts")
+	}
+	if len(s.Accounts) != len(s.PercentAllocations) {
+		return errors.New("accounts and allocations length mismatch")
+	}
+
+	var sum uint64
+	seen := make(map[common.Address]struct{}, len(s.Accounts))
+	for i, account := range s.Accounts {
+		if s.PercentAllocations[i] == 0 {
+			return fmt.Errorf("allocation for %s must be positive", account.Hex())
+		}
+		sum += uint64(s.PercentAllocations[i])
+		if _, ok := seen[account]; ok {
+			return fmt.Errorf("duplicate account %s", account.Hex())
+		}
+		seen[account] = struct{}{}
+	}
+	if sum != PercentageScale {
+		return fmt.Errorf("allocations sum to %d, want %d", sum, PercentageScale)
+	}
+	return nil
+}
+
+// Hash returns keccak256(abi.encodePacked(accounts, percentAllocations)).
+// Packed array elements are padded to 32 bytes each.
+func (s Split) Hash() common.Hash {
+	buf := make([]byte, 0, 32*(len(s.Accounts)+len(s.PercentAllocations)))
+	for _, account := range s.Accounts {
+		buf = append(buf, common.LeftPadBytes(account.Bytes(), 32)...)
+	}
+	for _, alloc := range s.PercentAllocations {
+		buf = append(buf, common.LeftPadBytes(new(big.Int).SetUint64(uint64(alloc)).Bytes(), 32)...)
+	}
+	return crypto.Keccak256Hash(buf)
+}
+
+// Payouts computes each recipient's share of amount. All but the last account
+// receive amount * allocation / PercentageScale (rounded down); the last
+// account receives the remainder.
+func (s Split) Payouts(amount *big.Int) []Payout {
+	payouts := make([]Payout, len(s.Accounts))
+	if len(s.Accounts) == 0 {
+		return payouts
+	}
+
+	running := new(big.Int)
+	last := len(s.Accounts) - 1
+	for i := 0; i < last; i++ {
+		share := new(big.Int).Mul(amount, new(big.Int).SetUint64(uint64(s.PercentAllocations[i])))
+		share.Div(share, big.NewInt(PercentageScale))
+		running.Add(running, share)
+		payouts[i] = Payout{Account: s.Accounts[i], Amount: share}
+	}
+	payouts[last] = Payout{Account: s.Accounts[last], Amount: new(big.Int).Sub(amount, running)}
+	return payouts
+}
+
+func (c *Client) Hash(ctx context.Context) (common.Hash, error) {
+	var hash common.Hash
+	if err := c.caller.CallCtx(ctx, eth.CallFunc(c.address, funcGetHash).Returns(&hash)); err != nil {
+		return common.Hash{}, fmt.Errorf("get hash: %w", err)
+	}
+	return hash, nil
+}
+
+// Verify checks the split against the validation rules and the on-chain hash.
+func (c *Client) Verify(ctx context.Context, split Split) error {
+	if err := split.Validate(); err != nil {
+		return err
+	}
+	hash, err := c.Hash(ctx)
+	if err != nil {
+		return err
+	}
+	if hash != split.Hash() {
+		return ErrHashMismatch
+	}
+	return nil
+}
+
+// InitialSplit recovers the split passed to initialize() from the factory
+// transaction that created this proxy.
+func (c *Client) InitialSplit(ctx context.Context, factory common.Address, fromBlock *big.Int) (Split, error) {
+	initData, err := publish.ProxyInitData(ctx, c.caller, factory, c.address, fromBlock)
+	if err != nil {
+		return Split{}, err
+	}
+
+	var (
+		owner common.Address
+		split Split
+	)
+	if err := funcInitialize.DecodeArgs(initData, &owner, &split.Accounts, &split.PercentAllocations); err != nil {
+		return Split{}, fmt.Errorf("decode initialize: %w", err)
+	}
+	return split, nil
+}
+
+// SplitFromTx decodes the split from an updateSplit transaction sent directly
+// to this splitter.
+func (c *Client) SplitFromTx(ctx context.Context, txHash common.Hash) (Split, error) {
+	tx, err := c.transaction(ctx, txHash)
+	if err != nil {
+		return Split{}, err
+	}
+	if tx.To() == nil || *tx.To() != c.address {
+		return Split{}, fmt.Errorf("tx %s was not sent to %s", txHash.Hex(), c.address.Hex())
+	}
+
+	var split Split
+	if err := funcUpdateSplit.DecodeArgs(tx.Data(), &split.Accounts, &split.PercentAllocations); err != nil {
+		return Split{}, fmt.Errorf("decode updateSplit in tx %s: %w", txHash.Hex(), err)
+	}
+	return split, nil
+}
+
+// Recover reconstructs the active split. Splitter emits no events, so the
+// updateSplit transactions must be supplied by the caller, oldest first; they
+// are tried newest first, followed by the initialize calldata. The first
+// candidate whose hash matches getHash() is returned.
+func (c *Client) Recover(ctx context.Context, factory common.Address, fromBlock *big.Int, updateTxs []common.Hash) (Split, error) {
+	hash, err := c.Hash(ctx)
+	if err != nil {
+		return Split{}, err
+	}
+
+	for i := len(updateTxs) - 1; i >= 0; i-- {
+		split, err := c.SplitFromTx(ctx, updateTxs[i])
+		if err != nil {
+			return Split{}, err
+		}
+		if split.Hash() == hash {
+			return split, nil
+		}
+	}
+
+	split, err := c.InitialSplit(ctx, factory, fromBlock)
+	if err != nil {
+		return Split{}, err
+	}
+	if split.Hash() == hash {
+		return split, nil
+	}
+	return Split{}, ErrSplitNotFound
+}
+
+// Preview reads the splitter's ETH balance and the balance of each token and
+// returns the payouts a distribution would make right now.
+func (c *Client) Preview(ctx context.Context, split Split, tokens []common.Address) ([]AssetPreview, error) {
+	balances, err := c.balances(ctx, tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	previews := make([]AssetPreview, len(balances))
+	for i, balance := range balances {
+		var token common.Address
+		if i > 0 {
+			token = tokens[i-1]
+		}
+		previews[i] = AssetPreview{
+			Token:   token,
+			Balance: balance,
+			Payouts: split.Payouts(balance),
+		}
+	}
+	return previews, nil
+}
+
+func (c *Client) DistributeETH(ctx context.Context, d *publish.Deployer, split Split) (common.Hash, error) {
+	calldata, err := funcDistributeETH.EncodeArgs(split.Accounts, split.PercentAllocations)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("encode distributeETH: %w", err)
+	}
+	return d.Transact(ctx, c.address, nil, calldata, 0)
+}
+
+func (c *Client) DistributeERC20(ctx context.Context, d *publish.Deployer, token common.Address, split Split) (common.Hash, error) {
+	calldata, err := funcDistributeERC20.EncodeArgs(token, split.Accounts, split.PercentAllocations)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("encode distributeERC20: %w", err)
+	}
+	return d.Transact(ctx, c.address, nil, calldata, 0)
+}
+
+// Distribute verifies the split against getHash() and then distributes ETH
+// followed by each token, waiting for every receipt. Assets with a zero
+// balance are skipped. On failure the distributions completed so far are
+// returned alongside the error.
+func (c *Client) Distribute(ctx context.Context, d *publish.Deployer, split Split, tokens []common.Address) ([]Distribution, error) {
+	if err := c.Verify(ctx, split); err != nil {
+		return nil, err
+	}
+
+	balances, err := c.balances(ctx, tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Distribution
+	for i, balance := range balances {
+		var (
+			token  common.Address
+			txHash common.Hash
+		)
+		if i == 0 {
+			if balance.Sign() == 0 {
+				done = append(done, Distribution{})
+				continue
+			}
+			txHash, err = c.DistributeETH(ctx, d, split)
+		} else {
+			token = tokens[i-1]
+			if balance.Sign() == 0 {
+				done = append(done, Distribution{Token: token})
+				continue
+			}
+			txHash, err = c.DistributeERC20(ctx, d, token, split)
+		}
+		if err != nil {
+			return done, fmt.Errorf("distribute %s: %w", token.Hex(), err)
+		}
+
+		receipt, err := d.WaitForReceipt(ctx, txHash)
+		if err != nil {
+			return done, fmt.Errorf("wait for distribute %s: %w", token.Hex(), err)
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			return done, fmt.Errorf("distribute %s reverted in tx %s", token.Hex(), txHash.Hex())
+		}
+		done = append(done, Distribution{Token: token, TxHash: txHash})
+	}
+	return done, nil
+}
+
+// balances returns the ETH balance followed by the balance of each token.
+func (c *Client) balances(ctx context.Context, tokens []common.Address) ([]*big.Int, error) {
+	balances := make([]*big.Int, len(tokens)+1)
+	calls := make([]w3types.RPCCaller, 0, len(tokens)+1)
+	calls = append(calls, eth.Balance(c.address, nil).Returns(&balances[0]))
+	for i, token := range tokens {
+		balances[i+1] = new(big.Int)
+		calls = append(calls, eth.CallFunc(token, funcBalanceOf, c.address).Returns(balances[i+1]))
+	}
+	if err := c.caller.CallCtx(ctx, calls...); err != nil {
+		return nil, fmt.Errorf("get balances: %w", err)
+	}
+	return balances, nil
+}
+
+func (c *Client) transaction(ctx context.Context, txHash common.Hash) (*types.Transaction, error) {
+	var tx *types.Transaction
+	if err := c.caller.CallCtx(ctx, eth.Tx(txHash).Returns(&tx)); err != nil {
+		return nil, fmt.Errorf("get tx %s: %w", txHash.Hex(), err)
+	}
+	return tx, nil
+}
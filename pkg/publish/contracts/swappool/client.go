@@ -0,0 +1,181 @@
+package swappool
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+)
+
+var (
+	funcQuoter                = w3.MustNewFunc("quoter()", "address")
+	funcFeePolicy             = w3.MustNewFunc("feePolicy()", "address")
+	funcFeeAddress            = w3.MustNewFunc("feeAddress()", "address")
+	funcTokenRegistry         = w3.MustNewFunc("tokenRegistry()", "address")
+	funcTokenLimiter          = w3.MustNewFunc("tokenLimiter()", "address")
+	funcFeesDecoupled         = w3.MustNewFunc("feesDecoupled()", "bool")
+	funcProtocolFeeController = w3.MustNewFunc("protocolFeeController()", "address")
+	funcFees                  = w3.MustNewFunc("fees(address)", "uint256")
+	funcGetAmountOut          = w3.MustNewFunc("getAmountOut(address,address,uint256)", "uint256")
+	funcGetAmountIn           = w3.MustNewFunc("getAmountIn(address,address,uint256)", "uint256")
+
+	funcGetFee                  = w3.MustNewFunc("getFee(address,address)", "uint256")
+	funcGetProtocolFee          = w3.MustNewFunc("getProtocolFee()", "uint256")
+	funcGetProtocolFeeRecipient = w3.MustNewFunc("getProtocolFeeRecipient()", "address")
+	funcBalanceOf               = w3.MustNewFunc("balanceOf(address)", "uint256")
+	funcLimitOf                 = w3.MustNewFunc("limitOf(address,address)", "uint256")
+	funcHave                    = w3.MustNewFunc("have(address)", "bool")
+)
+
+type Client struct {
+	caller  publish.Caller
+	address common.Address
+}
+
+func NewClient(caller publish.Caller, address common.Address) *Client {
+	return &Client{caller: caller, address: address}
+}
+
+func (c *Client) Address() common.Address {
+	return c.address
+}
+
+// State reads a quote snapshot for tokens at blockNumber (nil for latest):
+// the pool configuration, protocol fee, the fee of every ordered pair of
+// tokens, and each token's balance, fees, limit and registry membership.
+// quotes must price the pool's quoter and may be nil only if the pool has
+// none.
+func (c *Client) State(ctx context.Context, tokens []common.Address, quotes Quoter, blockNumber *big.Int) (*State, error) {
+	s := &State{Quotes: quotes}
+	if err := c.caller.CallCtx(ctx,
+		eth.CallFunc(c.address, funcQuoter).AtBlock(blockNumber).Returns(&s.Quoter),
+		eth.CallFunc(c.address, funcFeePolicy).AtBlock(blockNumber).Returns(&s.FeePolicy),
+		eth.CallFunc(c.address, funcFeeAddress).AtBlock(blockNumber).Returns(&s.FeeAddress),
+		eth.CallFunc(c.address, funcTokenRegistry).AtBlock(blockNumber).Returns(&s.TokenRegistry),
+		eth.CallFunc(c.address, funcTokenLimiter).AtBlock(blockNumber).Returns(&s.TokenLimiter),
+		eth.CallFunc(c.address, funcFeesDecoupled).AtBlock(blockNumber).Returns(&s.FeesDecoupled),
+		eth.CallFunc(c.address, funcProtocolFeeController).AtBlock(blockNumber).Returns(&s.ProtocolFeeController),
+	); err != nil {
+		return nil, fmt.Errorf("get pool config: %w", err)
+	}
+	if s.Quoter != (common.Address{}) && quotes == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoQuoter, s.Quoter.Hex())
+	}
+
+	var (
+		calls       []w3types.RPCCaller
+		protocolFee big.Int
+	)
+	if s.ProtocolFeeController != (common.Address{}) {
+		calls = append(calls,
+			eth.CallFunc(s.ProtocolFeeController, funcGetProtocolFee).AtBlock(blockNumber).Returns(&protocolFee),
+			eth.CallFunc(s.ProtocolFeeController, funcGetProtocolFeeRecipient).AtBlock(blockNumber).Returns(&s.ProtocolFeeRecipient),
+		)
+	}
+
+	s.Tokens = make(map[common.Address]*TokenState, len(tokens))
+	for _, token := range tokens {
+		if _, ok := s.Tokens[token]; ok {
+			continue
+		}
+		ts := &TokenState{Balance: new(big.Int), Fees: new(big.Int)}
+		s.Tokens[token] = ts
+		calls = append(calls,
+			eth.CallFunc(token, funcBalanceOf, c.address).AtBlock(blockNumber).Returns(ts.Balance),
+			eth.CallFunc(c.address, funcFees, token).AtBlock(blockNumber).Returns(ts.Fees),
+		)
+		if s.TokenLimiter != (common.Address{}) {
+			ts.Limit = new(big.Int)
+			calls = append(calls, eth.CallFunc(s.TokenLimiter, funcLimitOf, token, c.address).AtBlock(blockNumber).Returns(ts.Limit))
+		}
+		if s.TokenRegistry != (common.Address{}) {
+			calls = append(calls, eth.CallFunc(s.TokenRegistry, funcHave, token).AtBlock(blockNumber).Returns(&ts.Registered))
+		}
+	}
+
+	s.FeePPM = make(map[Pair]uint64)
+	var (
+		pairs []Pair
+		fees  []big.Int
+	)
+	if s.FeePolicy != (common.Address{}) {
+		for in := range s.Tokens {
+			for out := range s.Tokens {
+				pairs = append(pairs, Pair{In: in, Out: out})
+			}
+		}
+		fees = make([]big.Int, len(pairs))
+		for i, pair := range pairs {
+			calls = append(calls, eth.CallFunc(s.FeePolicy, funcGetFee, pair.In, pair.Out).AtBlock(blockNumber).Returns(&fees[i]))
+		}
+	}
+
+	if err := publish.BatchCall(ctx, c.caller, calls, 0); err != nil {
+		return nil, fmt.Errorf("get pool state: %w", err)
+	}
+
+	s.ProtocolFeePPM = protocolFee.Uint64()
+	for i, pair := range pairs {
+		s.FeePPM[pair] = fees[i].Uint64()
+	}
+	return s, nil
+}
+
+// AmountOut calls getAmountOut on chain at blockNumber (nil for latest).
+func (c *Client) AmountOut(ctx context.Context, outToken, inToken common.Address, amountIn, blockNumber *big.Int) (*big.Int, error) {
+	amountOut := new(big.Int)
+	if err := c.caller.CallCtx(ctx, eth.CallFunc(c.address, funcGetAmountOut, outToken, inToken, amountIn).AtBlock(blockNumber).Returns(amountOut)); err != nil {
+		return nil, fmt.Errorf("getAmountOut: %w", err)
+	}
+	return amountOut, nil
+}
+
+// AmountIn calls getAmountIn on chain at blockNumber (nil for latest).
+func (c *Client) AmountIn(ctx context.Context, outToken, inToken common.Address, amountOut, blockNumber *big.Int) (*big.Int, error) {
+	amountIn := new(big.Int)
+	if err := c.caller.CallCtx(ctx, eth.CallFunc(c.address, funcGetAmountIn, outToken, inToken, amountOut).AtBlock(blockNumber).Returns(amountIn)); err != nil {
+		return nil, fmt.Errorf("getAmountIn: %w", err)
+	}
+	return amountIn, nil
+}
+
+// Check compares s against the pool's own getAmountOut and getAmountIn for
+// each amount, at the block s was read at. It returns an error describing
+// the first disagreement, or a failure on either side that the other side
+// did not share.
+func (c *Client) Check(ctx context.Context, s *State, outToken, inToken common.Address, amounts []*big.Int, blockNumber *big.Int) error {
+	for _, amount := range amounts {
+		q, err := s.AmountOut(outToken, inToken, amount)
+		onChain, callErr := c.AmountOut(ctx, outToken, inToken, amount, blockNumber)
+		if err := compare("getAmountOut", amount, q.AmountOut, err, onChain, callErr); err != nil {
+			return err
+		}
+
+		in, err := s.AmountIn(outToken, inToken, amount)
+		onChain, callErr = c.AmountIn(ctx, outToken, inToken, amount, blockNumber)
+		if err := compare("getAmountIn", amount, in, err, onChain, callErr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func compare(method string, amount, local *big.Int, localErr error, onChain *big.Int, callErr error) error {
+	switch {
+	case localErr != nil && callErr != nil:
+		return nil
+	case localErr != nil:
+		return fmt.Errorf("%s(%s): local error %v, on chain %s", method, amount, localErr, onChain)
+	case callErr != nil:
+		return fmt.Errorf("%s(%s): local %s, on chain error %v", method, amount, local, callErr)
+	case local.Cmp(onChain) != 0:
+		return fmt.Errorf("%s(%s): local %s, on chain %s", method, amount, local, onChain)
+	}
+	return nil
+}
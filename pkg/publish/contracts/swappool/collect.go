@@ -0,0 +1,277 @@
+package swappool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/splitter"
+)
+
+var funcWithdraw = w3.MustNewFunc("withdraw(address)", "uint256")
+
+var ErrNotOwner = errors.New("sender is not the pool owner")
+
+// CollectorConfig sets when fees are collected. Thresholds are amounts in
+// whole token units, e.g. "250.5", that a token's fees must reach before
+// they are withdrawn. Tokens without an entry use DefaultThreshold and are
+// left alone if it is empty.
+//
+// Splits maps fee addresses that are Splitters to their active split. After
+// collecting into such an address, the collected tokens are distributed.
+// Splitter emits no events, so the split must be supplied; see
+// splitter.Client.Recover.
+//
+// Each collection is written to Log, if set, as one line of JSON once its
+// distribution, if any, has been attempted.
+type CollectorConfig struct {
+	Thresholds       map[common.Address]string
+	DefaultThreshold string
+	Splits           map[common.Address]splitter.Split
+	Log              io.Writer
+}
+
+// Collection is one withdraw(token) by the collector. DistributionTx is set
+// if the fee address is a configured Splitter and the token was distributed.
+type Collection struct {
+	Time           time.Time      `json:"time"`
+	Pool           common.Address `json:"pool"`
+	Token          common.Address `json:"token"`
+	Symbol         string         `json:"symbol"`
+	FeeAddress     common.Address `json:"fee_address"`
+	Amount         *big.Int       `json:"amount"`
+	TxHash         common.Hash    `json:"tx_hash"`
+	Block          uint64         `json:"block"`
+	DistributionTx common.Hash    `json:"distribution_tx,omitzero"`
+}
+
+// Collector withdraws the fees of a set of pools to their fee address once
+// they cross a threshold. The sender must own the pools, since withdraw is
+// onlyOwner.
+type Collector struct {
+	caller publish.Caller
+	d      *publish.Deployer
+	pools  []common.Address
+	cfg    CollectorConfig
+	log    *json.Encoder
+}
+
+func NewCollector(caller publish.Caller, d *publish.Deployer, pools []common.Address, cfg CollectorConfig) *Collector {
+	c := &Collector{caller: caller, d: d, pools: pools, cfg: cfg}
+	if cfg.Log != nil {
+		c.log = json.NewEncoder(cfg.Log)
+	}
+	return c
+}
+
+// Collect checks every pool once and withdraws each token whose fees have
+// reached its threshold. Pools without a token registry, and pools whose
+// feeAddress is zero, are skipped; withdraw would revert with
+// InvalidFeeAddress for the latter. A failing pool or withdraw does not
+// stop the others; the errors are joined.
+func (c *Collector) Collect(ctx context.Context) ([]Collection, error) {
+	var (
+		collections []Collection
+		errs        []error
+	)
+	for _, pool := range c.pools {
+		done, err := c.collectPool(ctx, pool)
+		collections = append(collections, done...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("pool %s: %w", pool.Hex(), err))
+		}
+	}
+	return collections, errors.Join(errs...)
+}
+
+// Run collects every interval until ctx is cancelled. Errors are passed to
+// onErr, if set, and retried on the next tick.
+func (c *Collector) Run(ctx context.Context, interval time.Duration, onErr func(error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := c.Collect(ctx); err != nil && onErr != nil {
+			onErr(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Collector) collectPool(ctx context.Context, pool common.Address) ([]Collection, error) {
+	var owner, feeAddress, registry common.Address
+	if err := c.caller.CallCtx(ctx,
+		eth.CallFunc(pool, funcOwner).Returns(&owner),
+		eth.CallFunc(pool, funcFeeAddress).Returns(&feeAddress),
+		eth.CallFunc(pool, funcTokenRegistry).Returns(&registry),
+	); err != nil {
+		return nil, fmt.Errorf("get pool config: %w", err)
+	}
+	if feeAddress == (common.Address{}) || registry == (common.Address{}) {
+		return nil, nil
+	}
+	if owner != c.d.Address() {
+		return nil, fmt.Errorf("%w: owner is %s", ErrNotOwner, owner.Hex())
+	}
+
+	tokens, err := NewClient(c.caller, pool).registryEntries(ctx, registry, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		collections []Collection
+		errs        []error
+	)
+	due, err := c.due(ctx, pool, tokens)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	defer func() {
+		for _, col := range collections {
+			c.write(col)
+		}
+	}()
+	// A failed withdraw leaves the token for the next run; the others are
+	// still collected and distributed. A withdraw that was mined but whose
+	// Collect event could not be read still moved the fees, so it is kept.
+	for _, col := range due {
+		col.FeeAddress = feeAddress
+		if err := c.withdraw(ctx, &col); err != nil {
+			errs = append(errs, fmt.Errorf("withdraw %s: %w", col.Symbol, err))
+			if col.Block == 0 {
+				continue
+			}
+		}
+		collections = append(collections, col)
+	}
+
+	split, ok := c.cfg.Splits[feeAddress]
+	if !ok || len(collections) == 0 {
+		return collections, errors.Join(errs...)
+	}
+	collected := make([]common.Address, len(collections))
+	for i, col := range collections {
+		collected[i] = col.Token
+	}
+	distributions, err := splitter.NewClient(c.caller, feeAddress).Distribute(ctx, c.d, split, collected)
+	for _, d := range distributions {
+		for i := range collections {
+			if collections[i].Token == d.Token && d.TxHash != (common.Hash{}) {
+				collections[i].DistributionTx = d.TxHash
+			}
+		}
+	}
+	if err != nil {
+		errs = append(errs, fmt.Errorf("distribute to splitter %s: %w", feeAddress.Hex(), err))
+	}
+	return collections, errors.Join(errs...)
+}
+
+// due returns a collection for each token whose fees have reached its
+// threshold, with Amount set to the fees. Tokens whose fees, decimals() or
+// symbol() cannot be read, or whose threshold is invalid, are left out and
+// reported in the error.
+func (c *Collector) due(ctx context.Context, pool common.Address, tokens []common.Address) ([]Collection, error) {
+	var (
+		fees     = make([]*big.Int, len(tokens))
+		decimals = make([]uint8, len(tokens))
+		symbols  = make([]string, len(tokens))
+		calls    = make([]w3types.RPCCaller, 0, 3*len(tokens))
+	)
+	for i, token := range tokens {
+		fees[i] = new(big.Int)
+		calls = append(calls,
+			eth.CallFunc(pool, funcFees, token).Returns(fees[i]),
+			eth.CallFunc(token, funcDecimals).Returns(&decimals[i]),
+			eth.CallFunc(token, funcSymbol).Returns(&symbols[i]),
+		)
+	}
+	callErrs, err := publish.BatchCallEach(ctx, c.caller, calls, 0)
+	if err != nil {
+		return nil, fmt.Errorf("get fees: %w", err)
+	}
+
+	var (
+		due  []Collection
+		errs []error
+	)
+	for i, token := range tokens {
+		if err := errors.Join(callErrs[3*i : 3*i+3]...); err != nil {
+			errs = append(errs, fmt.Errorf("token %s: %w", token.Hex(), err))
+			continue
+		}
+		threshold, ok := c.cfg.Thresholds[token]
+		if !ok {
+			threshold = c.cfg.DefaultThreshold
+		}
+		if threshold == "" || fees[i].Sign() == 0 {
+			continue
+		}
+		minFees, err := publish.ParseUnits(threshold, decimals[i])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("threshold for %s: %w", symbols[i], err))
+			continue
+		}
+		if fees[i].Cmp(minFees) >= 0 {
+			due = append(due, Collection{Pool: pool, Token: token, Symbol: symbols[i], Amount: fees[i]})
+		}
+	}
+	return due, errors.Join(errs...)
+}
+
+// withdraw sends withdraw(token) and fills in the receipt details and the
+// amount from the pool's Collect event.
+func (c *Collector) withdraw(ctx context.Context, col *Collection) error {
+	calldata, err := funcWithdraw.EncodeArgs(col.Token)
+	if err != nil {
+		return fmt.Errorf("encode withdraw: %w", err)
+	}
+	if col.TxHash, err = c.d.Transact(ctx, col.Pool, nil, calldata, 0); err != nil {
+		return err
+	}
+	receipt, err := c.d.WaitForReceipt(ctx, col.TxHash)
+	if err != nil {
+		return fmt.Errorf("wait for withdraw: %w", err)
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return fmt.Errorf("withdraw reverted in tx %s", col.TxHash.Hex())
+	}
+	col.Time, col.Block = time.Now().UTC(), receipt.BlockNumber.Uint64()
+
+	for _, log := range receipt.Logs {
+		if log.Address != col.Pool || len(log.Topics) == 0 || log.Topics[0] != EventCollect.Topic0 {
+			continue
+		}
+		var feeAddress, token common.Address
+		amount := new(big.Int)
+		if err := EventCollect.DecodeArgs(log, &feeAddress, &token, amount); err != nil {
+			return fmt.Errorf("decode Collect: %w", err)
+		}
+		col.FeeAddress, col.Amount = feeAddress, amount
+		return nil
+	}
+	return fmt.Errorf("no Collect event in tx %s", col.TxHash.Hex())
+}
+
+func (c *Collector) write(col Collection) {
+	if c.log != nil {
+		c.log.Encode(col)
+	}
+}
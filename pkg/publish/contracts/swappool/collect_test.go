@@ -0,0 +1,138 @@
+package swappool_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/internal/vmtest"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/accountsindex"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/feepolicy"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/giftabletoken"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/swappool"
+)
+
+var (
+	funcAdd      = w3.MustNewFunc("add(address)", "bool")
+	funcDecimals = w3.MustNewFunc("decimals()", "uint8")
+	funcFees     = w3.MustNewFunc("fees(address)", "uint256")
+)
+
+func TestCollect(t *testing.T) {
+	feeAddress := common.Address{0x77}
+	tests := []struct {
+		name       string
+		thresholds map[string]string
+		// failDecimals fails decimals() of token A.
+		failDecimals bool
+		collected    []string
+		wantErr      string
+	}{
+		{name: "all due", collected: []string{"A", "B"}},
+		{name: "below threshold", thresholds: map[string]string{"A": "100"}, collected: []string{"B"}},
+		{name: "decimals fails", failDecimals: true, collected: []string{"B"}, wantErr: "execution reverted"},
+		{name: "invalid threshold", thresholds: map[string]string{"A": "1e1"}, collected: []string{"B"}, wantErr: "threshold for A"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := vmtest.New(t)
+			d := e.Deployer(nil)
+			e.AutoMine()
+
+			init, err := accountsindex.EncodeInit(accountsindex.InitArgs{Owner: vmtest.Owner})
+			if err != nil {
+				t.Fatal(err)
+			}
+			registry := e.Proxy(accountsindex.Bytecode(), init)
+			if init, err = feepolicy.EncodeInit(feepolicy.InitArgs{Owner: vmtest.Owner, DefaultFee: big.NewInt(30_000)}); err != nil {
+				t.Fatal(err)
+			}
+			policy := e.Proxy(feepolicy.Bytecode(), init)
+			if init, err = swappool.EncodeInit(swappool.InitArgs{
+				Name:          "Pool",
+				Symbol:        "POOL",
+				Decimals:      6,
+				Owner:         d.Address(),
+				FeePolicy:     policy,
+				FeeAddress:    feeAddress,
+				TokenRegistry: registry,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			pool := e.Proxy(swappool.Bytecode(), init)
+
+			symbols := make(map[common.Address]string)
+			tokens := make(map[string]common.Address)
+			for _, symbol := range []string{"A", "B"} {
+				init, err := giftabletoken.EncodeInit(giftabletoken.InitArgs{Name: symbol, Symbol: symbol, Decimals: 6, Owner: vmtest.Owner, ExpiresAt: new(big.Int)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				token := e.Proxy(giftabletoken.Bytecode(), init)
+				tokens[symbol], symbols[token] = token, symbol
+				e.Send(registry, funcAdd, []any{token}, new(bool))
+				e.Send(token, funcMintTo, []any{vmtest.Owner, big.NewInt(10_000_000_000)})
+				e.Send(token, funcApprove, []any{pool, big.NewInt(10_000_000_000)}, new(bool))
+				e.Send(pool, funcDeposit, []any{token, big.NewInt(5_000_000_000)})
+			}
+			// 3% of 1000 leaves 30 of each token in fees.
+			e.Send(pool, funcWithdraw, []any{tokens["A"], tokens["B"], big.NewInt(1_000_000_000), vmtest.Owner})
+			e.Send(pool, funcWithdraw, []any{tokens["B"], tokens["A"], big.NewInt(1_000_000_000), vmtest.Owner})
+
+			caller := e.Caller()
+			if tt.failDecimals {
+				caller.Hook = func(method string, args []any) error {
+					if msg, ok := args[0].(*w3types.Message); ok && method == "eth_call" &&
+						*msg.To == tokens["A"] && bytes.HasPrefix(msg.Input, funcDecimals.Selector[:]) {
+						return errors.New("execution reverted")
+					}
+					return nil
+				}
+			}
+			thresholds := make(map[common.Address]string)
+			for symbol, threshold := range tt.thresholds {
+				thresholds[tokens[symbol]] = threshold
+			}
+			c := swappool.NewCollector(caller, d, []common.Address{pool}, swappool.CollectorConfig{Thresholds: thresholds, DefaultThreshold: "10"})
+
+			collections, err := c.Collect(context.Background())
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err %v, want %q", err, tt.wantErr)
+			}
+			var collected []string
+			for _, col := range collections {
+				collected = append(collected, col.Symbol)
+				if col.Amount.Cmp(big.NewInt(30_000_000)) != 0 || col.FeeAddress != feeAddress || col.Block == 0 {
+					t.Errorf("collection %+v", col)
+				}
+			}
+			if strings.Join(collected, " ") != strings.Join(tt.collected, " ") {
+				t.Errorf("collected %v, want %v", collected, tt.collected)
+			}
+
+			for symbol, token := range tokens {
+				fees, paid := new(big.Int), new(big.Int)
+				if err := e.Call(pool, funcFees, []any{token}, fees); err != nil {
+					t.Fatal(err)
+				}
+				if err := e.Call(token, funcBalanceOf, []any{feeAddress}, paid); err != nil {
+					t.Fatal(err)
+				}
+				want := int64(30_000_000)
+				if !strings.Contains(strings.Join(tt.collected, " "), symbol) {
+					want = 0
+				}
+				if paid.Int64() != want || fees.Int64() != 30_000_000-want {
+					t.Errorf("%s: fee address holds %s, pool fees %s", symbols[token], paid, fees)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package swappool
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+)
+
+// PPM and DefaultFeePPM mirror the SwapPool constants of the same name.
+// DefaultFeePPM is the 1% floor the protocol fee is computed against.
+const (
+	PPM           = 1_000_000
+	DefaultFeePPM = 10_000
+)
+
+var (
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	ErrLimitExceeded       = errors.New("limit exceeded")
+	ErrUnauthorizedToken   = errors.New("unauthorized token")
+	ErrUnknownToken        = errors.New("token not in state")
+	ErrUnknownPair         = errors.New("pair fee not in state")
+	ErrNoQuoter            = errors.New("pool has a quoter but state has none")
+)
+
+var (
+	bigPPM        = big.NewInt(PPM)
+	bigDefaultFee = big.NewInt(DefaultFeePPM)
+)
+
+// Quoter is the off-chain counterpart of IQuoter. Implementations must
+// return exactly what the on-chain quoter would for the same state.
+type Quoter interface {
+	ValueFor(outToken, inToken common.Address, value *big.Int) (*big.Int, error)
+	ReverseValueFor(outToken, inToken common.Address, value *big.Int) (*big.Int, error)
+}
+
+// Pair is a swap direction: In is deposited, Out is withdrawn.
+type Pair struct {
+	In  common.Address
+	Out common.Address
+}
+
+// TokenState is the per-token part of State. Limit is limitOf(token, pool)
+// and only consulted if the pool has a token limiter; Registered is
+// have(token) and only consulted if the pool has a token registry.
+type TokenState struct {
+	Balance    *big.Int
+	Fees       *big.Int
+	Limit      *big.Int
+	Registered bool
+}
+
+// State is a snapshot of everything SwapPool's quote and swap math reads.
+// Zero addresses have the same meaning as on chain: no quoter quotes 1:1,
+// no fee policy charges no fee, and so on.
+type State struct {
+	Quoter        common.Address
+	FeePolicy     common.Address
+	FeeAddress    common.Address
+	TokenRegistry common.Address
+	TokenLimiter  common.Address
+	FeesDecoupled bool
+
+	// ProtocolFeeController and the values it returned. ProtocolFeePPM is
+	// getProtocolFee(), which is already zero while the controller is
+	// inactive.
+	ProtocolFeeController common.Address
+	ProtocolFeePPM        uint64
+	ProtocolFeeRecipient  common.Address
+
+	// Quotes prices swaps when Quoter is set.
+	Quotes Quoter
+
+	// FeePPM holds FeePolicy.getFee(in, out) for every pair that can be
+	// quoted. It is ignored when FeePolicy is unset.
+	FeePPM map[Pair]uint64
+
+	Tokens map[common.Address]*TokenState
+}
+
+// Quote breaks one swap down the way SwapPool computes it. AmountOut is the
+// net amount sent to the recipient: Quoted - Fee - ProtocolFee.
+type Quote struct {
+	AmountIn    *big.Int
+	Quoted      *big.Int
+	Fee         *big.Int
+	ProtocolFee *big.Int
+	AmountOut   *big.Int
+}
+
+// Clone returns a deep copy of s, e.g. to simulate swaps without touching
+// the original. Quotes is shared.
+func (s *State) Clone() *State {
+	c := *s
+	c.FeePPM = make(map[Pair]uint64, len(s.FeePPM))
+	for pair, fee := range s.FeePPM {
+		c.FeePPM[pair] = fee
+	}
+	c.Tokens = make(map[common.Address]*TokenState, len(s.Tokens))
+	for token, ts := range s.Tokens {
+		t := *ts
+		t.Balance = cloneInt(ts.Balance)
+		t.Fees = cloneInt(ts.Fees)
+		t.Limit = cloneInt(ts.Limit)
+		c.Tokens[token] = &t
+	}
+	return &c
+}
+
+// FeeFor mirrors the fee policy lookup in getFee and getAmountIn.
+func (s *State) FeeFor(inToken, outToken common.Address) (uint64, error) {
+	if s.FeePolicy == (common.Address{}) {
+		return 0, nil
+	}
+	fee, ok := s.FeePPM[Pair{In: inToken, Out: outToken}]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s -> %s", ErrUnknownPair, inToken.Hex(), outToken.Hex())
+	}
+	return fee, nil
+}
+
+// EffectiveProtocolFeePPM mirrors _getProtocolFeePpm: zero if the
+// controller or recipient is unset.
+func (s *State) EffectiveProtocolFeePPM() uint64 {
+	if s.ProtocolFeeController == (common.Address{}) || s.ProtocolFeeRecipient == (common.Address{}) {
+		return 0
+	}
+	return s.ProtocolFeePPM
+}
+
+// ValueFor mirrors getQuote.
+func (s *State) ValueFor(outToken, inToken common.Address, value *big.Int) (*big.Int, error) {
+	if s.Quoter == (common.Address{}) {
+		return new(big.Int).Set(value), nil
+	}
+	if s.Quotes == nil {
+		return nil, ErrNoQuoter
+	}
+	quoted, err := s.Quotes.ValueFor(outToken, inToken, value)
+	if err != nil {
+		return nil, fmt.Errorf("valueFor: %w", err)
+	}
+	return quoted, nil
+}
+
+// AmountOut mirrors getAmountOut. Like the contract it does not check
+// liquidity; use Swap for that.
+func (s *State) AmountOut(outToken, inToken common.Address, amountIn *big.Int) (Quote, error) {
+	quoted, err := s.ValueFor(outToken, inToken, amountIn)
+	if err != nil {
+		return Quote{}, err
+	}
+	feePPM, err := s.FeeFor(inToken, outToken)
+	if err != nil {
+		return Quote{}, err
+	}
+	fee, err := mulDiv(quoted, new(big.Int).SetUint64(feePPM), bigPPM)
+	if err != nil {
+		return Quote{}, err
+	}
+	protocolFee, err := s.protocolFee(quoted, fee)
+	if err != nil {
+		return Quote{}, err
+	}
+	net, err := sub(quoted, fee, protocolFee)
+	if err != nil {
+		return Quote{}, err
+	}
+	return Quote{
+		AmountIn:    new(big.Int).Set(amountIn),
+		Quoted:      quoted,
+		Fee:         fee,
+		ProtocolFee: protocolFee,
+		AmountOut:   net,
+	}, nil
+}
+
+// AmountIn mirrors getAmountIn, including the +1 wei rounding margin.
+func (s *State) AmountIn(outToken, inToken common.Address, amountOut *big.Int) (*big.Int, error) {
+	feePPM, err := s.FeeFor(inToken, outToken)
+	if err != nil {
+		return nil, err
+	}
+	quoted, err := ReverseNetToQuoted(amountOut, feePPM, s.EffectiveProtocolFeePPM())
+	if err != nil {
+		return nil, err
+	}
+
+	amountIn := quoted
+	if s.Quoter != (common.Address{}) {
+		if s.Quotes == nil {
+			return nil, ErrNoQuoter
+		}
+		if amountIn, err = s.Quotes.ReverseValueFor(outToken, inToken, quoted); err != nil {
+			return nil, fmt.Errorf("reverseValueFor: %w", err)
+		}
+	}
+	return publish.CheckedAdd(amountIn, big.NewInt(1))
+}
+
+// Swap simulates withdraw(outToken, inToken, amountIn): the deposit checks
+// against the registry and limiter, the liquidity check, and the resulting
+// transfers. On success s is updated to the post-swap balances and fees; on
+// error s is left unchanged.
+func (s *State) Swap(outToken, inToken common.Address, amountIn *big.Int) (Quote, error) {
+	in, ok := s.Tokens[inToken]
+	if !ok {
+		return Quote{}, fmt.Errorf("%w: %s", ErrUnknownToken, inToken.Hex())
+	}
+	out, ok := s.Tokens[outToken]
+	if !ok {
+		return Quote{}, fmt.Errorf("%w: %s", ErrUnknownToken, outToken.Hex())
+	}
+
+	if s.TokenRegistry != (common.Address{}) && !in.Registered {
+		return Quote{}, ErrUnauthorizedToken
+	}
+	inBalance, err := publish.CheckedAdd(in.Balance, amountIn)
+	if err != nil {
+		return Quote{}, err
+	}
+	if s.TokenLimiter != (common.Address{}) {
+		limit := in.Limit
+		if limit == nil {
+			limit = new(big.Int)
+		}
+		if inBalance.Cmp(limit) > 0 {
+			return Quote{}, ErrLimitExceeded
+		}
+	}
+
+	q, err := s.AmountOut(outToken, inToken, amountIn)
+	if err != nil {
+		return Quote{}, err
+	}
+
+	// The deposit lands before the liquidity check, which matters when
+	// inToken == outToken.
+	outBalance := out.Balance
+	if inToken == outToken {
+		outBalance = inBalance
+	}
+	if s.available(outBalance, out.Fees).Cmp(q.Quoted) < 0 {
+		return Quote{}, ErrInsufficientBalance
+	}
+
+	in.Balance = inBalance
+	out.Balance = new(big.Int).Sub(out.Balance, q.ProtocolFee)
+	out.Balance.Sub(out.Balance, q.AmountOut)
+	if q.Fee.Sign() > 0 && s.FeeAddress != (common.Address{}) {
+		out.Fees = new(big.Int).Add(out.Fees, q.Fee)
+	}
+	return q, nil
+}
+
+// Available returns the liquidity of token that swaps may draw on: the
+// balance, less accumulated fees if fees are decoupled.
+func (s *State) Available(token common.Address) (*big.Int, error) {
+	ts, ok := s.Tokens[token]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownToken, token.Hex())
+	}
+	return s.available(ts.Balance, ts.Fees), nil
+}
+
+func (s *State) available(balance, fees *big.Int) *big.Int {
+	if !s.FeesDecoupled {
+		return new(big.Int).Set(balance)
+	}
+	if balance.Cmp(fees) > 0 {
+		return new(big.Int).Sub(balance, fees)
+	}
+	return new(big.Int)
+}
+
+// protocolFee mirrors _calcProtocolFee.
+func (s *State) protocolFee(quoted, fee *big.Int) (*big.Int, error) {
+	ppm := s.EffectiveProtocolFeePPM()
+	if ppm == 0 {
+		return new(big.Int), nil
+	}
+	assumed, err := mulDiv(quoted, bigDefaultFee, bigPPM)
+	if err != nil {
+		return nil, err
+	}
+	effective := fee
+	if assumed.Cmp(fee) > 0 {
+		effective = assumed
+	}
+	return mulDiv(effective, new(big.Int).SetUint64(ppm), bigPPM)
+}
+
+// ReverseNetToQuoted mirrors _reverseNetToQuoted: the smallest quoted value
+// whose net output, after the pool fee and the floored protocol fee, covers
+// netOutput.
+func ReverseNetToQuoted(netOutput *big.Int, feePPM, protocolFeePPM uint64) (*big.Int, error) {
+	if feePPM == 0 && protocolFeePPM == 0 {
+		return new(big.Int).Set(netOutput), nil
+	}
+
+	ppmSquared := new(big.Int).Mul(bigPPM, bigPPM)
+	fee := new(big.Int).SetUint64(feePPM)
+	protocol := new(big.Int).SetUint64(protocolFeePPM)
+
+	var deduct *big.Int
+	if feePPM >= DefaultFeePPM {
+		deduct = new(big.Int).Mul(fee, new(big.Int).Add(bigPPM, protocol))
+	} else {
+		deduct = new(big.Int).Mul(fee, bigPPM)
+		deduct.Add(deduct, new(big.Int).Mul(bigDefaultFee, protocol))
+	}
+	denominator, err := sub(ppmSquared, deduct)
+	if err != nil {
+		return nil, err
+	}
+	numerator, err := publish.CheckedMul(netOutput, ppmSquared)
+	if err != nil {
+		return nil, err
+	}
+	if numerator, err = publish.CheckedAdd(numerator, denominator); err != nil {
+		return nil, err
+	}
+	return publish.CheckedDiv(numerator.Sub(numerator, big.NewInt(1)), denominator)
+}
+
+// mulDiv computes x * y / d with Solidity's checked uint256 semantics.
+func mulDiv(x, y, d *big.Int) (*big.Int, error) {
+	product, err := publish.CheckedMul(x, y)
+	if err != nil {
+		return nil, err
+	}
+	return publish.CheckedDiv(product, d)
+}
+
+// sub computes x - ys[0] - ys[1] ..., failing on underflow.
+func sub(x *big.Int, ys ...*big.Int) (*big.Int, error) {
+	r := new(big.Int).Set(x)
+	for _, y := range ys {
+		if r.Sub(r, y).Sign() < 0 {
+			return nil, publish.ErrOverflow
+		}
+	}
+	return r, nil
+}
+
+func cloneInt(x *big.Int) *big.Int {
+	if x == nil {
+		return nil
+	}
+	return new(big.Int).Set(x)
+}
@@ -0,0 +1,150 @@
+package swappool_test
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lmittmann/w3"
+
+	"github.com/cosmo-local-credit/protocol/pkg/internal/vmtest"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/feepolicy"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/protocolfeecontroller"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/swappool"
+)
+
+var (
+	funcGetAmountOut = w3.MustNewFunc("getAmountOut(address,address,uint256)", "uint256")
+	funcGetAmountIn  = w3.MustNewFunc("getAmountIn(address,address,uint256)", "uint256")
+	funcSetPairFee   = w3.MustNewFunc("setPairFee(address,address,uint256)", "")
+	funcSetActive    = w3.MustNewFunc("setActive(bool)", "")
+)
+
+// Quoting never touches the tokens, so they need no code.
+var (
+	tokenA = common.HexToAddress("0x00000000000000000000000000000000000000aa")
+	tokenB = common.HexToAddress("0x00000000000000000000000000000000000000bb")
+)
+
+type protocolFee string
+
+const (
+	protocolFeeUnset    protocolFee = "unset"
+	protocolFeeOn       protocolFee = "on"
+	protocolFeeInactive protocolFee = "inactive"
+)
+
+func TestQuoteMatchesContract(t *testing.T) {
+	const protocolFeePPM = 2_000
+	for _, fee := range []uint64{0, 1, 3_000, 9_999, 10_000, 30_000, 500_000} {
+		for _, pf := range []protocolFee{protocolFeeUnset, protocolFeeOn, protocolFeeInactive} {
+			name := fmt.Sprintf("fee=%d/protocol=%s", fee, pf)
+			t.Run(name, func(t *testing.T) {
+				e := vmtest.New(t)
+
+				// B -> A gets a pair fee on the other side of the 1%
+				// floor where there is one.
+				pairFee := fee/2 + 7
+				if fee < swappool.DefaultFeePPM {
+					pairFee = fee + swappool.DefaultFeePPM
+				}
+				init, err := feepolicy.EncodeInit(feepolicy.InitArgs{Owner: vmtest.Owner, DefaultFee: new(big.Int).SetUint64(fee)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				policy := e.Proxy(feepolicy.Bytecode(), init)
+				e.Send(policy, funcSetPairFee, []any{tokenB, tokenA, new(big.Int).SetUint64(pairFee)})
+
+				s := &swappool.State{
+					FeePolicy: policy,
+					FeePPM: map[swappool.Pair]uint64{
+						{In: tokenA, Out: tokenB}: fee,
+						{In: tokenB, Out: tokenA}: pairFee,
+						{In: tokenA, Out: tokenA}: fee,
+					},
+				}
+				if pf != protocolFeeUnset {
+					init, err := protocolfeecontroller.EncodeInit(protocolfeecontroller.InitArgs{
+						Owner:            vmtest.Owner,
+						InitialFee:       big.NewInt(protocolFeePPM),
+						InitialRecipient: common.Address{0x99},
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+					s.ProtocolFeeController = e.Proxy(protocolfeecontroller.Bytecode(), init)
+					s.ProtocolFeeRecipient = common.Address{0x99}
+					s.ProtocolFeePPM = protocolFeePPM
+					if pf == protocolFeeInactive {
+						e.Send(s.ProtocolFeeController, funcSetActive, []any{false})
+						s.ProtocolFeePPM = 0
+					}
+				}
+
+				init, err = swappool.EncodeInit(swappool.InitArgs{
+					Name:                  "Pool",
+					Symbol:                "POOL",
+					Decimals:              6,
+					Owner:                 vmtest.Owner,
+					FeePolicy:             policy,
+					FeeAddress:            common.Address{0x77},
+					ProtocolFeeController: s.ProtocolFeeController,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				pool := e.Proxy(swappool.Bytecode(), init)
+
+				for _, pair := range []swappool.Pair{{In: tokenA, Out: tokenB}, {In: tokenB, Out: tokenA}, {In: tokenA, Out: tokenA}} {
+					for _, amount := range vmtest.Amounts() {
+						checkAmountOut(t, e, pool, s, pair, amount)
+						checkAmountIn(t, e, pool, s, pair, amount)
+					}
+				}
+			})
+		}
+	}
+}
+
+func checkAmountOut(t *testing.T, e *vmtest.Env, pool common.Address, s *swappool.State, pair swappool.Pair, amount *big.Int) {
+	t.Helper()
+	want := new(big.Int)
+	chainErr := e.Call(pool, funcGetAmountOut, []any{pair.Out, pair.In, amount}, want)
+	q, err := s.AmountOut(pair.Out, pair.In, amount)
+	switch {
+	case (chainErr == nil) != (err == nil):
+		t.Fatalf("AmountOut(%s): contract err %v, got err %v", amount, chainErr, err)
+	case err == nil && q.AmountOut.Cmp(want) != 0:
+		t.Fatalf("AmountOut(%s) = %s, contract %s", amount, q.AmountOut, want)
+	}
+}
+
+func checkAmountIn(t *testing.T, e *vmtest.Env, pool common.Address, s *swappool.State, pair swappool.Pair, amount *big.Int) {
+	t.Helper()
+	want := new(big.Int)
+	chainErr := e.Call(pool, funcGetAmountIn, []any{pair.Out, pair.In, amount}, want)
+	got, err := s.AmountIn(pair.Out, pair.In, amount)
+	switch {
+	case (chainErr == nil) != (err == nil):
+		t.Fatalf("AmountIn(%s): contract err %v, got err %v", amount, chainErr, err)
+	case err == nil && got.Cmp(want) != 0:
+		t.Fatalf("AmountIn(%s) = %s, contract %s", amount, got, want)
+	}
+	if chainErr != nil {
+		return
+	}
+
+	// Without a quoter getAmountIn is _reverseNetToQuoted + 1.
+	feePPM, err := s.FeeFor(pair.In, pair.Out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quoted, err := swappool.ReverseNetToQuoted(amount, feePPM, s.EffectiveProtocolFeePPM())
+	if err != nil {
+		t.Fatalf("ReverseNetToQuoted(%s): %v", amount, err)
+	}
+	if quoted.Add(quoted, big.NewInt(1)).Cmp(want) != 0 {
+		t.Fatalf("ReverseNetToQuoted(%s) + 1 = %s, contract %s", amount, quoted, want)
+	}
+}
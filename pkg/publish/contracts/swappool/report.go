@@ -0,0 +1,540 @@
+package swappool
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/big"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+)
+
+var (
+	eventProtocolFeeUpdated          = w3.MustNewEvent("ProtocolFeeUpdated(uint256 oldFee, uint256 newFee)")
+	eventProtocolFeeRecipientUpdated = w3.MustNewEvent("ProtocolFeeRecipientUpdated(address indexed oldRecipient, address indexed newRecipient)")
+	eventActiveStateUpdated          = w3.MustNewEvent("ActiveStateUpdated(bool active)")
+)
+
+// Period is the time bucket fee totals are aggregated over, in UTC.
+type Period uint8
+
+const (
+	PeriodNone Period = iota
+	PeriodDay
+	PeriodMonth
+)
+
+// Key returns the label of the period containing t: empty for PeriodNone,
+// 2006-01-02 for PeriodDay and 2006-01 for PeriodMonth.
+func (p Period) Key(t time.Time) string {
+	switch p {
+	case PeriodDay:
+		return t.UTC().Format(time.DateOnly)
+	case PeriodMonth:
+		return t.UTC().Format("2006-01")
+	default:
+		return ""
+	}
+}
+
+// SwapRecord is one Swap event with its fees. ProtocolFee is recomputed
+// from the ProtocolFeeController state the swap executed against, and
+// AmountOut is what the recipient was paid. Unresolved is set when the
+// controller changed both before and after the swap within its block, in
+// which case the state at the end of the block was used.
+type SwapRecord struct {
+	Pool      common.Address
+	Block     uint64
+	Time      time.Time
+	TxHash    common.Hash
+	LogIndex  uint
+	Initiator common.Address
+	TokenIn   common.Address
+	TokenOut  common.Address
+	AmountIn  *big.Int
+	Quoted    *big.Int
+	Fee       *big.Int
+
+	ProtocolFeePPM       uint64
+	ProtocolFeeRecipient common.Address
+	ProtocolFee          *big.Int
+	AmountOut            *big.Int
+	Unresolved           bool
+}
+
+// CollectRecord is one Collect event: Amount of Token paid from the pool's
+// accrued fees to FeeAddress.
+type CollectRecord struct {
+	Pool       common.Address
+	Block      uint64
+	Time       time.Time
+	TxHash     common.Hash
+	LogIndex   uint
+	FeeAddress common.Address
+	Token      common.Address
+	Amount     *big.Int
+}
+
+// FeeTotals aggregates one token of one pool over a period. VolumeIn counts
+// the token paid into the pool, VolumeOut the quoted value of the token paid
+// out before fees. Fees are charged in the output token.
+type FeeTotals struct {
+	Period       string
+	Pool         common.Address
+	Token        common.Address
+	Swaps        uint64
+	VolumeIn     *big.Int
+	VolumeOut    *big.Int
+	PoolFees     *big.Int
+	ProtocolFees *big.Int
+	Collected    *big.Int
+}
+
+// FeeBalance reconciles a pool's fees(token) over the report range:
+// Difference = Opening + Accrued - Collected - Closing. It is non-zero when
+// swap fees were not credited, which the pool does while feeAddress is
+// unset, or when fees changed outside Swap and Collect, e.g. by an upgrade.
+type FeeBalance struct {
+	Pool       common.Address
+	Token      common.Address
+	Opening    *big.Int
+	Accrued    *big.Int
+	Collected  *big.Int
+	Closing    *big.Int
+	Difference *big.Int
+}
+
+type FeeReport struct {
+	FromBlock uint64
+	ToBlock   uint64
+	Period    Period
+	Swaps     []SwapRecord
+	Collects  []CollectRecord
+	Totals    []FeeTotals
+	Balances  []FeeBalance
+}
+
+// protocolFeeState is a controller's getProtocolFee and
+// getProtocolFeeRecipient at one block.
+type protocolFeeState struct {
+	ppm       big.Int
+	recipient common.Address
+}
+
+type controllerBlock struct {
+	controller common.Address
+	block      uint64
+}
+
+type poolBlock struct {
+	pool  common.Address
+	block uint64
+}
+
+// BuildFeeReport scans the Swap and Collect events of pools in
+// [fromBlock, toBlock] and aggregates volume and fees per period, pool and
+// token. logRange bounds each eth_getLogs request; zero uses
+// publish.DefaultLogRange. Use publish.BlockAt to turn a time range into blocks.
+//
+// The protocol fee of each swap is not in its event, so it is recomputed as
+// _calcProtocolFee would from the controller's state before the swap: the
+// state at the end of the swap's block, or of the previous block if the
+// controller emitted an update later in the same block. The controller is
+// the one the pool has at the end of the swap's block; SwapPool emits no
+// event when it changes, which only an upgrade can do.
+func BuildFeeReport(ctx context.Context, caller publish.Caller, pools []common.Address, fromBlock, toBlock uint64, period Period, logRange uint64) (*FeeReport, error) {
+	if fromBlock > toBlock {
+		return nil, fmt.Errorf("invalid block range %d-%d", fromBlock, toBlock)
+	}
+	r := &FeeReport{FromBlock: fromBlock, ToBlock: toBlock, Period: period}
+
+	query := ethereum.FilterQuery{Addresses: pools, Topics: [][]common.Hash{{EventSwap.Topic0, EventCollect.Topic0}}}
+	logs, err := publish.GetLogs(ctx, caller, query, fromBlock, toBlock, logRange)
+	if err != nil {
+		return nil, err
+	}
+	for i := range logs {
+		log := &logs[i]
+		switch log.Topics[0] {
+		case EventSwap.Topic0:
+			s := SwapRecord{Pool: log.Address, Block: log.BlockNumber, TxHash: log.TxHash, LogIndex: log.Index, AmountIn: new(big.Int), Quoted: new(big.Int), Fee: new(big.Int)}
+			if err := EventSwap.DecodeArgs(log, &s.Initiator, &s.TokenIn, &s.TokenOut, s.AmountIn, s.Quoted, s.Fee); err != nil {
+				return nil, fmt.Errorf("decode Swap in tx %s: %w", log.TxHash.Hex(), err)
+			}
+			r.Swaps = append(r.Swaps, s)
+		case EventCollect.Topic0:
+			c := CollectRecord{Pool: log.Address, Block: log.BlockNumber, TxHash: log.TxHash, LogIndex: log.Index, Amount: new(big.Int)}
+			if err := EventCollect.DecodeArgs(log, &c.FeeAddress, &c.Token, c.Amount); err != nil {
+				return nil, fmt.Errorf("decode Collect in tx %s: %w", log.TxHash.Hex(), err)
+			}
+			r.Collects = append(r.Collects, c)
+		}
+	}
+
+	controllerOf, controllers, err := r.controllers(ctx, caller)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.protocolFees(ctx, caller, controllerOf, controllers, logRange); err != nil {
+		return nil, err
+	}
+	if err := r.times(ctx, caller); err != nil {
+		return nil, err
+	}
+	r.aggregate()
+	if err := r.reconcile(ctx, caller); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// controllers reads the protocolFeeController of each pool at the end of
+// every block it has swaps in, and returns them along with the distinct
+// non-zero controllers.
+func (r *FeeReport) controllers(ctx context.Context, caller publish.Caller) (map[poolBlock]common.Address, []common.Address, error) {
+	controllerOf := make(map[poolBlock]*common.Address)
+	var calls []w3types.RPCCaller
+	for _, s := range r.Swaps {
+		key := poolBlock{s.Pool, s.Block}
+		if _, ok := controllerOf[key]; !ok {
+			controllerOf[key] = new(common.Address)
+			calls = append(calls, eth.CallFunc(s.Pool, funcProtocolFeeController).AtBlock(new(big.Int).SetUint64(s.Block)).Returns(controllerOf[key]))
+		}
+	}
+	if err := publish.BatchCall(ctx, caller, calls, 0); err != nil {
+		return nil, nil, fmt.Errorf("protocolFeeController: %w", err)
+	}
+
+	out := make(map[poolBlock]common.Address, len(controllerOf))
+	var distinct []common.Address
+	for key, controller := range controllerOf {
+		out[key] = *controller
+		if *controller != (common.Address{}) && !slices.Contains(distinct, *controller) {
+			distinct = append(distinct, *controller)
+		}
+	}
+	return out, distinct, nil
+}
+
+// protocolFees resolves the controller state of every swap and fills in
+// its protocol fee and net output.
+func (r *FeeReport) protocolFees(ctx context.Context, caller publish.Caller, controllerOf map[poolBlock]common.Address, controllers []common.Address, logRange uint64) error {
+	updates := make(map[controllerBlock][]uint)
+	if len(controllers) > 0 && len(r.Swaps) > 0 {
+		query := ethereum.FilterQuery{
+			Addresses: controllers,
+			Topics:    [][]common.Hash{{eventProtocolFeeUpdated.Topic0, eventProtocolFeeRecipientUpdated.Topic0, eventActiveStateUpdated.Topic0}},
+		}
+		logs, err := publish.GetLogs(ctx, caller, query, r.FromBlock, r.ToBlock, logRange)
+		if err != nil {
+			return err
+		}
+		for _, log := range logs {
+			key := controllerBlock{log.Address, log.BlockNumber}
+			updates[key] = append(updates[key], log.Index)
+		}
+	}
+
+	keys := make([]controllerBlock, len(r.Swaps))
+	states := make(map[controllerBlock]*protocolFeeState)
+	var calls []w3types.RPCCaller
+	for i := range r.Swaps {
+		s := &r.Swaps[i]
+		controller := controllerOf[poolBlock{s.Pool, s.Block}]
+		if controller == (common.Address{}) {
+			continue
+		}
+		key := controllerBlock{controller, s.Block}
+		var before, after bool
+		for _, index := range updates[key] {
+			before = before || index < s.LogIndex
+			after = after || index > s.LogIndex
+		}
+		s.Unresolved = before && after
+		if after && !before && s.Block > 0 {
+			key.block--
+		}
+		keys[i] = key
+
+		if _, ok := states[key]; !ok {
+			state := new(protocolFeeState)
+			states[key] = state
+			block := new(big.Int).SetUint64(key.block)
+			calls = append(calls,
+				eth.CallFunc(controller, funcGetProtocolFee).AtBlock(block).Returns(&state.ppm),
+				eth.CallFunc(controller, funcGetProtocolFeeRecipient).AtBlock(block).Returns(&state.recipient),
+			)
+		}
+	}
+	if err := publish.BatchCall(ctx, caller, calls, 0); err != nil {
+		return fmt.Errorf("get protocol fee state: %w", err)
+	}
+
+	for i := range r.Swaps {
+		s := &r.Swaps[i]
+		pool := State{ProtocolFeeController: keys[i].controller}
+		if state, ok := states[keys[i]]; ok {
+			pool.ProtocolFeePPM = state.ppm.Uint64()
+			pool.ProtocolFeeRecipient = state.recipient
+		}
+		s.ProtocolFeePPM = pool.EffectiveProtocolFeePPM()
+		s.ProtocolFeeRecipient = pool.ProtocolFeeRecipient
+
+		var err error
+		if s.ProtocolFee, err = pool.protocolFee(s.Quoted, s.Fee); err != nil {
+			return fmt.Errorf("protocol fee of swap in tx %s: %w", s.TxHash.Hex(), err)
+		}
+		if s.AmountOut, err = sub(s.Quoted, s.Fee, s.ProtocolFee); err != nil {
+			return fmt.Errorf("net output of swap in tx %s: %w", s.TxHash.Hex(), err)
+		}
+	}
+	return nil
+}
+
+// times sets the block timestamp of every record.
+func (r *FeeReport) times(ctx context.Context, caller publish.Caller) error {
+	headers := make(map[uint64]**types.Header)
+	var calls []w3types.RPCCaller
+	request := func(block uint64) {
+		if _, ok := headers[block]; ok {
+			return
+		}
+		header := new(*types.Header)
+		headers[block] = header
+		calls = append(calls, eth.HeaderByNumber(new(big.Int).SetUint64(block)).Returns(header))
+	}
+	for _, s := range r.Swaps {
+		request(s.Block)
+	}
+	for _, c := range r.Collects {
+		request(c.Block)
+	}
+	if err := publish.BatchCall(ctx, caller, calls, 0); err != nil {
+		return fmt.Errorf("get headers: %w", err)
+	}
+
+	for i := range r.Swaps {
+		r.Swaps[i].Time = time.Unix(int64((*headers[r.Swaps[i].Block]).Time), 0).UTC()
+	}
+	for i := range r.Collects {
+		r.Collects[i].Time = time.Unix(int64((*headers[r.Collects[i].Block]).Time), 0).UTC()
+	}
+	return nil
+}
+
+func (r *FeeReport) aggregate() {
+	type key struct {
+		period      string
+		pool, token common.Address
+	}
+	totals := make(map[key]*FeeTotals)
+	get := func(period string, pool, token common.Address) *FeeTotals {
+		k := key{period, pool, token}
+		t, ok := totals[k]
+		if !ok {
+			t = &FeeTotals{
+				Period: period, Pool: pool, Token: token,
+				VolumeIn: new(big.Int), VolumeOut: new(big.Int), PoolFees: new(big.Int), ProtocolFees: new(big.Int), Collected: new(big.Int),
+			}
+			totals[k] = t
+		}
+		return t
+	}
+
+	for _, s := range r.Swaps {
+		period := r.Period.Key(s.Time)
+		in := get(period, s.Pool, s.TokenIn)
+		in.VolumeIn.Add(in.VolumeIn, s.AmountIn)
+		out := get(period, s.Pool, s.TokenOut)
+		out.Swaps++
+		out.VolumeOut.Add(out.VolumeOut, s.Quoted)
+		out.PoolFees.Add(out.PoolFees, s.Fee)
+		out.ProtocolFees.Add(out.ProtocolFees, s.ProtocolFee)
+	}
+	for _, c := range r.Collects {
+		t := get(r.Period.Key(c.Time), c.Pool, c.Token)
+		t.Collected.Add(t.Collected, c.Amount)
+	}
+
+	r.Totals = make([]FeeTotals, 0, len(totals))
+	for _, t := range totals {
+		r.Totals = append(r.Totals, *t)
+	}
+	slices.SortFunc(r.Totals, func(a, b FeeTotals) int {
+		return cmp.Or(
+			cmp.Compare(a.Period, b.Period),
+			a.Pool.Cmp(b.Pool),
+			a.Token.Cmp(b.Token),
+		)
+	})
+}
+
+// reconcile reads fees(token) before and after the range for every pool and
+// token with fees or collections in it. A pool without code before the
+// range opens at zero.
+func (r *FeeReport) reconcile(ctx context.Context, caller publish.Caller) error {
+	type key struct{ pool, token common.Address }
+	balances := make(map[key]*FeeBalance)
+	get := func(pool, token common.Address) *FeeBalance {
+		k := key{pool, token}
+		b, ok := balances[k]
+		if !ok {
+			b = &FeeBalance{Pool: pool, Token: token, Opening: new(big.Int), Accrued: new(big.Int), Collected: new(big.Int), Closing: new(big.Int)}
+			balances[k] = b
+		}
+		return b
+	}
+	for _, t := range r.Totals {
+		if t.PoolFees.Sign() == 0 && t.Collected.Sign() == 0 {
+			continue
+		}
+		b := get(t.Pool, t.Token)
+		b.Accrued.Add(b.Accrued, t.PoolFees)
+		b.Collected.Add(b.Collected, t.Collected)
+	}
+
+	r.Balances = make([]FeeBalance, 0, len(balances))
+	for _, b := range balances {
+		r.Balances = append(r.Balances, *b)
+	}
+	slices.SortFunc(r.Balances, func(a, b FeeBalance) int {
+		return cmp.Or(a.Pool.Cmp(b.Pool), a.Token.Cmp(b.Token))
+	})
+
+	var (
+		opening *big.Int
+		code    = make(map[common.Address]*[]byte)
+		calls   []w3types.RPCCaller
+	)
+	if r.FromBlock > 0 {
+		opening = new(big.Int).SetUint64(r.FromBlock - 1)
+		for _, b := range r.Balances {
+			if _, ok := code[b.Pool]; !ok {
+				code[b.Pool] = new([]byte)
+				calls = append(calls, eth.Code(b.Pool, opening).Returns(code[b.Pool]))
+			}
+		}
+		if err := publish.BatchCall(ctx, caller, calls, 0); err != nil {
+			return fmt.Errorf("get code: %w", err)
+		}
+	}
+
+	calls = calls[:0]
+	closing := new(big.Int).SetUint64(r.ToBlock)
+	for i := range r.Balances {
+		b := &r.Balances[i]
+		calls = append(calls, eth.CallFunc(b.Pool, funcFees, b.Token).AtBlock(closing).Returns(b.Closing))
+		if opening != nil && len(*code[b.Pool]) > 0 {
+			calls = append(calls, eth.CallFunc(b.Pool, funcFees, b.Token).AtBlock(opening).Returns(b.Opening))
+		}
+	}
+	if err := publish.BatchCall(ctx, caller, calls, 0); err != nil {
+		return fmt.Errorf("get fees: %w", err)
+	}
+
+	for i := range r.Balances {
+		b := &r.Balances[i]
+		b.Difference = new(big.Int).Add(b.Opening, b.Accrued)
+		b.Difference.Sub(b.Difference, b.Collected)
+		b.Difference.Sub(b.Difference, b.Closing)
+	}
+	return nil
+}
+
+// WriteTotalsCSV writes one row per period, pool and token.
+func (r *FeeReport) WriteTotalsCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"period", "pool", "token", "swaps", "volume_in", "volume_out", "pool_fees", "protocol_fees", "collected"}); err != nil {
+		return err
+	}
+	for _, t := range r.Totals {
+		record := []string{
+			t.Period,
+			t.Pool.Hex(),
+			t.Token.Hex(),
+			strconv.FormatUint(t.Swaps, 10),
+			t.VolumeIn.String(),
+			t.VolumeOut.String(),
+			t.PoolFees.String(),
+			t.ProtocolFees.String(),
+			t.Collected.String(),
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteBalancesCSV writes the fee reconciliation of every pool and token.
+func (r *FeeReport) WriteBalancesCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"pool", "token", "opening", "accrued", "collected", "closing", "difference"}); err != nil {
+		return err
+	}
+	for _, b := range r.Balances {
+		record := []string{
+			b.Pool.Hex(),
+			b.Token.Hex(),
+			b.Opening.String(),
+			b.Accrued.String(),
+			b.Collected.String(),
+			b.Closing.String(),
+			b.Difference.String(),
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteSwapsCSV writes every swap with its recomputed protocol fee, for
+// auditing the totals.
+func (r *FeeReport) WriteSwapsCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{
+		"block", "time", "tx", "log_index", "pool", "initiator", "token_in", "token_out",
+		"amount_in", "quoted", "pool_fee", "protocol_fee_ppm", "protocol_fee", "amount_out", "unresolved",
+	}); err != nil {
+		return err
+	}
+	for _, s := range r.Swaps {
+		record := []string{
+			strconv.FormatUint(s.Block, 10),
+			s.Time.Format(time.RFC3339),
+			s.TxHash.Hex(),
+			strconv.FormatUint(uint64(s.LogIndex), 10),
+			s.Pool.Hex(),
+			s.Initiator.Hex(),
+			s.TokenIn.Hex(),
+			s.TokenOut.Hex(),
+			s.AmountIn.String(),
+			s.Quoted.String(),
+			s.Fee.String(),
+			strconv.FormatUint(s.ProtocolFeePPM, 10),
+			s.ProtocolFee.String(),
+			s.AmountOut.String(),
+			strconv.FormatBool(s.Unresolved),
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,76 @@
+package swappool_test
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/cosmo-local-credit/protocol/pkg/internal/vmtest"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/protocolfeecontroller"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/swappool"
+)
+
+func TestFeeReportControllerChange(t *testing.T) {
+	p, a, b := newPool(t, false, false)
+	e := p.e
+	e.Mine()
+	from := e.Header.Number.Uint64() + 1
+	amount := big.NewInt(1_000_000)
+
+	e.Send(p.address, funcWithdraw, []any{a, b, amount, swapRecipient})
+	e.Mine()
+
+	// SwapPool has no setter for its controller, so swap it in storage as
+	// an upgrade would.
+	otherRecipient := common.Address{0x98}
+	init, err := protocolfeecontroller.EncodeInit(protocolfeecontroller.InitArgs{Owner: vmtest.Owner, InitialFee: big.NewInt(10_000), InitialRecipient: otherRecipient})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := e.Proxy(protocolfeecontroller.Bytecode(), init)
+	setController(t, e, p.address, p.s.ProtocolFeeController, other)
+	e.Mine()
+
+	e.Send(p.address, funcWithdraw, []any{a, b, amount, swapRecipient})
+	e.Mine()
+
+	r, err := swappool.BuildFeeReport(context.Background(), e.Caller(), []common.Address{p.address}, from, e.Header.Number.Uint64(), swappool.PeriodNone, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		ppm       uint64
+		recipient common.Address
+	}{{2_000, protocolRecipient}, {10_000, otherRecipient}}
+	if len(r.Swaps) != len(want) {
+		t.Fatalf("%d swaps, want %d", len(r.Swaps), len(want))
+	}
+	for i, s := range r.Swaps {
+		if s.ProtocolFeePPM != want[i].ppm || s.ProtocolFeeRecipient != want[i].recipient {
+			t.Errorf("swap %d: protocol fee %d ppm to %s, want %d ppm to %s", i, s.ProtocolFeePPM, s.ProtocolFeeRecipient.Hex(), want[i].ppm, want[i].recipient.Hex())
+		}
+		// The pool paid the recipient what the report says it did.
+		if paid := p.balanceOf(t, a, want[i].recipient); paid.Cmp(s.ProtocolFee) != 0 || paid.Sign() == 0 {
+			t.Errorf("swap %d: recipient holds %s, report says %s", i, paid, s.ProtocolFee)
+		}
+	}
+}
+
+// setController overwrites the storage slot of pool that holds controller.
+func setController(t *testing.T, e *vmtest.Env, pool, controller, to common.Address) {
+	t.Helper()
+	for i := range int64(64) {
+		slot := common.BigToHash(big.NewInt(i))
+		value, err := e.VM.StorageAt(pool, slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if common.BytesToAddress(value.Bytes()) == controller {
+			e.VM.SetStorageAt(pool, slot, common.BytesToHash(to.Bytes()))
+			return
+		}
+	}
+	t.Fatal("no slot holds the protocol fee controller")
+}
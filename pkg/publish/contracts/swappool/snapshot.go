@@ -0,0 +1,508 @@
+package swappool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+)
+
+// Seal state bits, mirroring SwapPool.
+const (
+	FeeState        uint8 = 1
+	FeeAddressState uint8 = 2
+	QuoterState     uint8 = 4
+	MaxSealState    uint8 = 7
+)
+
+var (
+	funcName       = w3.MustNewFunc("name()", "string")
+	funcSymbol     = w3.MustNewFunc("symbol()", "string")
+	funcDecimals   = w3.MustNewFunc("decimals()", "uint8")
+	funcOwner      = w3.MustNewFunc("owner()", "address")
+	funcSealState  = w3.MustNewFunc("sealState()", "uint8")
+	funcGetQuote   = w3.MustNewFunc("getQuote(address,address,uint256)", "uint256")
+	funcEntryCount = w3.MustNewFunc("entryCount()", "uint256")
+	funcEntry      = w3.MustNewFunc("entry(uint256)", "address")
+
+	funcGetDefaultFee = w3.MustNewFunc("getDefaultFee()", "uint256")
+	funcIsActive      = w3.MustNewFunc("isActive()", "bool")
+
+	eventPairFeeUpdated = w3.MustNewEvent("PairFeeUpdated(address indexed tokenIn, address indexed tokenOut, uint256 oldFee, uint256 newFee)")
+	eventPairFeeRemoved = w3.MustNewEvent("PairFeeRemoved(address indexed tokenIn, address indexed tokenOut)")
+)
+
+// Seal is the decoded sealState.
+type Seal struct {
+	State      uint8 `json:"state"`
+	Fee        bool  `json:"fee"`
+	FeeAddress bool  `json:"fee_address"`
+	Quoter     bool  `json:"quoter"`
+}
+
+func DecodeSeal(state uint8) Seal {
+	return Seal{
+		State:      state,
+		Fee:        state&FeeState != 0,
+		FeeAddress: state&FeeAddressState != 0,
+		Quoter:     state&QuoterState != 0,
+	}
+}
+
+// PairFee is a FeePolicy pair override. Its fee may equal the default.
+type PairFee struct {
+	In     common.Address `json:"in"`
+	Out    common.Address `json:"out"`
+	FeePPM uint64         `json:"fee_ppm"`
+}
+
+// TokenSnapshot is one token's position in the pool. Limit and Headroom are
+// nil without a limiter. A balanceOf, fees or limitOf call that fails
+// leaves its field nil, with the reason in BalanceErr, FeesErr or LimitErr,
+// and so do the fields derived from it. Price is getQuote(reference, token, 10^decimals),
+// i.e. what one whole token is worth in the reference token before fees; it
+// is nil if the quote failed, with the reason in PriceErr. A token whose
+// symbol() or decimals() fails, e.g. one returning bytes32, has the reason
+// in SymbolErr or DecimalsErr, and without decimals it is not priced.
+type TokenSnapshot struct {
+	Token       common.Address `json:"token"`
+	Symbol      string         `json:"symbol"`
+	SymbolErr   string         `json:"symbol_error,omitempty"`
+	Decimals    uint8          `json:"decimals"`
+	DecimalsErr string         `json:"decimals_error,omitempty"`
+	Balance     *big.Int       `json:"balance"`
+	BalanceErr  string         `json:"balance_error,omitempty"`
+	Fees        *big.Int       `json:"fees"`
+	FeesErr     string         `json:"fees_error,omitempty"`
+	Available   *big.Int       `json:"available"`
+	Limit       *big.Int       `json:"limit,omitempty"`
+	LimitErr    string         `json:"limit_error,omitempty"`
+	Headroom    *big.Int       `json:"headroom,omitempty"`
+	Price       *big.Int       `json:"price,omitempty"`
+	PriceErr    string         `json:"price_error,omitempty"`
+}
+
+// Snapshot is the full state of a pool at one block.
+type Snapshot struct {
+	Pool     common.Address `json:"pool"`
+	Block    uint64         `json:"block"`
+	Name     string         `json:"name"`
+	Symbol   string         `json:"symbol"`
+	Decimals uint8          `json:"decimals"`
+	Owner    common.Address `json:"owner"`
+	Seal     Seal           `json:"seal"`
+
+	Quoter                common.Address `json:"quoter"`
+	FeePolicy             common.Address `json:"fee_policy"`
+	FeeAddress            common.Address `json:"fee_address"`
+	TokenRegistry         common.Address `json:"token_registry"`
+	TokenLimiter          common.Address `json:"token_limiter"`
+	ProtocolFeeController common.Address `json:"protocol_fee_controller"`
+	FeesDecoupled         bool           `json:"fees_decoupled"`
+
+	DefaultFeePPM uint64    `json:"default_fee_ppm"`
+	PairFees      []PairFee `json:"pair_fees"`
+
+	ProtocolFeeActive    bool           `json:"protocol_fee_active"`
+	ProtocolFeePPM       uint64         `json:"protocol_fee_ppm"`
+	ProtocolFeeRecipient common.Address `json:"protocol_fee_recipient"`
+
+	Reference common.Address  `json:"reference"`
+	Tokens    []TokenSnapshot `json:"tokens"`
+}
+
+// SnapshotConfig selects what Snapshot reads. The zero value covers every
+// entry of the pool's tokenRegistry at the head, without prices.
+type SnapshotConfig struct {
+	// Tokens to report; nil for every entry of the pool's tokenRegistry.
+	Tokens []common.Address
+	// Reference is the token prices are quoted in; zero skips prices.
+	Reference common.Address
+	// Block to read at; nil for the head.
+	Block *big.Int
+	// FromBlock is where the scan for the fee policy's pair overrides
+	// starts, e.g. the block it was deployed at.
+	FromBlock uint64
+	// LogRange is the block span of each eth_getLogs request; zero uses
+	// publish.DefaultLogRange.
+	LogRange uint64
+}
+
+// Snapshot reads everything about the pool at cfg.Block in a few batched
+// rounds.
+//
+// FeePolicy keeps pair overrides in a private mapping, so PairFees is
+// rebuilt from its PairFeeUpdated and PairFeeRemoved logs between
+// cfg.FromBlock and cfg.Block. It lists every override between two of the
+// snapshot's tokens, including one equal to the default fee. Setting a
+// pair's fee to zero removes its override, as in FeePolicy.
+func (c *Client) Snapshot(ctx context.Context, cfg SnapshotConfig) (*Snapshot, error) {
+	tokens, reference, blockNumber := cfg.Tokens, cfg.Reference, cfg.Block
+	if blockNumber == nil {
+		if err := c.caller.CallCtx(ctx, eth.BlockNumber().Returns(&blockNumber)); err != nil {
+			return nil, fmt.Errorf("get block number: %w", err)
+		}
+	}
+
+	s := &Snapshot{Pool: c.address, Block: blockNumber.Uint64(), Reference: reference}
+	var sealState uint8
+	if err := c.caller.CallCtx(ctx,
+		eth.CallFunc(c.address, funcName).AtBlock(blockNumber).Returns(&s.Name),
+		eth.CallFunc(c.address, funcSymbol).AtBlock(blockNumber).Returns(&s.Symbol),
+		eth.CallFunc(c.address, funcDecimals).AtBlock(blockNumber).Returns(&s.Decimals),
+		eth.CallFunc(c.address, funcOwner).AtBlock(blockNumber).Returns(&s.Owner),
+		eth.CallFunc(c.address, funcSealState).AtBlock(blockNumber).Returns(&sealState),
+		eth.CallFunc(c.address, funcQuoter).AtBlock(blockNumber).Returns(&s.Quoter),
+		eth.CallFunc(c.address, funcFeePolicy).AtBlock(blockNumber).Returns(&s.FeePolicy),
+		eth.CallFunc(c.address, funcFeeAddress).AtBlock(blockNumber).Returns(&s.FeeAddress),
+		eth.CallFunc(c.address, funcTokenRegistry).AtBlock(blockNumber).Returns(&s.TokenRegistry),
+		eth.CallFunc(c.address, funcTokenLimiter).AtBlock(blockNumber).Returns(&s.TokenLimiter),
+		eth.CallFunc(c.address, funcFeesDecoupled).AtBlock(blockNumber).Returns(&s.FeesDecoupled),
+		eth.CallFunc(c.address, funcProtocolFeeController).AtBlock(blockNumber).Returns(&s.ProtocolFeeController),
+	); err != nil {
+		return nil, fmt.Errorf("get pool config: %w", err)
+	}
+	s.Seal = DecodeSeal(sealState)
+
+	if tokens == nil && s.TokenRegistry != (common.Address{}) {
+		var err error
+		if tokens, err = c.registryEntries(ctx, s.TokenRegistry, blockNumber); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		calls       []w3types.RPCCaller
+		defaultFee  big.Int
+		protocolFee big.Int
+	)
+	if s.FeePolicy != (common.Address{}) {
+		calls = append(calls, eth.CallFunc(s.FeePolicy, funcGetDefaultFee).AtBlock(blockNumber).Returns(&defaultFee))
+	}
+	if s.ProtocolFeeController != (common.Address{}) {
+		calls = append(calls,
+			eth.CallFunc(s.ProtocolFeeController, funcIsActive).AtBlock(blockNumber).Returns(&s.ProtocolFeeActive),
+			eth.CallFunc(s.ProtocolFeeController, funcGetProtocolFee).AtBlock(blockNumber).Returns(&protocolFee),
+			eth.CallFunc(s.ProtocolFeeController, funcGetProtocolFeeRecipient).AtBlock(blockNumber).Returns(&s.ProtocolFeeRecipient),
+		)
+	}
+
+	if err := publish.BatchCall(ctx, c.caller, calls, 0); err != nil {
+		return nil, fmt.Errorf("get pool state: %w", err)
+	}
+	s.DefaultFeePPM = defaultFee.Uint64()
+	s.ProtocolFeePPM = protocolFee.Uint64()
+	if s.FeePolicy != (common.Address{}) {
+		var err error
+		if s.PairFees, err = c.pairFees(ctx, s.FeePolicy, tokens, cfg.FromBlock, s.Block, cfg.LogRange); err != nil {
+			return nil, err
+		}
+	}
+
+	s.Tokens = make([]TokenSnapshot, len(tokens))
+	for i, token := range tokens {
+		s.Tokens[i].Token = token
+	}
+	if err := c.tokenState(ctx, s, blockNumber); err != nil {
+		return nil, err
+	}
+	if err := c.tokenMetadata(ctx, s.Tokens, blockNumber); err != nil {
+		return nil, err
+	}
+
+	state := State{FeesDecoupled: s.FeesDecoupled}
+	for i := range s.Tokens {
+		t := &s.Tokens[i]
+		if t.Balance == nil {
+			continue
+		}
+		if t.Fees != nil {
+			t.Available = state.available(t.Balance, t.Fees)
+		}
+		if t.Limit != nil {
+			t.Headroom = new(big.Int)
+			if t.Limit.Cmp(t.Balance) > 0 {
+				t.Headroom.Sub(t.Limit, t.Balance)
+			}
+		}
+	}
+
+	if reference != (common.Address{}) {
+		if err := c.prices(ctx, s, blockNumber); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// tokenState reads each token's balance, accrued fees and, with a limiter,
+// limit. The calls fail individually, e.g. for a token whose balanceOf
+// reverts, and a failure is recorded on the token.
+func (c *Client) tokenState(ctx context.Context, s *Snapshot, blockNumber *big.Int) error {
+	perToken := 2
+	if s.TokenLimiter != (common.Address{}) {
+		perToken = 3
+	}
+	calls := make([]w3types.RPCCaller, 0, perToken*len(s.Tokens))
+	for i := range s.Tokens {
+		t := &s.Tokens[i]
+		t.Balance, t.Fees = new(big.Int), new(big.Int)
+		calls = append(calls,
+			eth.CallFunc(t.Token, funcBalanceOf, c.address).AtBlock(blockNumber).Returns(t.Balance),
+			eth.CallFunc(c.address, funcFees, t.Token).AtBlock(blockNumber).Returns(t.Fees),
+		)
+		if perToken == 3 {
+			t.Limit = new(big.Int)
+			calls = append(calls, eth.CallFunc(s.TokenLimiter, funcLimitOf, t.Token, c.address).AtBlock(blockNumber).Returns(t.Limit))
+		}
+	}
+	errs, err := publish.BatchCallEach(ctx, c.caller, calls, 0)
+	if err != nil {
+		return fmt.Errorf("balanceOf / fees / limitOf: %w", err)
+	}
+	for i := range s.Tokens {
+		t := &s.Tokens[i]
+		if err := errs[perToken*i]; err != nil {
+			t.Balance, t.BalanceErr = nil, err.Error()
+		}
+		if err := errs[perToken*i+1]; err != nil {
+			t.Fees, t.FeesErr = nil, err.Error()
+		}
+		if perToken == 3 {
+			if err := errs[perToken*i+2]; err != nil {
+				t.Limit, t.LimitErr = nil, err.Error()
+			}
+		}
+	}
+	return nil
+}
+
+// pairFees replays the PairFeeUpdated and PairFeeRemoved logs of policy in
+// [fromBlock, toBlock] and returns the overrides left between two of
+// tokens, in the order they were first set.
+func (c *Client) pairFees(ctx context.Context, policy common.Address, tokens []common.Address, fromBlock, toBlock, logRange uint64) ([]PairFee, error) {
+	query := ethereum.FilterQuery{Addresses: []common.Address{policy}, Topics: [][]common.Hash{{eventPairFeeUpdated.Topic0, eventPairFeeRemoved.Topic0}}}
+	logs, err := publish.GetLogs(ctx, c.caller, query, fromBlock, toBlock, logRange)
+	if err != nil {
+		return nil, fmt.Errorf("get pair fee logs: %w", err)
+	}
+
+	var (
+		order []PairFee
+		fees  = make(map[[2]common.Address]*big.Int)
+	)
+	for _, log := range logs {
+		var in, out common.Address
+		fee := new(big.Int)
+		switch log.Topics[0] {
+		case eventPairFeeUpdated.Topic0:
+			if err := eventPairFeeUpdated.DecodeArgs(&log, &in, &out, new(big.Int), fee); err != nil {
+				return nil, fmt.Errorf("decode PairFeeUpdated in tx %s: %w", log.TxHash.Hex(), err)
+			}
+		case eventPairFeeRemoved.Topic0:
+			if err := eventPairFeeRemoved.DecodeArgs(&log, &in, &out); err != nil {
+				return nil, fmt.Errorf("decode PairFeeRemoved in tx %s: %w", log.TxHash.Hex(), err)
+			}
+		}
+		key := [2]common.Address{in, out}
+		if _, ok := fees[key]; !ok {
+			order = append(order, PairFee{In: in, Out: out})
+		}
+		fees[key] = fee
+	}
+
+	var pairs []PairFee
+	for _, pair := range order {
+		fee := fees[[2]common.Address{pair.In, pair.Out}]
+		if fee.Sign() == 0 || !slices.Contains(tokens, pair.In) || !slices.Contains(tokens, pair.Out) {
+			continue
+		}
+		pair.FeePPM = fee.Uint64()
+		pairs = append(pairs, pair)
+	}
+	return pairs, nil
+}
+
+// tokenMetadata reads symbol() and decimals() of each token. They are
+// optional in ERC20 and fail individually.
+func (c *Client) tokenMetadata(ctx context.Context, tokens []TokenSnapshot, blockNumber *big.Int) error {
+	calls := make([]w3types.RPCCaller, 0, 2*len(tokens))
+	for i := range tokens {
+		t := &tokens[i]
+		calls = append(calls,
+			eth.CallFunc(t.Token, funcSymbol).AtBlock(blockNumber).Returns(&t.Symbol),
+			eth.CallFunc(t.Token, funcDecimals).AtBlock(blockNumber).Returns(&t.Decimals),
+		)
+	}
+	errs, err := publish.BatchCallEach(ctx, c.caller, calls, 0)
+	if err != nil {
+		return fmt.Errorf("symbol / decimals: %w", err)
+	}
+	for i := range tokens {
+		if err := errs[2*i]; err != nil {
+			tokens[i].SymbolErr = err.Error()
+		}
+		if err := errs[2*i+1]; err != nil {
+			tokens[i].DecimalsErr = err.Error()
+		}
+	}
+	return nil
+}
+
+// prices quotes one whole unit of each token against s.Reference. Quotes
+// fail individually, e.g. for tokens the oracle has no feed for.
+func (c *Client) prices(ctx context.Context, s *Snapshot, blockNumber *big.Int) error {
+	calls := make([]w3types.RPCCaller, 0, len(s.Tokens))
+	idx := make([]int, 0, len(s.Tokens))
+	for i := range s.Tokens {
+		t := &s.Tokens[i]
+		if t.DecimalsErr != "" {
+			t.PriceErr = "decimals unknown"
+			continue
+		}
+		unit, err := publish.Pow10(uint64(t.Decimals))
+		if err != nil {
+			t.PriceErr = "decimals out of range"
+			continue
+		}
+		t.Price = new(big.Int)
+		calls = append(calls, eth.CallFunc(c.address, funcGetQuote, s.Reference, t.Token, unit).AtBlock(blockNumber).Returns(t.Price))
+		idx = append(idx, i)
+	}
+
+	errs, err := publish.BatchCallEach(ctx, c.caller, calls, 0)
+	if err != nil {
+		return fmt.Errorf("getQuote: %w", err)
+	}
+	for j, i := range idx {
+		if errs[j] != nil {
+			s.Tokens[i].Price = nil
+			s.Tokens[i].PriceErr = errs[j].Error()
+		}
+	}
+	return nil
+}
+
+func (c *Client) registryEntries(ctx context.Context, registry common.Address, blockNumber *big.Int) ([]common.Address, error) {
+	var count big.Int
+	if err := c.caller.CallCtx(ctx, eth.CallFunc(registry, funcEntryCount).AtBlock(blockNumber).Returns(&count)); err != nil {
+		return nil, fmt.Errorf("entryCount: %w", err)
+	}
+	tokens := make([]common.Address, count.Uint64())
+	calls := make([]w3types.RPCCaller, len(tokens))
+	for i := range tokens {
+		calls[i] = eth.CallFunc(registry, funcEntry, big.NewInt(int64(i))).AtBlock(blockNumber).Returns(&tokens[i])
+	}
+	if err := publish.BatchCall(ctx, c.caller, calls, 0); err != nil {
+		return nil, fmt.Errorf("entry: %w", err)
+	}
+	return tokens, nil
+}
+
+func (s *Snapshot) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// WriteTable renders the snapshot for a terminal: configuration first,
+// then one row per token.
+func (s *Snapshot) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	rows := [][2]string{
+		{"pool", fmt.Sprintf("%s (%s, %s, %d decimals)", s.Pool.Hex(), s.Name, s.Symbol, s.Decimals)},
+		{"block", fmt.Sprint(s.Block)},
+		{"owner", s.Owner.Hex()},
+		{"sealed", sealString(s.Seal)},
+		{"quoter", s.Quoter.Hex()},
+		{"fee policy", fmt.Sprintf("%s (default %d ppm)", s.FeePolicy.Hex(), s.DefaultFeePPM)},
+		{"fee address", s.FeeAddress.Hex()},
+		{"fees decoupled", fmt.Sprint(s.FeesDecoupled)},
+		{"token registry", s.TokenRegistry.Hex()},
+		{"token limiter", s.TokenLimiter.Hex()},
+		{"protocol fee", fmt.Sprintf("%d ppm to %s (active %t, controller %s)", s.ProtocolFeePPM, s.ProtocolFeeRecipient.Hex(), s.ProtocolFeeActive, s.ProtocolFeeController.Hex())},
+	}
+	for _, pf := range s.PairFees {
+		rows = append(rows, [2]string{"pair fee", fmt.Sprintf("%s -> %s: %d ppm", pf.In.Hex(), pf.Out.Hex(), pf.FeePPM)})
+	}
+	for _, row := range rows {
+		if _, err := fmt.Fprintf(tw, "%s\t%s\t\n", row[0], row[1]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintln(w); err != nil {
+		return err
+	}
+	price := "price"
+	if s.Reference != (common.Address{}) {
+		price = "price in " + s.Reference.Hex()
+	}
+	if _, err := fmt.Fprintf(tw, "token\tsymbol\tbalance\tfees\tavailable\tlimit\theadroom\t%s\t\n", price); err != nil {
+		return err
+	}
+	for _, t := range s.Tokens {
+		symbol := t.Symbol
+		if t.SymbolErr != "" {
+			symbol = "?"
+		}
+		balance, fees, limit := orDash(t.Balance), orDash(t.Fees), orDash(t.Limit)
+		if t.BalanceErr != "" {
+			balance = "error: " + t.BalanceErr
+		}
+		if t.FeesErr != "" {
+			fees = "error: " + t.FeesErr
+		}
+		if t.LimitErr != "" {
+			limit = "error: " + t.LimitErr
+		}
+		p := orDash(t.Price)
+		if t.PriceErr != "" {
+			p = "error: " + t.PriceErr
+		}
+		if _, err := fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n",
+			t.Token.Hex(), symbol, balance, fees, orDash(t.Available), limit, orDash(t.Headroom), p); err != nil {
+			return err
+		}
+	}
+	return tw.Flush()
+}
+
+func sealString(seal Seal) string {
+	var parts []string
+	if seal.Fee {
+		parts = append(parts, "fee")
+	}
+	if seal.FeeAddress {
+		parts = append(parts, "feeAddress")
+	}
+	if seal.Quoter {
+		parts = append(parts, "quoter")
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("%s (%d)", strings.Join(parts, ", "), seal.State)
+}
+
+func orDash(x *big.Int) string {
+	if x == nil {
+		return "-"
+	}
+	return x.String()
+}
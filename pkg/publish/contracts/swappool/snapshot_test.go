@@ -0,0 +1,142 @@
+package swappool_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/internal/vmtest"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/accountsindex"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/feepolicy"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/giftabletoken"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/swappool"
+)
+
+var funcRemovePairFee = w3.MustNewFunc("removePairFee(address,address)", "")
+
+func TestSnapshot(t *testing.T) {
+	tests := []struct {
+		name string
+		// failBalance fails balanceOf of token B.
+		failBalance bool
+		// afterUpdates starts the log scan after the fee updates.
+		afterUpdates bool
+		pairFees     []string
+	}{
+		{name: "overrides", pairFees: []string{"A>B 5000", "B>A 30000", "B>C 8000"}},
+		{name: "balanceOf fails", failBalance: true, pairFees: []string{"A>B 5000", "B>A 30000", "B>C 8000"}},
+		{name: "from after updates", afterUpdates: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := vmtest.New(t)
+
+			init, err := accountsindex.EncodeInit(accountsindex.InitArgs{Owner: vmtest.Owner})
+			if err != nil {
+				t.Fatal(err)
+			}
+			registry := e.Proxy(accountsindex.Bytecode(), init)
+			if init, err = feepolicy.EncodeInit(feepolicy.InitArgs{Owner: vmtest.Owner, DefaultFee: big.NewInt(30_000)}); err != nil {
+				t.Fatal(err)
+			}
+			policy := e.Proxy(feepolicy.Bytecode(), init)
+			if init, err = swappool.EncodeInit(swappool.InitArgs{
+				Name:          "Pool",
+				Symbol:        "POOL",
+				Decimals:      6,
+				Owner:         vmtest.Owner,
+				FeePolicy:     policy,
+				FeeAddress:    common.Address{0x77},
+				TokenRegistry: registry,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			pool := e.Proxy(swappool.Bytecode(), init)
+
+			symbols := make(map[common.Address]string)
+			tokens := make(map[string]common.Address)
+			for _, symbol := range []string{"A", "B", "C"} {
+				init, err := giftabletoken.EncodeInit(giftabletoken.InitArgs{Name: symbol, Symbol: symbol, Decimals: 6, Owner: vmtest.Owner, ExpiresAt: new(big.Int)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				token := e.Proxy(giftabletoken.Bytecode(), init)
+				tokens[symbol], symbols[token] = token, symbol
+				e.Send(registry, funcAdd, []any{token}, new(bool))
+				e.Send(token, funcMintTo, []any{vmtest.Owner, big.NewInt(1_000_000)})
+				e.Send(token, funcApprove, []any{pool, big.NewInt(1_000_000)}, new(bool))
+				e.Send(pool, funcDeposit, []any{token, big.NewInt(1_000_000)})
+			}
+			e.Mine()
+
+			setFee := func(in, out string, fee int64) {
+				e.Send(policy, funcSetPairFee, []any{tokens[in], tokens[out], big.NewInt(fee)})
+			}
+			setFee("A", "B", 5_000)
+			// An override equal to the default is still an override.
+			setFee("B", "A", 30_000)
+			setFee("C", "A", 1_000)
+			e.Send(policy, funcRemovePairFee, []any{tokens["C"], tokens["A"]})
+			// A zero fee falls back to the default, like a removal.
+			setFee("A", "C", 2_000)
+			setFee("A", "C", 0)
+			setFee("B", "C", 7_000)
+			setFee("B", "C", 8_000)
+			// Pairs with tokens outside the snapshot are left out.
+			e.Send(policy, funcSetPairFee, []any{tokens["A"], common.Address{0x01}, big.NewInt(100)})
+			updated := e.Mine().Number.Uint64()
+
+			caller := e.Caller()
+			if tt.failBalance {
+				caller.Hook = func(method string, args []any) error {
+					if method != "eth_call" {
+						return nil
+					}
+					if msg, ok := args[0].(*w3types.Message); ok &&
+						*msg.To == tokens["B"] && bytes.HasPrefix(msg.Input, funcBalanceOf.Selector[:]) {
+						return errors.New("execution reverted")
+					}
+					return nil
+				}
+			}
+			cfg := swappool.SnapshotConfig{LogRange: 1}
+			if tt.afterUpdates {
+				cfg.FromBlock = updated + 1
+			}
+			s, err := swappool.NewClient(caller, pool).Snapshot(context.Background(), cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var pairFees []string
+			for _, pf := range s.PairFees {
+				pairFees = append(pairFees, fmt.Sprintf("%s>%s %d", symbols[pf.In], symbols[pf.Out], pf.FeePPM))
+			}
+			if strings.Join(pairFees, " ") != strings.Join(tt.pairFees, " ") {
+				t.Errorf("pair fees %v, want %v", pairFees, tt.pairFees)
+			}
+			if s.DefaultFeePPM != 30_000 || len(s.Tokens) != 3 {
+				t.Fatalf("snapshot %+v", s)
+			}
+			for _, token := range s.Tokens {
+				if tt.failBalance && token.Token == tokens["B"] {
+					if token.Balance != nil || token.Available != nil || token.BalanceErr != "execution reverted" || token.Fees == nil {
+						t.Errorf("B: %+v", token)
+					}
+					continue
+				}
+				if token.BalanceErr != "" || token.Balance.Int64() != 1_000_000 || token.Available.Int64() != 1_000_000 || token.Symbol != symbols[token.Token] {
+					t.Errorf("%s: %+v", symbols[token.Token], token)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package swappool_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/internal/vmtest"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/decimalquoter"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/feepolicy"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/giftabletoken"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/protocolfeecontroller"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/swappool"
+)
+
+var (
+	funcMintTo    = w3.MustNewFunc("mintTo(address,uint256)", "")
+	funcApprove   = w3.MustNewFunc("approve(address,uint256)", "bool")
+	funcBalanceOf = w3.MustNewFunc("balanceOf(address)", "uint256")
+	funcDeposit   = w3.MustNewFunc("deposit(address,uint256)", "")
+	funcWithdraw  = w3.MustNewFunc("withdraw(address,address,uint256,address)", "")
+
+	errInsufficientBalance = crypto.Keccak256([]byte("InsufficientBalance()"))[:4]
+)
+
+var (
+	swapRecipient     = common.Address{0x55}
+	protocolRecipient = common.Address{0x99}
+)
+
+// pool is a funded SwapPool and the State that mirrors it.
+type pool struct {
+	e       *vmtest.Env
+	address common.Address
+	client  *swappool.Client
+	s       *swappool.State
+}
+
+// newPool deploys a SwapPool over two GiftableTokens with 6 and 18
+// decimals, funded with 1000 of each, charging 3% on the A -> B side, 0.5%
+// the other way and a 0.2% protocol fee.
+func newPool(t *testing.T, decoupled, quoted bool) (p *pool, a, b common.Address) {
+	e := vmtest.New(t)
+	tokens := make([]common.Address, 2)
+	for i, decimals := range []uint8{6, 18} {
+		init, err := giftabletoken.EncodeInit(giftabletoken.InitArgs{
+			Name:      fmt.Sprintf("Token %d", i),
+			Symbol:    fmt.Sprintf("T%d", i),
+			Decimals:  decimals,
+			Owner:     vmtest.Owner,
+			ExpiresAt: new(big.Int),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[i] = e.Proxy(giftabletoken.Bytecode(), init)
+		e.Send(tokens[i], funcMintTo, []any{vmtest.Owner, new(big.Int).Lsh(big.NewInt(1), 200)})
+	}
+	a, b = tokens[0], tokens[1]
+
+	init, err := feepolicy.EncodeInit(feepolicy.InitArgs{Owner: vmtest.Owner, DefaultFee: big.NewInt(30_000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := e.Proxy(feepolicy.Bytecode(), init)
+	e.Send(policy, funcSetPairFee, []any{b, a, big.NewInt(5_000)})
+
+	init, err = protocolfeecontroller.EncodeInit(protocolfeecontroller.InitArgs{
+		Owner:            vmtest.Owner,
+		InitialFee:       big.NewInt(2_000),
+		InitialRecipient: protocolRecipient,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller := e.Proxy(protocolfeecontroller.Bytecode(), init)
+
+	var (
+		quoter common.Address
+		quotes swappool.Quoter
+	)
+	if quoted {
+		quoter = e.Create(decimalquoter.Bytecode())
+		if quotes, err = decimalquoter.NewClient(e.Caller(), quoter).Load(context.Background(), tokens, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	init, err = swappool.EncodeInit(swappool.InitArgs{
+		Name:                  "Pool",
+		Symbol:                "POOL",
+		Decimals:              6,
+		Owner:                 vmtest.Owner,
+		FeePolicy:             policy,
+		FeeAddress:            common.Address{0x77},
+		Quoter:                quoter,
+		FeesDecoupled:         decoupled,
+		ProtocolFeeController: controller,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = &pool{e: e, address: e.Proxy(swappool.Bytecode(), init)}
+	p.client = swappool.NewClient(e.Caller(), p.address)
+	for i, token := range tokens {
+		e.Send(token, funcApprove, []any{p.address, new(big.Int).Lsh(big.NewInt(1), 200)}, new(bool))
+		units := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(6+12*i)), nil)
+		e.Send(p.address, funcDeposit, []any{token, units.Mul(units, big.NewInt(1000))})
+	}
+
+	if p.s, err = p.client.State(context.Background(), tokens, quotes, nil); err != nil {
+		t.Fatal(err)
+	}
+	return p, a, b
+}
+
+// swap runs withdraw on chain and Swap on p.s and fails the test unless
+// both revert for the same reason or both pay out the same amounts. It
+// returns Swap's error.
+func (p *pool) swap(t *testing.T, out, in common.Address, amount *big.Int) error {
+	t.Helper()
+	recipientBefore := p.balanceOf(t, out, swapRecipient)
+	protocolBefore := p.balanceOf(t, out, protocolRecipient)
+
+	q, err := p.s.Swap(out, in, amount)
+	input, encErr := funcWithdraw.EncodeArgs(out, in, amount, swapRecipient)
+	if encErr != nil {
+		t.Fatal(encErr)
+	}
+	r, chainErr := p.e.Apply(&w3types.Message{From: vmtest.Owner, To: &p.address, Input: input, Gas: vmtest.GasLimit})
+	switch {
+	case (chainErr == nil) != (err == nil):
+		t.Fatalf("swap %s: contract err %v, got err %v", amount, chainErr, err)
+	case err != nil:
+		if onChain := r != nil && bytes.HasPrefix(r.Output, errInsufficientBalance); onChain != errors.Is(err, swappool.ErrInsufficientBalance) {
+			t.Fatalf("swap %s: contract err %v (InsufficientBalance %t), got err %v", amount, chainErr, onChain, err)
+		}
+	default:
+		paid := new(big.Int).Sub(p.balanceOf(t, out, swapRecipient), recipientBefore)
+		protocolFee := new(big.Int).Sub(p.balanceOf(t, out, protocolRecipient), protocolBefore)
+		if paid.Cmp(q.AmountOut) != 0 || protocolFee.Cmp(q.ProtocolFee) != 0 {
+			t.Fatalf("swap %s paid %s and a protocol fee of %s, Swap quoted %s and %s", amount, paid, protocolFee, q.AmountOut, q.ProtocolFee)
+		}
+	}
+
+	// On success both sides moved the same way, on error neither moved.
+	tokens := make([]common.Address, 0, len(p.s.Tokens))
+	for token := range p.s.Tokens {
+		tokens = append(tokens, token)
+	}
+	onChain, loadErr := p.client.State(context.Background(), tokens, p.s.Quotes, nil)
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+	for token, want := range onChain.Tokens {
+		got := p.s.Tokens[token]
+		if got.Balance.Cmp(want.Balance) != 0 || got.Fees.Cmp(want.Fees) != 0 {
+			t.Fatalf("after swap %s: %s balance %s fees %s, contract %s and %s", amount, token.Hex(), got.Balance, got.Fees, want.Balance, want.Fees)
+		}
+	}
+	return err
+}
+
+func (p *pool) balanceOf(t *testing.T, token, owner common.Address) *big.Int {
+	t.Helper()
+	balance := new(big.Int)
+	if err := p.e.Call(token, funcBalanceOf, []any{owner}, balance); err != nil {
+		t.Fatal(err)
+	}
+	return balance
+}
+
+// amountFor returns the smallest deposit of in that quotes at least value
+// of out.
+func (p *pool) amountFor(t *testing.T, out, in common.Address, value *big.Int) *big.Int {
+	t.Helper()
+	if p.s.Quotes == nil {
+		return value
+	}
+	amount, err := p.s.Quotes.ReverseValueFor(out, in, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return amount
+}
+
+func TestSwapMatchesContract(t *testing.T) {
+	maxDeposit := new(big.Int).Exp(big.NewInt(10), big.NewInt(30), nil)
+	for _, decoupled := range []bool{false, true} {
+		for _, quoted := range []bool{false, true} {
+			t.Run(fmt.Sprintf("decoupled=%t/quoted=%t", decoupled, quoted), func(t *testing.T) {
+				p, a, b := newPool(t, decoupled, quoted)
+
+				// Swaps both ways and in place accrue fees in both tokens.
+				for _, pair := range []swappool.Pair{{In: a, Out: b}, {In: b, Out: a}, {In: a, Out: a}} {
+					for _, amount := range vmtest.Amounts() {
+						// Deposits the owner cannot pay for revert in the
+						// token, which Swap does not model; the cap also
+						// leaves enough for the swaps past the balance below.
+						if amount.Cmp(maxDeposit) <= 0 {
+							p.swap(t, pair.Out, pair.In, amount)
+						}
+					}
+				}
+
+				for _, pair := range []swappool.Pair{{In: a, Out: b}, {In: b, Out: a}} {
+					out := p.s.Tokens[pair.Out]
+					if out.Fees.Sign() == 0 {
+						t.Fatalf("no fees in %s", pair.Out.Hex())
+					}
+					balance := new(big.Int).Set(out.Balance)
+					spendable := new(big.Int).Sub(balance, out.Fees)
+
+					// More than the balance is short in either mode.
+					over := new(big.Int).Add(balance, big.NewInt(1))
+					if err := p.swap(t, pair.Out, pair.In, p.amountFor(t, pair.Out, pair.In, over)); !errors.Is(err, swappool.ErrInsufficientBalance) {
+						t.Fatalf("swap above the balance: %v", err)
+					}
+					// Dipping into the fees is short only if they are
+					// decoupled.
+					err := p.swap(t, pair.Out, pair.In, p.amountFor(t, pair.Out, pair.In, spendable.Add(spendable, big.NewInt(1))))
+					if decoupled != errors.Is(err, swappool.ErrInsufficientBalance) {
+						t.Fatalf("swap into the fees: %v", err)
+					}
+					if decoupled {
+						// Exactly what is left after the fees drains it.
+						available, err := p.s.Available(pair.Out)
+						if err != nil {
+							t.Fatal(err)
+						}
+						amount := p.amountFor(t, pair.Out, pair.In, available)
+						if q, err := p.s.AmountOut(pair.Out, pair.In, amount); err != nil || q.Quoted.Cmp(available) > 0 {
+							amount.Sub(amount, big.NewInt(1))
+						}
+						if err := p.swap(t, pair.Out, pair.In, amount); err != nil {
+							t.Fatalf("swap of the available balance: %v", err)
+						}
+					}
+				}
+			})
+		}
+	}
+}
@@ -25,6 +25,24 @@ var funcInitialize = w3.MustNewFunc(
 	"initialize(string,string,uint8,address,address,address,address,address,address,bool,address)", "",
 )
 
+// SwapEventSignature is the Swap event SwapPool emits for every withdraw.
+// amountOut is the quoted value before the pool and protocol fees are taken.
+const SwapEventSignature = "Swap(address indexed initiator, address indexed tokenIn, address tokenOut, uint256 amountIn, uint256 amountOut, uint256 fee)"
+
+var EventSwap = w3.MustNewEvent(SwapEventSignature)
+
+// DepositEventSignature is the Deposit event SwapPool emits for every
+// deposit, including the one at the start of each withdraw.
+const DepositEventSignature = "Deposit(address indexed initiator, address indexed tokenIn, uint256 amountIn)"
+
+var EventDeposit = w3.MustNewEvent(DepositEventSignature)
+
+// CollectEventSignature is the Collect event SwapPool emits when the owner
+// withdraws accumulated fees to the fee address.
+const CollectEventSignature = "Collect(address indexed feeAddress, address tokenOut, uint256 amountOut)"
+
+var EventCollect = w3.MustNewEvent(CollectEventSignature)
+
 type InitArgs struct {
 	Name                  string
 	Symbol                string
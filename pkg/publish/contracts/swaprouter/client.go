@@ -0,0 +1,87 @@
+package swaprouter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+)
+
+var (
+	funcQuoteExactInput  = w3.MustNewFunc("quoteExactInput((address pool,address tokenIn,address tokenOut)[] path,uint256 amountIn)", "uint256")
+	funcQuoteExactOutput = w3.MustNewFunc("quoteExactOutput((address pool,address tokenIn,address tokenOut)[] path,uint256 amountOut)", "uint256")
+)
+
+var ErrQuoteMismatch = errors.New("router quote does not match route")
+
+// Hop mirrors SwapRouter.Hop.
+type Hop struct {
+	Pool     common.Address
+	TokenIn  common.Address
+	TokenOut common.Address
+}
+
+type Client struct {
+	caller  publish.Caller
+	address common.Address
+}
+
+func NewClient(caller publish.Caller, address common.Address) *Client {
+	return &Client{caller: caller, address: address}
+}
+
+func (c *Client) Address() common.Address {
+	return c.address
+}
+
+// QuoteExactInput calls quoteExactInput at blockNumber (nil for latest).
+func (c *Client) QuoteExactInput(ctx context.Context, path []Hop, amountIn, blockNumber *big.Int) (*big.Int, error) {
+	amountOut := new(big.Int)
+	if err := c.caller.CallCtx(ctx, eth.CallFunc(c.address, funcQuoteExactInput, path, amountIn).AtBlock(blockNumber).Returns(amountOut)); err != nil {
+		return nil, fmt.Errorf("quoteExactInput: %w", err)
+	}
+	return amountOut, nil
+}
+
+// QuoteExactOutput calls quoteExactOutput at blockNumber (nil for latest).
+func (c *Client) QuoteExactOutput(ctx context.Context, path []Hop, amountOut, blockNumber *big.Int) (*big.Int, error) {
+	amountIn := new(big.Int)
+	if err := c.caller.CallCtx(ctx, eth.CallFunc(c.address, funcQuoteExactOutput, path, amountOut).AtBlock(blockNumber).Returns(amountIn)); err != nil {
+		return nil, fmt.Errorf("quoteExactOutput: %w", err)
+	}
+	return amountIn, nil
+}
+
+// ConfirmExactInput checks route.AmountOut against quoteExactInput for
+// route.AmountIn at blockNumber.
+func (c *Client) ConfirmExactInput(ctx context.Context, route Route, blockNumber *big.Int) error {
+	amountOut, err := c.QuoteExactInput(ctx, route.Hops, route.AmountIn, blockNumber)
+	if err != nil {
+		return err
+	}
+	if amountOut.Cmp(route.AmountOut) != 0 {
+		return fmt.Errorf("%w: quoteExactInput %s, route %s", ErrQuoteMismatch, amountOut, route.AmountOut)
+	}
+	return nil
+}
+
+// ConfirmExactOutput checks route.AmountIn against quoteExactOutput for
+// the desired output at blockNumber. The route's own AmountOut may exceed
+// the desired output by rounding, so the desired amount is passed
+// separately.
+func (c *Client) ConfirmExactOutput(ctx context.Context, route Route, amountOut, blockNumber *big.Int) error {
+	amountIn, err := c.QuoteExactOutput(ctx, route.Hops, amountOut, blockNumber)
+	if err != nil {
+		return err
+	}
+	if amountIn.Cmp(route.AmountIn) != 0 {
+		return fmt.Errorf("%w: quoteExactOutput %s, route %s", ErrQuoteMismatch, amountIn, route.AmountIn)
+	}
+	return nil
+}
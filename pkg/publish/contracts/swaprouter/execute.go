@@ -0,0 +1,213 @@
+package swaprouter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/giftabletoken"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/swappool"
+)
+
+var (
+	funcGetAmountOut = w3.MustNewFunc("getAmountOut(address,address,uint256)", "uint256")
+	funcWithdraw     = w3.MustNewFunc("withdraw(address,address,uint256,address)", "")
+	funcAllowance    = w3.MustNewFunc("allowance(address,address)", "uint256")
+	funcApprove      = w3.MustNewFunc("approve(address,uint256)", "bool")
+)
+
+var ErrSlippage = errors.New("expected output below minimum")
+
+// SwapEvent is a decoded SwapPool Swap event. AmountOut is the quoted value
+// before the pool and protocol fees are taken.
+type SwapEvent struct {
+	Initiator common.Address
+	TokenIn   common.Address
+	TokenOut  common.Address
+	AmountIn  *big.Int
+	AmountOut *big.Int
+	Fee       *big.Int
+}
+
+// HopResult records one executed hop. Expected is the final output the
+// remaining path was re-quoted at just before the hop was sent; Received is
+// what the hop's recipient was actually paid, or nil if the hop reverted or
+// its payout could not be decoded from Receipt.
+type HopResult struct {
+	Hop       Hop
+	AmountIn  *big.Int
+	Expected  *big.Int
+	ApproveTx common.Hash
+	TxHash    common.Hash
+	Receipt   *types.Receipt
+	Swap      SwapEvent
+	Received  *big.Int
+}
+
+// Execution is the outcome of Execute. Token and Amount say where the funds
+// are: the route input while no hop has completed, the output of the last
+// completed hop (held by the deployer) after a partial run, or the final
+// output (held by the recipient) once Completed. Amount is nil if the last
+// hop in Hops was mined but its payout could not be decoded. Hops ends with
+// the failed hop if it was mined, reverted or not.
+type Execution struct {
+	Hops      []HopResult
+	Token     common.Address
+	Amount    *big.Int
+	Completed bool
+}
+
+// Execute swaps route.AmountIn along route.Hops with one withdraw per hop.
+// Intermediate outputs are paid to the deployer and the last to recipient.
+// Before each hop the rest of the path is re-quoted with getAmountOut from
+// the amount actually held, and execution stops with ErrSlippage if the
+// final output would fall below minOut; a nil minOut sets no bound. Missing allowances are approved for
+// the exact hop amount. If a hop fails, the Execution so far is returned
+// with the error so the caller can see which token is held and how much.
+func Execute(ctx context.Context, d *publish.Deployer, route Route, minOut *big.Int, recipient common.Address) (Execution, error) {
+	if len(route.Hops) == 0 {
+		return Execution{}, errors.New("empty route")
+	}
+	if minOut == nil {
+		minOut = new(big.Int)
+	}
+	caller := d.Client()
+
+	exec := Execution{Token: route.Hops[0].TokenIn, Amount: route.AmountIn}
+	for i, hop := range route.Hops {
+		result := HopResult{Hop: hop, AmountIn: exec.Amount}
+
+		expected, err := quotePath(ctx, caller, route.Hops[i:], exec.Amount)
+		if err != nil {
+			return exec, fmt.Errorf("hop %d: %w", i, err)
+		}
+		result.Expected = expected
+		if expected.Cmp(minOut) < 0 {
+			return exec, fmt.Errorf("hop %d: %w: %s < %s", i, ErrSlippage, expected, minOut)
+		}
+
+		if result.ApproveTx, err = ensureAllowance(ctx, d, hop.TokenIn, hop.Pool, exec.Amount); err != nil {
+			return exec, fmt.Errorf("hop %d: %w", i, err)
+		}
+
+		to := d.Address()
+		if i == len(route.Hops)-1 {
+			to = recipient
+		}
+		calldata, err := funcWithdraw.EncodeArgs(hop.TokenOut, hop.TokenIn, exec.Amount, to)
+		if err != nil {
+			return exec, fmt.Errorf("hop %d: encode withdraw: %w", i, err)
+		}
+		if result.TxHash, err = d.Transact(ctx, hop.Pool, nil, calldata, 0); err != nil {
+			return exec, fmt.Errorf("hop %d: withdraw: %w", i, err)
+		}
+		if result.Receipt, err = d.WaitForReceipt(ctx, result.TxHash); err != nil {
+			return exec, fmt.Errorf("hop %d: wait for %s: %w", i, result.TxHash.Hex(), err)
+		}
+		if result.Receipt.Status != types.ReceiptStatusSuccessful {
+			exec.Hops = append(exec.Hops, result)
+			return exec, fmt.Errorf("hop %d: withdraw reverted in tx %s", i, result.TxHash.Hex())
+		}
+		if result.Swap, result.Received, err = decodeHop(result.Receipt, hop, to); err != nil {
+			// The swap went through, so the funds are in TokenOut now, but
+			// how much of it was paid out is unknown.
+			exec.Hops = append(exec.Hops, result)
+			exec.Token, exec.Amount = hop.TokenOut, nil
+			return exec, fmt.Errorf("hop %d: %w", i, err)
+		}
+
+		exec.Hops = append(exec.Hops, result)
+		exec.Token, exec.Amount = hop.TokenOut, result.Received
+	}
+	exec.Completed = true
+	return exec, nil
+}
+
+// quotePath chains getAmountOut over hops starting from amountIn.
+func quotePath(ctx context.Context, caller publish.Caller, hops []Hop, amountIn *big.Int) (*big.Int, error) {
+	amount := amountIn
+	for _, hop := range hops {
+		out := new(big.Int)
+		if err := caller.CallCtx(ctx, eth.CallFunc(hop.Pool, funcGetAmountOut, hop.TokenOut, hop.TokenIn, amount).Returns(out)); err != nil {
+			return nil, fmt.Errorf("getAmountOut on %s: %w", hop.Pool.Hex(), err)
+		}
+		amount = out
+	}
+	return amount, nil
+}
+
+// ensureAllowance approves spender for amount of token if the current
+// allowance is lower, and waits for the approval to be mined. It returns the
+// zero hash if no approval was needed.
+func ensureAllowance(ctx context.Context, d *publish.Deployer, token, spender common.Address, amount *big.Int) (common.Hash, error) {
+	var allowance big.Int
+	if err := d.Client().CallCtx(ctx, eth.CallFunc(token, funcAllowance, d.Address(), spender).Returns(&allowance)); err != nil {
+		return common.Hash{}, fmt.Errorf("allowance: %w", err)
+	}
+	if allowance.Cmp(amount) >= 0 {
+		return common.Hash{}, nil
+	}
+
+	calldata, err := funcApprove.EncodeArgs(spender, amount)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("encode approve: %w", err)
+	}
+	txHash, err := d.Transact(ctx, token, nil, calldata, 0)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("approve: %w", err)
+	}
+	receipt, err := d.WaitForReceipt(ctx, txHash)
+	if err != nil {
+		return txHash, fmt.Errorf("wait for %s: %w", txHash.Hex(), err)
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return txHash, fmt.Errorf("approve reverted in tx %s", txHash.Hex())
+	}
+	return txHash, nil
+}
+
+// decodeHop extracts the pool's Swap event and the amount of TokenOut the
+// pool transferred to recipient. The net payout is the pool's last transfer
+// to recipient, after any protocol fee transfer.
+func decodeHop(receipt *types.Receipt, hop Hop, recipient common.Address) (SwapEvent, *big.Int, error) {
+	var (
+		swap     SwapEvent
+		found    bool
+		received *big.Int
+	)
+	for _, log := range receipt.Logs {
+		switch {
+		case log.Address == hop.Pool && len(log.Topics) > 0 && log.Topics[0] == swappool.EventSwap.Topic0:
+			swap = SwapEvent{AmountIn: new(big.Int), AmountOut: new(big.Int), Fee: new(big.Int)}
+			if err := swappool.EventSwap.DecodeArgs(log, &swap.Initiator, &swap.TokenIn, &swap.TokenOut, swap.AmountIn, swap.AmountOut, swap.Fee); err != nil {
+				return SwapEvent{}, nil, fmt.Errorf("decode Swap: %w", err)
+			}
+			found = true
+		case log.Address == hop.TokenOut && len(log.Topics) == 3 && log.Topics[0] == giftabletoken.EventTransfer.Topic0:
+			var (
+				from, to common.Address
+				value    big.Int
+			)
+			if err := giftabletoken.EventTransfer.DecodeArgs(log, &from, &to, &value); err != nil {
+				return SwapEvent{}, nil, fmt.Errorf("decode Transfer: %w", err)
+			}
+			if from == hop.Pool && to == recipient {
+				received = &value
+			}
+		}
+	}
+	if !found {
+		return SwapEvent{}, nil, fmt.Errorf("no Swap event in tx %s", receipt.TxHash.Hex())
+	}
+	if received == nil {
+		return swap, nil, fmt.Errorf("no transfer to %s in tx %s", recipient.Hex(), receipt.TxHash.Hex())
+	}
+	return swap, received, nil
+}
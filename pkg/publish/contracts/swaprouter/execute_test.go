@@ -0,0 +1,107 @@
+package swaprouter_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lmittmann/w3"
+
+	"github.com/cosmo-local-credit/protocol/pkg/internal/vmtest"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/giftabletoken"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/swappool"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/swaprouter"
+)
+
+var (
+	funcMintTo    = w3.MustNewFunc("mintTo(address,uint256)", "")
+	funcApprove   = w3.MustNewFunc("approve(address,uint256)", "bool")
+	funcBalanceOf = w3.MustNewFunc("balanceOf(address)", "uint256")
+	funcDeposit   = w3.MustNewFunc("deposit(address,uint256)", "")
+)
+
+// newToken deploys a GiftableToken and mints amount of it to each of
+// holders.
+func newToken(t *testing.T, e *vmtest.Env, symbol string, amount *big.Int, holders ...common.Address) common.Address {
+	t.Helper()
+	init, err := giftabletoken.EncodeInit(giftabletoken.InitArgs{Name: symbol, Symbol: symbol, Decimals: 6, Owner: vmtest.Owner, ExpiresAt: new(big.Int)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := e.Proxy(giftabletoken.Bytecode(), init)
+	for _, holder := range holders {
+		e.Send(token, funcMintTo, []any{holder, amount})
+	}
+	return token
+}
+
+// newPool deploys a fee-free SwapPool holding liquidity of each of tokens.
+func newPool(t *testing.T, e *vmtest.Env, liquidity *big.Int, tokens ...common.Address) common.Address {
+	t.Helper()
+	init, err := swappool.EncodeInit(swappool.InitArgs{Name: "Pool", Symbol: "POOL", Decimals: 6, Owner: vmtest.Owner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := e.Proxy(swappool.Bytecode(), init)
+	for _, token := range tokens {
+		e.Send(token, funcApprove, []any{pool, liquidity}, new(bool))
+		e.Send(pool, funcDeposit, []any{token, liquidity})
+	}
+	return pool
+}
+
+func TestExecuteMinOut(t *testing.T) {
+	amount := big.NewInt(1_000)
+	tests := []struct {
+		name    string
+		minOut  *big.Int
+		wantErr error
+	}{
+		{name: "no minimum"},
+		{name: "met", minOut: amount},
+		{name: "slippage", minOut: new(big.Int).Add(amount, big.NewInt(1)), wantErr: swaprouter.ErrSlippage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := vmtest.New(t)
+			d := e.Deployer(nil)
+
+			liquidity := big.NewInt(1_000_000)
+			a := newToken(t, e, "A", liquidity, d.Address())
+			b := newToken(t, e, "B", liquidity, vmtest.Owner)
+			c := newToken(t, e, "C", liquidity, vmtest.Owner)
+			route := swaprouter.Route{
+				Hops: []swaprouter.Hop{
+					{Pool: newPool(t, e, liquidity, b), TokenIn: a, TokenOut: b},
+					{Pool: newPool(t, e, liquidity, c), TokenIn: b, TokenOut: c},
+				},
+				AmountIn: amount,
+			}
+			e.AutoMine()
+
+			recipient := common.Address{0x55}
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			exec, err := swaprouter.Execute(ctx, d, route, tt.minOut, recipient)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err %v, want %v", err, tt.wantErr)
+			}
+
+			received := new(big.Int)
+			if err := e.Call(c, funcBalanceOf, []any{recipient}, received); err != nil {
+				t.Fatal(err)
+			}
+			want := fmt.Sprintf("completed %t, holding %s of %s, recipient paid %s", true, amount, c.Hex(), amount)
+			if tt.wantErr != nil {
+				want = fmt.Sprintf("completed %t, holding %s of %s, recipient paid %d", false, amount, a.Hex(), 0)
+			}
+			if got := fmt.Sprintf("completed %t, holding %s of %s, recipient paid %s", exec.Completed, exec.Amount, exec.Token.Hex(), received); got != want {
+				t.Errorf("%s, want %s", got, want)
+			}
+		})
+	}
+}
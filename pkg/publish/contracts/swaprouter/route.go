@@ -0,0 +1,371 @@
+package swaprouter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/swappool"
+)
+
+const (
+	// DefaultMaxHops bounds route searches when maxHops is zero.
+	DefaultMaxHops = 3
+	// MaxHops is the most hops a route search takes. The paths to search
+	// grow as the number of pools per token to the power of the hops.
+	MaxHops = 5
+)
+
+var (
+	funcTokenRegistry = w3.MustNewFunc("tokenRegistry()", "address")
+	funcQuoter        = w3.MustNewFunc("quoter()", "address")
+	funcEntryCount    = w3.MustNewFunc("entryCount()", "uint256")
+	funcEntry         = w3.MustNewFunc("entry(uint256)", "address")
+)
+
+var (
+	ErrNoRoute     = errors.New("no route")
+	ErrNoRegistry  = errors.New("pool has no token registry to enumerate")
+	ErrTooManyHops = errors.New("too many hops")
+)
+
+// QuoterLoader returns an off-chain model of the quoter at address for
+// tokens at blockNumber. contracts.QuoterLoader provides one that
+// identifies the quoter by its code.
+type QuoterLoader func(ctx context.Context, quoter common.Address, tokens []common.Address, blockNumber *big.Int) (swappool.Quoter, error)
+
+// Route is a path with its simulated amounts. Quotes holds the breakdown of
+// each hop, in order.
+type Route struct {
+	Hops      []Hop
+	AmountIn  *big.Int
+	AmountOut *big.Int
+	Quotes    []swappool.Quote
+}
+
+// Graph is a snapshot of a set of pools at one block, indexed by the token
+// pairs they can swap.
+type Graph struct {
+	Block  *big.Int
+	Pools  map[common.Address]*swappool.State
+	Errors map[common.Address]error
+
+	// edges and into index the hops by their input and output token.
+	edges map[common.Address][]Hop
+	into  map[common.Address][]Hop
+}
+
+// BuildGraph snapshots pools at blockNumber (nil for the current head).
+// Each pool's tokens are the entries of its tokenRegistry, and its quoter is
+// modelled with loadQuoter. Pools that cannot be loaded, such as pools
+// without a registry, are left out and their error recorded in
+// Graph.Errors.
+func BuildGraph(ctx context.Context, caller publish.Caller, pools []common.Address, loadQuoter QuoterLoader, blockNumber *big.Int) (*Graph, error) {
+	if blockNumber == nil {
+		if err := caller.CallCtx(ctx, eth.BlockNumber().Returns(&blockNumber)); err != nil {
+			return nil, fmt.Errorf("get block number: %w", err)
+		}
+	}
+
+	registries := make([]common.Address, len(pools))
+	quoters := make([]common.Address, len(pools))
+	calls := make([]w3types.RPCCaller, 0, 2*len(pools))
+	for i, pool := range pools {
+		calls = append(calls,
+			eth.CallFunc(pool, funcTokenRegistry).AtBlock(blockNumber).Returns(&registries[i]),
+			eth.CallFunc(pool, funcQuoter).AtBlock(blockNumber).Returns(&quoters[i]),
+		)
+	}
+	if err := publish.BatchCall(ctx, caller, calls, 0); err != nil {
+		return nil, fmt.Errorf("tokenRegistry / quoter: %w", err)
+	}
+
+	tokens, err := registryTokens(ctx, caller, registries, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Graph{
+		Block:  blockNumber,
+		Pools:  make(map[common.Address]*swappool.State, len(pools)),
+		Errors: make(map[common.Address]error),
+		edges:  make(map[common.Address][]Hop),
+		into:   make(map[common.Address][]Hop),
+	}
+	for i, pool := range pools {
+		if registries[i] == (common.Address{}) {
+			g.Errors[pool] = ErrNoRegistry
+			continue
+		}
+		poolTokens := tokens[registries[i]]
+
+		var quotes swappool.Quoter
+		if quoters[i] != (common.Address{}) {
+			if quotes, err = loadQuoter(ctx, quoters[i], poolTokens, blockNumber); err != nil {
+				g.Errors[pool] = fmt.Errorf("load quoter %s: %w", quoters[i].Hex(), err)
+				continue
+			}
+		}
+		state, err := swappool.NewClient(caller, pool).State(ctx, poolTokens, quotes, blockNumber)
+		if err != nil {
+			g.Errors[pool] = err
+			continue
+		}
+		g.Pools[pool] = state
+
+		for _, in := range poolTokens {
+			for _, out := range poolTokens {
+				if in != out {
+					hop := Hop{Pool: pool, TokenIn: in, TokenOut: out}
+					g.edges[in] = append(g.edges[in], hop)
+					g.into[out] = append(g.into[out], hop)
+				}
+			}
+		}
+	}
+	return g, nil
+}
+
+// BestExactInput returns the route of at most maxHops hops from tokenIn to
+// tokenOut that yields the most non-zero output for amountIn. Every hop is
+// simulated against the snapshot, so routes that would exceed a limiter cap
+// or the pool's available liquidity are discarded. A pool used twice sees the
+// state left by the earlier hop.
+//
+// The search is pruned: a partial path is dropped when an earlier one
+// reached the same token in no more hops with at least as much of it. The
+// two are not compared on the tokens they visited or the state they left
+// their pools in, and the larger amount may later hit a cap the smaller
+// one would not, so a route that only wins for those reasons can be
+// missed.
+func (g *Graph) BestExactInput(tokenIn, tokenOut common.Address, amountIn *big.Int, maxHops int) (Route, error) {
+	s, err := g.newSearch(tokenIn, maxHops)
+	if err != nil {
+		return Route{}, err
+	}
+	var best Route
+	s.forward(tokenIn, tokenOut, amountIn, func(route Route) {
+		if route.AmountOut.Sign() > 0 && (best.AmountOut == nil || route.AmountOut.Cmp(best.AmountOut) > 0) {
+			best = route
+		}
+	})
+	if best.AmountOut == nil {
+		return Route{}, ErrNoRoute
+	}
+	best.AmountIn = amountIn
+	return best, nil
+}
+
+// BestExactOutput returns the route of at most maxHops hops that delivers
+// at least amountOut of tokenOut for the least tokenIn. Inputs are computed
+// hop by hop from the end with getAmountIn, as quoteExactOutput does, and
+// each complete path is then simulated forward to check caps and
+// liquidity. It is pruned like BestExactInput, keeping the partial path
+// that needs the least of a token.
+func (g *Graph) BestExactOutput(tokenIn, tokenOut common.Address, amountOut *big.Int, maxHops int) (Route, error) {
+	s, err := g.newSearch(tokenOut, maxHops)
+	if err != nil {
+		return Route{}, err
+	}
+	var best Route
+	s.backward(tokenOut, tokenIn, amountOut, func(path []Hop, amountIn *big.Int) {
+		if best.AmountIn != nil && amountIn.Cmp(best.AmountIn) >= 0 {
+			return
+		}
+		route, err := s.simulate(path, amountIn)
+		if err == nil && route.AmountOut.Cmp(amountOut) >= 0 {
+			best = route
+		}
+	})
+	if best.AmountIn == nil {
+		return Route{}, ErrNoRoute
+	}
+	return best, nil
+}
+
+// search is one depth-first route search over paths that visit no token
+// twice. Each pool is cloned once, when first swapped through, and every
+// swap is undone on the way back.
+type search struct {
+	g       *Graph
+	maxHops int
+	seen    map[common.Address]bool
+	states  map[common.Address]*swappool.State
+	// best holds, per token, the best amount of it a partial path has
+	// reached in each number of hops.
+	best   map[common.Address][]*big.Int
+	path   []Hop
+	quotes []swappool.Quote
+}
+
+func (g *Graph) newSearch(start common.Address, maxHops int) (*search, error) {
+	if maxHops <= 0 {
+		maxHops = DefaultMaxHops
+	}
+	if maxHops > MaxHops {
+		return nil, fmt.Errorf("%w: %d, at most %d", ErrTooManyHops, maxHops, MaxHops)
+	}
+	return &search{
+		g:       g,
+		maxHops: maxHops,
+		seen:    map[common.Address]bool{start: true},
+		states:  make(map[common.Address]*swappool.State),
+		best:    make(map[common.Address][]*big.Int),
+	}, nil
+}
+
+// dominated reports whether amount of token after hops hops is no better
+// than one already reached in no more hops, and records it otherwise.
+// better orders amounts, best first.
+func (s *search) dominated(token common.Address, hops int, amount *big.Int, better func(a, b *big.Int) bool) bool {
+	best, ok := s.best[token]
+	if !ok {
+		best = make([]*big.Int, s.maxHops+1)
+		s.best[token] = best
+	}
+	for _, b := range best[:hops+1] {
+		if b != nil && !better(amount, b) {
+			return true
+		}
+	}
+	best[hops] = amount
+	return false
+}
+
+func more(a, b *big.Int) bool { return a.Cmp(b) > 0 }
+func less(a, b *big.Int) bool { return a.Cmp(b) < 0 }
+
+// swap simulates hop on the search's copy of its pool and returns a
+// function that restores the two token states the swap changed.
+func (s *search) swap(hop Hop, amountIn *big.Int) (swappool.Quote, func(), error) {
+	state, ok := s.states[hop.Pool]
+	if !ok {
+		state = s.g.Pools[hop.Pool].Clone()
+		s.states[hop.Pool] = state
+	}
+	in, out := state.Tokens[hop.TokenIn], state.Tokens[hop.TokenOut]
+	if in == nil || out == nil {
+		return swappool.Quote{}, nil, fmt.Errorf("%w: %s -> %s", swappool.ErrUnknownToken, hop.TokenIn.Hex(), hop.TokenOut.Hex())
+	}
+	// Swap replaces the big.Ints it changes rather than writing to them,
+	// so copying the structs is enough to undo it.
+	savedIn, savedOut := *in, *out
+	undo := func() { *in, *out = savedIn, savedOut }
+	q, err := state.Swap(hop.TokenOut, hop.TokenIn, amountIn)
+	if err != nil {
+		undo()
+		return swappool.Quote{}, nil, err
+	}
+	return q, undo, nil
+}
+
+// forward walks from token holding amount, simulating each hop, and passes
+// every route that reaches tokenOut to found.
+func (s *search) forward(token, tokenOut common.Address, amount *big.Int, found func(Route)) {
+	for _, hop := range s.g.edges[token] {
+		if hop.TokenOut != tokenOut && s.seen[hop.TokenOut] {
+			continue
+		}
+		q, undo, err := s.swap(hop, amount)
+		if err != nil {
+			continue
+		}
+		s.path, s.quotes = append(s.path, hop), append(s.quotes, q)
+		if hop.TokenOut == tokenOut {
+			found(Route{Hops: slices.Clone(s.path), AmountOut: q.AmountOut, Quotes: slices.Clone(s.quotes)})
+		} else if len(s.path) < s.maxHops && q.AmountOut.Sign() > 0 && !s.dominated(hop.TokenOut, len(s.path), q.AmountOut, more) {
+			s.seen[hop.TokenOut] = true
+			s.forward(hop.TokenOut, tokenOut, q.AmountOut, found)
+			s.seen[hop.TokenOut] = false
+		}
+		s.path, s.quotes = s.path[:len(s.path)-1], s.quotes[:len(s.quotes)-1]
+		undo()
+	}
+}
+
+// backward walks from token, needing amount of it, to tokenIn with
+// getAmountIn on the unchanged pools, and passes each path that reaches
+// tokenIn to found with the input it needs.
+func (s *search) backward(token, tokenIn common.Address, amount *big.Int, found func(path []Hop, amountIn *big.Int)) {
+	for _, hop := range s.g.into[token] {
+		if hop.TokenIn != tokenIn && s.seen[hop.TokenIn] {
+			continue
+		}
+		need, err := s.g.Pools[hop.Pool].AmountIn(hop.TokenOut, hop.TokenIn, amount)
+		if err != nil {
+			continue
+		}
+		s.path = append(s.path, hop)
+		if hop.TokenIn == tokenIn {
+			path := slices.Clone(s.path)
+			slices.Reverse(path)
+			found(path, need)
+		} else if len(s.path) < s.maxHops && !s.dominated(hop.TokenIn, len(s.path), need, less) {
+			s.seen[hop.TokenIn] = true
+			s.backward(hop.TokenIn, tokenIn, need, found)
+			s.seen[hop.TokenIn] = false
+		}
+		s.path = s.path[:len(s.path)-1]
+	}
+}
+
+// simulate runs path with State.Swap on the search's pool copies and
+// undoes it again.
+func (s *search) simulate(path []Hop, amountIn *big.Int) (Route, error) {
+	route := Route{Hops: path, AmountIn: amountIn, Quotes: make([]swappool.Quote, len(path))}
+	amount := amountIn
+	for i, hop := range path {
+		q, undo, err := s.swap(hop, amount)
+		if err != nil {
+			return Route{}, fmt.Errorf("hop %d via %s: %w", i, hop.Pool.Hex(), err)
+		}
+		defer undo()
+		route.Quotes[i] = q
+		amount = q.AmountOut
+	}
+	route.AmountOut = amount
+	return route, nil
+}
+
+// registryTokens enumerates each distinct registry with entryCount and
+// entry.
+func registryTokens(ctx context.Context, caller publish.Caller, registries []common.Address, blockNumber *big.Int) (map[common.Address][]common.Address, error) {
+	var distinct []common.Address
+	tokens := make(map[common.Address][]common.Address)
+	for _, registry := range registries {
+		if _, ok := tokens[registry]; registry != (common.Address{}) && !ok {
+			tokens[registry] = nil
+			distinct = append(distinct, registry)
+		}
+	}
+
+	counts := make([]big.Int, len(distinct))
+	calls := make([]w3types.RPCCaller, len(distinct))
+	for i, registry := range distinct {
+		calls[i] = eth.CallFunc(registry, funcEntryCount).AtBlock(blockNumber).Returns(&counts[i])
+	}
+	if err := publish.BatchCall(ctx, caller, calls, 0); err != nil {
+		return nil, fmt.Errorf("entryCount: %w", err)
+	}
+
+	calls = calls[:0]
+	for i, registry := range distinct {
+		entries := make([]common.Address, counts[i].Uint64())
+		for j := range entries {
+			calls = append(calls, eth.CallFunc(registry, funcEntry, big.NewInt(int64(j))).AtBlock(blockNumber).Returns(&entries[j]))
+		}
+		tokens[registry] = entries
+	}
+	if err := publish.BatchCall(ctx, caller, calls, 0); err != nil {
+		return nil, fmt.Errorf("entry: %w", err)
+	}
+	return tokens, nil
+}
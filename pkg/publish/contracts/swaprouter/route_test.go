@@ -0,0 +1,138 @@
+package swaprouter_test
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lmittmann/w3"
+
+	"github.com/cosmo-local-credit/protocol/pkg/internal/vmtest"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/accountsindex"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/feepolicy"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/swappool"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/swaprouter"
+)
+
+var funcAdd = w3.MustNewFunc("add(address)", "bool")
+
+// newRegisteredPool deploys a SwapPool charging feePPM whose tokenRegistry
+// lists tokens, and deposits liquidity of each.
+func newRegisteredPool(t *testing.T, e *vmtest.Env, feePPM int64, liquidity *big.Int, tokens ...common.Address) common.Address {
+	t.Helper()
+	init, err := accountsindex.EncodeInit(accountsindex.InitArgs{Owner: vmtest.Owner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := e.Proxy(accountsindex.Bytecode(), init)
+	if init, err = feepolicy.EncodeInit(feepolicy.InitArgs{Owner: vmtest.Owner, DefaultFee: big.NewInt(feePPM)}); err != nil {
+		t.Fatal(err)
+	}
+	policy := e.Proxy(feepolicy.Bytecode(), init)
+	if init, err = swappool.EncodeInit(swappool.InitArgs{
+		Name: "Pool", Symbol: "POOL", Decimals: 6, Owner: vmtest.Owner,
+		FeePolicy: policy, FeeAddress: common.Address{0x77}, TokenRegistry: registry,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pool := e.Proxy(swappool.Bytecode(), init)
+	for _, token := range tokens {
+		e.Send(registry, funcAdd, []any{token}, new(bool))
+		e.Send(token, funcApprove, []any{pool, liquidity}, new(bool))
+		e.Send(pool, funcDeposit, []any{token, liquidity})
+	}
+	return pool
+}
+
+func TestBestRoute(t *testing.T) {
+	e := vmtest.New(t)
+	supply := big.NewInt(1_000_000_000)
+	a := newToken(t, e, "A", supply, vmtest.Owner)
+	b := newToken(t, e, "B", supply, vmtest.Owner)
+	c := newToken(t, e, "C", supply, vmtest.Owner)
+	d := newToken(t, e, "D", supply, vmtest.Owner)
+
+	liquidity := big.NewInt(1_000_000)
+	names := map[common.Address]string{
+		// A -> B directly at 10%, or through C at 1% a hop.
+		newRegisteredPool(t, e, 100_000, liquidity, a, b): "AB",
+		newRegisteredPool(t, e, 10_000, liquidity, a, c):  "AC",
+		newRegisteredPool(t, e, 10_000, liquidity, c, b):  "CB",
+		// Through D without fees, but for at most 500. getAmountIn rounds
+		// up, so 400 out takes 402 in over two hops.
+		newRegisteredPool(t, e, 0, big.NewInt(500), a, d): "AD",
+		newRegisteredPool(t, e, 0, big.NewInt(500), d, b): "DB",
+	}
+	pools := make([]common.Address, 0, len(names))
+	for pool := range names {
+		pools = append(pools, pool)
+	}
+	g, err := swaprouter.BuildGraph(context.Background(), e.Caller(), pools, nil, nil)
+	if err != nil || len(g.Errors) > 0 {
+		t.Fatalf("graph: %v %v", err, g.Errors)
+	}
+
+	tests := []struct {
+		name      string
+		exactOut  bool
+		tokenOut  common.Address
+		amount    int64
+		maxHops   int
+		want      string
+		wantIn    int64
+		wantErr   error
+		wantOutGT int64
+	}{
+		{name: "exact input", tokenOut: b, amount: 1_000, want: "AC CB", wantOutGT: 900},
+		{name: "exact input, one hop", tokenOut: b, amount: 1_000, maxHops: 1, want: "AB"},
+		{name: "exact input within cap", tokenOut: b, amount: 400, want: "AD DB"},
+		{name: "exact output", exactOut: true, tokenOut: b, amount: 400, want: "AD DB", wantIn: 402},
+		{name: "exact output over cap", exactOut: true, tokenOut: b, amount: 1_000, want: "AC CB"},
+		{name: "too many hops", tokenOut: b, amount: 1_000, maxHops: swaprouter.MaxHops + 1, wantErr: swaprouter.ErrTooManyHops},
+		{name: "no route", tokenOut: common.Address{0x01}, amount: 1_000, wantErr: swaprouter.ErrNoRoute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Each search runs twice: the first must leave the graph as it
+			// found it.
+			for range 2 {
+				var route swaprouter.Route
+				if tt.exactOut {
+					route, err = g.BestExactOutput(a, tt.tokenOut, big.NewInt(tt.amount), tt.maxHops)
+				} else {
+					route, err = g.BestExactInput(a, tt.tokenOut, big.NewInt(tt.amount), tt.maxHops)
+				}
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err %v, want %v", err, tt.wantErr)
+				}
+				if err != nil {
+					return
+				}
+
+				var got []string
+				for _, hop := range route.Hops {
+					got = append(got, names[hop.Pool])
+				}
+				if strings.Join(got, " ") != tt.want || len(route.Quotes) != len(route.Hops) {
+					t.Errorf("route %v with %d quotes, want %s", got, len(route.Quotes), tt.want)
+				}
+				if route.AmountOut.Cmp(route.Quotes[len(route.Quotes)-1].AmountOut) != 0 ||
+					tt.exactOut && route.AmountOut.Int64() < tt.amount ||
+					tt.wantIn != 0 && route.AmountIn.Int64() != tt.wantIn ||
+					route.AmountOut.Int64() <= tt.wantOutGT {
+					t.Errorf("route %v: in %s, out %s", got, route.AmountIn, route.AmountOut)
+				}
+			}
+		})
+	}
+	for pool, state := range g.Pools {
+		for token, ts := range state.Tokens {
+			if ts.Balance.Cmp(big.NewInt(500)) != 0 && ts.Balance.Cmp(liquidity) != 0 {
+				t.Errorf("%s: balance of %s is %s after the searches", names[pool], token.Hex(), ts.Balance)
+			}
+		}
+	}
+}
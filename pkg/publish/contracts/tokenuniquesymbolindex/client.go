@@ -0,0 +1,247 @@
+package tokenuniquesymbolindex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+)
+
+var (
+	funcAddressOf  = w3.MustNewFunc("addressOf(bytes32)", "address")
+	funcEntryCount = w3.MustNewFunc("entryCount()", "uint256")
+	funcEntry      = w3.MustNewFunc("entry(uint256)", "address")
+	funcIdentifier = w3.MustNewFunc("identifier(uint256)", "bytes32")
+	funcHave       = w3.MustNewFunc("have(address)", "bool")
+	funcIsWriter   = w3.MustNewFunc("isWriter(address)", "bool")
+	funcOwner      = w3.MustNewFunc("owner()", "address")
+	funcRegister   = w3.MustNewFunc("register(address)", "bool")
+	funcSymbol     = w3.MustNewFunc("symbol()", "string")
+)
+
+var ErrNotWriter = errors.New("sender is neither owner nor writer of the index")
+
+// Entry is one registered token.
+type Entry struct {
+	Index  uint64
+	Token  common.Address
+	Symbol string
+}
+
+// RegisterResult is the outcome of registering one token. Err is set when a
+// pre-check failed (no transaction sent) or the transaction reverted.
+type RegisterResult struct {
+	Token  common.Address
+	Symbol string
+	TxHash common.Hash
+	Err    error
+}
+
+type Client struct {
+	caller  publish.Caller
+	address common.Address
+}
+
+func NewClient(caller publish.Caller, address common.Address) *Client {
+	return &Client{caller: caller, address: address}
+}
+
+func (c *Client) Address() common.Address {
+	return c.address
+}
+
+// AddressOf returns the token registered under symbol, or the zero address if
+// none is.
+func (c *Client) AddressOf(ctx context.Context, symbol string) (common.Address, error) {
+	key, err := publish.EncodeBytes32String(symbol)
+	if err != nil {
+		return common.Address{}, err
+	}
+	var token common.Address
+	if err := c.caller.CallCtx(ctx, eth.CallFunc(c.address, funcAddressOf, key).Returns(&token)); err != nil {
+		return common.Address{}, fmt.Errorf("addressOf: %w", err)
+	}
+	return token, nil
+}
+
+func (c *Client) Count(ctx context.Context) (uint64, error) {
+	var count big.Int
+	if err := c.caller.CallCtx(ctx, eth.CallFunc(c.address, funcEntryCount).Returns(&count)); err != nil {
+		return 0, fmt.Errorf("entryCount: %w", err)
+	}
+	return count.Uint64(), nil
+}
+
+// Entries enumerates every registered token and its symbol with batched
+// calls pinned to a single block.
+func (c *Client) Entries(ctx context.Context) ([]Entry, error) {
+	var head *big.Int
+	if err := c.caller.CallCtx(ctx, eth.BlockNumber().Returns(&head)); err != nil {
+		return nil, fmt.Errorf("get block number: %w", err)
+	}
+
+	var count big.Int
+	if err := c.caller.CallCtx(ctx, eth.CallFunc(c.address, funcEntryCount).AtBlock(head).Returns(&count)); err != nil {
+		return nil, fmt.Errorf("entryCount: %w", err)
+	}
+
+	n := count.Uint64()
+	entries := make([]Entry, n)
+	keys := make([][32]byte, n)
+	calls := make([]w3types.RPCCaller, 0, 2*n)
+	for i := range entries {
+		idx := new(big.Int).SetUint64(uint64(i))
+		entries[i].Index = uint64(i)
+		calls = append(calls,
+			eth.CallFunc(c.address, funcEntry, idx).AtBlock(head).Returns(&entries[i].Token),
+			eth.CallFunc(c.address, funcIdentifier, idx).AtBlock(head).Returns(&keys[i]),
+		)
+	}
+	if err := publish.BatchCall(ctx, c.caller, calls, 0); err != nil {
+		return nil, fmt.Errorf("entry / identifier: %w", err)
+	}
+	for i := range entries {
+		entries[i].Symbol = publish.DecodeBytes32(keys[i])
+	}
+	return entries, nil
+}
+
+// CanWrite reports whether account may register tokens. The public isWriter
+// mapping does not include the owner, so both are checked.
+func (c *Client) CanWrite(ctx context.Context, account common.Address) (bool, error) {
+	var (
+		writer bool
+		owner  common.Address
+	)
+	if err := c.caller.CallCtx(ctx,
+		eth.CallFunc(c.address, funcIsWriter, account).Returns(&writer),
+		eth.CallFunc(c.address, funcOwner).Returns(&owner),
+	); err != nil {
+		return false, fmt.Errorf("isWriter / owner: %w", err)
+	}
+	return writer || owner == account, nil
+}
+
+// CheckRegister runs the pre-checks register() would otherwise revert on for
+// each token: symbol() must succeed, fit in 32 bytes, not be taken by
+// another token or an earlier token in the same list, and the token must not
+// already be indexed. Results carry the symbol and any pre-check error.
+func (c *Client) CheckRegister(ctx context.Context, tokens []common.Address) ([]RegisterResult, error) {
+	results := make([]RegisterResult, len(tokens))
+	have := make([]bool, len(tokens))
+	symbolCalls := make([]w3types.RPCCaller, len(tokens))
+	haveCalls := make([]w3types.RPCCaller, len(tokens))
+	for i, token := range tokens {
+		results[i].Token = token
+		symbolCalls[i] = eth.CallFunc(token, funcSymbol).Returns(&results[i].Symbol)
+		haveCalls[i] = eth.CallFunc(c.address, funcHave, token).Returns(&have[i])
+	}
+	if err := publish.BatchCall(ctx, c.caller, haveCalls, 0); err != nil {
+		return nil, fmt.Errorf("have: %w", err)
+	}
+
+	// symbol() failures are per token.
+	errs, err := publish.BatchCallEach(ctx, c.caller, symbolCalls, 0)
+	if err != nil {
+		return nil, fmt.Errorf("symbol: %w", err)
+	}
+	for i, callErr := range errs {
+		if callErr != nil {
+			results[i].Err = fmt.Errorf("symbol(): %w", callErr)
+		}
+	}
+
+	keys := make([][32]byte, len(tokens))
+	taken := make([]common.Address, len(tokens))
+	var lookups []w3types.RPCCaller
+	for i := range results {
+		if results[i].Err != nil {
+			continue
+		}
+		if have[i] {
+			results[i].Err = errors.New("token already registered")
+			continue
+		}
+		key, err := publish.EncodeBytes32String(results[i].Symbol)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		keys[i] = key
+		lookups = append(lookups, eth.CallFunc(c.address, funcAddressOf, key).Returns(&taken[i]))
+	}
+	if err := publish.BatchCall(ctx, c.caller, lookups, 0); err != nil {
+		return nil, fmt.Errorf("addressOf: %w", err)
+	}
+
+	claimed := make(map[[32]byte]common.Address, len(tokens))
+	for i := range results {
+		if results[i].Err != nil {
+			continue
+		}
+		if taken[i] != (common.Address{}) {
+			results[i].Err = fmt.Errorf("symbol %q already registered to %s", results[i].Symbol, taken[i].Hex())
+			continue
+		}
+		if prev, ok := claimed[keys[i]]; ok {
+			results[i].Err = fmt.Errorf("symbol %q also used by %s earlier in the list", results[i].Symbol, prev.Hex())
+			continue
+		}
+		claimed[keys[i]] = results[i].Token
+	}
+	return results, nil
+}
+
+// Register registers each token that passes CheckRegister. Transactions are
+// sent back to back and then all receipts are awaited; tokens that failed a
+// pre-check are reported without sending anything.
+func (c *Client) Register(ctx context.Context, d *publish.Deployer, tokens []common.Address) ([]RegisterResult, error) {
+	ok, err := c.CanWrite(ctx, d.Address())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotWriter
+	}
+
+	results, err := c.CheckRegister(ctx, tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range results {
+		if results[i].Err != nil {
+			continue
+		}
+		calldata, err := funcRegister.EncodeArgs(results[i].Token)
+		if err != nil {
+			results[i].Err = fmt.Errorf("encode register: %w", err)
+			continue
+		}
+		// A failed send gives its nonce back, so the tokens after it are
+		// not queued behind a gap and can still be sent.
+		results[i].TxHash, results[i].Err = d.Transact(ctx, c.address, nil, calldata, 0)
+	}
+
+	for i := range results {
+		if results[i].Err != nil {
+			continue
+		}
+		receipt, err := d.WaitForReceipt(ctx, results[i].TxHash)
+		if err != nil {
+			return results, fmt.Errorf("wait for %s: %w", results[i].TxHash.Hex(), err)
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			results[i].Err = fmt.Errorf("register reverted in tx %s", results[i].TxHash.Hex())
+		}
+	}
+	return results, nil
+}
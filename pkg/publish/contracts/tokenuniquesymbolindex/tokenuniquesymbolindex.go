@@ -2,6 +2,7 @@ package tokenuniquesymbolindex
 
 import (
 	_ "embed"
+	"fmt"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/lmittmann/w3"
@@ -43,13 +44,12 @@ func Bytecode() []byte {
 }
 
 func EncodeInit(args InitArgs) ([]byte, error) {
-	return funcInitialize.EncodeArgs(args.Owner, args.InitialTokens, toBytes32Slice(args.InitialSymbols))
-}
-
-func toBytes32Slice(values [][]byte) [][32]byte {
-	out := make([][32]byte, len(values))
-	for i, value := range values {
-		out[i] = common.BytesToHash(common.RightPadBytes(value, 32))
+	if len(args.InitialTokens) != len(args.InitialSymbols) {
+		return nil, fmt.Errorf("%d initial tokens but %d symbols", len(args.InitialTokens), len(args.InitialSymbols))
+	}
+	symbols, err := publish.EncodeBytes32Slice(args.InitialSymbols)
+	if err != nil {
+		return nil, fmt.Errorf("encode symbols: %w", err)
 	}
-	return out
+	return funcInitialize.EncodeArgs(args.Owner, args.InitialTokens, symbols)
 }
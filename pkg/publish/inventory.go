@@ -0,0 +1,319 @@
+package publish
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+)
+
+var (
+	eventUpgraded = w3.MustNewEvent(
+		"Upgraded(address indexed,address indexed)",
+	)
+	eventAdminChanged = w3.MustNewEvent(
+		"AdminChanged(address indexed,address indexed)",
+	)
+	eventHandoverRequested = w3.MustNewEvent(
+		"OwnershipHandoverRequested(address indexed)",
+	)
+
+	funcAdminOf                    = w3.MustNewFunc("adminOf(address)", "address")
+	funcOwner                      = w3.MustNewFunc("owner()", "address")
+	funcOwnershipHandoverExpiresAt = w3.MustNewFunc("ownershipHandoverExpiresAt(address)", "uint256")
+)
+
+// Identifier names the contract package whose runtime code is code, e.g.
+// contracts.IdentifyPackage.
+type Identifier func(code []byte) (string, bool)
+
+type (
+	// ProxyRecord is one proxy deployed by a factory. Implementation and
+	// Admin follow the factory's Upgraded and AdminChanged events; Warnings
+	// note where they disagree with the implementation slot or adminOf.
+	// Contract is the package identified from the implementation code, empty
+	// if unknown. Owner is zero and OwnerErr set if owner() failed.
+	//
+	// Handovers lists ownership handovers that were requested and are still
+	// pending; an expired one can no longer be completed.
+	ProxyRecord struct {
+		Proxy          common.Address `json:"proxy"`
+		DeployedBlock  uint64         `json:"deployed_block"`
+		DeployTx       common.Hash    `json:"deploy_tx"`
+		Contract       string         `json:"contract"`
+		Implementation common.Address `json:"implementation"`
+		Upgrades       int            `json:"upgrades"`
+		Admin          common.Address `json:"admin"`
+		AdminChanges   int            `json:"admin_changes"`
+		Owner          common.Address `json:"owner"`
+		OwnerErr       string         `json:"owner_error,omitempty"`
+		Handovers      []Handover     `json:"handovers,omitempty"`
+		Warnings       []string       `json:"warnings,omitempty"`
+	}
+
+	Handover struct {
+		PendingOwner common.Address `json:"pending_owner"`
+		ExpiresAt    uint64         `json:"expires_at"`
+		Expired      bool           `json:"expired"`
+	}
+
+	// Inventory is every proxy a factory deployed in a block range, in
+	// deployment order, with state read at ToBlock.
+	Inventory struct {
+		Factory   common.Address `json:"factory"`
+		FromBlock uint64         `json:"from_block"`
+		ToBlock   uint64         `json:"to_block"`
+		Proxies   []ProxyRecord  `json:"proxies"`
+	}
+)
+
+// BuildInventory scans factory's Deployed, Upgraded and AdminChanged events
+// in [fromBlock, toBlock] and reads the state of every proxy at toBlock
+// (zero for the current head). identify may be nil to skip identifying
+// implementations. logRange bounds each eth_getLogs request; zero uses
+// DefaultLogRange.
+func BuildInventory(ctx context.Context, caller Caller, factory common.Address, fromBlock, toBlock uint64, identify Identifier, logRange uint64) (*Inventory, error) {
+	var header *types.Header
+	var number *big.Int
+	if toBlock != 0 {
+		number = new(big.Int).SetUint64(toBlock)
+	}
+	if err := caller.CallCtx(ctx, eth.HeaderByNumber(number).Returns(&header)); err != nil {
+		return nil, fmt.Errorf("get header: %w", err)
+	}
+	block := header.Number
+	inv := &Inventory{Factory: factory, FromBlock: fromBlock, ToBlock: block.Uint64()}
+
+	query := ethereum.FilterQuery{
+		Addresses: []common.Address{factory},
+		Topics:    [][]common.Hash{{eventDeployed.Topic0, eventUpgraded.Topic0, eventAdminChanged.Topic0}},
+	}
+	logs, err := GetLogs(ctx, caller, query, fromBlock, inv.ToBlock, logRange)
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[common.Address]int)
+	for _, log := range logs {
+		if len(log.Topics) < 3 {
+			continue
+		}
+		proxy := common.BytesToAddress(log.Topics[1].Bytes())
+		switch log.Topics[0] {
+		case eventDeployed.Topic0:
+			if len(log.Topics) != 4 {
+				continue
+			}
+			index[proxy] = len(inv.Proxies)
+			inv.Proxies = append(inv.Proxies, ProxyRecord{
+				Proxy:          proxy,
+				DeployedBlock:  log.BlockNumber,
+				DeployTx:       log.TxHash,
+				Implementation: common.BytesToAddress(log.Topics[2].Bytes()),
+				Admin:          common.BytesToAddress(log.Topics[3].Bytes()),
+			})
+		case eventUpgraded.Topic0:
+			if i, ok := index[proxy]; ok {
+				inv.Proxies[i].Implementation = common.BytesToAddress(log.Topics[2].Bytes())
+				inv.Proxies[i].Upgrades++
+			}
+		case eventAdminChanged.Topic0:
+			if i, ok := index[proxy]; ok {
+				inv.Proxies[i].Admin = common.BytesToAddress(log.Topics[2].Bytes())
+				inv.Proxies[i].AdminChanges++
+			}
+		}
+	}
+	if len(inv.Proxies) == 0 {
+		return inv, nil
+	}
+
+	if err := inventoryState(ctx, caller, inv, factory, block, identify); err != nil {
+		return nil, err
+	}
+	if err := inventoryHandovers(ctx, caller, inv, index, fromBlock, header, logRange); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// inventoryState reads each proxy's implementation slot, adminOf, owner()
+// and implementation code at block. The code is fetched for the
+// implementation the events name, and again for the slot's where the two
+// disagree, so that Contract always describes Implementation.
+func inventoryState(ctx context.Context, caller Caller, inv *Inventory, factory common.Address, block *big.Int, identify Identifier) error {
+	var (
+		n      = len(inv.Proxies)
+		slots  = make([]common.Hash, n)
+		admins = make([]common.Address, n)
+		codes  = make([][]byte, n)
+		calls  = make([]w3types.RPCCaller, 0, 4*n)
+	)
+	for i := range inv.Proxies {
+		p := &inv.Proxies[i]
+		calls = append(calls,
+			eth.StorageAt(p.Proxy, ImplementationSlot, block).Returns(&slots[i]),
+			eth.CallFunc(factory, funcAdminOf, p.Proxy).AtBlock(block).Returns(&admins[i]),
+			eth.Code(p.Implementation, block).Returns(&codes[i]),
+			eth.CallFunc(p.Proxy, funcOwner).AtBlock(block).Returns(&p.Owner),
+		)
+	}
+	errs, err := BatchCallEach(ctx, caller, calls, 0)
+	if err != nil {
+		return fmt.Errorf("get proxy state: %w", err)
+	}
+
+	var mismatched []int
+	for i := range inv.Proxies {
+		p := &inv.Proxies[i]
+		for j, field := range []string{"implementation slot", "adminOf", "implementation code"} {
+			if errs[4*i+j] != nil {
+				return fmt.Errorf("%s of %s: %w", field, p.Proxy.Hex(), errs[4*i+j])
+			}
+		}
+		if errs[4*i+3] != nil {
+			p.Owner, p.OwnerErr = common.Address{}, errs[4*i+3].Error()
+		}
+		if impl := common.BytesToAddress(slots[i].Bytes()); impl != p.Implementation {
+			p.Warnings = append(p.Warnings, fmt.Sprintf("implementation slot is %s, events say %s", impl.Hex(), p.Implementation.Hex()))
+			p.Implementation = impl
+			mismatched = append(mismatched, i)
+		}
+		if admins[i] != p.Admin {
+			p.Warnings = append(p.Warnings, fmt.Sprintf("adminOf is %s, events say %s", admins[i].Hex(), p.Admin.Hex()))
+			p.Admin = admins[i]
+		}
+	}
+	if identify == nil {
+		return nil
+	}
+
+	if len(mismatched) > 0 {
+		calls = calls[:0]
+		for _, i := range mismatched {
+			calls = append(calls, eth.Code(inv.Proxies[i].Implementation, block).Returns(&codes[i]))
+		}
+		if err := BatchCall(ctx, caller, calls, 0); err != nil {
+			return fmt.Errorf("get implementation code: %w", err)
+		}
+	}
+	for i := range inv.Proxies {
+		inv.Proxies[i].Contract, _ = identify(codes[i])
+	}
+	return nil
+}
+
+// inventoryHandovers finds the ownership handovers requested on each proxy
+// and keeps those whose ownershipHandoverExpiresAt is still set. A
+// completed or cancelled handover reads zero.
+func inventoryHandovers(ctx context.Context, caller Caller, inv *Inventory, index map[common.Address]int, fromBlock uint64, header *types.Header, logRange uint64) error {
+	proxies := make([]common.Address, len(inv.Proxies))
+	for i, p := range inv.Proxies {
+		proxies[i] = p.Proxy
+	}
+	query := ethereum.FilterQuery{Addresses: proxies, Topics: [][]common.Hash{{eventHandoverRequested.Topic0}}}
+	logs, err := GetLogs(ctx, caller, query, fromBlock, header.Number.Uint64(), logRange)
+	if err != nil {
+		return err
+	}
+
+	type candidate struct {
+		proxy, pending common.Address
+	}
+	var (
+		candidates []candidate
+		seen       = make(map[candidate]bool)
+	)
+	for _, log := range logs {
+		if len(log.Topics) != 2 {
+			continue
+		}
+		c := candidate{log.Address, common.BytesToAddress(log.Topics[1].Bytes())}
+		if !seen[c] {
+			seen[c] = true
+			candidates = append(candidates, c)
+		}
+	}
+
+	expiries := make([]big.Int, len(candidates))
+	calls := make([]w3types.RPCCaller, len(candidates))
+	for i, c := range candidates {
+		calls[i] = eth.CallFunc(c.proxy, funcOwnershipHandoverExpiresAt, c.pending).AtBlock(header.Number).Returns(&expiries[i])
+	}
+	errs, err := BatchCallEach(ctx, caller, calls, 0)
+	if err != nil {
+		return fmt.Errorf("get ownership handovers: %w", err)
+	}
+	for i, c := range candidates {
+		if errs[i] != nil || expiries[i].Sign() == 0 {
+			continue
+		}
+		p := &inv.Proxies[index[c.proxy]]
+		expiresAt := expiries[i].Uint64()
+		p.Handovers = append(p.Handovers, Handover{PendingOwner: c.pending, ExpiresAt: expiresAt, Expired: header.Time > expiresAt})
+	}
+	return nil
+}
+
+func (inv *Inventory) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(inv)
+}
+
+// WriteTable writes one row per proxy, followed by its warnings.
+func (inv *Inventory) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "PROXY\tCONTRACT\tIMPLEMENTATION\tADMIN\tOWNER\tPENDING HANDOVER\tDEPLOYED\n")
+	for _, p := range inv.Proxies {
+		contract := p.Contract
+		if contract == "" {
+			contract = "unknown"
+		}
+		owner := p.Owner.Hex()
+		if p.OwnerErr != "" {
+			owner = "-"
+		}
+		handovers := make([]string, len(p.Handovers))
+		for i, h := range p.Handovers {
+			state := "until"
+			if h.Expired {
+				state = "expired"
+			}
+			handovers[i] = fmt.Sprintf("%s (%s %s)", h.PendingOwner.Hex(), state, time.Unix(int64(h.ExpiresAt), 0).UTC().Format(time.RFC3339))
+		}
+		if len(handovers) == 0 {
+			handovers = append(handovers, "-")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s%s\t%s%s\t%s\t%s\t%d\n",
+			p.Proxy.Hex(), contract,
+			p.Implementation.Hex(), changes(p.Upgrades, "upgrade"),
+			p.Admin.Hex(), changes(p.AdminChanges, "change"),
+			owner, strings.Join(handovers, ", "), p.DeployedBlock)
+		for _, warning := range p.Warnings {
+			fmt.Fprintf(tw, "\twarning: %s\t\t\t\t\t\n", warning)
+		}
+	}
+	return tw.Flush()
+}
+
+func changes(n int, noun string) string {
+	switch n {
+	case 0:
+		return ""
+	case 1:
+		return fmt.Sprintf(" (1 %s)", noun)
+	default:
+		return fmt.Sprintf(" (%d %ss)", n, noun)
+	}
+}
@@ -0,0 +1,326 @@
+package publish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+)
+
+const (
+	// DefaultMulticallCalldata is the maximum calldata size, in bytes, of
+	// one aggregate3 call.
+	DefaultMulticallCalldata = 100_000
+
+	// DefaultMulticallGas is the gas limit of one aggregate3 call.
+	DefaultMulticallGas uint64 = 30_000_000
+
+	// DefaultMulticallCallGas is the gas assumed per aggregated call when
+	// packing calls under the gas limit.
+	DefaultMulticallCallGas uint64 = 100_000
+)
+
+// Multicall3Address is the address Multicall3 is deployed at on most chains.
+var Multicall3Address = common.HexToAddress("0xcA11bde05977b3631167028862bE2a6E1b8E4aA1")
+
+var (
+	funcAggregate3 = w3.MustNewFunc(
+		"aggregate3((address target, bool allowFailure, bytes callData)[] calls)",
+		"(bool success, bytes returnData)[] returnData",
+	)
+	errorSelector = []byte{0x08, 0xc3, 0x79, 0xa0} // Error(string)
+)
+
+type (
+	// MulticallConfig configures a Multicall. Zero values use the defaults.
+	MulticallConfig struct {
+		Address     common.Address
+		MaxCalldata int
+		Gas         uint64
+		CallGas     uint64
+	}
+
+	// Multicall is a Caller that sends eth_calls through Multicall3's
+	// aggregate3, so that a batch of reads costs one eth_call per chunk. Any
+	// Caller-based reader can use it in place of a *w3.Client.
+	//
+	// Only plain reads are aggregated: calls that set a sender, value, gas
+	// or state overrides, and requests other than eth_call, are sent
+	// alongside as a JSON-RPC batch. If Multicall3 has no code, all calls are
+	// sent that way.
+	Multicall struct {
+		caller Caller
+		cfg    MulticallConfig
+
+		mu       sync.Mutex
+		checked  bool
+		deployed bool
+	}
+
+	call3 struct {
+		Target       common.Address
+		AllowFailure bool
+		CallData     []byte
+	}
+
+	result3 struct {
+		Success    bool
+		ReturnData []byte
+	}
+)
+
+// RevertError is the error of a call that reverted inside an aggregate3
+// call. Like the error of a reverted eth_call, it implements rpc.DataError
+// with the revert data as hex.
+type RevertError struct {
+	Data []byte
+}
+
+func (e *RevertError) Error() string {
+	if bytes.HasPrefix(e.Data, errorSelector) {
+		if reason, err := abi.UnpackRevert(e.Data); err == nil {
+			return "execution reverted: " + reason
+		}
+	}
+	return "execution reverted"
+}
+
+func (e *RevertError) ErrorData() any {
+	return hexutil.Encode(e.Data)
+}
+
+func NewMulticall(caller Caller, cfg MulticallConfig) *Multicall {
+	if cfg.Address == (common.Address{}) {
+		cfg.Address = Multicall3Address
+	}
+	if cfg.MaxCalldata <= 0 {
+		cfg.MaxCalldata = DefaultMulticallCalldata
+	}
+	if cfg.Gas == 0 {
+		cfg.Gas = DefaultMulticallGas
+	}
+	if cfg.CallGas == 0 {
+		cfg.CallGas = DefaultMulticallCallGas
+	}
+	return &Multicall{caller: caller, cfg: cfg}
+}
+
+// multicallReq is an eth_call that can be aggregated.
+type multicallReq struct {
+	index int
+	elem  rpc.BatchElem
+	call  call3
+}
+
+// CallCtx sends calls like w3.Client.CallCtx: the error of each call is
+// reported in a w3.CallErrors at its index. Aggregated calls at the same
+// block are chunked by calldata size and gas; a chunk whose aggregate3 call
+// fails as a whole is split in half and retried, down to single calls sent
+// as plain eth_calls.
+func (m *Multicall) CallCtx(ctx context.Context, calls ...w3types.RPCCaller) error {
+	if len(calls) == 0 {
+		return nil
+	}
+	deployed, err := m.isDeployed(ctx)
+	if err != nil {
+		return err
+	}
+	if !deployed {
+		return m.caller.CallCtx(ctx, calls...)
+	}
+
+	var (
+		direct  []int
+		blocks  []string
+		byBlock = make(map[string][]multicallReq)
+	)
+	for i, call := range calls {
+		elem, err := call.CreateRequest()
+		if err != nil {
+			return err
+		}
+		block, c, ok := aggregatable(elem)
+		if !ok {
+			direct = append(direct, i)
+			continue
+		}
+		if _, ok := byBlock[block]; !ok {
+			blocks = append(blocks, block)
+		}
+		byBlock[block] = append(byBlock[block], multicallReq{index: i, elem: elem, call: c})
+	}
+
+	var chunks [][]multicallReq
+	for _, block := range blocks {
+		chunks = append(chunks, m.chunk(byBlock[block])...)
+	}
+	errs := make([]error, len(calls))
+	if err := m.send(ctx, calls, direct, chunks, errs); err != nil {
+		return err
+	}
+	for _, err := range errs {
+		if err != nil {
+			return w3.CallErrors(errs)
+		}
+	}
+	return nil
+}
+
+// send sends the direct calls and one aggregate3 call per chunk in a single
+// JSON-RPC batch, recording each call's error in errs. Chunks that fail are
+// split and sent again.
+func (m *Multicall) send(ctx context.Context, calls []w3types.RPCCaller, direct []int, chunks [][]multicallReq, errs []error) error {
+	for len(direct) > 0 || len(chunks) > 0 {
+		batch := make([]w3types.RPCCaller, 0, len(direct)+len(chunks))
+		for _, i := range direct {
+			batch = append(batch, calls[i])
+		}
+		results := make([][]result3, len(chunks))
+		for i, chunk := range chunks {
+			c3 := make([]call3, len(chunk))
+			for j, req := range chunk {
+				c3[j] = req.call
+			}
+			input, err := funcAggregate3.EncodeArgs(c3)
+			if err != nil {
+				return fmt.Errorf("encode aggregate3: %w", err)
+			}
+			msg := &w3types.Message{To: &m.cfg.Address, Input: input, Gas: m.cfg.Gas}
+			batch = append(batch, &aggregateCall{msg: msg, block: chunk[0].elem.Args[1].(string), results: &results[i]})
+		}
+
+		err := m.caller.CallCtx(ctx, batch...)
+		var callErrs w3.CallErrors
+		if err != nil && !errors.As(err, &callErrs) {
+			return err
+		}
+		for k, i := range direct {
+			if callErrs != nil {
+				errs[i] = callErrs[k]
+			}
+		}
+
+		var retry [][]multicallReq
+		direct = nil
+		for i, chunk := range chunks {
+			if callErrs != nil && callErrs[len(batch)-len(chunks)+i] != nil || len(results[i]) != len(chunk) {
+				if len(chunk) == 1 {
+					direct = append(direct, chunk[0].index)
+				} else {
+					retry = append(retry, chunk[:len(chunk)/2], chunk[len(chunk)/2:])
+				}
+				continue
+			}
+			for j, req := range chunk {
+				errs[req.index] = resolve(calls[req.index], req.elem, results[i][j])
+			}
+		}
+		chunks = retry
+	}
+	return nil
+}
+
+// chunk splits reqs so that each chunk stays within the calldata size and
+// gas limits.
+func (m *Multicall) chunk(reqs []multicallReq) [][]multicallReq {
+	maxCalls := max(1, int(m.cfg.Gas/m.cfg.CallGas))
+
+	var (
+		chunks [][]multicallReq
+		start  int
+		size   int
+	)
+	for i, req := range reqs {
+		// Each call3 takes a head word, three tuple words and its padded
+		// calldata.
+		n := 32*5 + (len(req.call.CallData)+31)/32*32
+		if i > start && (size+n > m.cfg.MaxCalldata || i-start == maxCalls) {
+			chunks = append(chunks, reqs[start:i])
+			start, size = i, 0
+		}
+		size += n
+	}
+	return append(chunks, reqs[start:])
+}
+
+func (m *Multicall) isDeployed(ctx context.Context) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.checked {
+		return m.deployed, nil
+	}
+	var code []byte
+	if err := m.caller.CallCtx(ctx, eth.Code(m.cfg.Address, nil).Returns(&code)); err != nil {
+		return false, fmt.Errorf("get Multicall3 code: %w", err)
+	}
+	m.checked, m.deployed = true, len(code) > 0
+	return m.deployed, nil
+}
+
+// aggregatable reports whether elem is an eth_call that behaves the same
+// inside aggregate3, and returns its block argument and call.
+func aggregatable(elem rpc.BatchElem) (string, call3, bool) {
+	if elem.Method != "eth_call" || len(elem.Args) != 2 {
+		return "", call3{}, false
+	}
+	msg, ok := elem.Args[0].(*w3types.Message)
+	block, ok2 := elem.Args[1].(string)
+	if !ok || !ok2 || msg.To == nil {
+		return "", call3{}, false
+	}
+	if msg.From != (common.Address{}) || msg.Value != nil && msg.Value.Sign() != 0 || msg.Gas != 0 ||
+		len(msg.AccessList) > 0 || len(msg.SetCodeAuthorizations) > 0 {
+		return "", call3{}, false
+	}
+	return block, call3{Target: *msg.To, AllowFailure: true, CallData: msg.Input}, true
+}
+
+// resolve hands the result of an aggregated call to its RPCCaller as if it
+// had come from its own eth_call.
+func resolve(call w3types.RPCCaller, elem rpc.BatchElem, r result3) error {
+	if !r.Success {
+		elem.Error = &RevertError{Data: r.ReturnData}
+	} else {
+		raw, err := json.Marshal(hexutil.Bytes(r.ReturnData))
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(raw, elem.Result); err != nil {
+			return err
+		}
+	}
+	return call.HandleResponse(elem)
+}
+
+// aggregateCall is an aggregate3 eth_call with a raw block argument.
+type aggregateCall struct {
+	msg     *w3types.Message
+	block   string
+	output  hexutil.Bytes
+	results *[]result3
+}
+
+func (c *aggregateCall) CreateRequest() (rpc.BatchElem, error) {
+	return rpc.BatchElem{
+		Method: "eth_call",
+		Args:   []any{c.msg, c.block},
+		Result: &c.output,
+	}, nil
+}
+
+func (c *aggregateCall) HandleResponse(elem rpc.BatchElem) error {
+	if err := elem.Error; err != nil {
+		return err
+	}
+	return funcAggregate3.DecodeReturns(c.output, c.results)
+}
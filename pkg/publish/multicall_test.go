@@ -0,0 +1,196 @@
+package publish_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/internal/vmtest"
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+)
+
+var (
+	funcAggregate3 = w3.MustNewFunc(
+		"aggregate3((address target, bool allowFailure, bytes callData)[] calls)",
+		"(bool success, bytes returnData)[] returnData",
+	)
+	funcValue = w3.MustNewFunc("value()", "uint256")
+)
+
+type (
+	call3 struct {
+		Target       common.Address
+		AllowFailure bool
+		CallData     []byte
+	}
+
+	result3 struct {
+		Success    bool
+		ReturnData []byte
+	}
+)
+
+// aggregator stands in for Multicall3 in front of a vmtest Caller. It runs
+// the calls of each aggregate3 one by one and records how many there were.
+// With fail set, every aggregate3 fails as a whole, as one that runs out
+// of gas does, and so does one of more than maxCalls calls.
+type aggregator struct {
+	caller   *vmtest.Caller
+	maxCalls int
+	fail     bool
+
+	sizes  []int
+	direct int
+}
+
+func (a *aggregator) CallCtx(ctx context.Context, calls ...w3types.RPCCaller) error {
+	errs := make(w3.CallErrors, len(calls))
+	failed := false
+	for i, call := range calls {
+		elem, err := call.CreateRequest()
+		if err != nil {
+			return err
+		}
+		if msg, ok := callMessage(elem.Method, elem.Args); ok && *msg.To == publish.Multicall3Address {
+			elem.Error = a.aggregate(ctx, msg.Input, elem.Result)
+			errs[i] = call.HandleResponse(elem)
+		} else {
+			if ok {
+				a.direct++
+			}
+			var callErrs w3.CallErrors
+			if err := a.caller.CallCtx(ctx, call); errors.As(err, &callErrs) {
+				errs[i] = callErrs[0]
+			} else if err != nil {
+				return err
+			}
+		}
+		failed = failed || errs[i] != nil
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+func (a *aggregator) aggregate(ctx context.Context, input []byte, result any) error {
+	var calls []call3
+	if err := funcAggregate3.DecodeArgs(input, &calls); err != nil {
+		return err
+	}
+	a.sizes = append(a.sizes, len(calls))
+	if a.fail || a.maxCalls > 0 && len(calls) > a.maxCalls {
+		return errors.New("out of gas")
+	}
+
+	results := make([]result3, len(calls))
+	for i, c := range calls {
+		var output []byte
+		err := a.caller.CallCtx(ctx, eth.Call(&w3types.Message{To: &c.Target, Input: c.CallData}, nil, nil).Returns(&output))
+		results[i] = result3{Success: err == nil, ReturnData: output}
+	}
+	output, err := funcAggregate3.Returns.Pack(results)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(hexutil.Bytes(output))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, result)
+}
+
+// callMessage returns the message of an eth_call.
+func callMessage(method string, args []any) (*w3types.Message, bool) {
+	if method != "eth_call" || len(args) == 0 {
+		return nil, false
+	}
+	msg, ok := args[0].(*w3types.Message)
+	return msg, ok && msg.To != nil
+}
+
+func TestMulticall(t *testing.T) {
+	const n = 10
+	tests := []struct {
+		name        string
+		cfg         publish.MulticallConfig
+		notDeployed bool
+		maxCalls    int
+		fail        bool
+		// revert makes target 3 revert, and sender gives call 0 a sender,
+		// which aggregate3 cannot keep.
+		revert     bool
+		sender     bool
+		wantSizes  string
+		wantDirect int
+	}{
+		{name: "one chunk", wantSizes: "[10]"},
+		{name: "gas limit", cfg: publish.MulticallConfig{Gas: 400_000, CallGas: 100_000}, wantSizes: "[4 4 2]"},
+		// Each call3 takes 5 words and one word of calldata.
+		{name: "calldata limit", cfg: publish.MulticallConfig{MaxCalldata: 400}, wantSizes: "[2 2 2 2 2]"},
+		{name: "split on failure", maxCalls: 3, wantSizes: "[10 5 5 2 3 2 3]"},
+		{name: "split down to single calls", maxCalls: 1, wantSizes: "[10 5 5 2 3 2 3 1 1 1 2 1 1 1 2 1 1 1 1]"},
+		{name: "every aggregate fails", fail: true, wantSizes: "[10 5 5 2 3 2 3 1 1 1 2 1 1 1 2 1 1 1 1]", wantDirect: n},
+		{name: "not deployed", notDeployed: true, wantSizes: "[]", wantDirect: n},
+		{name: "revert", revert: true, wantSizes: "[10]"},
+		{name: "sender sent directly", sender: true, wantSizes: "[9]", wantDirect: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := vmtest.New(t)
+			if !tt.notDeployed {
+				e.VM.SetCode(publish.Multicall3Address, codeStop)
+			}
+			targets := make([]common.Address, n)
+			for i := range targets {
+				targets[i] = common.BigToAddress(big.NewInt(int64(0x1000 + i)))
+				e.SetReturnData(targets[i], vmtest.Word(big.NewInt(int64(i))))
+			}
+			if tt.revert {
+				e.VM.SetCode(targets[3], codeRevert)
+			}
+
+			a := &aggregator{caller: e.Caller(), maxCalls: tt.maxCalls, fail: tt.fail}
+			m := publish.NewMulticall(a, tt.cfg)
+			values := make([]big.Int, n)
+			calls := make([]w3types.RPCCaller, n)
+			for i, target := range targets {
+				calls[i] = eth.CallFunc(target, funcValue).Returns(&values[i])
+			}
+			if tt.sender {
+				calls[0] = eth.CallFunc(targets[0], funcValue).From(vmtest.Owner).Returns(&values[0])
+			}
+			err := m.CallCtx(context.Background(), calls...)
+
+			var callErrs w3.CallErrors
+			if tt.revert {
+				var revertErr *publish.RevertError
+				if !errors.As(err, &callErrs) || !errors.As(callErrs[3], &revertErr) {
+					t.Fatalf("err %v, want a RevertError for call 3", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			for i := range values {
+				if tt.revert && i == 3 {
+					continue
+				}
+				if callErrs != nil && callErrs[i] != nil || values[i].Int64() != int64(i) {
+					t.Errorf("call %d: %v, value %s", i, callErrs, &values[i])
+				}
+			}
+			if got := fmt.Sprint(a.sizes); got != tt.wantSizes || a.direct != tt.wantDirect {
+				t.Errorf("aggregate3 sizes %s with %d direct calls, want %s with %d", got, a.direct, tt.wantSizes, tt.wantDirect)
+			}
+		})
+	}
+}
@@ -0,0 +1,476 @@
+package publish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+)
+
+// DefaultMaxPending is the number of pipeline transactions in flight at
+// once, matching the per-account pending slots of a default geth txpool.
+const DefaultMaxPending = 16
+
+const cancelGasLimit uint64 = 21_000
+
+var ErrDependencyFailed = errors.New("dependency failed")
+
+type (
+	// TxRequest is a transaction for a Pipeline to send. A nil To creates a
+	// contract. A zero Gas is estimated against the pending block, which
+	// only sees unmined dependencies on nodes that simulate the pending
+	// state; set it for steps that depend on unmined ones. Creates is the
+	// address a call is known to deploy at, such as a CREATE2 prediction,
+	// and is reported as the step's ContractAddress once it is sent.
+	TxRequest struct {
+		To      *common.Address
+		Value   *big.Int
+		Data    []byte
+		Gas     uint64
+		Creates common.Address
+	}
+
+	// Step is one transaction of a pipeline. Build is called with the
+	// results of the steps in DependsOn once all of them have been sent,
+	// or once all of them have succeeded if Mined is set. A contract
+	// creation's address is known as soon as it is sent, so steps that only
+	// need it can be pipelined; steps that need a receipt, such as a proxy
+	// address, must set Mined.
+	Step struct {
+		Name      string
+		DependsOn []string
+		Mined     bool
+		Build     func(deps map[string]StepResult) (TxRequest, error)
+	}
+
+	StepStatus string
+
+	// StepResult is the outcome of a step. ContractAddress is the created
+	// contract, predicted from the nonce once sent; or, once mined, the
+	// proxy of an ERC1967Factory Deployed event in the receipt. CancelTx is
+	// set if the step was replaced because a dependency failed.
+	StepResult struct {
+		Name            string
+		Status          StepStatus
+		Nonce           uint64
+		TxHash          common.Hash
+		CancelTx        common.Hash
+		ContractAddress common.Address
+		Receipt         *types.Receipt
+		Err             error
+	}
+
+	PipelineConfig struct {
+		MaxPending int
+	}
+)
+
+const (
+	StepPending   StepStatus = "pending"
+	StepSent      StepStatus = "sent"
+	StepSucceeded StepStatus = "succeeded"
+	StepReverted  StepStatus = "reverted"
+	StepFailed    StepStatus = "failed"
+	StepSkipped   StepStatus = "skipped"
+	StepCancelled StepStatus = "cancelled"
+)
+
+func (s StepStatus) done() bool {
+	return s != StepPending && s != StepSent
+}
+
+// DeployStep deploys bytecode as a step with no dependencies.
+func DeployStep(name string, bytecode []byte, gasLimit uint64) Step {
+	return Step{
+		Name: name,
+		Build: func(map[string]StepResult) (TxRequest, error) {
+			return TxRequest{Data: bytecode, Gas: gasLimit}, nil
+		},
+	}
+}
+
+// ProxyStep deploys a proxy of the implementation deployed by the step
+// impl through factory. It is pipelined behind impl, which is mined first
+// since it has a lower nonce; steps that need the proxy address must
+// depend on it with Mined set.
+func ProxyStep(name string, factory common.Address, impl string, admin common.Address, initData []byte) Step {
+	return Step{
+		Name:      name,
+		DependsOn: []string{impl},
+		Build: func(deps map[string]StepResult) (TxRequest, error) {
+			calldata, err := funcDeployAndCall.EncodeArgs(deps[impl].ContractAddress, admin, initData)
+			if err != nil {
+				return TxRequest{}, fmt.Errorf("encode deployAndCall: %w", err)
+			}
+			return TxRequest{To: &factory, Data: calldata, Gas: ProxyGasLimit}, nil
+		},
+	}
+}
+
+// ProxyStepFunc is like ProxyStep for init data that needs the results of
+// the steps in after, such as the addresses of other proxies. It is sent
+// once impl and those steps have been mined.
+func ProxyStepFunc(name string, factory common.Address, impl string, admin common.Address, after []string, initData func(deps map[string]StepResult) ([]byte, error)) Step {
+	return Step{
+		Name:      name,
+		DependsOn: append([]string{impl}, after...),
+		Mined:     true,
+		Build: func(deps map[string]StepResult) (TxRequest, error) {
+			data, err := initData(deps)
+			if err != nil {
+				return TxRequest{}, fmt.Errorf("init data: %w", err)
+			}
+			calldata, err := funcDeployAndCall.EncodeArgs(deps[impl].ContractAddress, admin, data)
+			if err != nil {
+				return TxRequest{}, fmt.Errorf("encode deployAndCall: %w", err)
+			}
+			return TxRequest{To: &factory, Data: calldata, Gas: ProxyGasLimit}, nil
+		},
+	}
+}
+
+// pipelineWait is the receipt of a sent step, tagged with the generation
+// of its waiter so that superseded waiters are ignored.
+type pipelineWait struct {
+	step    int
+	gen     int
+	receipt *types.Receipt
+	err     error
+}
+
+type pipeline struct {
+	d       *Deployer
+	steps   []Step
+	results []StepResult
+	index   map[string]int
+	gens    []int
+	stops   []context.CancelFunc
+	waits   chan pipelineWait
+	held    []pipelineWait
+}
+
+// RunPipeline sends steps with consecutive nonces as soon as their
+// dependencies allow, without waiting for receipts in between, and awaits
+// the receipts concurrently with at most cfg.MaxPending in flight. Steps
+// are sent in the order given among those that are ready.
+//
+// When a step fails or reverts, the steps that depend on it, directly or
+// not, are rolled back: those not yet sent are skipped, and those already
+// pending are replaced by a zero-value transfer to the deployer with the
+// same nonce, so that the nonce sequence stays intact. A dependent that
+// was mined before it could be replaced fails with ErrDependencyFailed all
+// the same, and its own dependents are rolled back in turn. Independent
+// steps carry on.
+//
+// The results are in step order. The error reports invalid steps, steps
+// that could not complete, or a cancelled ctx.
+func (d *Deployer) RunPipeline(ctx context.Context, steps []Step, cfg PipelineConfig) ([]StepResult, error) {
+	if cfg.MaxPending <= 0 {
+		cfg.MaxPending = DefaultMaxPending
+	}
+	p := &pipeline{
+		d:       d,
+		steps:   steps,
+		results: make([]StepResult, len(steps)),
+		index:   make(map[string]int, len(steps)),
+		gens:    make([]int, len(steps)),
+		stops:   make([]context.CancelFunc, len(steps)),
+		waits:   make(chan pipelineWait, 2*len(steps)),
+	}
+	for i, s := range steps {
+		if _, ok := p.index[s.Name]; ok {
+			return nil, fmt.Errorf("duplicate step %q", s.Name)
+		}
+		p.index[s.Name] = i
+		p.results[i] = StepResult{Name: s.Name, Status: StepPending}
+	}
+	for _, s := range steps {
+		for _, dep := range s.DependsOn {
+			if _, ok := p.index[dep]; !ok {
+				return nil, fmt.Errorf("step %q depends on unknown step %q", s.Name, dep)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	inFlight := 0
+	for {
+		for inFlight < cfg.MaxPending {
+			i := p.next()
+			if i < 0 {
+				break
+			}
+			if p.send(ctx, i) {
+				inFlight++
+			}
+		}
+
+		if !slices.ContainsFunc(p.results, func(r StepResult) bool { return !r.Status.done() }) {
+			break
+		}
+		if inFlight == 0 && p.next() < 0 {
+			var stuck []string
+			for _, r := range p.results {
+				if !r.Status.done() {
+					stuck = append(stuck, r.Name)
+				}
+			}
+			return p.results, fmt.Errorf("steps can never run, check for cycles: %v", stuck)
+		}
+
+		select {
+		case <-ctx.Done():
+			return p.results, ctx.Err()
+		case w := <-p.waits:
+			if w.gen != p.gens[w.step] {
+				continue
+			}
+			inFlight--
+			p.settle(ctx, w)
+		}
+	}
+
+	var failed []string
+	for _, r := range p.results {
+		if r.Status != StepSucceeded {
+			failed = append(failed, fmt.Sprintf("%s (%s)", r.Name, r.Status))
+		}
+	}
+	if len(failed) > 0 {
+		return p.results, fmt.Errorf("%d of %d steps did not succeed: %v", len(failed), len(steps), failed)
+	}
+	return p.results, nil
+}
+
+// next returns the first pending step whose dependencies allow it to be
+// sent, skipping steps whose dependencies failed, or -1.
+func (p *pipeline) next() int {
+	for i, s := range p.steps {
+		if p.results[i].Status != StepPending {
+			continue
+		}
+		ready := true
+		for _, dep := range s.DependsOn {
+			status := p.results[p.index[dep]].Status
+			switch {
+			case status.done() && status != StepSucceeded:
+				p.results[i].Status = StepSkipped
+				p.results[i].Err = fmt.Errorf("%w: %s %s", ErrDependencyFailed, dep, status)
+				return p.next()
+			case status == StepPending || s.Mined && status != StepSucceeded:
+				ready = false
+			}
+		}
+		if ready {
+			return i
+		}
+	}
+	return -1
+}
+
+// send builds and sends step i and starts waiting for its receipt. It
+// reports whether the step is in flight.
+func (p *pipeline) send(ctx context.Context, i int) bool {
+	r := &p.results[i]
+	deps := make(map[string]StepResult, len(p.steps[i].DependsOn))
+	for _, dep := range p.steps[i].DependsOn {
+		deps[dep] = p.results[p.index[dep]]
+	}
+	req, err := p.steps[i].Build(deps)
+	if err != nil {
+		r.Status, r.Err = StepFailed, fmt.Errorf("build: %w", err)
+		return false
+	}
+	if req.Gas == 0 {
+		msg := &w3types.Message{From: p.d.address, To: req.To, Value: req.Value, Input: req.Data}
+		if err := p.d.client.CallCtx(ctx, eth.EstimateGas(msg, big.NewInt(-1)).Returns(&req.Gas)); err != nil {
+			r.Status, r.Err = StepFailed, fmt.Errorf("estimate gas: %w", err)
+			return false
+		}
+	}
+
+	nonce, err := p.d.getNonce(ctx)
+	if err != nil {
+		r.Status, r.Err = StepFailed, err
+		return false
+	}
+	txHash, err := p.d.sendTx(ctx, types.NewTx(&types.DynamicFeeTx{
+		Nonce:     nonce,
+		To:        req.To,
+		Value:     req.Value,
+		GasFeeCap: p.d.gasFeeCap,
+		GasTipCap: p.d.gasTipCap,
+		Gas:       req.Gas,
+		Data:      req.Data,
+	}))
+	if err != nil {
+		p.d.releaseNonce(nonce, err)
+		r.Status, r.Err = StepFailed, err
+		return false
+	}
+
+	r.Status, r.Nonce, r.TxHash = StepSent, nonce, txHash
+	if req.To == nil {
+		r.ContractAddress = crypto.CreateAddress(p.d.address, nonce)
+	} else {
+		r.ContractAddress = req.Creates
+	}
+	p.wait(ctx, i, txHash)
+	return true
+}
+
+// wait starts a waiter for the first of hashes to be mined, superseding
+// any earlier waiter of step i.
+func (p *pipeline) wait(ctx context.Context, i int, hashes ...common.Hash) {
+	if p.stops[i] != nil {
+		p.stops[i]()
+	}
+	p.gens[i]++
+	gen := p.gens[i]
+	ctx, stop := context.WithCancel(ctx)
+	p.stops[i] = stop
+
+	go func() {
+		defer stop()
+		found := make(chan *types.Receipt, len(hashes))
+		failed := make(chan error, len(hashes))
+		for _, hash := range hashes {
+			go func() {
+				if receipt, err := p.d.WaitForReceipt(ctx, hash); err != nil {
+					failed <- err
+				} else {
+					found <- receipt
+				}
+			}()
+		}
+		// The step fails only once every hash has failed to be waited for.
+		var errs []error
+		for {
+			select {
+			case receipt := <-found:
+				p.waits <- pipelineWait{step: i, gen: gen, receipt: receipt}
+				return
+			case err := <-failed:
+				if errs = append(errs, err); len(errs) < len(hashes) {
+					continue
+				}
+				p.waits <- pipelineWait{step: i, gen: gen, err: errors.Join(errs...)}
+				return
+			case <-ctx.Done():
+				p.waits <- pipelineWait{step: i, gen: gen, err: ctx.Err()}
+				return
+			}
+		}
+	}()
+}
+
+// settle records the receipt of a step and rolls back its dependents if
+// it failed. A successful receipt is held until the step's dependencies
+// have settled, and fails the step if any of them did not succeed: the
+// step ran against their failure.
+func (p *pipeline) settle(ctx context.Context, w pipelineWait) {
+	r := &p.results[w.step]
+	switch {
+	case w.err != nil:
+		r.Status, r.Err = StepFailed, w.err
+	case r.CancelTx != (common.Hash{}) && w.receipt.TxHash == r.CancelTx:
+		r.Status, r.Receipt = StepCancelled, w.receipt
+	case w.receipt.Status != types.ReceiptStatusSuccessful:
+		r.Status, r.Receipt = StepReverted, w.receipt
+		r.Err = fmt.Errorf("reverted in tx %s", w.receipt.TxHash.Hex())
+	default:
+		failed := ""
+		for _, dep := range p.steps[w.step].DependsOn {
+			status := p.results[p.index[dep]].Status
+			if !status.done() {
+				p.held = append(p.held, w)
+				return
+			}
+			if status != StepSucceeded && failed == "" {
+				failed = fmt.Sprintf("%s %s", dep, status)
+			}
+		}
+		r.Receipt = w.receipt
+		if failed != "" {
+			r.Status, r.Err = StepFailed, fmt.Errorf("%w: %s; mined before it could be replaced", ErrDependencyFailed, failed)
+			break
+		}
+		r.Status = StepSucceeded
+		if w.receipt.ContractAddress != (common.Address{}) {
+			r.ContractAddress = w.receipt.ContractAddress
+		} else if proxy, err := ProxyAddressFromReceipt(w.receipt); err == nil {
+			r.ContractAddress = proxy
+		}
+	}
+	if r.Status != StepSucceeded {
+		r.ContractAddress = common.Address{}
+		p.rollback(ctx, r.Name)
+	}
+
+	// Settle the receipts held for this step.
+	held := p.held
+	p.held = nil
+	for _, h := range held {
+		p.settle(ctx, h)
+	}
+}
+
+// rollback replaces every pending step that depends on name, directly or
+// not. Steps not yet sent are skipped by next, and steps already mined are
+// failed by settle.
+func (p *pipeline) rollback(ctx context.Context, name string) {
+	for i := range p.steps {
+		r := &p.results[i]
+		if r.Status != StepSent || r.CancelTx != (common.Hash{}) || !p.dependsOn(i, name) {
+			continue
+		}
+		if slices.ContainsFunc(p.held, func(w pipelineWait) bool { return w.step == i }) {
+			// Already mined; settle fails it once name has settled.
+			continue
+		}
+		cancelTx, err := p.d.sendTx(ctx, types.NewTx(&types.DynamicFeeTx{
+			Nonce:     r.Nonce,
+			To:        &p.d.address,
+			GasFeeCap: bumpFee(p.d.gasFeeCap),
+			GasTipCap: bumpFee(p.d.gasTipCap),
+			Gas:       cancelGasLimit,
+		}))
+		if err != nil {
+			// Most likely the step was already mined; its own receipt
+			// will settle it.
+			r.Err = fmt.Errorf("%w: %s; replacement failed: %v", ErrDependencyFailed, name, err)
+			continue
+		}
+		r.CancelTx = cancelTx
+		r.Err = fmt.Errorf("%w: %s", ErrDependencyFailed, name)
+		p.wait(ctx, i, r.TxHash, cancelTx)
+	}
+}
+
+// dependsOn reports whether step i depends on the step name, directly or
+// not.
+func (p *pipeline) dependsOn(i int, name string) bool {
+	for _, dep := range p.steps[i].DependsOn {
+		if dep == name || p.dependsOn(p.index[dep], name) {
+			return true
+		}
+	}
+	return false
+}
+
+// bumpFee raises fee by 20%, above the 10% replacement minimum of most
+// txpools.
+func bumpFee(fee *big.Int) *big.Int {
+	bumped := new(big.Int).Mul(fee, big.NewInt(6))
+	bumped.Div(bumped, big.NewInt(5))
+	return bumped.Add(bumped, big.NewInt(1))
+}
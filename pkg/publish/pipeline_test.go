@@ -0,0 +1,266 @@
+package publish_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"github.com/cosmo-local-credit/protocol/pkg/internal/vmtest"
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+)
+
+var (
+	// codeStop deploys a contract whose code is a single STOP.
+	codeStop = common.FromHex("0x6001600c60003960016000f300")
+	// codeRevert reverts on deployment.
+	codeRevert = common.FromHex("0x60006000fd")
+)
+
+// waitFor polls cond until it holds, failing the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type pipelineRun struct {
+	results []publish.StepResult
+	err     error
+}
+
+// runPipeline runs steps in the background so that the test can mine.
+func runPipeline(d *publish.Deployer, steps []publish.Step, cfg publish.PipelineConfig) <-chan pipelineRun {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	done := make(chan pipelineRun, 1)
+	go func() {
+		defer cancel()
+		results, err := d.RunPipeline(ctx, steps, cfg)
+		done <- pipelineRun{results, err}
+	}()
+	return done
+}
+
+func byName(results []publish.StepResult) map[string]publish.StepResult {
+	m := make(map[string]publish.StepResult, len(results))
+	for _, r := range results {
+		m[r.Name] = r
+	}
+	return m
+}
+
+func TestRunPipelineOrder(t *testing.T) {
+	e := vmtest.New(t)
+	d := e.Deployer(nil)
+	e.AutoMine()
+
+	var seen common.Address
+	steps := []publish.Step{
+		publish.DeployStep("a", codeStop, 100_000),
+		publish.ProxyStep("aProxy", e.Factory, "a", d.Address(), nil),
+		{
+			Name:      "useProxy",
+			DependsOn: []string{"aProxy"},
+			Mined:     true,
+			Build: func(deps map[string]publish.StepResult) (publish.TxRequest, error) {
+				seen = deps["aProxy"].ContractAddress
+				return publish.TxRequest{To: &seen, Gas: 100_000}, nil
+			},
+		},
+		publish.DeployStep("b", codeStop, 100_000),
+	}
+	run := <-runPipeline(d, steps, publish.PipelineConfig{})
+	if run.err != nil {
+		t.Fatal(run.err)
+	}
+
+	for i, r := range run.results {
+		if r.Name != steps[i].Name {
+			t.Errorf("result %d is %s, want %s", i, r.Name, steps[i].Name)
+		}
+		if r.Status != publish.StepSucceeded {
+			t.Errorf("%s: %s %v", r.Name, r.Status, r.Err)
+		}
+	}
+	res := byName(run.results)
+	// Steps are sent in the order given among those that are ready, and
+	// useProxy waits for aProxy to be mined.
+	for _, order := range [][2]string{{"a", "aProxy"}, {"aProxy", "b"}, {"b", "useProxy"}} {
+		if res[order[0]].Nonce >= res[order[1]].Nonce {
+			t.Errorf("%s has nonce %d, not before %s with %d", order[0], res[order[0]].Nonce, order[1], res[order[1]].Nonce)
+		}
+	}
+	if want := crypto.CreateAddress(d.Address(), res["a"].Nonce); res["a"].ContractAddress != want {
+		t.Errorf("a at %s, want %s", res["a"].ContractAddress.Hex(), want.Hex())
+	}
+	proxy := res["aProxy"].ContractAddress
+	if proxy == (common.Address{}) || seen != proxy {
+		t.Errorf("useProxy built with %s, aProxy at %s", seen.Hex(), proxy.Hex())
+	}
+	impl, err := publish.ImplementationOf(context.Background(), e.Caller(), proxy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if impl != res["a"].ContractAddress {
+		t.Errorf("proxy implementation %s, want %s", impl.Hex(), res["a"].ContractAddress.Hex())
+	}
+}
+
+func TestRunPipelineMaxPending(t *testing.T) {
+	e := vmtest.New(t)
+	e.MaxBlockTxs = 1
+	d := e.Deployer(nil)
+
+	var steps []publish.Step
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		steps = append(steps, publish.DeployStep(name, codeStop, 100_000))
+	}
+	done := runPipeline(d, steps, publish.PipelineConfig{MaxPending: 2})
+
+	most := 0
+	for mined := 0; mined < len(steps); mined++ {
+		waitFor(t, "a pending transaction", func() bool { return len(e.Pending()) > 0 })
+		// Give the pipeline time to overfill the window if it would.
+		time.Sleep(5 * time.Millisecond)
+		most = max(most, len(e.Pending()))
+		e.Mine()
+	}
+	run := <-done
+	if run.err != nil {
+		t.Fatal(run.err)
+	}
+	if most != 2 {
+		t.Errorf("at most %d transactions pending, want 2", most)
+	}
+}
+
+func TestRunPipelineRollback(t *testing.T) {
+	// bad reverts while badProxy, pipelined behind it, is still pending.
+	steps := func(e *vmtest.Env, d *publish.Deployer) []publish.Step {
+		return []publish.Step{
+			publish.DeployStep("bad", codeRevert, 100_000),
+			publish.ProxyStep("badProxy", e.Factory, "bad", d.Address(), nil),
+			{
+				Name:      "afterProxy",
+				DependsOn: []string{"badProxy"},
+				Mined:     true,
+				Build: func(map[string]publish.StepResult) (publish.TxRequest, error) {
+					t.Error("afterProxy was built")
+					return publish.TxRequest{}, nil
+				},
+			},
+			publish.DeployStep("other", codeStop, 100_000),
+		}
+	}
+
+	t.Run("replaced", func(t *testing.T) {
+		e := vmtest.New(t)
+		e.MaxBlockTxs = 1
+		d := e.Deployer(nil)
+		done := runPipeline(d, steps(e, d), publish.PipelineConfig{})
+
+		waitFor(t, "three pending transactions", func() bool { return len(e.Pending()) == 3 })
+		e.Mine()
+		// The replacement is a transfer to the deployer with badProxy's
+		// nonce.
+		waitFor(t, "the replacement", func() bool {
+			return slices.ContainsFunc(e.Pending(), func(tx *types.Transaction) bool {
+				return tx.To() != nil && *tx.To() == d.Address()
+			})
+		})
+		e.MaxBlockTxs = 0
+		e.Mine()
+
+		run := <-done
+		if run.err == nil {
+			t.Fatal("no error")
+		}
+		res := byName(run.results)
+		want := map[string]publish.StepStatus{
+			"bad":        publish.StepReverted,
+			"badProxy":   publish.StepCancelled,
+			"afterProxy": publish.StepSkipped,
+			"other":      publish.StepSucceeded,
+		}
+		for name, status := range want {
+			if res[name].Status != status {
+				t.Errorf("%s: %s (%v), want %s", name, res[name].Status, res[name].Err, status)
+			}
+		}
+		if r := res["badProxy"]; r.CancelTx == (common.Hash{}) || r.Receipt.TxHash != r.CancelTx || r.ContractAddress != (common.Address{}) {
+			t.Errorf("badProxy: cancel tx %s, receipt for %s, address %s", r.CancelTx.Hex(), r.Receipt.TxHash.Hex(), r.ContractAddress.Hex())
+		}
+		for _, name := range []string{"badProxy", "afterProxy"} {
+			if !errors.Is(res[name].Err, publish.ErrDependencyFailed) {
+				t.Errorf("%s: err %v, want ErrDependencyFailed", name, res[name].Err)
+			}
+		}
+		if res["other"].Nonce != res["badProxy"].Nonce+1 {
+			t.Errorf("other has nonce %d after badProxy's %d", res["other"].Nonce, res["badProxy"].Nonce)
+		}
+	})
+
+	t.Run("mined before replaced", func(t *testing.T) {
+		e := vmtest.New(t)
+		d := e.Deployer(nil)
+		done := runPipeline(d, steps(e, d), publish.PipelineConfig{})
+
+		waitFor(t, "three pending transactions", func() bool { return len(e.Pending()) == 3 })
+		e.Mine()
+
+		run := <-done
+		res := byName(run.results)
+		r := res["badProxy"]
+		if r.Status != publish.StepFailed || !errors.Is(r.Err, publish.ErrDependencyFailed) {
+			t.Errorf("badProxy: %s (%v), want failed with ErrDependencyFailed", r.Status, r.Err)
+		}
+		if r.Receipt == nil || r.Receipt.Status != types.ReceiptStatusSuccessful || r.CancelTx != (common.Hash{}) {
+			t.Errorf("badProxy: receipt %+v, cancel tx %s", r.Receipt, r.CancelTx.Hex())
+		}
+		if r.ContractAddress != (common.Address{}) {
+			t.Errorf("badProxy: address %s of a failed step", r.ContractAddress.Hex())
+		}
+		if got := res["afterProxy"].Status; got != publish.StepSkipped {
+			t.Errorf("afterProxy: %s, want skipped", got)
+		}
+		if got := res["other"].Status; got != publish.StepSucceeded {
+			t.Errorf("other: %s, want succeeded", got)
+		}
+	})
+}
+
+func TestRunPipelineInvalid(t *testing.T) {
+	build := func(map[string]publish.StepResult) (publish.TxRequest, error) {
+		return publish.TxRequest{}, nil
+	}
+	tests := []struct {
+		name  string
+		steps []publish.Step
+	}{
+		{"duplicate", []publish.Step{{Name: "a", Build: build}, {Name: "a", Build: build}}},
+		{"unknown dependency", []publish.Step{{Name: "a", DependsOn: []string{"b"}, Build: build}}},
+		{"cycle", []publish.Step{{Name: "a", DependsOn: []string{"b"}, Build: build}, {Name: "b", DependsOn: []string{"a"}, Build: build}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := vmtest.New(t)
+			d := e.Deployer(nil)
+			if _, err := d.RunPipeline(context.Background(), tt.steps, publish.PipelineConfig{}); err == nil {
+				t.Error("no error")
+			}
+			if n := len(e.Pending()); n != 0 {
+				t.Errorf("%d transactions sent", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,592 @@
+package publish
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+	"golang.org/x/time/rate"
+)
+
+const (
+	DefaultRetries          = 3
+	DefaultRetryBackoff     = 500 * time.Millisecond
+	DefaultMaxRetryBackoff  = 10 * time.Second
+	DefaultAttemptTimeout   = 30 * time.Second
+	DefaultEndpointCooldown = 30 * time.Second
+)
+
+// JSON-RPC error codes that providers use for rate limiting.
+const (
+	errCodeLimitExceeded   = -32005
+	errCodeTooManyRequests = 429
+)
+
+var ErrNoEndpoints = errors.New("no rpc endpoints")
+
+// ErrMaybeSent is wrapped into the error of a failed transaction send that
+// may have reached a node, such as one that timed out. The transaction may
+// still be mined, so its nonce must not be reused.
+var ErrMaybeSent = errors.New("the transaction may have been sent")
+
+type (
+	// Endpoint is one RPC URL of a Pool. RateLimit is the number of
+	// requests per second to send it, zero for no limit; a JSON-RPC batch
+	// counts as one request. Burst defaults to 1.
+	Endpoint struct {
+		URL       string
+		RateLimit float64
+		Burst     int
+	}
+
+	// PoolConfig configures a Pool. Zero values use the defaults.
+	//
+	// Each request is attempted up to 1+Retries times, waiting Backoff,
+	// doubling up to MaxBackoff, between attempts. An attempt that fails
+	// with a transient error, such as a timeout after Timeout, a connection
+	// error, HTTP 429 or 5xx, or a rate-limit error, moves on to the next
+	// endpoint and takes the failing one out of rotation for Cooldown.
+	//
+	// ChainID, if set, is the chain every endpoint must serve; otherwise the
+	// first endpoint to answer Check sets it. MaxLag, if set, makes Check
+	// take endpoints more than MaxLag blocks behind the highest out of
+	// rotation.
+	PoolConfig struct {
+		Retries    int
+		Backoff    time.Duration
+		MaxBackoff time.Duration
+		Timeout    time.Duration
+		Cooldown   time.Duration
+		ChainID    int64
+		MaxLag     uint64
+	}
+
+	// EndpointStatus is the result of checking one endpoint. URL has its
+	// path and query removed, since they often carry an API key.
+	EndpointStatus struct {
+		URL     string `json:"url"`
+		Healthy bool   `json:"healthy"`
+		ChainID int64  `json:"chain_id,omitempty"`
+		Block   uint64 `json:"block,omitempty"`
+		Err     string `json:"error,omitempty"`
+	}
+
+	// Pool is a Caller over several endpoints with retries and failover.
+	// Endpoints are used in the order given: requests go to the first
+	// endpoint in rotation, and the others are fallbacks.
+	Pool struct {
+		endpoints []*endpoint
+		cfg       PoolConfig
+
+		mu sync.Mutex
+	}
+
+	endpoint struct {
+		name      string
+		client    *w3.Client
+		downUntil time.Time
+	}
+)
+
+// DialPool dials every endpoint and checks them. It fails if none is
+// healthy.
+func DialPool(ctx context.Context, endpoints []Endpoint, cfg PoolConfig) (*Pool, error) {
+	if len(endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	if cfg.Retries == 0 {
+		cfg.Retries = DefaultRetries
+	}
+	if cfg.Backoff == 0 {
+		cfg.Backoff = DefaultRetryBackoff
+	}
+	if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = DefaultMaxRetryBackoff
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultAttemptTimeout
+	}
+	if cfg.Cooldown == 0 {
+		cfg.Cooldown = DefaultEndpointCooldown
+	}
+
+	p := &Pool{cfg: cfg}
+	for _, ep := range endpoints {
+		var opts []w3.Option
+		if ep.RateLimit > 0 {
+			opts = append(opts, w3.WithRateLimiter(rate.NewLimiter(rate.Limit(ep.RateLimit), max(ep.Burst, 1)), nil))
+		}
+		client, err := w3.Dial(ep.URL, opts...)
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("dial %s: %w", redact(ep.URL), err)
+		}
+		p.endpoints = append(p.endpoints, &endpoint{name: redact(ep.URL), client: client})
+	}
+
+	statuses := p.Check(ctx)
+	for _, s := range statuses {
+		if s.Healthy {
+			return p, nil
+		}
+	}
+	p.Close()
+	return nil, fmt.Errorf("no healthy endpoint: %s: %s", statuses[0].URL, statuses[0].Err)
+}
+
+func (p *Pool) Close() error {
+	var errs []error
+	for _, e := range p.endpoints {
+		errs = append(errs, e.client.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// CallCtx sends calls like w3.Client.CallCtx, retrying transient failures
+// on the next endpoint in rotation. Errors of individual calls, such as
+// reverts, are returned as they are.
+//
+// A transaction sent with eth_sendRawTransaction is not sent again once an
+// earlier attempt may have reached a node: every endpoint is first asked
+// for it by hash. A node answering "already known", or "nonce too low"
+// for a transaction some endpoint knows, counts as having accepted it. If
+// the call still fails after an attempt that may have reached a node, the
+// error wraps ErrMaybeSent.
+func (p *Pool) CallCtx(ctx context.Context, calls ...w3types.RPCCaller) error {
+	if len(calls) == 0 {
+		return nil
+	}
+	var (
+		err       error
+		known     []bool
+		maybeSent bool
+	)
+	for attempt := 0; attempt <= p.cfg.Retries; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, p.backoff(attempt)); err != nil {
+				return err
+			}
+			if maybeSent {
+				known = p.sentBefore(ctx, calls)
+			}
+		}
+		e := p.pick()
+		err = p.attempt(ctx, e, calls, known)
+		maybeSent = maybeSent || mayHaveSent(calls, err)
+		if !transient(err) || ctx.Err() != nil {
+			break
+		}
+		p.markDown(e)
+		if attempt == p.cfg.Retries {
+			err = fmt.Errorf("%d attempts failed: %w", p.cfg.Retries+1, err)
+		}
+	}
+	if err != nil && maybeSent {
+		return fmt.Errorf("%w; %w", err, ErrMaybeSent)
+	}
+	return err
+}
+
+// attempt sends the calls to e, except for the transactions known to have
+// been sent before, which are resolved with their hash.
+func (p *Pool) attempt(ctx context.Context, e *endpoint, calls []w3types.RPCCaller, known []bool) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+
+	send := make([]int, 0, len(calls))
+	errs := make(w3.CallErrors, len(calls))
+	failed := false
+	for i, call := range calls {
+		if known != nil && known[i] {
+			if errs[i] = resolveSent(call); errs[i] != nil {
+				failed = true
+			}
+			continue
+		}
+		send = append(send, i)
+	}
+	if len(send) == 0 {
+		if failed {
+			return errs
+		}
+		return nil
+	}
+
+	batch := make([]w3types.RPCCaller, len(send))
+	for k, i := range send {
+		batch[k] = calls[i]
+	}
+	err := e.client.CallCtx(ctx, batch...)
+	var callErrs w3.CallErrors
+	if err != nil && !errors.As(err, &callErrs) {
+		return fmt.Errorf("%s: %w", e.name, redactErr(err))
+	}
+	for k, i := range send {
+		if callErrs == nil || callErrs[k] == nil {
+			continue
+		}
+		if p.accepted(ctx, calls[i], callErrs[k]) {
+			if errs[i] = resolveSent(calls[i]); errs[i] == nil {
+				continue
+			}
+		} else {
+			errs[i] = callErrs[k]
+		}
+		failed = true
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+// accepted reports whether err of the eth_sendRawTransaction call means
+// a node already has the transaction.
+func (p *Pool) accepted(ctx context.Context, call w3types.RPCCaller, err error) bool {
+	hash, ok := sentHash(call)
+	switch {
+	case !ok:
+		return false
+	case alreadyKnown(err):
+		return true
+	case strings.Contains(strings.ToLower(err.Error()), "nonce too low"):
+		// The nonce is taken, possibly by this very transaction.
+		return p.knownAnywhere(ctx, hash)
+	}
+	return false
+}
+
+// sentBefore reports for each call whether it is an
+// eth_sendRawTransaction of a transaction that an endpoint already knows.
+func (p *Pool) sentBefore(ctx context.Context, calls []w3types.RPCCaller) []bool {
+	known := make([]bool, len(calls))
+	for i, call := range calls {
+		if hash, ok := sentHash(call); ok {
+			known[i] = p.knownAnywhere(ctx, hash)
+		}
+	}
+	return known
+}
+
+// knownAnywhere reports whether any endpoint, in rotation or not, knows
+// the transaction hash. Endpoints that fail to answer count as not
+// knowing it.
+func (p *Pool) knownAnywhere(ctx context.Context, hash common.Hash) bool {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+	found := make(chan bool, len(p.endpoints))
+	for _, e := range p.endpoints {
+		go func() {
+			known, _ := knownTx(ctx, e.client, hash)
+			found <- known
+		}()
+	}
+	for range p.endpoints {
+		if <-found {
+			return true
+		}
+	}
+	return false
+}
+
+// sentHash returns the transaction hash of an eth_sendRawTransaction call.
+func sentHash(call w3types.RPCCaller) (common.Hash, bool) {
+	elem, err := call.CreateRequest()
+	if err != nil || elem.Method != "eth_sendRawTransaction" || len(elem.Args) != 1 {
+		return common.Hash{}, false
+	}
+	raw, ok := elem.Args[0].(string)
+	if !ok {
+		return common.Hash{}, false
+	}
+	data, err := hexutil.Decode(raw)
+	if err != nil {
+		return common.Hash{}, false
+	}
+	return crypto.Keccak256Hash(data), true
+}
+
+// resolveSent resolves an eth_sendRawTransaction call with the hash of its
+// transaction, as if the node had just accepted it.
+func resolveSent(call w3types.RPCCaller) error {
+	hash, _ := sentHash(call)
+	elem, err := call.CreateRequest()
+	if err != nil {
+		return err
+	}
+	result, err := json.Marshal(hash)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(result, elem.Result); err != nil {
+		return err
+	}
+	return call.HandleResponse(elem)
+}
+
+// alreadyKnown reports whether err is a node's answer to a transaction it
+// already has, as worded by geth, Erigon, Nethermind and Besu.
+func alreadyKnown(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "already known") ||
+		strings.Contains(msg, "alreadyknown") ||
+		strings.Contains(msg, "known transaction")
+}
+
+// mayHaveSent reports whether an attempt at calls that failed with err may
+// have handed a transaction to a node. A node that answers a transaction
+// with an error has refused it; so has one that refused the connection or
+// rate-limited the request. Any other failure, such as a timeout, may come
+// after the node accepted it.
+func mayHaveSent(calls []w3types.RPCCaller, err error) bool {
+	if err == nil || !slices.ContainsFunc(calls, func(call w3types.RPCCaller) bool {
+		_, ok := sentHash(call)
+		return ok
+	}) {
+		return false
+	}
+	var callErrs w3.CallErrors
+	if errors.As(err, &callErrs) {
+		for i, call := range calls {
+			if _, ok := sentHash(call); ok && i < len(callErrs) && callErrs[i] == nil {
+				return true
+			}
+		}
+		return false
+	}
+	var httpErr rpc.HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == 429 {
+		return false
+	}
+	return !errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// knownTx reports whether the node behind caller knows the transaction
+// hash, pending or mined.
+func knownTx(ctx context.Context, caller Caller, hash common.Hash) (bool, error) {
+	var result json.RawMessage
+	if err := caller.CallCtx(ctx, &rawCall{method: "eth_getTransactionByHash", args: []any{hash}, result: &result}); err != nil {
+		return false, fmt.Errorf("look up tx %s: %w", hash.Hex(), err)
+	}
+	return len(result) > 0 && string(result) != "null", nil
+}
+
+// rawCall is a request whose result is kept as raw JSON, so that a null
+// result can be told apart from an error.
+type rawCall struct {
+	method string
+	args   []any
+	result *json.RawMessage
+}
+
+func (c *rawCall) CreateRequest() (rpc.BatchElem, error) {
+	return rpc.BatchElem{Method: c.method, Args: c.args, Result: c.result}, nil
+}
+
+func (c *rawCall) HandleResponse(elem rpc.BatchElem) error {
+	return elem.Error
+}
+
+// pick returns the first endpoint in rotation, or the one that returns to
+// rotation soonest if all are out.
+func (p *Pool) pick() *endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	next := p.endpoints[0]
+	for _, e := range p.endpoints {
+		if !now.Before(e.downUntil) {
+			return e
+		}
+		if e.downUntil.Before(next.downUntil) {
+			next = e
+		}
+	}
+	return next
+}
+
+func (p *Pool) markDown(e *endpoint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e.downUntil = time.Now().Add(p.cfg.Cooldown)
+}
+
+func (p *Pool) backoff(attempt int) time.Duration {
+	d := min(p.cfg.Backoff<<(attempt-1), p.cfg.MaxBackoff)
+	return d/2 + rand.N(d/2+1)
+}
+
+// Check queries the chain ID and block number of every endpoint, takes
+// failing, lagging or wrong-chain endpoints out of rotation for Cooldown
+// and returns each endpoint's status in order.
+func (p *Pool) Check(ctx context.Context) []EndpointStatus {
+	statuses := make([]EndpointStatus, len(p.endpoints))
+	var wg sync.WaitGroup
+	for i, e := range p.endpoints {
+		wg.Go(func() {
+			ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+			defer cancel()
+			var chainID uint64
+			var block *big.Int
+			s := EndpointStatus{URL: e.name}
+			if err := e.client.CallCtx(ctx, eth.ChainID().Returns(&chainID), eth.BlockNumber().Returns(&block)); err != nil {
+				s.Err = redactErr(err).Error()
+			} else {
+				s.ChainID, s.Block, s.Healthy = int64(chainID), block.Uint64(), true
+			}
+			statuses[i] = s
+		})
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var head uint64
+	for i := range statuses {
+		s := &statuses[i]
+		if !s.Healthy {
+			continue
+		}
+		if p.cfg.ChainID == 0 {
+			p.cfg.ChainID = s.ChainID
+		}
+		if s.ChainID != p.cfg.ChainID {
+			s.Healthy, s.Err = false, fmt.Sprintf("chain id %d, want %d", s.ChainID, p.cfg.ChainID)
+			continue
+		}
+		head = max(head, s.Block)
+	}
+	for i, e := range p.endpoints {
+		s := &statuses[i]
+		if s.Healthy && p.cfg.MaxLag > 0 && head-s.Block > p.cfg.MaxLag {
+			s.Healthy, s.Err = false, fmt.Sprintf("%d blocks behind", head-s.Block)
+		}
+		if s.Healthy {
+			e.downUntil = time.Time{}
+		} else {
+			e.downUntil = time.Now().Add(p.cfg.Cooldown)
+		}
+	}
+	return statuses
+}
+
+// Run checks the endpoints every interval until ctx is cancelled, passing
+// the status of each unhealthy endpoint to onUnhealthy, if set.
+func (p *Pool) Run(ctx context.Context, interval time.Duration, onUnhealthy func(EndpointStatus)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		for _, s := range p.Check(ctx) {
+			if !s.Healthy && onUnhealthy != nil {
+				onUnhealthy(s)
+			}
+		}
+	}
+}
+
+// transient reports whether err may succeed on a retry or another endpoint.
+func transient(err error) bool {
+	if err == nil {
+		return false
+	}
+	var callErrs w3.CallErrors
+	if errors.As(err, &callErrs) {
+		for _, err := range callErrs {
+			var rpcErr rpc.Error
+			if errors.As(err, &rpcErr) && (rpcErr.ErrorCode() == errCodeLimitExceeded || rpcErr.ErrorCode() == errCodeTooManyRequests) {
+				return true
+			}
+		}
+		return false
+	}
+	var httpErr rpc.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode == 429 || httpErr.StatusCode >= 500
+	}
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// redact strips the path, query and credentials from rawURL.
+func redact(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "endpoint"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// redactErr redacts the URL of an HTTP client error.
+func redactErr(err error) error {
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return err
+	}
+	return &url.Error{Op: urlErr.Op, URL: redact(urlErr.URL), Err: urlErr.Err}
+}
+
+// SubscribeCtx subscribes on the first endpoint in rotation that accepts
+// the subscription, making a Pool a Subscriber. Subscriptions need
+// websocket endpoints; over HTTP they fail with
+// rpc.ErrNotificationsUnsupported.
+func (p *Pool) SubscribeCtx(ctx context.Context, s w3types.RPCSubscriber) (*rpc.ClientSubscription, error) {
+	p.mu.Lock()
+	now := time.Now()
+	endpoints := make([]*endpoint, 0, len(p.endpoints))
+	for _, e := range p.endpoints {
+		if !now.Before(e.downUntil) {
+			endpoints = append(endpoints, e)
+		}
+	}
+	p.mu.Unlock()
+
+	err := ErrNoEndpoints
+	for _, e := range endpoints {
+		var sub *rpc.ClientSubscription
+		if sub, err = e.client.SubscribeCtx(ctx, s); err == nil {
+			return sub, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,317 @@
+package publish_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lmittmann/w3/module/eth"
+
+	"github.com/cosmo-local-credit/protocol/pkg/internal/vmtest"
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+)
+
+// node is an HTTP endpoint serving an Env, with failures on demand.
+type node struct {
+	caller *vmtest.Caller
+	url    string
+
+	hits atomic.Int64
+	// fail is the number of requests left to answer with status.
+	fail   atomic.Int64
+	status int
+	// stall is the number of transactions left to accept and then leave
+	// unanswered until the client gives up.
+	stall atomic.Int64
+}
+
+func newNode(t *testing.T, e *vmtest.Env) *node {
+	n := &node{caller: e.Caller(), status: http.StatusServiceUnavailable}
+	srv := httptest.NewServer(n)
+	t.Cleanup(srv.Close)
+	n.url = srv.URL
+	return n
+}
+
+func (n *node) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.hits.Add(1)
+	if n.fail.Add(-1) >= 0 {
+		w.WriteHeader(n.status)
+		return
+	}
+	n.fail.Store(0)
+
+	body, _ := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if bytes.Contains(body, []byte("eth_sendRawTransaction")) {
+		if n.stall.Add(-1) >= 0 {
+			n.caller.ServeHTTP(httptest.NewRecorder(), r)
+			<-r.Context().Done()
+			return
+		}
+		n.stall.Store(0)
+	}
+	n.caller.ServeHTTP(w, r)
+}
+
+// failing returns a Hook that fails method with err, the first times
+// calls or always if times is negative.
+func failing(method string, times int64, err error) func(string, []any) error {
+	var n atomic.Int64
+	return func(m string, _ []any) error {
+		if m == method && (times < 0 || n.Add(1) <= times) {
+			return err
+		}
+		return nil
+	}
+}
+
+func dialPool(t *testing.T, cfg publish.PoolConfig, nodes ...*node) *publish.Pool {
+	t.Helper()
+	var endpoints []publish.Endpoint
+	for _, n := range nodes {
+		endpoints = append(endpoints, publish.Endpoint{URL: n.url})
+	}
+	if cfg.Backoff == 0 {
+		cfg.Backoff = time.Millisecond
+	}
+	p, err := publish.DialPool(context.Background(), endpoints, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	for _, n := range nodes {
+		n.hits.Store(0)
+	}
+	return p
+}
+
+func blockNumber(p *publish.Pool) error {
+	var n *big.Int
+	return p.CallCtx(context.Background(), eth.BlockNumber().Returns(&n))
+}
+
+func TestPoolFailover(t *testing.T) {
+	e := vmtest.New(t)
+	a, b := newNode(t, e), newNode(t, e)
+	p := dialPool(t, publish.PoolConfig{}, a, b)
+
+	a.fail.Store(1)
+	if err := blockNumber(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := blockNumber(p); err != nil {
+		t.Fatal(err)
+	}
+	// a is out of rotation after its failure.
+	if a.hits.Load() != 1 || b.hits.Load() != 2 {
+		t.Errorf("a served %d requests and b %d, want 1 and 2", a.hits.Load(), b.hits.Load())
+	}
+
+	statuses := p.Check(context.Background())
+	if len(statuses) != 2 || !statuses[0].Healthy || !statuses[1].Healthy {
+		t.Fatalf("statuses %+v", statuses)
+	}
+	if err := blockNumber(p); err != nil {
+		t.Fatal(err)
+	}
+	if a.hits.Load() != 3 {
+		t.Errorf("a served %d requests after a healthy check, want 3", a.hits.Load())
+	}
+}
+
+func TestPoolRetries(t *testing.T) {
+	limited := vmtest.NewRPCError(-32005, "limit exceeded")
+	tests := []struct {
+		name    string
+		retries int
+		fail    int64
+		hook    func(string, []any) error
+		hits    int64
+		wantErr string
+	}{
+		{name: "recovers", retries: 3, fail: 2, hits: 3},
+		{name: "gives up", retries: 2, fail: 5, hits: 3, wantErr: "3 attempts failed"},
+		{name: "rate limited", retries: 1, hook: failing("eth_blockNumber", 1, limited), hits: 2},
+		{name: "call error", retries: 3, hook: failing("eth_blockNumber", -1, errors.New("boom")), hits: 1, wantErr: "boom"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := vmtest.New(t)
+			n := newNode(t, e)
+			p := dialPool(t, publish.PoolConfig{Retries: tt.retries, Backoff: 10 * time.Millisecond}, n)
+			n.fail.Store(tt.fail)
+			n.caller.Hook = tt.hook
+
+			start := time.Now()
+			err := blockNumber(p)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err %v, want %q", err, tt.wantErr)
+			}
+			if n.hits.Load() != tt.hits {
+				t.Errorf("%d requests, want %d", n.hits.Load(), tt.hits)
+			}
+			// Each retry waits at least half its backoff, which doubles.
+			var least time.Duration
+			for i := range tt.hits - 1 {
+				least += 5 * time.Millisecond << i
+			}
+			if elapsed := time.Since(start); elapsed < least {
+				t.Errorf("%d requests took %s, want at least %s", tt.hits, elapsed, least)
+			}
+		})
+	}
+}
+
+func TestPoolRateLimit(t *testing.T) {
+	e := vmtest.New(t)
+	n := newNode(t, e)
+	p, err := publish.DialPool(context.Background(), []publish.Endpoint{{URL: n.url, RateLimit: 20}}, publish.PoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	start := time.Now()
+	for range 5 {
+		if err := blockNumber(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The check on dialling took the one token of the burst; each call
+	// then waits 50ms for the next.
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("5 calls at 20/s took %s", elapsed)
+	}
+}
+
+func TestPoolResend(t *testing.T) {
+	to := common.HexToAddress("0xb0b")
+	notFound := errors.New("lookup failed")
+	tests := []struct {
+		name string
+		// hook is set on both nodes after dialling.
+		hook func() func(string, []any) error
+		// mine mines the transaction a accepted before it is resent.
+		mine bool
+	}{
+		{name: "found by hash"},
+		{
+			name: "already known",
+			hook: func() func(string, []any) error { return failing("eth_getTransactionByHash", -1, notFound) },
+		},
+		{
+			// The lookups before the resend fail, the one after "nonce
+			// too low" finds the mined transaction.
+			name: "nonce too low",
+			hook: func() func(string, []any) error { return failing("eth_getTransactionByHash", 1, notFound) },
+			mine: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := vmtest.New(t)
+			a, b := newNode(t, e), newNode(t, e)
+			p := dialPool(t, publish.PoolConfig{Timeout: 200 * time.Millisecond}, a, b)
+			d := e.Deployer(p)
+			if tt.hook != nil {
+				a.caller.Hook, b.caller.Hook = tt.hook(), tt.hook()
+			}
+			a.stall.Store(1)
+			if tt.mine {
+				go func() {
+					waitFor(t, "the stalled transaction", func() bool { return len(e.Pending()) == 1 })
+					e.Mine()
+				}()
+			}
+
+			hash, err := d.Transact(context.Background(), to, big.NewInt(1), nil, 21_000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.mine {
+				if n := len(e.Pending()); n != 0 {
+					t.Fatalf("%d transactions pending", n)
+				}
+			} else {
+				pending := e.Pending()
+				if len(pending) != 1 || pending[0].Hash() != hash {
+					t.Fatalf("pending %v, want only %s", pending, hash.Hex())
+				}
+				e.Mine()
+			}
+			var balance *big.Int
+			if err := e.Caller().CallCtx(context.Background(), eth.Balance(to, nil).Returns(&balance)); err != nil {
+				t.Fatal(err)
+			}
+			if balance.Cmp(big.NewInt(1)) != 0 {
+				t.Errorf("balance %s after one transfer", balance)
+			}
+		})
+	}
+}
+
+func TestPoolNonceRelease(t *testing.T) {
+	to := common.HexToAddress("0xb0b")
+	rejected := errors.New("insufficient funds for gas * price + value")
+
+	t.Run("rejected", func(t *testing.T) {
+		e := vmtest.New(t)
+		a := newNode(t, e)
+		p := dialPool(t, publish.PoolConfig{}, a)
+		d := e.Deployer(p)
+		a.caller.Hook = failing("eth_sendRawTransaction", 1, rejected)
+
+		if _, err := d.Transact(context.Background(), to, nil, nil, 21_000); err == nil || errors.Is(err, publish.ErrMaybeSent) {
+			t.Fatalf("err %v, want a rejection", err)
+		}
+		if _, err := d.Transact(context.Background(), to, nil, nil, 21_000); err != nil {
+			t.Fatal(err)
+		}
+		// Nothing was sent, so the second transaction takes nonce 0.
+		if pending := e.Pending(); len(pending) != 1 || pending[0].Nonce() != 0 {
+			t.Errorf("pending %v, want one transaction with nonce 0", pending)
+		}
+	})
+
+	t.Run("maybe sent", func(t *testing.T) {
+		e := vmtest.New(t)
+		a, b := newNode(t, e), newNode(t, e)
+		p := dialPool(t, publish.PoolConfig{Timeout: 200 * time.Millisecond}, a, b)
+		d := e.Deployer(p)
+		a.stall.Store(1)
+		a.caller.Hook = failing("eth_getTransactionByHash", -1, errors.New("lookup failed"))
+		b.caller.Hook = func(method string, args []any) error {
+			switch method {
+			case "eth_getTransactionByHash":
+				return errors.New("lookup failed")
+			case "eth_sendRawTransaction":
+				return rejected
+			}
+			return nil
+		}
+
+		_, err := d.Transact(context.Background(), to, nil, nil, 21_000)
+		if !errors.Is(err, publish.ErrMaybeSent) {
+			t.Fatalf("err %v, want ErrMaybeSent", err)
+		}
+		b.caller.Hook = nil
+		if _, err := d.Transact(context.Background(), to, nil, nil, 21_000); err != nil {
+			t.Fatal(err)
+		}
+		// a accepted nonce 0, so the second transaction takes nonce 1.
+		pending := e.Pending()
+		if len(pending) != 2 || pending[0].Nonce() != 0 || pending[1].Nonce() != 1 {
+			t.Errorf("pending nonces %v, want 0 and 1", pending)
+		}
+	})
+}
@@ -1,43 +1,72 @@
 package publish
 
 import (
+	"cmp"
 	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
+	"slices"
 	"strings"
-	"time"
 
+	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/lmittmann/w3"
 	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
 )
 
-const ProxyGasLimit uint64 = 500_000
+const (
+	ProxyGasLimit uint64 = 500_000
 
-var ArachnidCreate2Factory = common.HexToAddress("0x4e59b44847b379578588920cA78FbF26c0B4956C")
+	// DefaultBatchSize is the number of calls BatchCall sends per JSON-RPC
+	// batch request.
+	DefaultBatchSize = 100
+
+	// DefaultLogRange is the maximum block span of one eth_getLogs request
+	// made by GetLogs and ScanLogs.
+	DefaultLogRange = 10_000
+)
+
+var (
+	ArachnidCreate2Factory = common.HexToAddress("0x4e59b44847b379578588920cA78FbF26c0B4956C")
+
+	// ImplementationSlot is the ERC1967 implementation storage slot,
+	// bytes32(uint256(keccak256("eip1967.proxy.implementation")) - 1).
+	ImplementationSlot = common.HexToHash("0x360894a13ba1a3210667c828492db98dca3e2076cc3735a920a3ca505d382bbc")
+)
 
 var (
 	funcDeployAndCall = w3.MustNewFunc(
 		"deployAndCall(address,address,bytes)", "address",
 	)
+	funcDeployDeterministicAndCall = w3.MustNewFunc(
+		"deployDeterministicAndCall(address,address,bytes32,bytes)", "address",
+	)
 	eventDeployed = w3.MustNewEvent(
 		"Deployed(address indexed,address indexed,address indexed)",
 	)
 )
 
 type (
+	// Caller is the read-side RPC interface used by the contract clients.
+	// *w3.Client satisfies it.
+	Caller interface {
+		CallCtx(ctx context.Context, calls ...w3types.RPCCaller) error
+	}
+
 	DeployResult struct {
 		TxHash          common.Hash
 		ContractAddress common.Address
 	}
 
 	Deployer struct {
-		client    *w3.Client
+		client    Caller
 		signer    types.Signer
 		key       *ecdsa.PrivateKey
 		address   common.Address
@@ -45,6 +74,7 @@ type (
 		gasTipCap *big.Int
 		nonce     uint64
 		hasNonce  bool
+		receipts  ReceiptConfig
 	}
 )
 
@@ -53,22 +83,37 @@ func NewDeployer(rpcURL string, chainID int64, privateKey *ecdsa.PrivateKey, gas
 	if err != nil {
 		return nil, fmt.Errorf("dial rpc: %w", err)
 	}
+	return NewDeployerWithCaller(client, chainID, privateKey, gasFeeCap, gasTipCap), nil
+}
+
+// NewDeployerWithCaller is NewDeployer over an existing connection, such as
+// a Pool of several endpoints. Close closes caller if it is an io.Closer.
+func NewDeployerWithCaller(caller Caller, chainID int64, privateKey *ecdsa.PrivateKey, gasFeeCap, gasTipCap *big.Int) *Deployer {
 	return &Deployer{
-		client:    client,
+		client:    caller,
 		signer:    types.NewLondonSigner(big.NewInt(chainID)),
 		key:       privateKey,
 		address:   crypto.PubkeyToAddress(privateKey.PublicKey),
 		gasFeeCap: gasFeeCap,
 		gasTipCap: gasTipCap,
-	}, nil
+	}
 }
 
 func (d *Deployer) Address() common.Address {
 	return d.address
 }
 
+// Client returns the underlying RPC client, e.g. for constructing contract
+// clients that share the deployer's connection.
+func (d *Deployer) Client() Caller {
+	return d.client
+}
+
 func (d *Deployer) Close() error {
-	return d.client.Close()
+	if c, ok := d.client.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
 }
 
 func (d *Deployer) getNonce(ctx context.Context) (uint64, error) {
@@ -85,13 +130,35 @@ func (d *Deployer) getNonce(ctx context.Context) (uint64, error) {
 	return n, nil
 }
 
+// releaseNonce hands nonce back if it was the last one taken and sendErr,
+// the error of sending its transaction, shows that no node can have it.
+// The next transaction then takes the nonce instead of queueing behind a
+// gap.
+func (d *Deployer) releaseNonce(nonce uint64, sendErr error) {
+	if d.hasNonce && d.nonce == nonce+1 && !errors.Is(sendErr, ErrMaybeSent) {
+		d.nonce = nonce
+	}
+}
+
 func (d *Deployer) sendTx(ctx context.Context, tx *types.Transaction) (common.Hash, error) {
 	signedTx, err := types.SignTx(tx, d.signer, d.key)
 	if err != nil {
 		return common.Hash{}, fmt.Errorf("sign tx: %w", err)
 	}
 	var txHash common.Hash
-	if err := d.client.CallCtx(ctx, eth.SendTx(signedTx).Returns(&txHash)); err != nil {
+	call := eth.SendTx(signedTx).Returns(&txHash)
+	if err := d.client.CallCtx(ctx, call); err != nil {
+		// The node may have accepted the transaction before failing, e.g.
+		// on a timeout, or be rejecting a resend as already known.
+		if alreadyKnown(err) {
+			return signedTx.Hash(), nil
+		}
+		if known, _ := knownTx(ctx, d.client, signedTx.Hash()); known {
+			return signedTx.Hash(), nil
+		}
+		if !errors.Is(err, ErrMaybeSent) && mayHaveSent([]w3types.RPCCaller{call}, err) {
+			err = fmt.Errorf("%w; %w", err, ErrMaybeSent)
+		}
 		return common.Hash{}, fmt.Errorf("send tx: %w", err)
 	}
 	return txHash, nil
@@ -116,6 +183,7 @@ func (d *Deployer) DeployImplementation(ctx context.Context, bytecode []byte, ga
 
 	txHash, err := d.sendTx(ctx, tx)
 	if err != nil {
+		d.releaseNonce(nonce, err)
 		return DeployResult{}, err
 	}
 
@@ -145,26 +213,57 @@ func (d *Deployer) DeployProxy(ctx context.Context, factory, implementation, adm
 		Data:      calldata,
 	})
 
-	return d.sendTx(ctx, tx)
+	txHash, err := d.sendTx(ctx, tx)
+	if err != nil {
+		d.releaseNonce(nonce, err)
+		return common.Hash{}, err
+	}
+	return txHash, nil
 }
 
-func (d *Deployer) WaitForReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
-	ticker := time.NewTicker(2 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		var receipt *types.Receipt
-		err := d.client.CallCtx(ctx, eth.TxReceipt(txHash).Returns(&receipt))
-		if err == nil {
-			return receipt, nil
+// Transact sends a call transaction to the given contract. If gasLimit is
+// zero, the gas limit is estimated against the latest block.
+func (d *Deployer) Transact(ctx context.Context, to common.Address, value *big.Int, data []byte, gasLimit uint64) (common.Hash, error) {
+	if gasLimit == 0 {
+		msg := &w3types.Message{From: d.address, To: &to, Value: value, Input: data}
+		if err := d.client.CallCtx(ctx, eth.EstimateGas(msg, nil).Returns(&gasLimit)); err != nil {
+			return common.Hash{}, fmt.Errorf("estimate gas: %w", err)
 		}
+	}
 
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case <-ticker.C:
-		}
+	nonce, err := d.getNonce(ctx)
+	if err != nil {
+		return common.Hash{}, err
 	}
+
+	tx := types.NewTx(&types.DynamicFeeTx{
+		Nonce:     nonce,
+		To:        &to,
+		Value:     value,
+		GasFeeCap: d.gasFeeCap,
+		GasTipCap: d.gasTipCap,
+		Gas:       gasLimit,
+		Data:      data,
+	})
+
+	txHash, err := d.sendTx(ctx, tx)
+	if err != nil {
+		d.releaseNonce(nonce, err)
+		return common.Hash{}, err
+	}
+	return txHash, nil
+}
+
+// SetReceiptConfig sets how WaitForReceipt waits for the deployer's
+// transactions.
+func (d *Deployer) SetReceiptConfig(cfg ReceiptConfig) {
+	d.receipts = cfg
+}
+
+// WaitForReceipt waits for the receipt of txHash as set by
+// SetReceiptConfig; see the package-level WaitForReceipt.
+func (d *Deployer) WaitForReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	return WaitForReceipt(ctx, d.client, txHash, d.receipts)
 }
 
 func (d *Deployer) CodeAt(ctx context.Context, address common.Address) ([]byte, error) {
@@ -195,6 +294,7 @@ func (d *Deployer) DeployDeterministicViaArachnid(ctx context.Context, salt comm
 
 	txHash, err := d.sendTx(ctx, tx)
 	if err != nil {
+		d.releaseNonce(nonce, err)
 		return DeployResult{}, err
 	}
 
@@ -215,6 +315,152 @@ func ProxyAddressFromReceipt(receipt *types.Receipt) (common.Address, error) {
 	return common.Address{}, errors.New("Deployed event not found in receipt logs")
 }
 
+// BatchCall sends calls in JSON-RPC batches of at most batchSize calls. A
+// batchSize of zero or less uses DefaultBatchSize.
+func BatchCall(ctx context.Context, caller Caller, calls []w3types.RPCCaller, batchSize int) error {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	for start := 0; start < len(calls); start += batchSize {
+		end := min(start+batchSize, len(calls))
+		if err := caller.CallCtx(ctx, calls[start:end]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BatchCallEach is BatchCall for calls that may fail individually, such as
+// calls to arbitrary tokens. It returns the error of each call in order;
+// the second return value is only set for failures of a whole batch.
+func BatchCallEach(ctx context.Context, caller Caller, calls []w3types.RPCCaller, batchSize int) ([]error, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	errs := make([]error, len(calls))
+	for start := 0; start < len(calls); start += batchSize {
+		end := min(start+batchSize, len(calls))
+		err := caller.CallCtx(ctx, calls[start:end]...)
+		var callErrs w3.CallErrors
+		if errors.As(err, &callErrs) {
+			copy(errs[start:end], callErrs)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return errs, nil
+}
+
+// GetLogs returns the logs matching query's Addresses and Topics in
+// [fromBlock, toBlock], in block and log index order. The range is fetched
+// in eth_getLogs requests of at most logRange blocks; zero uses
+// DefaultLogRange. Removed logs are dropped.
+func GetLogs(ctx context.Context, caller Caller, query ethereum.FilterQuery, fromBlock, toBlock, logRange uint64) ([]types.Log, error) {
+	var all []types.Log
+	err := ScanLogs(ctx, caller, query, fromBlock, toBlock, logRange, func(_, _ uint64, logs []types.Log) error {
+		all = append(all, logs...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(all, func(a, b types.Log) int {
+		return cmp.Or(cmp.Compare(a.BlockNumber, b.BlockNumber), cmp.Compare(a.Index, b.Index))
+	})
+	return all, nil
+}
+
+// ScanLogs is GetLogs for callers that keep state as they go: fn is called
+// with the logs of each request in turn, along with the block range it
+// covered, so that a failure part way keeps the ranges already handled. It
+// stops at the first error, from the node or from fn.
+func ScanLogs(ctx context.Context, caller Caller, query ethereum.FilterQuery, fromBlock, toBlock, logRange uint64, fn func(from, to uint64, logs []types.Log) error) error {
+	if logRange == 0 {
+		logRange = DefaultLogRange
+	}
+	for from := fromBlock; from <= toBlock; {
+		to := min(from+logRange-1, toBlock)
+
+		var logs []types.Log
+		query.FromBlock = new(big.Int).SetUint64(from)
+		query.ToBlock = new(big.Int).SetUint64(to)
+		if err := caller.CallCtx(ctx, eth.Logs(query).Returns(&logs)); err != nil {
+			return fmt.Errorf("get logs %d-%d: %w", from, to, err)
+		}
+		logs = slices.DeleteFunc(logs, func(log types.Log) bool { return log.Removed })
+		if err := fn(from, to, logs); err != nil {
+			return err
+		}
+
+		if to == toBlock {
+			break
+		}
+		from = to + 1
+	}
+	return nil
+}
+
+// ImplementationOf reads the ERC1967 implementation slot of proxy at
+// blockNumber (nil for latest). It returns the zero address for contracts
+// that are not ERC1967 proxies.
+func ImplementationOf(ctx context.Context, caller Caller, proxy common.Address, blockNumber *big.Int) (common.Address, error) {
+	var slot common.Hash
+	if err := caller.CallCtx(ctx, eth.StorageAt(proxy, ImplementationSlot, blockNumber).Returns(&slot)); err != nil {
+		return common.Address{}, fmt.Errorf("get implementation slot of %s: %w", proxy.Hex(), err)
+	}
+	return common.BytesToAddress(slot.Bytes()), nil
+}
+
+// ProxyInitData recovers the initialize() calldata a proxy was created with by
+// locating its Deployed event on factory and decoding the deployAndCall or
+// deployDeterministicAndCall transaction that emitted it. fromBlock bounds the
+// log search and may be nil to search from genesis; the search up to the
+// head is paged as by GetLogs. Proxies created through another contract
+// cannot be recovered this way.
+func ProxyInitData(ctx context.Context, caller Caller, factory, proxy common.Address, fromBlock *big.Int) ([]byte, error) {
+	var head *big.Int
+	if err := caller.CallCtx(ctx, eth.BlockNumber().Returns(&head)); err != nil {
+		return nil, fmt.Errorf("get block number: %w", err)
+	}
+	var from uint64
+	if fromBlock != nil {
+		from = fromBlock.Uint64()
+	}
+	query := ethereum.FilterQuery{
+		Addresses: []common.Address{factory},
+		Topics:    [][]common.Hash{{eventDeployed.Topic0}, {common.BytesToHash(proxy.Bytes())}},
+	}
+	logs, err := GetLogs(ctx, caller, query, from, head.Uint64(), DefaultLogRange)
+	if err != nil {
+		return nil, fmt.Errorf("get Deployed logs: %w", err)
+	}
+	if len(logs) == 0 {
+		return nil, fmt.Errorf("no Deployed event for %s on factory %s", proxy.Hex(), factory.Hex())
+	}
+
+	var tx *types.Transaction
+	if err := caller.CallCtx(ctx, eth.Tx(logs[0].TxHash).Returns(&tx)); err != nil {
+		return nil, fmt.Errorf("get tx %s: %w", logs[0].TxHash.Hex(), err)
+	}
+	if tx.To() == nil || *tx.To() != factory {
+		return nil, fmt.Errorf("tx %s was not sent to the factory directly", logs[0].TxHash.Hex())
+	}
+
+	var (
+		implementation common.Address
+		admin          common.Address
+		salt           common.Hash
+		initData       []byte
+	)
+	if err := funcDeployAndCall.DecodeArgs(tx.Data(), &implementation, &admin, &initData); err == nil {
+		return initData, nil
+	}
+	if err := funcDeployDeterministicAndCall.DecodeArgs(tx.Data(), &implementation, &admin, &salt, &initData); err != nil {
+		return nil, fmt.Errorf("decode factory call in tx %s: %w", tx.Hash().Hex(), err)
+	}
+	return initData, nil
+}
+
 func MustHexDecode(hexStr string) []byte {
 	b, err := hex.DecodeString(strings.TrimSpace(hexStr))
 	if err != nil {
@@ -0,0 +1,134 @@
+package publish_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/lmittmann/w3/module/eth"
+
+	"github.com/cosmo-local-credit/protocol/pkg/internal/vmtest"
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/giftabletoken"
+)
+
+// refuseOnce is a Hook that refuses the first eth_sendRawTransaction, as a
+// node does a transaction it will not pool.
+func refuseOnce() func(string, []any) error {
+	refused := false
+	return func(method string, _ []any) error {
+		if method != "eth_sendRawTransaction" || refused {
+			return nil
+		}
+		refused = true
+		return vmtest.NewRPCError(-32000, "insufficient funds for gas * price + value")
+	}
+}
+
+func TestDeployReleasesNonce(t *testing.T) {
+	init, err := giftabletoken.EncodeInit(giftabletoken.InitArgs{Name: "Token", Symbol: "TKN", Decimals: 6, Owner: vmtest.Owner, ExpiresAt: new(big.Int)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		send func(context.Context, *vmtest.Env, *publish.Deployer) (common.Hash, error)
+	}{
+		{"DeployImplementation", func(ctx context.Context, _ *vmtest.Env, d *publish.Deployer) (common.Hash, error) {
+			r, err := d.DeployImplementation(ctx, giftabletoken.Bytecode(), 5_000_000)
+			return r.TxHash, err
+		}},
+		{"DeployProxy", func(ctx context.Context, e *vmtest.Env, d *publish.Deployer) (common.Hash, error) {
+			return d.DeployProxy(ctx, e.Factory, e.Create(giftabletoken.Bytecode()), vmtest.Owner, init, 1_000_000)
+		}},
+		{"DeployDeterministicViaArachnid", func(ctx context.Context, _ *vmtest.Env, d *publish.Deployer) (common.Hash, error) {
+			r, err := d.DeployDeterministicViaArachnid(ctx, common.Hash{1}, giftabletoken.Bytecode(), 5_000_000)
+			return r.TxHash, err
+		}},
+		{"Transact", func(ctx context.Context, _ *vmtest.Env, d *publish.Deployer) (common.Hash, error) {
+			return d.Transact(ctx, common.Address{0x55}, big.NewInt(1), nil, 21_000)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := vmtest.New(t)
+			caller := e.Caller()
+			caller.Hook = refuseOnce()
+			d := e.Deployer(caller)
+			e.AutoMine()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			if _, err := tt.send(ctx, e, d); err == nil {
+				t.Fatal("refused send succeeded")
+			}
+			// The refused nonce is taken again, so the retry is mined
+			// rather than queued behind a gap.
+			hash, err := tt.send(ctx, e, d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			receipt, err := d.WaitForReceipt(ctx, hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var tx *types.Transaction
+			if err := e.Caller().CallCtx(ctx, eth.Tx(receipt.TxHash).Returns(&tx)); err != nil {
+				t.Fatal(err)
+			}
+			if tx.Nonce() != 0 {
+				t.Errorf("retry sent with nonce %d, want 0", tx.Nonce())
+			}
+		})
+	}
+}
+
+func TestProxyInitData(t *testing.T) {
+	e := vmtest.New(t)
+	caller := e.Caller()
+	d := e.Deployer(caller)
+	e.AutoMine()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	init, err := giftabletoken.EncodeInit(giftabletoken.InitArgs{Name: "Token", Symbol: "TKN", Decimals: 6, Owner: vmtest.Owner, ExpiresAt: new(big.Int)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := d.DeployProxy(ctx, e.Factory, e.Create(giftabletoken.Bytecode()), vmtest.Owner, init, 1_000_000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt, err := d.WaitForReceipt(ctx, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := publish.ProxyAddressFromReceipt(receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every eth_getLogs request is bounded, as GetLogs pages them.
+	caller.Hook = func(method string, args []any) error {
+		if method == "eth_getLogs" {
+			q, _ := json.Marshal(args[0])
+			var filter struct{ FromBlock, ToBlock string }
+			if json.Unmarshal(q, &filter); filter.FromBlock == "" || filter.ToBlock == "" || filter.ToBlock == "latest" {
+				t.Errorf("unbounded eth_getLogs %s", q)
+			}
+		}
+		return nil
+	}
+	got, err := publish.ProxyInitData(ctx, caller, e.Factory, proxy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, init) {
+		t.Errorf("init data %x, want %x", got, init)
+	}
+}
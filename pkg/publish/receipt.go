@@ -0,0 +1,155 @@
+package publish
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+)
+
+// DefaultPollInterval is how often WaitForReceipt polls when the endpoint
+// cannot push new heads.
+const DefaultPollInterval = 2 * time.Second
+
+type (
+	// ReceiptConfig controls WaitForReceipt. Confirmations is the number of
+	// blocks, counting the receipt's own, that must be canonical before the
+	// receipt is returned; zero is the same as one. PollInterval defaults
+	// to DefaultPollInterval.
+	ReceiptConfig struct {
+		Confirmations uint64
+		PollInterval  time.Duration
+	}
+
+	// Subscriber is implemented by Callers that support eth_subscribe, such
+	// as a *w3.Client dialled over a websocket.
+	Subscriber interface {
+		SubscribeCtx(ctx context.Context, s w3types.RPCSubscriber) (*rpc.ClientSubscription, error)
+	}
+)
+
+// WaitForReceipt blocks until the receipt of txHash has cfg.Confirmations
+// confirmations and its block is still canonical, ctx is cancelled or the
+// endpoint returns an error; a receipt not found yet is not an error. It
+// checks on every new head if caller is a Subscriber whose endpoint
+// supports newHeads subscriptions, and every cfg.PollInterval otherwise,
+// including after a subscription drops.
+//
+// If the receipt's block is reorged out, waiting continues for the
+// receipt in the new canonical chain.
+func WaitForReceipt(ctx context.Context, caller Caller, txHash common.Hash, cfg ReceiptConfig) (*types.Receipt, error) {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = DefaultPollInterval
+	}
+	confirmations := max(cfg.Confirmations, 1)
+
+	var (
+		heads chan *types.Header
+		sub   *rpc.ClientSubscription
+	)
+	if s, ok := caller.(Subscriber); ok {
+		heads = make(chan *types.Header, 16)
+		var err error
+		if sub, err = s.SubscribeCtx(ctx, eth.NewHeads(heads)); err != nil {
+			heads, sub = nil, nil
+		} else {
+			defer sub.Unsubscribe()
+		}
+	}
+	ticker := time.NewTicker(cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		receipt, err := confirmedReceipt(ctx, caller, txHash, confirmations)
+		if err != nil {
+			return nil, err
+		}
+		if receipt != nil {
+			return receipt, nil
+		}
+
+		if sub == nil {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-ticker.C:
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-heads:
+			drain(heads)
+		case <-sub.Err():
+			// Fall back to polling once the subscription is gone.
+			sub = nil
+		}
+	}
+}
+
+// drain discards heads that arrived while the last one was handled.
+func drain(heads chan *types.Header) {
+	for {
+		select {
+		case <-heads:
+		default:
+			return
+		}
+	}
+}
+
+// confirmedReceipt returns the receipt of txHash if it has confirmations
+// confirmations and its block is canonical, and nil if not yet. Only a
+// null receipt or block counts as not yet; any error from the endpoint is
+// returned.
+func confirmedReceipt(ctx context.Context, caller Caller, txHash common.Hash, confirmations uint64) (*types.Receipt, error) {
+	var raw json.RawMessage
+	if err := caller.CallCtx(ctx, &rawCall{method: "eth_getTransactionReceipt", args: []any{txHash}, result: &raw}); err != nil {
+		return nil, fmt.Errorf("get receipt of %s: %w", txHash.Hex(), err)
+	}
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	receipt := new(types.Receipt)
+	if err := json.Unmarshal(raw, receipt); err != nil {
+		return nil, fmt.Errorf("decode receipt of %s: %w", txHash.Hex(), err)
+	}
+
+	// The block hash is taken as reported rather than recomputed from the
+	// header, which may carry fields go-ethereum does not hash.
+	var (
+		head  *big.Int
+		block json.RawMessage
+	)
+	if err := caller.CallCtx(ctx,
+		eth.BlockNumber().Returns(&head),
+		&rawCall{method: "eth_getBlockByNumber", args: []any{hexutil.EncodeBig(receipt.BlockNumber), false}, result: &block},
+	); err != nil {
+		return nil, fmt.Errorf("get block %s: %w", receipt.BlockNumber, err)
+	}
+	if head.Uint64()+1 < receipt.BlockNumber.Uint64()+confirmations {
+		return nil, nil
+	}
+	if len(block) == 0 || string(block) == "null" {
+		return nil, nil
+	}
+	var canonical struct {
+		Hash common.Hash `json:"hash"`
+	}
+	if err := json.Unmarshal(block, &canonical); err != nil {
+		return nil, fmt.Errorf("decode block %s: %w", receipt.BlockNumber, err)
+	}
+	if canonical.Hash != receipt.BlockHash {
+		return nil, nil
+	}
+	return receipt, nil
+}
@@ -0,0 +1,106 @@
+package publish_test
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/cosmo-local-credit/protocol/pkg/internal/vmtest"
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+)
+
+func TestWaitForReceipt(t *testing.T) {
+	tests := []struct {
+		name string
+		// chain changes the chain after the transaction is sent.
+		chain func(e *vmtest.Env)
+		hook  func(method string, args []any) error
+		// confirmed is whether the receipt is returned; if not,
+		// WaitForReceipt runs until the deadline unless wantErr is set.
+		confirmed bool
+		wantErr   string
+	}{
+		{name: "pending", chain: func(e *vmtest.Env) {}},
+		{name: "confirmed", chain: func(e *vmtest.Env) { mine(e, 3) }, confirmed: true},
+		{name: "too few confirmations", chain: func(e *vmtest.Env) { mine(e, 2) }},
+		{
+			name: "reorged out",
+			chain: func(e *vmtest.Env) {
+				mine(e, 3)
+				e.Reorg(3)
+			},
+		},
+		{
+			name: "reorged and included again",
+			chain: func(e *vmtest.Env) {
+				mine(e, 3)
+				e.Reorg(3)
+				mine(e, 3)
+			},
+			confirmed: true,
+		},
+		{
+			name:  "receipt error",
+			chain: func(e *vmtest.Env) { mine(e, 3) },
+			hook: func(method string, _ []any) error {
+				if method == "eth_getTransactionReceipt" {
+					return vmtest.NewRPCError(-32602, "invalid params")
+				}
+				return nil
+			},
+			wantErr: "invalid params",
+		},
+		{
+			name:  "block error",
+			chain: func(e *vmtest.Env) { mine(e, 3) },
+			hook: func(method string, _ []any) error {
+				if method == "eth_getBlockByNumber" {
+					return errors.New("unauthorized")
+				}
+				return nil
+			},
+			wantErr: "unauthorized",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := vmtest.New(t)
+			d := e.Deployer(nil)
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			hash, err := d.Transact(ctx, common.Address{0x55}, big.NewInt(1), nil, 21_000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.chain(e)
+
+			caller := e.Caller()
+			caller.Hook = tt.hook
+			receipt, err := publish.WaitForReceipt(ctx, caller, hash, publish.ReceiptConfig{Confirmations: 3, PollInterval: time.Millisecond})
+			switch {
+			case tt.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) || ctx.Err() != nil {
+					t.Errorf("err %v, want %q before the deadline", err, tt.wantErr)
+				}
+			case tt.confirmed:
+				if err != nil || receipt.TxHash != hash {
+					t.Errorf("receipt %v, err %v", receipt, err)
+				}
+			case !errors.Is(err, context.DeadlineExceeded):
+				t.Errorf("receipt %v, err %v, want the deadline", receipt, err)
+			}
+		})
+	}
+}
+
+// mine mines n blocks.
+func mine(e *vmtest.Env, n int) {
+	for range n {
+		e.Mine()
+	}
+}
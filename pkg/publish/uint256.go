@@ -0,0 +1,107 @@
+package publish
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+// Helpers for reproducing Solidity's checked uint256 arithmetic with
+// big.Int. Each returns an error where the contract would revert.
+
+var (
+	ErrOverflow       = errors.New("uint256 overflow or underflow")
+	ErrDivisionByZero = errors.New("division by zero")
+)
+
+var MaxUint256 = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+
+// Uint256 returns x if it fits in a uint256 and ErrOverflow otherwise.
+func Uint256(x *big.Int) (*big.Int, error) {
+	if x.Sign() < 0 || x.Cmp(MaxUint256) > 0 {
+		return nil, ErrOverflow
+	}
+	return x, nil
+}
+
+func CheckedAdd(x, y *big.Int) (*big.Int, error) {
+	return Uint256(new(big.Int).Add(x, y))
+}
+
+func CheckedSub(x, y *big.Int) (*big.Int, error) {
+	return Uint256(new(big.Int).Sub(x, y))
+}
+
+func CheckedMul(x, y *big.Int) (*big.Int, error) {
+	return Uint256(new(big.Int).Mul(x, y))
+}
+
+// CheckedDiv is Solidity's x / y, which reverts on division by zero.
+func CheckedDiv(x, y *big.Int) (*big.Int, error) {
+	if y.Sign() == 0 {
+		return nil, ErrDivisionByZero
+	}
+	return new(big.Int).Div(x, y), nil
+}
+
+// Pow10 is 10 ** n in uint256, which overflows for n > 77.
+func Pow10(n uint64) (*big.Int, error) {
+	if n > 77 {
+		return nil, ErrOverflow
+	}
+	return new(big.Int).Exp(big.NewInt(10), new(big.Int).SetUint64(n), nil), nil
+}
+
+// FullMulDiv mirrors solady's FixedPointMathLib.fullMulDiv: floor(x * y / d)
+// with a 512-bit intermediate product. It fails if d is zero or the result
+// does not fit in a uint256.
+func FullMulDiv(x, y, d *big.Int) (*big.Int, error) {
+	if d.Sign() == 0 {
+		return nil, ErrDivisionByZero
+	}
+	return Uint256(new(big.Int).Div(new(big.Int).Mul(x, y), d))
+}
+
+// FullMulDivUp is FullMulDiv rounded up, as fullMulDivUp.
+func FullMulDivUp(x, y, d *big.Int) (*big.Int, error) {
+	if d.Sign() == 0 {
+		return nil, ErrDivisionByZero
+	}
+	q, r := new(big.Int).QuoRem(new(big.Int).Mul(x, y), d, new(big.Int))
+	if r.Sign() != 0 {
+		q.Add(q, big.NewInt(1))
+	}
+	return Uint256(q)
+}
+
+// decimalAmount is a plain decimal: digits with an optional fraction, and
+// no sign, exponent or ratio.
+var decimalAmount = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+
+// ParseUnits converts a decimal amount in whole token units, e.g. "12.5",
+// to base units of a token with the given decimals. It fails if the amount
+// is not a plain decimal, has more fractional digits than decimals, or
+// overflows.
+func ParseUnits(amount string, decimals uint8) (*big.Int, error) {
+	if !decimalAmount.MatchString(amount) {
+		return nil, fmt.Errorf("invalid amount %q", amount)
+	}
+	if _, err := Pow10(uint64(decimals)); err != nil {
+		return nil, err
+	}
+	whole, frac, _ := strings.Cut(amount, ".")
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > int(decimals) {
+		return nil, fmt.Errorf("amount %q has more than %d decimals", amount, decimals)
+	}
+	digits := strings.TrimLeft(whole+frac+strings.Repeat("0", int(decimals)-len(frac)), "0")
+	// MaxUint256 has 78 digits, so longer amounts overflow without being
+	// parsed.
+	if len(digits) > 78 {
+		return nil, ErrOverflow
+	}
+	x, _ := new(big.Int).SetString("0"+digits, 10)
+	return Uint256(x)
+}
@@ -0,0 +1,54 @@
+package publish_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+)
+
+func TestParseUnits(t *testing.T) {
+	tests := []struct {
+		amount   string
+		decimals uint8
+		want     string // empty if ParseUnits fails
+	}{
+		{"0", 6, "0"},
+		{"12", 6, "12000000"},
+		{"12.5", 6, "12500000"},
+		{"0.000001", 6, "1"},
+		{"1.500000000", 6, "1500000"},
+		{"007.10", 2, "710"},
+		{"1", 0, "1"},
+		{"0.0000001", 6, ""},
+		{"1.5", 0, ""},
+		{"1", 78, ""},
+		{"1" + strings.Repeat("0", 77), 0, "1" + strings.Repeat("0", 77)},
+		{"1" + strings.Repeat("0", 78), 0, ""},
+		{publish.MaxUint256.String(), 0, publish.MaxUint256.String()},
+		{"115792089237316195423570985008687907853269984665640564039457584007913129639936", 0, ""},
+		{"1" + strings.Repeat("0", 1_000_000), 18, ""},
+		{"", 6, ""},
+		{".5", 6, ""},
+		{"5.", 6, ""},
+		{"-1", 6, ""},
+		{"+1", 6, ""},
+		{"1/3", 6, ""},
+		{"1e3", 6, ""},
+		{"1e1000000", 6, ""},
+		{"0x10", 6, ""},
+		{" 1", 6, ""},
+		{"1_000", 6, ""},
+	}
+	for _, tt := range tests {
+		got, err := publish.ParseUnits(tt.amount, tt.decimals)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("ParseUnits(%.20q, %d) = %s, want an error", tt.amount, tt.decimals, got)
+		case tt.want != "" && err != nil:
+			t.Errorf("ParseUnits(%.20q, %d): %v", tt.amount, tt.decimals, err)
+		case tt.want != "" && got.String() != tt.want:
+			t.Errorf("ParseUnits(%.20q, %d) = %s, want %s", tt.amount, tt.decimals, got, tt.want)
+		}
+	}
+}
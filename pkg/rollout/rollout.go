@@ -0,0 +1,495 @@
+// Package rollout runs one deployment definition on several chains and
+// checks that the addresses derived with CREATE2, those of the factory and
+// of deterministic proxies, are the same on each.
+package rollout
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/big"
+	"slices"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/erc1967factory"
+)
+
+// FactoryName is the name the factory is compared under in parity checks.
+// Definition entries cannot use it.
+const FactoryName = "ERC1967Factory"
+
+var ErrNoCreate2Factory = errors.New("Arachnid CREATE2 factory is not deployed")
+
+var (
+	funcDeployDeterministic        = w3.MustNewFunc("deployDeterministic(address,address,bytes32)", "address")
+	funcDeployDeterministicAndCall = w3.MustNewFunc("deployDeterministicAndCall(address,address,bytes32,bytes)", "address")
+	funcInitCodeHash               = w3.MustNewFunc("initCodeHash()", "bytes32")
+)
+
+type (
+	// Chain is one chain to deploy to, with its own endpoints and fees.
+	// The endpoints are dialed as a publish.Pool configured by Pool, whose
+	// ChainID is set to ChainID. MaxPending zero uses
+	// publish.DefaultMaxPending.
+	Chain struct {
+		Name       string
+		Endpoints  []publish.Endpoint
+		Pool       publish.PoolConfig
+		ChainID    int64
+		GasFeeCap  *big.Int
+		GasTipCap  *big.Int
+		Receipts   publish.ReceiptConfig
+		MaxPending int
+	}
+
+	// Implementation is a contract deployed with CREATE, so its address
+	// differs from chain to chain. Contract is a package under
+	// pkg/publish/contracts. A zero GasLimit is estimated.
+	Implementation struct {
+		Name     string
+		Contract string
+		GasLimit uint64
+	}
+
+	// Proxy is deployed through the factory's deployDeterministicAndCall,
+	// so its address depends only on the factory and Salt. The factory
+	// requires Salt to start with the deployer's address or with 20 zero
+	// bytes, as publish.GenerateSalt's salts do. Init builds the
+	// initialize calldata from the addresses of the entries in After, and
+	// a nil Init deploys the proxy without calling it. A zero GasLimit uses
+	// publish.ProxyGasLimit.
+	Proxy struct {
+		Name           string
+		Implementation string
+		Salt           common.Hash
+		Admin          common.Address
+		After          []string
+		Init           func(addrs map[string]common.Address) ([]byte, error)
+		GasLimit       uint64
+	}
+
+	// Definition is one deployment, run the same way on every chain. The
+	// factory is deployed through the Arachnid CREATE2 factory with
+	// FactorySalt. Names are the address book entry names.
+	Definition struct {
+		FactorySalt     common.Hash
+		Implementations []Implementation
+		Proxies         []Proxy
+	}
+
+	// ChainResult is the outcome on one chain. Book holds what is deployed,
+	// including proxies found from an earlier run. Failed lists the steps
+	// that did not succeed, and Err why the chain did not complete.
+	ChainResult struct {
+		Chain   string               `json:"chain"`
+		ChainID int64                `json:"chain_id"`
+		Book    *publish.AddressBook `json:"book,omitempty"`
+		Failed  []string             `json:"failed,omitempty"`
+		Err     string               `json:"error,omitempty"`
+
+		Steps []publish.StepResult `json:"-"`
+	}
+
+	// Mismatch is a CREATE2-derived address that differs between chains.
+	Mismatch struct {
+		Name      string                   `json:"name"`
+		Addresses map[int64]common.Address `json:"addresses"`
+	}
+
+	// Report is the outcome of a rollout. Books is the combined address
+	// book, keyed by chain ID.
+	Report struct {
+		Chains     []ChainResult      `json:"chains"`
+		Books      publish.ChainBooks `json:"books"`
+		Mismatches []Mismatch         `json:"mismatches"`
+	}
+)
+
+// OK reports whether every chain completed and every CREATE2-derived
+// address matches across chains.
+func (r *Report) OK() bool {
+	for _, c := range r.Chains {
+		if c.Err != "" {
+			return false
+		}
+	}
+	return len(r.Mismatches) == 0
+}
+
+// Run deploys def to every chain concurrently, with the same key, and
+// checks parity across the chains' address books. The factory is reused
+// where it already exists, and so are proxies from an earlier run, along
+// with implementations only they use; everything else is deployed through
+// a publish pipeline.
+//
+// The error reports an invalid definition or chain list only. Failures on
+// a chain are recorded in its ChainResult, and the other chains carry on.
+func Run(ctx context.Context, def Definition, chains []Chain, key *ecdsa.PrivateKey) (*Report, error) {
+	if err := def.validate(crypto.PubkeyToAddress(key.PublicKey)); err != nil {
+		return nil, err
+	}
+	seen := make(map[int64]bool, len(chains))
+	for _, c := range chains {
+		if seen[c.ChainID] {
+			return nil, fmt.Errorf("chain %d is listed twice", c.ChainID)
+		}
+		seen[c.ChainID] = true
+	}
+
+	results := make([]ChainResult, len(chains))
+	var wg sync.WaitGroup
+	for i, chain := range chains {
+		wg.Go(func() {
+			results[i] = deploy(ctx, def, chain, key)
+		})
+	}
+	wg.Wait()
+
+	r := &Report{Chains: results, Books: make(publish.ChainBooks)}
+	for _, c := range results {
+		if c.Book != nil {
+			r.Books[c.ChainID] = c.Book
+		}
+	}
+	r.Mismatches = Parity(def, r.Books)
+	return r, nil
+}
+
+// Parity compares the factory and deterministic proxy addresses of def
+// across books. Chains without an entry are left out.
+func Parity(def Definition, books publish.ChainBooks) []Mismatch {
+	names := []string{FactoryName}
+	for _, p := range def.Proxies {
+		names = append(names, p.Name)
+	}
+
+	var mismatches []Mismatch
+	for _, name := range names {
+		addrs := make(map[int64]common.Address)
+		for chainID, book := range books {
+			if name == FactoryName {
+				if book.Factory != (common.Address{}) {
+					addrs[chainID] = book.Factory
+				}
+			} else if entry, ok := book.Contracts[name]; ok {
+				addrs[chainID] = entry.Address
+			}
+		}
+		distinct := slices.Compact(slices.SortedFunc(maps.Values(addrs), func(a, b common.Address) int { return a.Cmp(b) }))
+		if len(distinct) > 1 {
+			mismatches = append(mismatches, Mismatch{Name: name, Addresses: addrs})
+		}
+	}
+	return mismatches
+}
+
+// validate checks def before anything is sent. A salt the factory would
+// reject for deployer fails here rather than as a reverted proxy step.
+func (def Definition) validate(deployer common.Address) error {
+	names := map[string]bool{FactoryName: true}
+	impls := make(map[string]bool)
+	for _, impl := range def.Implementations {
+		if _, ok := contracts.ByPackage(impl.Contract); !ok {
+			return fmt.Errorf("implementation %q: unknown contract %q", impl.Name, impl.Contract)
+		}
+		if names[impl.Name] {
+			return fmt.Errorf("implementation %q: name is taken", impl.Name)
+		}
+		names[impl.Name], impls[impl.Name] = true, true
+	}
+	salts := make(map[common.Hash]string)
+	for _, p := range def.Proxies {
+		if names[p.Name] {
+			return fmt.Errorf("proxy %q: name is taken", p.Name)
+		}
+		if !impls[p.Implementation] {
+			return fmt.Errorf("proxy %q: unknown implementation %q", p.Name, p.Implementation)
+		}
+		if prefix := common.BytesToAddress(p.Salt[:common.AddressLength]); prefix != deployer && prefix != (common.Address{}) {
+			return fmt.Errorf("proxy %q: salt starts with %s, want the deployer %s or zero", p.Name, prefix.Hex(), deployer.Hex())
+		}
+		if other, ok := salts[p.Salt]; ok {
+			return fmt.Errorf("proxy %q: salt is also used by %q", p.Name, other)
+		}
+		names[p.Name], salts[p.Salt] = true, p.Name
+	}
+	for _, p := range def.Proxies {
+		for _, name := range p.After {
+			if !names[name] || name == FactoryName {
+				return fmt.Errorf("proxy %q: unknown entry %q", p.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// deploy runs def on one chain.
+func deploy(ctx context.Context, def Definition, chain Chain, key *ecdsa.PrivateKey) ChainResult {
+	res := ChainResult{Chain: chain.Name, ChainID: chain.ChainID}
+	fail := func(err error) ChainResult {
+		res.Err = err.Error()
+		return res
+	}
+
+	cfg := chain.Pool
+	cfg.ChainID = chain.ChainID
+	pool, err := publish.DialPool(ctx, chain.Endpoints, cfg)
+	if err != nil {
+		return fail(err)
+	}
+	d := publish.NewDeployerWithCaller(pool, chain.ChainID, key, chain.GasFeeCap, chain.GasTipCap)
+	defer d.Close()
+	d.SetReceiptConfig(chain.Receipts)
+	caller := d.Client()
+
+	factory, err := deployFactory(ctx, d, def.FactorySalt)
+	if err != nil {
+		return fail(err)
+	}
+	res.Book = publish.NewAddressBook(chain.ChainID)
+	res.Book.Factory = factory
+
+	var initCodeHash common.Hash
+	if err := caller.CallCtx(ctx, eth.CallFunc(factory, funcInitCodeHash).Returns(&initCodeHash)); err != nil {
+		return fail(fmt.Errorf("get factory init code hash: %w", err))
+	}
+
+	// Proxies deployed by an earlier run, and the implementations only
+	// they use, are recorded rather than deployed again, once the
+	// implementation each points at is checked to be the expected contract.
+	implOf := make(map[string]Implementation)
+	for _, impl := range def.Implementations {
+		implOf[impl.Name] = impl
+	}
+	predicted := make(map[string]common.Address)
+	codes := make([][]byte, len(def.Proxies))
+	slots := make([]common.Hash, len(def.Proxies))
+	var calls []w3types.RPCCaller
+	for i, p := range def.Proxies {
+		predicted[p.Name] = crypto.CreateAddress2(factory, p.Salt, initCodeHash.Bytes())
+		calls = append(calls,
+			eth.Code(predicted[p.Name], nil).Returns(&codes[i]),
+			eth.StorageAt(predicted[p.Name], publish.ImplementationSlot, nil).Returns(&slots[i]),
+		)
+	}
+	if err := publish.BatchCall(ctx, caller, calls, 0); err != nil {
+		return fail(fmt.Errorf("check existing proxies: %w", err))
+	}
+
+	known := make(map[string]common.Address)
+	existingImpl := make(map[string]common.Address)
+	for i, p := range def.Proxies {
+		if len(codes[i]) == 0 {
+			continue
+		}
+		impl := common.BytesToAddress(slots[i].Bytes())
+		if err := contracts.VerifyAt(ctx, caller, impl, implOf[p.Implementation].Contract); err != nil {
+			return fail(fmt.Errorf("proxy %q at %s: implementation: %w", p.Name, predicted[p.Name].Hex(), err))
+		}
+		known[p.Name] = predicted[p.Name]
+		res.Book.Set(p.Name, publish.BookEntry{Contract: implOf[p.Implementation].Contract, Address: predicted[p.Name], Implementation: impl})
+		if _, ok := existingImpl[p.Implementation]; !ok {
+			existingImpl[p.Implementation] = impl
+		}
+	}
+
+	var steps []publish.Step
+	isStep := make(map[string]bool)
+	for _, impl := range def.Implementations {
+		if addr, ok := existingImpl[impl.Name]; ok && !needed(def, impl.Name, known) {
+			known[impl.Name] = addr
+			res.Book.Set(impl.Name, publish.BookEntry{Contract: impl.Contract, Address: addr})
+			continue
+		}
+		c, _ := contracts.ByPackage(impl.Contract)
+		steps = append(steps, publish.DeployStep(impl.Name, c.Bytecode(), impl.GasLimit))
+		isStep[impl.Name] = true
+	}
+	for _, p := range def.Proxies {
+		if _, ok := known[p.Name]; ok {
+			continue
+		}
+		steps = append(steps, proxyStep(p, factory, predicted[p.Name], known, isStep))
+		isStep[p.Name] = true
+	}
+	if len(steps) == 0 {
+		return res
+	}
+
+	results, err := d.RunPipeline(ctx, steps, publish.PipelineConfig{MaxPending: chain.MaxPending})
+	res.Steps = results
+	addrs := maps.Clone(known)
+	for _, r := range results {
+		if r.Status == publish.StepSucceeded {
+			addrs[r.Name] = r.ContractAddress
+		}
+	}
+	for _, r := range results {
+		if r.Status != publish.StepSucceeded {
+			res.Failed = append(res.Failed, fmt.Sprintf("%s: %s: %v", r.Name, r.Status, r.Err))
+			continue
+		}
+		if impl, ok := implOf[r.Name]; ok {
+			res.Book.Set(r.Name, publish.BookEntry{Contract: impl.Contract, Address: r.ContractAddress})
+			continue
+		}
+		p := def.Proxies[slices.IndexFunc(def.Proxies, func(p Proxy) bool { return p.Name == r.Name })]
+		res.Book.Set(r.Name, publish.BookEntry{Contract: implOf[p.Implementation].Contract, Address: r.ContractAddress, Implementation: addrs[p.Implementation]})
+	}
+	if err != nil {
+		return fail(err)
+	}
+	return res
+}
+
+// needed reports whether the implementation name must be deployed: it is
+// referenced by an After list, used by no proxy, or used by a proxy that
+// is not deployed yet.
+func needed(def Definition, name string, known map[string]common.Address) bool {
+	used := false
+	for _, p := range def.Proxies {
+		if slices.Contains(p.After, name) {
+			return true
+		}
+		if p.Implementation == name {
+			used = true
+			if _, ok := known[p.Name]; !ok {
+				return true
+			}
+		}
+	}
+	return !used
+}
+
+// deployFactory deploys the ERC1967Factory through the Arachnid CREATE2
+// factory unless it is already there, and checks the code at its address.
+func deployFactory(ctx context.Context, d *publish.Deployer, salt common.Hash) (common.Address, error) {
+	bytecode := erc1967factory.Bytecode()
+	factory := publish.PredictCreate2Address(publish.ArachnidCreate2Factory, salt, bytecode)
+
+	var code, create2Code []byte
+	if err := d.Client().CallCtx(ctx,
+		eth.Code(factory, nil).Returns(&code),
+		eth.Code(publish.ArachnidCreate2Factory, nil).Returns(&create2Code),
+	); err != nil {
+		return common.Address{}, fmt.Errorf("get factory code: %w", err)
+	}
+	if len(code) == 0 {
+		if len(create2Code) == 0 {
+			return common.Address{}, ErrNoCreate2Factory
+		}
+		result, err := d.DeployDeterministicViaArachnid(ctx, salt, bytecode, erc1967factory.GasLimit)
+		if err != nil {
+			return common.Address{}, fmt.Errorf("deploy factory: %w", err)
+		}
+		receipt, err := d.WaitForReceipt(ctx, result.TxHash)
+		if err != nil {
+			return common.Address{}, fmt.Errorf("deploy factory: %w", err)
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			return common.Address{}, fmt.Errorf("deploy factory: reverted in tx %s", result.TxHash.Hex())
+		}
+	}
+	if err := contracts.VerifyAt(ctx, d.Client(), factory, "erc1967factory"); err != nil {
+		return common.Address{}, fmt.Errorf("factory: %w", err)
+	}
+	return factory, nil
+}
+
+// proxyStep deploys p through factory at its predicted address. Entries
+// that are steps become dependencies; the others are taken from known.
+// Every address it needs is known once sent, so it is pipelined.
+func proxyStep(p Proxy, factory, predicted common.Address, known map[string]common.Address, isStep map[string]bool) publish.Step {
+	var deps []string
+	for _, name := range append([]string{p.Implementation}, p.After...) {
+		if isStep[name] && !slices.Contains(deps, name) {
+			deps = append(deps, name)
+		}
+	}
+	gasLimit := p.GasLimit
+	if gasLimit == 0 {
+		gasLimit = publish.ProxyGasLimit
+	}
+
+	return publish.Step{
+		Name:      p.Name,
+		DependsOn: deps,
+		Build: func(results map[string]publish.StepResult) (publish.TxRequest, error) {
+			addrs := maps.Clone(known)
+			for name, r := range results {
+				addrs[name] = r.ContractAddress
+			}
+			var (
+				calldata []byte
+				err      error
+			)
+			if p.Init == nil {
+				calldata, err = funcDeployDeterministic.EncodeArgs(addrs[p.Implementation], p.Admin, p.Salt)
+			} else {
+				var initData []byte
+				if initData, err = p.Init(addrs); err != nil {
+					return publish.TxRequest{}, fmt.Errorf("init data: %w", err)
+				}
+				calldata, err = funcDeployDeterministicAndCall.EncodeArgs(addrs[p.Implementation], p.Admin, p.Salt, initData)
+			}
+			if err != nil {
+				return publish.TxRequest{}, fmt.Errorf("encode deployDeterministic: %w", err)
+			}
+			return publish.TxRequest{To: &factory, Data: calldata, Gas: gasLimit, Creates: predicted}, nil
+		},
+	}
+}
+
+func (r *Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, c := range r.Chains {
+		fmt.Fprintf(tw, "%s (chain %d)\n", c.Chain, c.ChainID)
+		if c.Book != nil {
+			fmt.Fprintf(tw, "  %s\t%s\n", FactoryName, c.Book.Factory.Hex())
+			for _, name := range c.Book.Names() {
+				entry := c.Book.Contracts[name]
+				if entry.Implementation != (common.Address{}) {
+					fmt.Fprintf(tw, "  %s\t%s\t%s proxy of %s\n", name, entry.Address.Hex(), entry.Contract, entry.Implementation.Hex())
+				} else {
+					fmt.Fprintf(tw, "  %s\t%s\t%s\n", name, entry.Address.Hex(), entry.Contract)
+				}
+			}
+		}
+		for _, failed := range c.Failed {
+			fmt.Fprintf(tw, "  failed: %s\n", failed)
+		}
+		if c.Err != "" {
+			fmt.Fprintf(tw, "  error: %s\n", c.Err)
+		}
+	}
+	if len(r.Mismatches) == 0 {
+		fmt.Fprintf(tw, "CREATE2 addresses match on %d chains\n", len(r.Books))
+	}
+	for _, m := range r.Mismatches {
+		fmt.Fprintf(tw, "mismatch %s\n", m.Name)
+		for _, chainID := range slices.Sorted(maps.Keys(m.Addresses)) {
+			fmt.Fprintf(tw, "  chain %d\t%s\n", chainID, m.Addresses[chainID].Hex())
+		}
+	}
+	return tw.Flush()
+}
+
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
@@ -0,0 +1,213 @@
+package rollout_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/lmittmann/w3"
+
+	"github.com/cosmo-local-credit/protocol/pkg/internal/vmtest"
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/feepolicy"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts/limiter"
+	"github.com/cosmo-local-credit/protocol/pkg/rollout"
+)
+
+// arachnidCode is the runtime code of the Arachnid CREATE2 factory.
+var arachnidCode = common.FromHex("0x7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffe03601600081602082378035828234f58015156039578182fd5b8082525050506014600cf3")
+
+func definition(deployer common.Address) rollout.Definition {
+	return rollout.Definition{
+		FactorySalt: common.HexToHash("0x01"),
+		Implementations: []rollout.Implementation{
+			{Name: "feepolicy", Contract: "feepolicy", GasLimit: feepolicy.ImplGasLimit},
+			{Name: "limiter", Contract: "limiter", GasLimit: limiter.ImplGasLimit},
+		},
+		Proxies: []rollout.Proxy{
+			{
+				Name: "FeePolicy", Implementation: "feepolicy", Admin: vmtest.Owner,
+				Salt: publish.GenerateSalt(deployer, "FeePolicy"),
+				Init: func(map[string]common.Address) ([]byte, error) {
+					return feepolicy.EncodeInit(feepolicy.InitArgs{Owner: vmtest.Owner, DefaultFee: big.NewInt(5000)})
+				},
+			},
+			{
+				Name: "Limiter", Implementation: "limiter", Admin: vmtest.Owner,
+				Salt:  common.HexToHash("0x02"),
+				After: []string{"FeePolicy"},
+				Init: func(addrs map[string]common.Address) ([]byte, error) {
+					return limiter.EncodeInit(limiter.InitArgs{Owner: addrs["FeePolicy"]})
+				},
+			},
+		},
+	}
+}
+
+// chain serves e over HTTP with the Arachnid factory deployed and key
+// funded.
+func chain(t *testing.T, e *vmtest.Env, key *ecdsa.PrivateKey) rollout.Chain {
+	t.Helper()
+	e.VM.SetCode(publish.ArachnidCreate2Factory, arachnidCode)
+	e.VM.SetBalance(crypto.PubkeyToAddress(key.PublicKey), w3.I("1 ether"))
+	e.AutoMine()
+	srv := httptest.NewServer(e.Caller())
+	t.Cleanup(srv.Close)
+	return rollout.Chain{
+		Name:      "vmtest",
+		Endpoints: []publish.Endpoint{{URL: srv.URL}},
+		ChainID:   vmtest.ChainID,
+		GasFeeCap: big.NewInt(100),
+		GasTipCap: big.NewInt(10),
+		Receipts:  publish.ReceiptConfig{PollInterval: time.Millisecond},
+	}
+}
+
+func TestRun(t *testing.T) {
+	e := vmtest.New(t)
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployer := crypto.PubkeyToAddress(key.PublicKey)
+	def := definition(deployer)
+	c := chain(t, e, key)
+	ctx := context.Background()
+
+	report, err := rollout.Run(ctx, def, []rollout.Chain{c}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || len(report.Chains[0].Steps) != 4 {
+		t.Fatalf("first run: %+v", report.Chains[0])
+	}
+	book := report.Books[vmtest.ChainID]
+	for _, name := range []string{"FeePolicy", "Limiter"} {
+		var code []byte
+		if code, err = e.VM.Code(book.Contracts[name].Address); err != nil || len(code) == 0 {
+			t.Fatalf("%s: no code at %s", name, book.Contracts[name].Address.Hex())
+		}
+	}
+
+	// A second run finds both proxies and deploys nothing.
+	if report, err = rollout.Run(ctx, def, []rollout.Chain{c}, key); err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || len(report.Chains[0].Steps) != 0 {
+		t.Fatalf("second run: %+v", report.Chains[0])
+	}
+	if again := report.Books[vmtest.ChainID]; again.Factory != book.Factory ||
+		again.Contracts["Limiter"] != book.Contracts["Limiter"] || again.Contracts["feepolicy"] != book.Contracts["feepolicy"] {
+		t.Errorf("second run book %+v, want %+v", again, book)
+	}
+
+	// A proxy whose slot points at another contract is not taken as done.
+	e.VM.SetStorageAt(book.Contracts["FeePolicy"].Address, publish.ImplementationSlot, common.BytesToHash(book.Contracts["limiter"].Address.Bytes()))
+	if report, err = rollout.Run(ctx, def, []rollout.Chain{c}, key); err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() || !strings.Contains(report.Chains[0].Err, `proxy "FeePolicy"`) || !strings.Contains(report.Chains[0].Err, "want feepolicy") {
+		t.Errorf("swapped implementation: %+v", report.Chains[0])
+	}
+}
+
+func TestRunSalt(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		salt    common.Hash
+		wantErr string
+	}{
+		{name: "deployer prefix", salt: publish.GenerateSalt(crypto.PubkeyToAddress(key.PublicKey), "FeePolicy")},
+		{name: "zero prefix", salt: common.HexToHash("0x03")},
+		{name: "other prefix", salt: publish.GenerateSalt(common.Address{0x01}, "FeePolicy"), wantErr: "want the deployer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			def := definition(crypto.PubkeyToAddress(key.PublicKey))
+			def.Proxies[0].Salt = tt.salt
+			// No chains: only the definition is checked.
+			_, err := rollout.Run(context.Background(), def, nil, key)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParity(t *testing.T) {
+	def := definition(common.Address{})
+	factory, other := common.Address{0xfa}, common.Address{0xfb}
+	proxy, otherProxy := common.Address{0x01}, common.Address{0x02}
+	book := func(chainID int64, factory common.Address, proxies map[string]common.Address) *publish.AddressBook {
+		b := publish.NewAddressBook(chainID)
+		b.Factory = factory
+		for name, addr := range proxies {
+			b.Set(name, publish.BookEntry{Contract: "feepolicy", Address: addr})
+		}
+		// Implementations are deployed with CREATE and may differ.
+		b.Set("feepolicy", publish.BookEntry{Contract: "feepolicy", Address: common.BigToAddress(big.NewInt(chainID))})
+		return b
+	}
+
+	tests := []struct {
+		name  string
+		books publish.ChainBooks
+		want  []string
+	}{
+		{
+			name: "match",
+			books: publish.ChainBooks{
+				1: book(1, factory, map[string]common.Address{"FeePolicy": proxy}),
+				2: book(2, factory, map[string]common.Address{"FeePolicy": proxy}),
+			},
+		},
+		{
+			name: "proxy differs",
+			books: publish.ChainBooks{
+				1: book(1, factory, map[string]common.Address{"FeePolicy": proxy}),
+				2: book(2, factory, map[string]common.Address{"FeePolicy": otherProxy}),
+			},
+			want: []string{"FeePolicy"},
+		},
+		{
+			name: "factory differs",
+			books: publish.ChainBooks{
+				1: book(1, factory, map[string]common.Address{"FeePolicy": proxy}),
+				2: book(2, other, map[string]common.Address{"FeePolicy": proxy}),
+				3: book(3, factory, map[string]common.Address{"FeePolicy": proxy}),
+			},
+			want: []string{rollout.FactoryName},
+		},
+		{
+			name: "missing entries are left out",
+			books: publish.ChainBooks{
+				1: book(1, factory, map[string]common.Address{"FeePolicy": proxy, "Limiter": otherProxy}),
+				2: book(2, common.Address{}, map[string]common.Address{"FeePolicy": proxy}),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, m := range rollout.Parity(def, tt.books) {
+				got = append(got, m.Name)
+				if len(m.Addresses) != len(tt.books) {
+					t.Errorf("%s: addresses %v, want one per chain", m.Name, m.Addresses)
+				}
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("mismatches %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
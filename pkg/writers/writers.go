@@ -0,0 +1,347 @@
+// Package writers audits the writer role of GiftableToken, Limiter, CAT,
+// AccountsIndex and TokenUniqueSymbolIndex contracts. None of them can
+// enumerate their writers, so the sets are rebuilt from events.
+package writers
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math/big"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/lmittmann/w3"
+	"github.com/lmittmann/w3/module/eth"
+	"github.com/lmittmann/w3/w3types"
+
+	"github.com/cosmo-local-credit/protocol/pkg/publish"
+	"github.com/cosmo-local-credit/protocol/pkg/publish/contracts"
+)
+
+// DefaultMinShared is the number of contracts a writer must be on to be
+// reported as shared, if Config.MinShared is zero.
+const DefaultMinShared = 3
+
+// Packages are the contract packages with a writer role. The solady-style
+// contracts emit WriterAdded and WriterRemoved with an indexed address;
+// AccountsIndex and TokenUniqueSymbolIndex emit WriterAdded and
+// WriterDeleted with a non-indexed one.
+var Packages = []string{"giftabletoken", "limiter", "cat", "accountsindex", "tokenuniquesymbolindex"}
+
+var (
+	eventWriterAdded   = w3.MustNewEvent("WriterAdded(address)")
+	eventWriterRemoved = w3.MustNewEvent("WriterRemoved(address)")
+	eventWriterDeleted = w3.MustNewEvent("WriterDeleted(address)")
+
+	funcIsWriter = w3.MustNewFunc("isWriter(address)", "bool")
+	funcOwner    = w3.MustNewFunc("owner()", "address")
+)
+
+type (
+	// Target is a contract to audit. Contract is one of Packages.
+	Target struct {
+		Name     string         `json:"name"`
+		Contract string         `json:"contract"`
+		Address  common.Address `json:"address"`
+	}
+
+	// Config bounds the audit. ToBlock zero audits up to the current head.
+	// LogRange zero uses publish.DefaultLogRange, MinShared zero DefaultMinShared.
+	Config struct {
+		FromBlock uint64
+		ToBlock   uint64
+		LogRange  uint64
+		MinShared int
+	}
+
+	// Writer is a current member of a contract's writer set. Kind is "eoa"
+	// or "contract"; Contract is the package identified from its code, or
+	// from its implementation if it is a proxy, and empty if unknown.
+	Writer struct {
+		Address    common.Address `json:"address"`
+		Kind       string         `json:"kind"`
+		Contract   string         `json:"contract,omitempty"`
+		AddedBlock uint64         `json:"added_block"`
+		AddedTx    common.Hash    `json:"added_tx"`
+	}
+
+	// Writers is the writer set of one target. Owner is not listed as a
+	// writer, although every package but TokenUniqueSymbolIndex treats its
+	// owner as one. Warnings note where isWriter disagrees with the events,
+	// e.g. because writers were added before Config.FromBlock.
+	Writers struct {
+		Target
+		Owner    common.Address `json:"owner"`
+		Writers  []Writer       `json:"writers"`
+		Warnings []string       `json:"warnings,omitempty"`
+	}
+
+	// Shared is a writer found on at least Config.MinShared contracts.
+	Shared struct {
+		Address common.Address `json:"address"`
+		Kind    string         `json:"kind"`
+		Names   []string       `json:"names"`
+	}
+
+	// Report is the result of Audit, in target order.
+	Report struct {
+		FromBlock uint64    `json:"from_block"`
+		ToBlock   uint64    `json:"to_block"`
+		Contracts []Writers `json:"contracts"`
+		Shared    []Shared  `json:"shared"`
+	}
+)
+
+// TargetsFromBook returns every entry of book whose contract has a writer
+// role, by name.
+func TargetsFromBook(book *publish.AddressBook) []Target {
+	var targets []Target
+	for _, name := range book.Names() {
+		entry := book.Contracts[name]
+		if slices.Contains(Packages, entry.Contract) {
+			targets = append(targets, Target{Name: name, Contract: entry.Contract, Address: entry.Address})
+		}
+	}
+	return targets
+}
+
+// Audit rebuilds the writer set of each target from its writer events in
+// the configured block range and confirms every address ever added with
+// isWriter at the end of the range. Writers that are EOAs are told apart
+// from contracts by their code.
+func Audit(ctx context.Context, caller publish.Caller, targets []Target, cfg Config) (*Report, error) {
+	if cfg.MinShared == 0 {
+		cfg.MinShared = DefaultMinShared
+	}
+	var number *big.Int
+	if cfg.ToBlock != 0 {
+		number = new(big.Int).SetUint64(cfg.ToBlock)
+	}
+	var header *types.Header
+	if err := caller.CallCtx(ctx, eth.HeaderByNumber(number).Returns(&header)); err != nil {
+		return nil, fmt.Errorf("get header: %w", err)
+	}
+	block := header.Number
+
+	r := &Report{FromBlock: cfg.FromBlock, ToBlock: block.Uint64(), Contracts: []Writers{}, Shared: []Shared{}}
+	if len(targets) == 0 {
+		return r, nil
+	}
+	addresses := make([]common.Address, len(targets))
+	for i, t := range targets {
+		if !slices.Contains(Packages, t.Contract) {
+			return nil, fmt.Errorf("%s: %s has no writer role", t.Name, t.Contract)
+		}
+		addresses[i] = t.Address
+	}
+	query := ethereum.FilterQuery{
+		Addresses: addresses,
+		Topics:    [][]common.Hash{{eventWriterAdded.Topic0, eventWriterRemoved.Topic0, eventWriterDeleted.Topic0}},
+	}
+	logs, err := publish.GetLogs(ctx, caller, query, cfg.FromBlock, r.ToBlock, cfg.LogRange)
+	if err != nil {
+		return nil, err
+	}
+
+	// Replay the events of each target, keeping every address ever added
+	// so that isWriter can also catch removals the events missed.
+	var (
+		added     = make([]map[common.Address]*types.Log, len(targets))
+		candidate = make([][]common.Address, len(targets))
+	)
+	for i := range targets {
+		added[i] = make(map[common.Address]*types.Log)
+	}
+	for _, log := range logs {
+		for i, t := range targets {
+			if log.Address != t.Address {
+				continue
+			}
+			writer, isAdd, err := decodeWriterEvent(t.Contract, &log)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", t.Name, err)
+			}
+			if !slices.Contains(candidate[i], writer) {
+				candidate[i] = append(candidate[i], writer)
+			}
+			if isAdd {
+				added[i][writer] = &log
+			} else {
+				delete(added[i], writer)
+			}
+		}
+	}
+
+	var (
+		owners   = make([]common.Address, len(targets))
+		isWriter = make([][]bool, len(targets))
+		calls    []w3types.RPCCaller
+	)
+	for i, t := range targets {
+		calls = append(calls, eth.CallFunc(t.Address, funcOwner).AtBlock(block).Returns(&owners[i]))
+		isWriter[i] = make([]bool, len(candidate[i]))
+		for j, writer := range candidate[i] {
+			calls = append(calls, eth.CallFunc(t.Address, funcIsWriter, writer).AtBlock(block).Returns(&isWriter[i][j]))
+		}
+	}
+	errs, err := publish.BatchCallEach(ctx, caller, calls, 0)
+	if err != nil {
+		return nil, fmt.Errorf("get writers: %w", err)
+	}
+
+	var (
+		k       int
+		members = make(map[common.Address][]string)
+	)
+	for i, t := range targets {
+		w := Writers{Target: t, Owner: owners[i], Writers: []Writer{}}
+		if errs[k] != nil {
+			w.Warnings = append(w.Warnings, fmt.Sprintf("owner(): %v", errs[k]))
+		}
+		k++
+		for j, writer := range candidate[i] {
+			log, inEvents := added[i][writer]
+			confirmed := isWriter[i][j]
+			if err := errs[k]; err != nil {
+				w.Warnings = append(w.Warnings, fmt.Sprintf("isWriter(%s): %v", writer.Hex(), err))
+				confirmed = inEvents
+			}
+			k++
+			// isWriter is true for the owner regardless of the events.
+			implicit := writer == owners[i] && t.Contract != "tokenuniquesymbolindex"
+			switch {
+			case implicit:
+			case inEvents && !confirmed:
+				w.Warnings = append(w.Warnings, fmt.Sprintf("%s was added but isWriter is false", writer.Hex()))
+			case !inEvents && confirmed:
+				w.Warnings = append(w.Warnings, fmt.Sprintf("%s was removed but isWriter is true", writer.Hex()))
+			}
+			if !confirmed || implicit {
+				continue
+			}
+			entry := Writer{Address: writer}
+			if log != nil {
+				entry.AddedBlock, entry.AddedTx = log.BlockNumber, log.TxHash
+			}
+			w.Writers = append(w.Writers, entry)
+			members[writer] = append(members[writer], t.Name)
+		}
+		r.Contracts = append(r.Contracts, w)
+	}
+
+	kinds, err := classify(ctx, caller, slices.Collect(maps.Keys(members)), block)
+	if err != nil {
+		return nil, err
+	}
+	for i := range r.Contracts {
+		for j := range r.Contracts[i].Writers {
+			writer := &r.Contracts[i].Writers[j]
+			writer.Kind, writer.Contract = kinds[writer.Address].kind, kinds[writer.Address].contract
+		}
+	}
+	for writer, names := range members {
+		if len(names) >= cfg.MinShared {
+			r.Shared = append(r.Shared, Shared{Address: writer, Kind: kinds[writer].kind, Names: names})
+		}
+	}
+	slices.SortFunc(r.Shared, func(a, b Shared) int {
+		return cmp.Or(cmp.Compare(len(b.Names), len(a.Names)), a.Address.Cmp(b.Address))
+	})
+	return r, nil
+}
+
+// decodeWriterEvent decodes a writer event as emitted by a contract of pkg
+// and reports whether it adds the writer.
+func decodeWriterEvent(pkg string, log *types.Log) (common.Address, bool, error) {
+	c, ok := contracts.ByPackage(pkg)
+	if !ok {
+		return common.Address{}, false, fmt.Errorf("unknown package %s", pkg)
+	}
+	name, args, err := c.DecodeEvent(log)
+	if err != nil {
+		return common.Address{}, false, fmt.Errorf("block %d: %w", log.BlockNumber, err)
+	}
+	var writers []common.Address
+	for _, arg := range args {
+		if writer, ok := arg.(common.Address); ok {
+			writers = append(writers, writer)
+		}
+	}
+	if len(args) != 1 || len(writers) != 1 {
+		return common.Address{}, false, fmt.Errorf("block %d: unexpected %s arguments", log.BlockNumber, name)
+	}
+	return writers[0], name == "WriterAdded", nil
+}
+
+type kind struct {
+	kind, contract string
+}
+
+// classify tells EOAs from contracts and identifies the contracts.
+func classify(ctx context.Context, caller publish.Caller, writers []common.Address, block *big.Int) (map[common.Address]kind, error) {
+	codes := make([][]byte, len(writers))
+	calls := make([]w3types.RPCCaller, len(writers))
+	for i, writer := range writers {
+		calls[i] = eth.Code(writer, block).Returns(&codes[i])
+	}
+	if err := publish.BatchCall(ctx, caller, calls, 0); err != nil {
+		return nil, fmt.Errorf("get writer code: %w", err)
+	}
+
+	kinds := make(map[common.Address]kind, len(writers))
+	for i, writer := range writers {
+		if len(codes[i]) == 0 {
+			kinds[writer] = kind{kind: "eoa"}
+			continue
+		}
+		k := kind{kind: "contract"}
+		if c, _, err := contracts.IdentifyAt(ctx, caller, writer, block); err == nil {
+			k.contract = c.Package
+		}
+		kinds[writer] = k
+	}
+	return kinds, nil
+}
+
+// WriteText writes each contract's writers and warnings, then the shared
+// writers.
+func (r *Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, c := range r.Contracts {
+		fmt.Fprintf(tw, "%s (%s %s) owner %s\n", c.Name, c.Contract, c.Address.Hex(), c.Owner.Hex())
+		if len(c.Writers) == 0 {
+			fmt.Fprintf(tw, "  no writers\n")
+		}
+		for _, writer := range c.Writers {
+			kind := writer.Kind
+			if writer.Contract != "" {
+				kind += " " + writer.Contract
+			}
+			fmt.Fprintf(tw, "  %s\t%s\tadded in block %d\n", writer.Address.Hex(), kind, writer.AddedBlock)
+		}
+		for _, warning := range c.Warnings {
+			fmt.Fprintf(tw, "  warning: %s\n", warning)
+		}
+	}
+	if len(r.Shared) > 0 {
+		fmt.Fprintf(tw, "shared writers\n")
+	}
+	for _, s := range r.Shared {
+		fmt.Fprintf(tw, "  %s\t%s\t%d contracts: %s\n", s.Address.Hex(), s.Kind, len(s.Names), strings.Join(s.Names, ", "))
+	}
+	return tw.Flush()
+}
+
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}